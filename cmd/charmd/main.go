@@ -14,6 +14,7 @@ import (
 	"github.com/juju/loggo"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/goose.v2/identity"
+	"gopkg.in/juju/charmrepo.v3/csclient/params"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
 	"gopkg.in/macaroon-bakery.v2-unstable/httpbakery"
 	"gopkg.in/mgo.v2"
@@ -81,7 +82,8 @@ func serve(conf *config.Config) error {
 	var es *elasticsearch.Database
 	if conf.ESAddr != "" {
 		es = &elasticsearch.Database{
-			Addr: conf.ESAddr,
+			Addr:    conf.ESAddr,
+			Timeout: conf.ESTimeout.Duration,
 		}
 	}
 
@@ -120,6 +122,23 @@ func serve(conf *config.Config) error {
 		DockerRegistryAuthCertificates: conf.DockerRegistryAuthCertificates.Certificates,
 		DockerRegistryAuthKey:          conf.DockerRegistryAuthKey.Key,
 		DockerRegistryTokenDuration:    conf.DockerRegistryTokenDuration.Duration,
+		DeprecatedSeries:               conf.DeprecatedSeries,
+		MaxMetaAnySize:                 conf.MaxMetaAnySize,
+		IgnoreAdminOnlyFilters:         conf.IgnoreAdminOnlyFilters,
+		SearchFallback:                 conf.SearchFallback,
+		MaxSearchLimit:                 conf.MaxSearchLimit,
+		DownloadBoost:                  conf.DownloadBoost,
+		PromulgatedBoost:               conf.PromulgatedBoost,
+		MaxBulkMetaConcurrency:         conf.MaxBulkMetaConcurrency,
+		ExtraSeries:                    conf.ExtraSeries,
+		CORSAllowedOrigins:             conf.CORSAllowedOrigins,
+		RateLimits:                     conf.RateLimits,
+		HandlerTimeout:                 conf.HandlerTimeout.Duration,
+		SearchRetries:                  conf.ESRetries,
+		GroupsCacheMaxAge:              conf.GroupsCacheMaxAge.Duration,
+	}
+	for _, ch := range conf.ResolveChannels {
+		cfg.ResolveChannels = append(cfg.ResolveChannels, params.Channel(ch))
 	}
 	switch conf.BlobStore {
 	case config.MongoDBBlobStore:
@@ -65,7 +65,7 @@ func run(confPath string) error {
 	}
 	si := &charmstore.SearchIndex{
 		Database: &elasticsearch.Database{
-			conf.ESAddr,
+			Addr: conf.ESAddr,
 		},
 		Index: *index,
 	}
@@ -60,7 +60,7 @@ func populate(confPath string) error {
 	}
 	si := &charmstore.SearchIndex{
 		Database: &elasticsearch.Database{
-			conf.ESAddr,
+			Addr: conf.ESAddr,
 		},
 		Index: *index,
 	}
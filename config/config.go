@@ -31,6 +31,8 @@ type Config struct {
 	AuthUsername                   string            `yaml:"auth-username,omitempty"`
 	AuthPassword                   string            `yaml:"auth-password,omitempty"`
 	ESAddr                         string            `yaml:"elasticsearch-addr,omitempty"` // elasticsearch is optional
+	ESTimeout                      DurationString    `yaml:"elasticsearch-timeout,omitempty"`
+	ESRetries                      int               `yaml:"elasticsearch-retries,omitempty"`
 	IdentityPublicKey              *bakery.PublicKey `yaml:"identity-public-key,omitempty"`
 	IdentityLocation               string            `yaml:"identity-location"`
 	TermsPublicKey                 *bakery.PublicKey `yaml:"terms-public-key,omitempty"`
@@ -61,6 +63,20 @@ type Config struct {
 	DockerRegistryAuthKey          X509PrivateKey    `yaml:"docker-registry-auth-key"`
 	DockerRegistryTokenDuration    DurationString    `yaml:"docker-registry-token-duration"`
 	TempDir                        string            `yaml:"tempdir"`
+	DeprecatedSeries               []string          `yaml:"deprecated-series,omitempty"`
+	MaxMetaAnySize                 int               `yaml:"max-meta-any-size,omitempty"`
+	IgnoreAdminOnlyFilters         bool              `yaml:"ignore-admin-only-filters,omitempty"`
+	SearchFallback                 bool              `yaml:"search-fallback,omitempty"`
+	MaxSearchLimit                 int               `yaml:"max-search-limit,omitempty"`
+	DownloadBoost                  float64           `yaml:"download-boost,omitempty"`
+	PromulgatedBoost               float64           `yaml:"promulgated-boost,omitempty"`
+	MaxBulkMetaConcurrency         int               `yaml:"max-bulk-meta-concurrency,omitempty"`
+	ExtraSeries                    []string          `yaml:"extra-series,omitempty"`
+	CORSAllowedOrigins             []string          `yaml:"cors-allowed-origins,omitempty"`
+	RateLimits                     map[string]int    `yaml:"rate-limits,omitempty"`
+	HandlerTimeout                 DurationString    `yaml:"handler-timeout,omitempty"`
+	ResolveChannels                []string          `yaml:"resolve-channels,omitempty"`
+	GroupsCacheMaxAge              DurationString    `yaml:"groups-cache-max-age,omitempty"`
 }
 
 type BlobStoreType string
@@ -91,6 +91,26 @@ docker-registry-auth-key: |
   -----END EC PRIVATE KEY-----
 docker-registry-token-duration: 1h10m
 tempdir: /var/tmp/charmstore
+deprecated-series: [precise, trusty]
+max-meta-any-size: 1048576
+ignore-admin-only-filters: true
+search-fallback: true
+max-search-limit: 500
+download-boost: 0.5
+promulgated-boost: 2
+max-bulk-meta-concurrency: 20
+extra-series: [focal, jammy]
+cors-allowed-origins: ["https://jujucharms.com"]
+rate-limits:
+  search: 600
+  archive: 120
+handler-timeout: 30s
+resolve-channels:
+  - stable
+  - candidate
+elasticsearch-timeout: 5s
+elasticsearch-retries: 3
+groups-cache-max-age: 30s
 `
 
 func (s *ConfigSuite) readConfig(c *gc.C, content string) (*config.Config, error) {
@@ -156,6 +176,25 @@ func (s *ConfigSuite) TestRead(c *gc.C) {
 		},
 		DockerRegistryTokenDuration: config.DurationString{time.Hour + 10*time.Minute},
 		TempDir:                     "/var/tmp/charmstore",
+		DeprecatedSeries:            []string{"precise", "trusty"},
+		MaxMetaAnySize:              1048576,
+		IgnoreAdminOnlyFilters:      true,
+		SearchFallback:              true,
+		MaxSearchLimit:              500,
+		DownloadBoost:               0.5,
+		PromulgatedBoost:            2,
+		MaxBulkMetaConcurrency:      20,
+		ExtraSeries:                 []string{"focal", "jammy"},
+		CORSAllowedOrigins:          []string{"https://jujucharms.com"},
+		RateLimits: map[string]int{
+			"search":  600,
+			"archive": 120,
+		},
+		HandlerTimeout:    config.DurationString{30 * time.Second},
+		ResolveChannels:   []string{"stable", "candidate"},
+		ESTimeout:         config.DurationString{5 * time.Second},
+		ESRetries:         3,
+		GroupsCacheMaxAge: config.DurationString{30 * time.Second},
 	})
 }
 
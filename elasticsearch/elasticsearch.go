@@ -20,6 +20,7 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/juju/loggo"
 	"gopkg.in/errgo.v1"
@@ -44,6 +45,10 @@ var log = loggo.GetLogger("charmstore.elasticsearch")
 var ErrConflict = errgo.New("elasticsearch document conflict")
 var ErrNotFound = errgo.New("elasticsearch document not found")
 
+// ErrUnavailable is the cause of errors returned when the
+// elasticsearch server cannot be reached or does not respond in time.
+var ErrUnavailable = errgo.New("elasticsearch unavailable")
+
 type ElasticSearchError struct {
 	Err    string `json:"error"`
 	Status int    `json:"status"`
@@ -55,6 +60,24 @@ func (e ElasticSearchError) Error() string {
 
 type Database struct {
 	Addr string
+
+	// Timeout holds the maximum length of time to wait for
+	// the response to a request. If it is zero, there is no
+	// timeout.
+	Timeout time.Duration
+}
+
+// IsTransient reports whether the given error cause indicates a
+// failure that may succeed if the request is retried, such as the
+// server being unreachable or returning a 5xx status.
+func IsTransient(cause error) bool {
+	if cause == ErrUnavailable {
+		return true
+	}
+	if eserr, ok := cause.(*ElasticSearchError); ok {
+		return eserr.Status >= http.StatusInternalServerError
+	}
+	return false
 }
 
 // Document represents a document in the elasticsearch database.
@@ -298,6 +321,77 @@ func (db *Database) PutDocumentVersionWithType(
 	return nil
 }
 
+// BulkIndexItem holds a document to be indexed by BulkIndex.
+type BulkIndexItem struct {
+	Index string
+	Type  string
+	ID    string
+
+	// Version and VersionType, if VersionType is not empty, hold
+	// the version of the document, as for PutDocumentVersionWithType.
+	Version     int64
+	VersionType string
+
+	// Doc holds the document. It is marshaled as JSON.
+	Doc interface{}
+}
+
+// BulkIndex creates or updates all the given documents with a single
+// request to the _bulk endpoint. Documents that are not written because
+// the stored document has a later version are not treated as errors.
+// If any other document cannot be written, an error describing the
+// first such failure is returned; the other documents may still have
+// been written.
+// See http://www.elasticsearch.org/guide/en/elasticsearch/reference/current/docs-bulk.html
+// for further details.
+func (db *Database) BulkIndex(items []BulkIndexItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, item := range items {
+		action := map[string]interface{}{
+			"_index": item.Index,
+			"_type":  item.Type,
+			"_id":    item.ID,
+		}
+		if item.VersionType != "" {
+			action["_version"] = item.Version
+			action["_version_type"] = item.VersionType
+		}
+		if err := enc.Encode(map[string]interface{}{"index": action}); err != nil {
+			return errgo.Notef(err, "cannot marshal bulk action")
+		}
+		if err := enc.Encode(item.Doc); err != nil {
+			return errgo.Notef(err, "cannot marshal document %s", item.ID)
+		}
+	}
+	var resp struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID     string          `json:"_id"`
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := db.post(db.url("_bulk"), rawBody(buf.Bytes()), &resp); err != nil {
+		return errgo.NoteMask(getError(err), "bulk index failed", IsTransient)
+	}
+	if !resp.Errors {
+		return nil
+	}
+	for _, item := range resp.Items {
+		for _, r := range item {
+			if r.Status < 300 || r.Status == http.StatusConflict {
+				continue
+			}
+			return errgo.Newf("cannot index document %s: %s", r.ID, r.Error)
+		}
+	}
+	return nil
+}
+
 // PutIndex creates the index with the given configuration.
 func (db *Database) PutIndex(index string, config interface{}) error {
 	if err := db.put(db.url(index), config, nil); err != nil {
@@ -328,18 +422,67 @@ func (db *Database) RefreshIndex(index string) error {
 func (db *Database) Search(index, type_ string, q QueryDSL) (SearchResult, error) {
 	var sr SearchResult
 	if err := db.get(db.url(index, type_, "_search"), q, &sr); err != nil {
-		return SearchResult{}, errgo.Notef(getError(err), "search failed")
+		return SearchResult{}, errgo.NoteMask(getError(err), "search failed", IsTransient)
+	}
+	return sr, nil
+}
+
+// Scroll is like Search except that it starts a scrolled search,
+// keeping the search context alive for at least keepAlive. The
+// returned result holds the first page of hits and a ScrollID that
+// can be passed to ScrollNext to retrieve the following pages.
+// See https://www.elastic.co/guide/en/elasticsearch/reference/1.3/search-request-scroll.html
+// for further details.
+func (db *Database) Scroll(index, type_ string, q QueryDSL, keepAlive time.Duration) (SearchResult, error) {
+	var sr SearchResult
+	url := fmt.Sprintf("%s?scroll=%s", db.url(index, type_, "_search"), scrollKeepAlive(keepAlive))
+	if err := db.get(url, q, &sr); err != nil {
+		return SearchResult{}, errgo.NoteMask(getError(err), "search failed", IsTransient)
 	}
 	return sr, nil
 }
 
+// ScrollNext returns the next page of hits of the scrolled search
+// with the given scroll id, keeping the search context alive for at
+// least keepAlive. When all the hits have been returned, the result
+// holds no hits.
+func (db *Database) ScrollNext(scrollID string, keepAlive time.Duration) (SearchResult, error) {
+	var sr SearchResult
+	v := url.Values{
+		"scroll":    {scrollKeepAlive(keepAlive)},
+		"scroll_id": {scrollID},
+	}
+	if err := db.get(db.url("_search", "scroll")+"?"+v.Encode(), nil, &sr); err != nil {
+		return SearchResult{}, errgo.NoteMask(getError(err), "scroll failed", IsTransient)
+	}
+	return sr, nil
+}
+
+// ClearScroll releases the search context of the scrolled search with
+// the given scroll id.
+func (db *Database) ClearScroll(scrollID string) error {
+	if err := db.delete(db.url("_search", "scroll", scrollID), nil, nil); err != nil {
+		return getError(err)
+	}
+	return nil
+}
+
+// scrollKeepAlive returns d in the time unit format understood by
+// elasticsearch.
+func scrollKeepAlive(d time.Duration) string {
+	return fmt.Sprintf("%dms", d/time.Millisecond)
+}
+
 // do performs a request on the elasticsearch server. If body is not nil it will be
 // marshaled as a json object and sent with the request. If v is non nil the response
 // body will be unmarshalled into the value it points to.
 func (db *Database) do(method, url string, body, v interface{}) error {
 	log.Tracef(">>> %s %s", method, url)
 	var r io.Reader
-	if body != nil {
+	if b, ok := body.(rawBody); ok {
+		log.Tracef(">>> %s", b)
+		r = bytes.NewReader(b)
+	} else if body != nil {
 		b, err := json.Marshal(body)
 		if err != nil {
 			return errgo.Notef(err, "can not marshaling body")
@@ -355,16 +498,24 @@ func (db *Database) do(method, url string, body, v interface{}) error {
 	if body != nil {
 		req.Header.Add("Content-Type", "application/json")
 	}
-	resp, err := http.DefaultClient.Do(req)
+	client := http.DefaultClient
+	if db.Timeout > 0 {
+		client = &http.Client{
+			Timeout: db.Timeout,
+		}
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		log.Debugf("*** %s", err)
-		return errgo.Mask(err)
+		return errgo.WithCausef(err, ErrUnavailable, "")
 	}
 	defer resp.Body.Close()
 	b, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		log.Debugf("*** %s", err)
-		return errgo.Notef(err, "cannot read response")
+		// The connection failed or timed out part way
+		// through the response.
+		return errgo.WithCausef(err, ErrUnavailable, "cannot read response")
 	}
 	log.Tracef("<<< %s", resp.Status)
 	log.Tracef("<<< %s", b)
@@ -385,6 +536,10 @@ func (db *Database) do(method, url string, body, v interface{}) error {
 	return nil
 }
 
+// rawBody holds a request body that is sent as is
+// rather than being marshaled as JSON.
+type rawBody []byte
+
 // delete makes a DELETE request to the database url. A non-nil body will be
 // sent with the request and if v is not nill then the response will be unmarshaled
 // into tha value it points to.
@@ -434,6 +589,55 @@ type SearchResult struct {
 	} `json:"hits"`
 	Took     int  `json:"took"`
 	TimedOut bool `json:"timed_out"`
+
+	// ScrollID holds the id used to retrieve the next page of
+	// a scrolled search. See Database.Scroll.
+	ScrollID string `json:"_scroll_id"`
+
+	// Aggregations holds the result of each requested
+	// aggregation, keyed by the aggregation name.
+	Aggregations map[string]json.RawMessage `json:"aggregations"`
+
+	// Suggest holds the result of each requested suggester,
+	// keyed by the suggester name.
+	Suggest map[string][]Suggestion `json:"suggest"`
+}
+
+// Suggestion holds the suggestions for a single term of the
+// text given to a suggester.
+type Suggestion struct {
+	Text    string             `json:"text"`
+	Offset  int                `json:"offset"`
+	Length  int                `json:"length"`
+	Options []SuggestionOption `json:"options"`
+}
+
+// SuggestionOption holds a single suggested replacement
+// for a term.
+type SuggestionOption struct {
+	Text  string  `json:"text"`
+	Score float64 `json:"score"`
+	Freq  int     `json:"freq"`
+}
+
+// BucketAggregationResult holds the result of an aggregation, such as
+// a terms aggregation, that groups documents into buckets.
+type BucketAggregationResult struct {
+	Buckets []Bucket `json:"buckets"`
+}
+
+// SingleBucketAggregationResult holds the result of an aggregation,
+// such as a filter aggregation, that places the matching documents
+// into a single bucket.
+type SingleBucketAggregationResult struct {
+	DocCount int `json:"doc_count"`
+}
+
+// Bucket holds a single bucket returned from a bucket aggregation.
+// Only aggregations on string-valued fields are supported.
+type Bucket struct {
+	Key      string `json:"key"`
+	DocCount int    `json:"doc_count"`
 }
 
 // Hit represents an individual search hit returned from elasticsearch
@@ -444,6 +648,14 @@ type Hit struct {
 	Score  float64         `json:"_score"`
 	Source json.RawMessage `json:"_source"`
 	Fields Fields          `json:"fields"`
+
+	// Sort holds the values of the sort fields for the hit,
+	// suitable for use in QueryDSL.SearchAfter.
+	Sort []json.RawMessage `json:"sort"`
+
+	// Highlight holds the highlighted fragments for the hit,
+	// keyed by field name, when highlighting was requested.
+	Highlight map[string][]string `json:"highlight"`
 }
 
 type Fields map[string][]interface{}
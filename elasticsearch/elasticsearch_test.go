@@ -255,6 +255,64 @@ func (s *Suite) TestSearch(c *gc.C) {
 	c.Assert(results.Hits.Hits[0].Fields.GetString("foo"), gc.Equals, "baz")
 }
 
+func (s *Suite) TestScroll(c *gc.C) {
+	for i := 0; i < 5; i++ {
+		_, err := s.ES.PostDocument(s.TestIndex, "scrolltype", map[string]int{"n": i})
+		c.Assert(err, gc.Equals, nil)
+	}
+	s.ES.RefreshIndex(s.TestIndex)
+	q := es.QueryDSL{
+		Size:   2,
+		Query:  es.MatchAllQuery{},
+		Fields: []string{"n"},
+		Sort:   []es.Sort{{Field: "n", Order: es.Ascending}},
+	}
+	results, err := s.ES.Scroll(s.TestIndex, "scrolltype", q, time.Minute)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(results.Hits.Total, gc.Equals, 5)
+	c.Assert(results.ScrollID, gc.Not(gc.Equals), "")
+	var got []float64
+	for len(results.Hits.Hits) > 0 {
+		c.Assert(len(got) < 5, gc.Equals, true)
+		for _, h := range results.Hits.Hits {
+			got = append(got, h.Fields.Get("n").(float64))
+		}
+		results, err = s.ES.ScrollNext(results.ScrollID, time.Minute)
+		c.Assert(err, gc.Equals, nil)
+	}
+	c.Assert(got, gc.DeepEquals, []float64{0, 1, 2, 3, 4})
+	err = s.ES.ClearScroll(results.ScrollID)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *Suite) TestBulkIndex(c *gc.C) {
+	err := s.ES.PutDocumentVersionWithType(s.TestIndex, "testtype", "b", 5, es.ExternalGTE, map[string]string{"foo": "old"})
+	c.Assert(err, gc.Equals, nil)
+	err = s.ES.BulkIndex([]es.BulkIndexItem{{
+		Index: s.TestIndex,
+		Type:  "testtype",
+		ID:    "a",
+		Doc:   map[string]string{"foo": "a"},
+	}, {
+		// The stored document has a later version, so
+		// this one is ignored.
+		Index:       s.TestIndex,
+		Type:        "testtype",
+		ID:          "b",
+		Version:     4,
+		VersionType: es.ExternalGTE,
+		Doc:         map[string]string{"foo": "new"},
+	}})
+	c.Assert(err, gc.Equals, nil)
+	var doc map[string]string
+	err = s.ES.GetDocument(s.TestIndex, "testtype", "a", &doc)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc, gc.DeepEquals, map[string]string{"foo": "a"})
+	err = s.ES.GetDocument(s.TestIndex, "testtype", "b", &doc)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc, gc.DeepEquals, map[string]string{"foo": "old"})
+}
+
 func (s *Suite) TestPutMapping(c *gc.C) {
 	var mapping = map[string]interface{}{
 		"testtype": map[string]interface{}{
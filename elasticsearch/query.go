@@ -68,6 +68,18 @@ type MultiMatchQuery struct {
 	// please see:
 	// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-minimum-should-match.html
 	MinimumShouldMatch string
+
+	// Fuzziness optionally contains the maximum edit distance
+	// allowed when matching terms (for example "1" or "AUTO"). For
+	// details of possible values please see:
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/common-options.html#fuzziness
+	Fuzziness string
+
+	// Type optionally contains the type of the query (for example
+	// "phrase" to match the query as an ordered phrase). For
+	// details of possible values please see:
+	// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-multi-match-query.html#multi-match-types
+	Type string
 }
 
 func (m MultiMatchQuery) MarshalJSON() ([]byte, error) {
@@ -75,9 +87,15 @@ func (m MultiMatchQuery) MarshalJSON() ([]byte, error) {
 		"query":  m.Query,
 		"fields": m.Fields,
 	}
+	if m.Type != "" {
+		mm["type"] = m.Type
+	}
 	if m.MinimumShouldMatch != "" {
 		mm["minimum_should_match"] = m.MinimumShouldMatch
 	}
+	if m.Fuzziness != "" {
+		mm["fuzziness"] = m.Fuzziness
+	}
 	return marshalNamedObject("multi_match", mm)
 }
 
@@ -120,6 +138,51 @@ func (t TermQuery) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// PrefixQuery provides a query that matches documents with a field
+// containing a term that starts with the given prefix.
+type PrefixQuery struct {
+	Field  string
+	Prefix string
+}
+
+func (p PrefixQuery) MarshalJSON() ([]byte, error) {
+	return marshalNamedObject("prefix", map[string]interface{}{
+		p.Field: p.Prefix,
+	})
+}
+
+// BoolQuery provides a query that combines other queries. A document
+// matches if it matches all of the Must queries and none of the
+// MustNot queries. If there are no Must queries then the document
+// must also match at least one of the Should queries.
+type BoolQuery struct {
+	Must    []Query
+	Should  []Query
+	MustNot []Query
+
+	// MinimumShouldMatch optionally contains the value for the
+	// minimum_should_match parameter, which specifies how many of
+	// the Should queries must match.
+	MinimumShouldMatch string
+}
+
+func (b BoolQuery) MarshalJSON() ([]byte, error) {
+	bq := make(map[string]interface{})
+	if len(b.Must) > 0 {
+		bq["must"] = b.Must
+	}
+	if len(b.Should) > 0 {
+		bq["should"] = b.Should
+	}
+	if len(b.MustNot) > 0 {
+		bq["must_not"] = b.MustNot
+	}
+	if b.MinimumShouldMatch != "" {
+		bq["minimum_should_match"] = b.MinimumShouldMatch
+	}
+	return marshalNamedObject("bool", bq)
+}
+
 // DecayFunction provides a function that boosts depending on
 // the difference in values of a certain field. See
 // http://www.elasticsearch.org/guide/en/elasticsearch/reference/current/query-dsl-function-score-query.html#_decay_functions
@@ -217,6 +280,33 @@ func (t TermFilter) MarshalJSON() ([]byte, error) {
 	return marshalNamedObject("term", map[string]string{t.Field: t.Value})
 }
 
+// RangeFilter provides a filter that requires the value of a field to
+// lie within a range. Any bound that is nil is not checked.
+type RangeFilter struct {
+	Field string
+	GT    interface{}
+	GTE   interface{}
+	LT    interface{}
+	LTE   interface{}
+}
+
+func (r RangeFilter) MarshalJSON() ([]byte, error) {
+	bounds := make(map[string]interface{})
+	if r.GT != nil {
+		bounds["gt"] = r.GT
+	}
+	if r.GTE != nil {
+		bounds["gte"] = r.GTE
+	}
+	if r.LT != nil {
+		bounds["lt"] = r.LT
+	}
+	if r.LTE != nil {
+		bounds["lte"] = r.LTE
+	}
+	return marshalNamedObject("range", map[string]interface{}{r.Field: bounds})
+}
+
 // ExistsFilter provides a filter that requres a field to be present.
 type ExistsFilter string
 
@@ -227,11 +317,98 @@ func (f ExistsFilter) MarshalJSON() ([]byte, error) {
 // QueryDSL provides a structure to put together a query using the
 // elasticsearch DSL.
 type QueryDSL struct {
-	Fields []string `json:"fields"`
-	From   int      `json:"from,omitempty"`
-	Size   int      `json:"size,omitempty"`
-	Query  Query    `json:"query,omitempty"`
-	Sort   []Sort   `json:"sort,omitempty"`
+	Fields       []string               `json:"fields"`
+	From         int                    `json:"from,omitempty"`
+	Size         int                    `json:"size,omitempty"`
+	Query        Query                  `json:"query,omitempty"`
+	Sort         []Sort                 `json:"sort,omitempty"`
+	Aggregations map[string]Aggregation `json:"aggs,omitempty"`
+	TrackScores  bool                   `json:"track_scores,omitempty"`
+	SearchAfter  []json.RawMessage      `json:"search_after,omitempty"`
+	Highlight    *Highlight             `json:"highlight,omitempty"`
+	Suggest      map[string]Suggester   `json:"suggest,omitempty"`
+}
+
+// Suggester represents a suggester in the elasticsearch DSL.
+type Suggester interface {
+	json.Marshaler
+}
+
+// TermSuggester provides a suggester that returns terms in Field
+// that are similar to the terms in Text. If Size is non-zero it
+// limits the number of suggestions returned for each term.
+type TermSuggester struct {
+	Text  string
+	Field string
+	Size  int
+}
+
+func (t TermSuggester) MarshalJSON() ([]byte, error) {
+	params := map[string]interface{}{"field": t.Field}
+	if t.Size != 0 {
+		params["size"] = t.Size
+	}
+	return json.Marshal(map[string]interface{}{
+		"text": t.Text,
+		"term": params,
+	})
+}
+
+// Highlight specifies the fields for which fragments of text that
+// match the query are returned with each hit.
+type Highlight struct {
+	// PreTags and PostTags hold the tags that surround each
+	// match in the fragments. If they are empty, elasticsearch
+	// uses <em> and </em>.
+	PreTags  []string `json:"pre_tags,omitempty"`
+	PostTags []string `json:"post_tags,omitempty"`
+
+	// Fields holds the fields to highlight, keyed by field name.
+	Fields map[string]HighlightField `json:"fields"`
+}
+
+// HighlightField specifies how to highlight a single field.
+type HighlightField struct {
+	// FragmentSize holds the approximate size of each
+	// fragment in characters.
+	FragmentSize int `json:"fragment_size,omitempty"`
+
+	// NumberOfFragments holds the maximum number of
+	// fragments to return.
+	NumberOfFragments int `json:"number_of_fragments,omitempty"`
+}
+
+// Aggregation represents an aggregation in the elasticsearch DSL.
+type Aggregation interface {
+	json.Marshaler
+}
+
+// TermsAggregation provides an aggregation that returns a bucket
+// for each distinct value of a field, along with the number of
+// matching documents that have that value. The buckets are ordered
+// by descending document count. If Size is non-zero it limits the
+// number of buckets returned.
+type TermsAggregation struct {
+	Field string
+	Size  int
+}
+
+func (t TermsAggregation) MarshalJSON() ([]byte, error) {
+	params := map[string]interface{}{"field": t.Field}
+	if t.Size != 0 {
+		params["size"] = t.Size
+	}
+	return marshalNamedObject("terms", params)
+}
+
+// FilterAggregation provides an aggregation that counts the
+// matching documents that also match Filter.
+type FilterAggregation struct {
+	Filter Filter
+}
+
+func (f FilterAggregation) MarshalJSON() ([]byte, error) {
+	return marshalNamedObject("filter", f.Filter)
 }
 
 type Sort struct {
@@ -4,6 +4,8 @@
 package elasticsearch_test
 
 import (
+	"encoding/json"
+
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
 
@@ -23,6 +25,10 @@ func (s *QuerySuite) TestJSONEncodings(c *gc.C) {
 		about: "term query",
 		query: TermQuery{Field: "foo", Value: "bar"},
 		json:  `{"term": {"foo": "bar"}}`,
+	}, {
+		about: "prefix query",
+		query: PrefixQuery{Field: "foo", Prefix: "ba"},
+		json:  `{"prefix": {"foo": "ba"}}`,
 	}, {
 		about: "match all query",
 		query: MatchAllQuery{},
@@ -88,6 +94,29 @@ func (s *QuerySuite) TestJSONEncodings(c *gc.C) {
 		about: "regexp filter",
 		query: RegexpFilter{Field: "foo", Regexp: ".*"},
 		json:  `{"regexp": {"foo": ".*"}}`,
+	}, {
+		about: "range filter",
+		query: RangeFilter{Field: "foo", GTE: 3, LT: 10},
+		json:  `{"range": {"foo": {"gte": 3, "lt": 10}}}`,
+	}, {
+		about: "bool query",
+		query: BoolQuery{
+			Must:    []Query{TermQuery{Field: "foo", Value: "bar"}},
+			MustNot: []Query{TermQuery{Field: "foo", Value: "baz"}},
+		},
+		json: `{"bool": {"must": [{"term": {"foo": "bar"}}], "must_not": [{"term": {"foo": "baz"}}]}}`,
+	}, {
+		about: "fuzzy multi match query",
+		query: MultiMatchQuery{Query: "foo", Fields: []string{"bar"}, Fuzziness: "AUTO"},
+		json:  `{"multi_match": {"query": "foo", "fields": ["bar"], "fuzziness": "AUTO"}}`,
+	}, {
+		about: "terms aggregation",
+		query: TermsAggregation{Field: "foo", Size: 5},
+		json:  `{"terms": {"field": "foo", "size": 5}}`,
+	}, {
+		about: "filter aggregation",
+		query: FilterAggregation{Filter: TermFilter{Field: "foo", Value: "bar"}},
+		json:  `{"filter": {"term": {"foo": "bar"}}}`,
 	}, {
 		about: "query dsl",
 		query: QueryDSL{
@@ -131,6 +160,22 @@ func (s *QuerySuite) TestJSONEncodings(c *gc.C) {
 			From:   10,
 		},
 		json: `{"fields": ["foo", "bar"], "size": 10, "query": {"term": {"baz": "quz"}}, "sort": [{"foo": { "order": "desc"}}], "from": 10}`,
+	}, {
+		about: "query dsl tracking scores",
+		query: QueryDSL{
+			Query:       TermQuery{Field: "baz", Value: "quz"},
+			Sort:        []Sort{{Field: "foo", Order: Order{"desc"}}},
+			TrackScores: true,
+		},
+		json: `{"fields": null, "query": {"term": {"baz": "quz"}}, "sort": [{"foo": { "order": "desc"}}], "track_scores": true}`,
+	}, {
+		about: "query dsl search after",
+		query: QueryDSL{
+			Query:       TermQuery{Field: "baz", Value: "quz"},
+			Sort:        []Sort{{Field: "foo", Order: Order{"desc"}}},
+			SearchAfter: []json.RawMessage{json.RawMessage(`"bar"`)},
+		},
+		json: `{"fields": null, "query": {"term": {"baz": "quz"}}, "sort": [{"foo": { "order": "desc"}}], "search_after": ["bar"]}`,
 	}, {
 		about: "field value factor",
 		query: FieldValueFactorFunction{
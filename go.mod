@@ -24,7 +24,7 @@ require (
 	github.com/juju/schema v0.0.0-20180109041850-e4f08199aa80 // indirect
 	github.com/juju/testing v0.0.0-20180402130637-44801989f0f7
 	github.com/juju/utils v0.0.0-20180207021810-d18e608d0140
-	github.com/juju/version v0.0.0-20161031051906-1f41e27e54f2 // indirect
+	github.com/juju/version v0.0.0-20161031051906-1f41e27e54f2
 	github.com/juju/webbrowser v0.0.0-20160309143629-54b8c57083b4 // indirect
 	github.com/juju/xml v0.0.0-20150413131121-eb759a627588
 	github.com/juju/zip v0.0.0-20160205105221-f6b1e93fa2e2
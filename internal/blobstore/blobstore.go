@@ -212,7 +212,8 @@ func (s *Store) Open(hash string, index *mongodoc.MultipartIndex) (ReadSeekClose
 }
 
 // GC runs the garbage collector, deleting all blobs not present in refs
-// that have not been Put since the given time.
+// that have not been Put since the given time. The returned statistics
+// describe the blobs that remain and the blobs that were removed.
 // Note that it also adds any internal blobs held by
 // in-progress uploads to refs.
 func (s *Store) GC(refs *Refs, before time.Time) (monitoring.BlobStats, error) {
@@ -255,6 +256,8 @@ func (s *Store) GC(refs *Refs, before time.Time) (monitoring.BlobStats, error) {
 			}
 			return fail(errgo.Notef(err, "cannot remove blobref entry"))
 		}
+		stats.RemovedCount++
+		stats.RemovedSize += doc.Size
 		if err := s.backend.Remove(doc.Name); err != nil {
 			logger.Errorf("cannot remove garbage blob %q from backend (hash %q)", doc.Name, doc.Hash)
 		}
@@ -140,9 +140,11 @@ func (s *blobStoreSuite) TestGC(c *gc.C) {
 	stats, err := s.store.GC(refs, time.Now())
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(stats, jc.DeepEquals, monitoring.BlobStats{
-		Count:    2,
-		MaxSize:  5,
-		MeanSize: (2 + 5) / 2,
+		Count:        2,
+		MaxSize:      5,
+		MeanSize:     (2 + 5) / 2,
+		RemovedCount: N - 2,
+		RemovedSize:  0 + 1 + 3 + 4 + 6 + 7 + 8 + 9,
 	})
 
 	s.assertBlobContent(c, nil, content(2))
@@ -62,6 +62,7 @@ func (c *Cache) Evict(key string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	delete(c.new, key)
+	delete(c.old, key)
 }
 
 // EvictAll removes all entries from the cache.
@@ -141,6 +141,34 @@ func (*suite) TestRefreshedEntry(c *gc.C) {
 	c.Assert(p.Len(), gc.Equals, 2)
 }
 
+// TestEvictOldEntry tests that evicting an entry that
+// has been moved to the old map removes it.
+func (*suite) TestEvictOldEntry(c *gc.C) {
+	now := time.Now()
+	p := cache.New(time.Minute)
+
+	// Populate the cache with an initial entry.
+	v, err := cache.GetAtTime(p, "a", fetchValue("a"), now)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v, gc.Equals, "a")
+
+	// Fetch another item very close to the expiry time.
+	v, err = cache.GetAtTime(p, "b", fetchValue("b"), now.Add(time.Minute-1))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v, gc.Equals, "b")
+
+	// Fetch another item just after the expiry time,
+	// which moves "b" into the old map.
+	v, err = cache.GetAtTime(p, "c", fetchValue("c"), now.Add(time.Minute+1))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v, gc.Equals, "c")
+
+	p.Evict("b")
+	v, err = cache.GetAtTime(p, "b", fetchValue("b2"), now.Add(time.Minute+2))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v, gc.Equals, "b2")
+}
+
 // TestConcurrentFetch checks that the cache is safe
 // to use concurrently. It is designed to fail when
 // tested with the race detector enabled.
@@ -13,16 +13,19 @@ import (
 	"io"
 	"io/ioutil"
 	"sort"
+	"strings"
 	"time"
 
 	jujuzip "github.com/juju/zip"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6"
+	"gopkg.in/juju/charm.v6/resource"
 	"gopkg.in/juju/charmrepo.v3/csclient/params"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"gopkg.in/yaml.v2"
 
+	"gopkg.in/juju/charmstore.v5/elasticsearch"
 	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5/internal/monitoring"
@@ -31,7 +34,7 @@ import (
 )
 
 // addParams holds parameters held in common between the
-// Store.addCharm and Store.addBundle methods.
+// Store.newCharmEntity and Store.addBundle methods.
 type addParams struct {
 	// url holds the id to be associated with the stored entity.
 	// If URL.PromulgatedRevision is not -1, the entity will
@@ -65,6 +68,13 @@ type addParams struct {
 
 	// chans holds the channels to associate with the entity.
 	chans []params.Channel
+
+	// extraMeta holds charm metadata that is not parsed by the
+	// charm package. It is nil for bundles.
+	extraMeta *extraCharmMeta
+
+	// force holds whether to skip validation of charm metadata.
+	force bool
 }
 
 // AddCharmWithArchive adds the given charm, which must
@@ -91,6 +101,29 @@ func (s *Store) AddBundleWithArchive(url *router.ResolvedURL, b charm.Bundle) er
 // defined in the charm package, and any that implement
 // ArchiverTo.
 func (s *Store) AddEntityWithArchive(url *router.ResolvedURL, archive interface{}) error {
+	return s.AddEntityWithArchiveOptions(url, archive, AddOptions{})
+}
+
+// AddOptions holds optional parameters for adding an entity to the
+// store.
+type AddOptions struct {
+	// Idempotent specifies that adding an entity with the
+	// same id and archive blob hash as an existing entity
+	// succeeds without changing anything, so that uploads
+	// may safely be retried. Adding an entity with the same
+	// id but a different blob still fails with a
+	// params.ErrDuplicateUpload cause.
+	Idempotent bool
+
+	// Force specifies that charms are added even if their
+	// metadata fails validation. It is intended for
+	// migrating existing charms.
+	Force bool
+}
+
+// AddEntityWithArchiveOptions is like AddEntityWithArchive except that
+// it accepts additional options.
+func (s *Store) AddEntityWithArchiveOptions(url *router.ResolvedURL, archive interface{}, opts AddOptions) error {
 	blob, err := getArchive(archive)
 	if err != nil {
 		return errgo.Notef(err, "cannot get archive")
@@ -104,12 +137,141 @@ func (s *Store) AddEntityWithArchive(url *router.ResolvedURL, archive interface{
 	if _, err := blob.Seek(0, 0); err != nil {
 		return errgo.Notef(err, "cannot seek to start of archive")
 	}
-	if err := s.UploadEntity(url, blob, fmt.Sprintf("%x", hash.Sum(nil)), size, nil); err != nil {
+	if err := s.UploadEntityWithOptions(url, blob, fmt.Sprintf("%x", hash.Sum(nil)), size, nil, opts); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
 	return nil
 }
 
+// CharmToAdd holds a charm to be added to the store by AddCharms.
+type CharmToAdd struct {
+	// URL holds the id to associate with the charm.
+	URL *router.ResolvedURL
+
+	// Charm holds the charm to add. It must be either
+	// a *charm.CharmDir or implement ArchiverTo.
+	Charm charm.Charm
+}
+
+// AddCharms adds all the charms in the given batch to the store.
+// The entities are inserted into the database with a single bulk
+// operation and the search index is updated with a single bulk
+// request once all of them have been inserted. A failure to add one
+// charm does not prevent the others from being added: the returned
+// slice holds the error (or nil) for each item in the batch, in the
+// same order as the batch.
+//
+// The following error causes may be returned for an item:
+//	params.ErrDuplicateUpload if the URL duplicates an existing entity
+//		or an earlier item in the batch.
+//	params.ErrEntityIdNotAllowed if the id may not be created.
+//	params.ErrInvalidEntity if the provided charm is invalid.
+func (s *Store) AddCharms(batch []CharmToAdd) []error {
+	errs := make([]error, len(batch))
+	entities := make([]*mongodoc.Entity, 0, len(batch))
+	// indexes holds the batch index of each element of entities.
+	indexes := make([]int, 0, len(batch))
+	seen := make(map[string]bool, len(batch))
+	for i, item := range batch {
+		if seen[item.URL.URL.String()] {
+			errs[i] = errgo.WithCausef(nil, params.ErrDuplicateUpload, "%v duplicates an earlier item in the batch", &item.URL.URL)
+			continue
+		}
+		seen[item.URL.URL.String()] = true
+		entity, err := s.newCharmEntityFromArchive(item.URL, item.Charm)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		entities = append(entities, entity)
+		indexes = append(indexes, i)
+	}
+	for i, err := range s.addEntities(entities) {
+		errs[indexes[i]] = err
+	}
+	if s.ES == nil || s.ES.Database == nil {
+		return errs
+	}
+	si := &SearchIndex{
+		Database: s.ES.Database,
+		Index:    s.ES.Index,
+		retries:  s.ES.retries,
+		bulk:     new([]elasticsearch.BulkIndexItem),
+	}
+	// The entities have been added successfully, so just log
+	// any failure to index them as UpdateSearchAsync does.
+	updated := make(map[string]bool, len(entities))
+	for i, entity := range entities {
+		if errs[indexes[i]] != nil || updated[entity.BaseURL.String()] {
+			continue
+		}
+		updated[entity.BaseURL.String()] = true
+		if err := s.updateSearchBaseURL(si, entity.BaseURL); err != nil {
+			logger.Errorf("cannot update search record for %v: %s", entity.BaseURL, err)
+		}
+	}
+	if err := si.flushBulk(); err != nil {
+		logger.Errorf("cannot update search records: %s", err)
+	}
+	return errs
+}
+
+// newCharmEntityFromArchive puts the archive of the given charm into
+// the blob store and returns the entity that should be inserted
+// into the database for it.
+func (s *Store) newCharmEntityFromArchive(url *router.ResolvedURL, ch charm.Charm) (*mongodoc.Entity, error) {
+	if url.URL.Series == "bundle" {
+		return nil, errgo.WithCausef(nil, params.ErrEntityIdNotAllowed, "%v is not a charm id", &url.URL)
+	}
+	if err := checkUploadURL(url); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrEntityIdNotAllowed))
+	}
+	// Check for an existing entity before putting the archive, so
+	// that a duplicate does not leave an unused blob behind.
+	_, err := s.FindEntityIncludingArchived(url, FieldSelector("_id"))
+	if err == nil {
+		return nil, errgo.WithCausef(nil, params.ErrDuplicateUpload, "%v already exists", &url.URL)
+	}
+	if errgo.Cause(err) != params.ErrNotFound {
+		return nil, errgo.Mask(err)
+	}
+	blob, err := getArchive(ch)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get archive")
+	}
+	defer blob.Close()
+	hash := blobstore.NewHash()
+	size, err := io.Copy(hash, blob)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot copy archive")
+	}
+	if _, err := blob.Seek(0, 0); err != nil {
+		return nil, errgo.Notef(err, "cannot seek to start of archive")
+	}
+	blobHash := fmt.Sprintf("%x", hash.Sum(nil))
+	blobHash256, err := s.putArchive(blob, size, blobHash)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrInvalidEntity))
+	}
+	r, _, err := s.BlobStore.Open(blobHash, nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open newly created blob")
+	}
+	defer r.Close()
+	if err := s.AddRevision(url); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	entity, err := s.newCharmEntityFromReader(r, newAddParams(url, blobHash, blobHash256, size, nil))
+	if err != nil {
+		return nil, errgo.Mask(err,
+			errgo.Is(params.ErrDuplicateUpload),
+			errgo.Is(params.ErrEntityIdNotAllowed),
+			errgo.Is(params.ErrInvalidEntity),
+		)
+	}
+	return entity, nil
+}
+
 // UploadEntity reads the given blob, which should have the given hash
 // and size, and uploads it to the charm store, associating it with
 // the given channels (without actually making it current in any of them).
@@ -119,15 +281,30 @@ func (s *Store) AddEntityWithArchive(url *router.ResolvedURL, archive interface{
 //	params.ErrEntityIdNotAllowed if the id may not be created.
 //	params.ErrInvalidEntity if the provided blob is invalid.
 func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash string, size int64, chans []params.Channel) error {
-	// Strictly speaking these tests are redundant, because a ResolvedURL should
-	// always be canonical, but check just in case anyway, as this is
-	// final gateway before a potentially invalid url might be stored
-	// in the database.
-	if url.URL.User == "" {
-		return errgo.WithCausef(nil, params.ErrEntityIdNotAllowed, "entity id does not specify user")
-	}
-	if url.URL.Revision == -1 {
-		return errgo.WithCausef(nil, params.ErrEntityIdNotAllowed, "entity id does not specify revision")
+	err := s.UploadEntityWithOptions(url, blob, blobHash, size, chans, AddOptions{})
+	return errgo.Mask(err,
+		errgo.Is(params.ErrDuplicateUpload),
+		errgo.Is(params.ErrEntityIdNotAllowed),
+		errgo.Is(params.ErrInvalidEntity),
+	)
+}
+
+// UploadEntityWithOptions is like UploadEntity except that it accepts
+// additional options.
+func (s *Store) UploadEntityWithOptions(url *router.ResolvedURL, blob io.Reader, blobHash string, size int64, chans []params.Channel, opts AddOptions) error {
+	if err := checkUploadURL(url); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrEntityIdNotAllowed))
+	}
+	if opts.Idempotent {
+		existing, err := s.FindEntityIncludingArchived(url, FieldSelector("blobhash"))
+		switch {
+		case err == nil && existing.BlobHash == blobHash:
+			return nil
+		case err == nil:
+			return errgo.WithCausef(nil, params.ErrDuplicateUpload, "%s already exists with different content", &url.URL)
+		case errgo.Cause(err) != params.ErrNotFound:
+			return errgo.Mask(err)
+		}
 	}
 	blobHash256, err := s.putArchive(blob, size, blobHash)
 	if err != nil {
@@ -143,7 +320,7 @@ func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash s
 	if err := s.AddRevision(url); err != nil {
 		return errgo.Mask(err)
 	}
-	if err := s.addEntityFromReader(url, r, blobHash, blobHash256, size, chans); err != nil {
+	if err := s.addEntityFromReader(url, r, blobHash, blobHash256, size, chans, opts.Force); err != nil {
 		return errgo.Mask(err,
 			errgo.Is(params.ErrDuplicateUpload),
 			errgo.Is(params.ErrEntityIdNotAllowed),
@@ -153,6 +330,54 @@ func (s *Store) UploadEntity(url *router.ResolvedURL, blob io.Reader, blobHash s
 	return nil
 }
 
+// UploadEntityFromBlob is like UploadEntity except that, rather than
+// reading the archive from the caller, it uses the blob with the given
+// hash that is already held in the blob store. The caller is
+// responsible for checking that the client may read the blob, see
+// FindEntitiesWithBlobHash.
+//
+// The following error causes may be returned:
+//	params.ErrNotFound if there is no blob with the given hash.
+//	params.ErrDuplicateUpload if the URL duplicates an existing entity.
+//	params.ErrEntityIdNotAllowed if the id may not be created.
+//	params.ErrInvalidEntity if the blob is invalid.
+func (s *Store) UploadEntityFromBlob(url *router.ResolvedURL, blobHash string, chans []params.Channel) error {
+	if err := checkUploadURL(url); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrEntityIdNotAllowed))
+	}
+	r, size, err := s.BlobStore.Open(blobHash, nil)
+	if err != nil {
+		if errgo.Cause(err) == blobstore.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "blob %s not found", blobHash)
+		}
+		return errgo.Notef(err, "cannot open blob")
+	}
+	defer r.Close()
+	// Putting the existing content again verifies its hash and
+	// refreshes its put time so that it is not garbage collected.
+	err = s.UploadEntityWithOptions(url, r, blobHash, size, chans, AddOptions{})
+	return errgo.Mask(err,
+		errgo.Is(params.ErrDuplicateUpload),
+		errgo.Is(params.ErrEntityIdNotAllowed),
+		errgo.Is(params.ErrInvalidEntity),
+	)
+}
+
+// checkUploadURL checks that the given id is fully specified.
+func checkUploadURL(url *router.ResolvedURL) error {
+	// Strictly speaking these tests are redundant, because a ResolvedURL should
+	// always be canonical, but check just in case anyway, as this is
+	// final gateway before a potentially invalid url might be stored
+	// in the database.
+	if url.URL.User == "" {
+		return errgo.WithCausef(nil, params.ErrEntityIdNotAllowed, "entity id does not specify user")
+	}
+	if url.URL.Revision == -1 {
+		return errgo.WithCausef(nil, params.ErrEntityIdNotAllowed, "entity id does not specify revision")
+	}
+	return nil
+}
+
 // putArchive reads the charm or bundle archive from the given reader and
 // puts into the blob store. The archiveSize and hash must holds the length
 // of the blob content and its SHA384 hash respectively.
@@ -176,18 +401,11 @@ func (s *Store) putArchive(blob io.Reader, blobSize int64, hash string) (blobHas
 }
 
 // addEntityFromReader adds the entity represented by the contents
-// of the given reader, associating it with the given id.
-func (s *Store) addEntityFromReader(id *router.ResolvedURL, r io.ReadSeeker, hash, hash256 string, blobSize int64, chans []params.Channel) error {
-	p := addParams{
-		url:              id,
-		blobHash:         hash,
-		blobHash256:      hash256,
-		blobSize:         blobSize,
-		preV5BlobHash:    hash,
-		preV5BlobHash256: hash256,
-		preV5BlobSize:    blobSize,
-		chans:            chans,
-	}
+// of the given reader, associating it with the given id. If force is
+// true, charm metadata is not validated.
+func (s *Store) addEntityFromReader(id *router.ResolvedURL, r io.ReadSeeker, hash, hash256 string, blobSize int64, chans []params.Channel, force bool) error {
+	p := newAddParams(id, hash, hash256, blobSize, chans)
+	p.force = force
 	if id.URL.Series == "bundle" {
 		b, err := s.newBundle(id, r, blobSize)
 		if err != nil {
@@ -206,29 +424,62 @@ func (s *Store) addEntityFromReader(id *router.ResolvedURL, r io.ReadSeeker, has
 		err = s.addBundle(b, p)
 		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload), errgo.Is(params.ErrEntityIdNotAllowed))
 	}
-	ch, err := s.newCharm(id, r, blobSize)
+	entity, err := s.newCharmEntityFromReader(r, p)
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrInvalidEntity), errgo.Is(params.ErrDuplicateUpload), errgo.Is(params.ErrEntityIdNotAllowed))
 	}
+	if err := s.addEntity(entity); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload))
+	}
+	return nil
+}
+
+// newAddParams returns the addParams for an entity with the given
+// id whose archive has the given hashes and size.
+func newAddParams(id *router.ResolvedURL, hash, hash256 string, blobSize int64, chans []params.Channel) addParams {
+	return addParams{
+		url:              id,
+		blobHash:         hash,
+		blobHash256:      hash256,
+		blobSize:         blobSize,
+		preV5BlobHash:    hash,
+		preV5BlobHash256: hash256,
+		preV5BlobSize:    blobSize,
+		chans:            chans,
+	}
+}
+
+// newCharmEntityFromReader reads the charm archive from the given
+// reader and returns the entity that should be added to the
+// database for it.
+func (s *Store) newCharmEntityFromReader(r io.ReadSeeker, p addParams) (*mongodoc.Entity, error) {
+	ch, err := s.newCharm(p.url, r, p.blobSize, p.force)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrInvalidEntity), errgo.Is(params.ErrDuplicateUpload), errgo.Is(params.ErrEntityIdNotAllowed))
+	}
+	p.extraMeta, err = readExtraCharmMeta(r, p.blobSize)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrInvalidEntity))
+	}
 	if len(ch.Meta().Series) > 0 {
 		if _, err := r.Seek(0, 0); err != nil {
-			return errgo.Notef(err, "cannot seek to start of archive")
+			return nil, errgo.Notef(err, "cannot seek to start of archive")
 		}
-		logger.Infof("adding pre-v5 compat blob for %#v", id)
+		logger.Infof("adding pre-v5 compat blob for %#v", p.url)
 		info, err := addPreV5CharmCompatibilityHackBlob(s.BlobStore, r, p.blobSize)
 		if err != nil {
-			return errgo.Notef(err, "cannot add pre-v5 compatibility blob")
+			return nil, errgo.Notef(err, "cannot add pre-v5 compatibility blob")
 		}
 		p.preV5BlobHash = info.hash
 		p.preV5BlobHash256 = info.hash256
 		p.preV5BlobSize = info.size
 		p.preV5BlobExtraHash = info.extraHash
 	}
-	err = s.addCharm(ch, p)
+	entity, err := s.newCharmEntity(ch, p)
 	if err != nil {
-		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload), errgo.Is(params.ErrEntityIdNotAllowed))
+		return nil, errgo.Mask(err, errgo.Is(params.ErrEntityIdNotAllowed))
 	}
-	return nil
+	return entity, nil
 }
 
 type compatibilityHackBlobInfo struct {
@@ -405,15 +656,18 @@ func updateZipFile(r io.ReadSeeker, size int64, filename string, updatef func(io
 // read from r, that should have the given size and will
 // be named with the given id.
 //
-// The charm is checked for validity before returning.
-func (s *Store) newCharm(id *router.ResolvedURL, r io.ReadSeeker, blobSize int64) (charm.Charm, error) {
+// Unless force is true, the charm is checked for validity before
+// returning.
+func (s *Store) newCharm(id *router.ResolvedURL, r io.ReadSeeker, blobSize int64, force bool) (charm.Charm, error) {
 	readerAt := ReaderAtSeeker(r)
 	ch, err := charm.ReadCharmArchiveFromReader(readerAt, blobSize)
 	if err != nil {
 		return nil, zipReadError(err, "cannot read charm archive")
 	}
-	if err := checkCharmIsValid(ch); err != nil {
-		return nil, errgo.Mask(err, errgo.Is(params.ErrInvalidEntity))
+	if !force {
+		if err := checkCharmIsValid(ch); err != nil {
+			return nil, errgo.Mask(err, errgo.Is(params.ErrInvalidEntity))
+		}
 	}
 	if err := checkIdAllowed(id, ch); err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrEntityIdNotAllowed))
@@ -421,31 +675,264 @@ func (s *Store) newCharm(id *router.ResolvedURL, r io.ReadSeeker, blobSize int64
 	return ch, nil
 }
 
-func checkCharmIsValid(ch charm.Charm) error {
-	m := ch.Meta()
-	for _, rels := range []map[string]charm.Relation{m.Provides, m.Requires, m.Peers} {
-		if err := checkRelationsAreValid(rels); err != nil {
-			return errgo.Mask(err, errgo.Is(params.ErrInvalidEntity))
+// extraCharmMeta holds fields from a charm's metadata.yaml
+// that are not parsed by the charm package.
+type extraCharmMeta struct {
+	// Assumes holds the expressions in the "assumes" section.
+	// Each expression is either a feature requirement, such
+	// as "juju >= 2.9", or a map holding an "any-of" or "all-of"
+	// key with a list of nested expressions.
+	Assumes []interface{} `yaml:"assumes"`
+
+	// Architectures holds the machine architectures that the
+	// charm may be deployed on (for instance "amd64"). If this is
+	// empty, the charm can be deployed on any architecture.
+	Architectures []string `yaml:"architectures"`
+
+	// License holds the license under which the charm is
+	// distributed, usually as an SPDX identifier such as
+	// "Apache-2.0".
+	License string `yaml:"license"`
+
+	// Containers holds the containers declared by a Kubernetes
+	// charm, keyed by container name.
+	Containers map[string]extraContainerMeta `yaml:"containers"`
+
+	// Resources holds the fields of the charm's resources
+	// that are not parsed by the charm package, keyed by
+	// resource name.
+	Resources map[string]extraResourceMeta `yaml:"resources"`
+}
+
+// extraContainerMeta holds a container declared in a charm's
+// metadata.yaml.
+type extraContainerMeta struct {
+	// Resource holds the name of the oci-image resource
+	// that provides the container's image.
+	Resource string `yaml:"resource"`
+}
+
+// extraResourceMeta holds the fields of a resource declared in a
+// charm's metadata.yaml that are not parsed by the charm package.
+type extraResourceMeta struct {
+	// UpstreamSource holds the image reference that an oci-image
+	// resource was taken from (for instance "mariadb:10.3").
+	UpstreamSource string `yaml:"upstream-source"`
+}
+
+// containers returns the sorted names of the containers declared in
+// meta along with the sorted, de-duplicated upstream image references
+// of the resources used by those containers.
+func containers(meta *extraCharmMeta) (names, images []string) {
+	found := make(map[string]bool)
+	for name, c := range meta.Containers {
+		names = append(names, name)
+		image := meta.Resources[c.Resource].UpstreamSource
+		if image != "" && !found[image] {
+			found[image] = true
+			images = append(images, image)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(images)
+	return names, images
+}
+
+// readExtraCharmMeta reads the fields from the metadata.yaml file
+// in the charm archive read from r that are not parsed by the charm
+// package.
+func readExtraCharmMeta(r io.ReadSeeker, blobSize int64) (*extraCharmMeta, error) {
+	z, err := zip.NewReader(ReaderAtSeeker(r), blobSize)
+	if err != nil {
+		return nil, zipReadError(err, "cannot read charm archive")
+	}
+	for _, f := range z.File {
+		if f.Name != "metadata.yaml" {
+			continue
+		}
+		fr, err := f.Open()
+		if err != nil {
+			return nil, zipReadError(err, "cannot read metadata.yaml")
 		}
+		defer fr.Close()
+		data, err := ioutil.ReadAll(fr)
+		if err != nil {
+			return nil, zipReadError(err, "cannot read metadata.yaml")
+		}
+		var meta extraCharmMeta
+		if err := yaml.Unmarshal(data, &meta); err != nil {
+			return nil, errgo.WithCausef(err, params.ErrInvalidEntity, "cannot unmarshal metadata.yaml")
+		}
+		return &meta, nil
+	}
+	return nil, errgo.WithCausef(nil, params.ErrInvalidEntity, "no metadata.yaml file found")
+}
+
+// assumedFeatures returns the sorted names of all the features
+// referred to by the given "assumes" expressions.
+func assumedFeatures(exprs []interface{}) []string {
+	found := make(map[string]bool)
+	addAssumedFeatures(found, exprs)
+	if len(found) == 0 {
+		return nil
 	}
+	features := make([]string, 0, len(found))
+	for f := range found {
+		features = append(features, f)
+	}
+	sort.Strings(features)
+	return features
+}
+
+func addAssumedFeatures(found map[string]bool, exprs []interface{}) {
+	for _, expr := range exprs {
+		switch expr := expr.(type) {
+		case string:
+			// The feature name is followed by an optional
+			// version constraint (for example "juju >= 2.9").
+			name := expr
+			if i := strings.IndexAny(name, " <>="); i >= 0 {
+				name = name[:i]
+			}
+			if name != "" {
+				found[name] = true
+			}
+		case map[interface{}]interface{}:
+			// Composite expressions hold nested expressions
+			// under an "any-of" or "all-of" key.
+			for _, sub := range expr {
+				if sub, ok := sub.([]interface{}); ok {
+					addAssumedFeatures(found, sub)
+				}
+			}
+		}
+	}
+}
+
+// charmProblem holds a problem found when validating a charm.
+type charmProblem struct {
+	// field holds the metadata field with the problem,
+	// for example "provides.db" or "series".
+	field string
+
+	// message holds a description of the problem.
+	message string
+}
+
+// charmValidationError holds all the problems found when validating
+// a charm. Each problem is reported separately in the Info field of
+// the error response, keyed by field.
+type charmValidationError []charmProblem
+
+// Error implements error. When there is more than one problem, the
+// string representation is a list of all the problem messages in JSON
+// format, as for bundle verification errors.
+func (e charmValidationError) Error() string {
+	if len(e) == 1 {
+		return e[0].message
+	}
+	messages := make([]string, len(e))
+	for i, p := range e {
+		messages[i] = p.message
+	}
+	data, err := json.Marshal(messages)
+	if err != nil {
+		// This should never happen.
+		return fmt.Sprintf("%q", messages)
+	}
+	return "charm validation failed: " + string(data)
+}
+
+// ErrorInfo returns the problems keyed by field. It is used by the
+// router to populate the Info field of the error response.
+func (e charmValidationError) ErrorInfo() map[string]*params.Error {
+	info := make(map[string]*params.Error, len(e))
+	for _, p := range e {
+		info[p.field] = &params.Error{
+			Code:    params.ErrInvalidEntity,
+			Message: p.message,
+		}
+	}
+	return info
+}
+
+// checkCharmIsValid checks the relations, series and resources
+// declared in the charm metadata. If any problems are found, the
+// returned error has a cause of params.ErrInvalidEntity and describes
+// each problem.
+func checkCharmIsValid(ch charm.Charm) error {
+	m := ch.Meta()
+	var problems charmValidationError
+	problems = append(problems, relationProblems("provides", m.Provides)...)
+	problems = append(problems, relationProblems("requires", m.Requires)...)
+	problems = append(problems, relationProblems("peers", m.Peers)...)
 	if err := checkConsistentSeries(m.Series); err != nil {
-		return errgo.Mask(err, errgo.Is(params.ErrInvalidEntity))
+		problems = append(problems, charmProblem{
+			field:   "series",
+			message: err.Error(),
+		})
 	}
-	return nil
+	problems = append(problems, resourceProblems(m.Resources)...)
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Sort(charmProblemsByField(problems))
+	return errgo.WithCausef(problems, params.ErrInvalidEntity, "")
 }
 
-func checkRelationsAreValid(rels map[string]charm.Relation) error {
-	for _, rel := range rels {
-		if rel.Name == "relation-name" {
-			return errgo.WithCausef(nil, params.ErrInvalidEntity, "relation %s has almost certainly not been changed from the template", rel.Name)
+// relationProblems returns any problems with the given relations,
+// which are declared in the given metadata section.
+func relationProblems(section string, rels map[string]charm.Relation) []charmProblem {
+	var problems []charmProblem
+	for name, rel := range rels {
+		var message string
+		switch {
+		case rel.Name == "relation-name":
+			message = fmt.Sprintf("relation %s has almost certainly not been changed from the template", rel.Name)
+		case rel.Interface == "interface-name":
+			message = fmt.Sprintf("interface %s in relation %s has almost certainly not been changed from the template", rel.Interface, rel.Name)
+		case rel.Interface == "":
+			message = fmt.Sprintf("relation %s does not specify an interface", rel.Name)
+		default:
+			continue
 		}
-		if rel.Interface == "interface-name" {
-			return errgo.WithCausef(nil, params.ErrInvalidEntity, "interface %s in relation %s has almost certainly not been changed from the template", rel.Interface, rel.Name)
+		problems = append(problems, charmProblem{
+			field:   section + "." + name,
+			message: message,
+		})
+	}
+	return problems
+}
+
+// resourceProblems returns any problems with the given resources.
+func resourceProblems(resources map[string]resource.Meta) []charmProblem {
+	var problems []charmProblem
+	for name, res := range resources {
+		var message string
+		switch {
+		case res.Name != "" && res.Name != name:
+			message = fmt.Sprintf("resource %s has mismatched name %q", name, res.Name)
+		case res.Type == resource.TypeFile && res.Path == "":
+			message = fmt.Sprintf("resource %s does not specify a filename", name)
+		default:
+			continue
 		}
+		problems = append(problems, charmProblem{
+			field:   "resources." + name,
+			message: message,
+		})
 	}
-	return nil
+	return problems
 }
 
+// charmProblemsByField implements sort.Interface for []charmProblem,
+// ordering by field.
+type charmProblemsByField []charmProblem
+
+func (p charmProblemsByField) Len() int           { return len(p) }
+func (p charmProblemsByField) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p charmProblemsByField) Less(i, j int) bool { return p[i].field < p[j].field }
+
 // checkConsistentSeries ensures that all of the series listed in the
 // charm metadata come from the same distribution. If an error is
 // returned it will have a cause of params.ErrInvalidEntity.
@@ -484,12 +971,11 @@ func checkIdAllowed(id *router.ResolvedURL, ch charm.Charm) error {
 	return errgo.WithCausef(nil, params.ErrEntityIdNotAllowed, "%q series not listed in charm metadata", id.URL.Series)
 }
 
-// addCharm adds a charm to the entities collection with the given parameters.
-// If p.URL cannot be used as a name for the charm then the returned
-// error will have the cause params.ErrEntityIdNotAllowed. If the charm
-// duplicates an existing charm then the returned error will have the
-// cause params.ErrDuplicateUpload.
-func (s *Store) addCharm(c charm.Charm, p addParams) (err error) {
+// newCharmEntity returns the entity that should be added to the
+// database for the given charm. It returns an error with a
+// params.ErrEntityIdNotAllowed cause if the charm would clash with
+// an existing entity.
+func (s *Store) newCharmEntity(c charm.Charm, p addParams) (*mongodoc.Entity, error) {
 	// Strictly speaking this test is redundant, because a ResolvedURL should
 	// always be canonical, but check just in case anyway, as this is
 	// final gateway before a potentially invalid url might be stored
@@ -517,6 +1003,12 @@ func (s *Store) addCharm(c charm.Charm, p addParams) (err error) {
 	if metrics != nil && len(metrics.Metrics) > 0 {
 		entity.CharmMetrics = metrics
 	}
+	if p.extraMeta != nil {
+		entity.CharmAssumes = assumedFeatures(p.extraMeta.Assumes)
+		entity.CharmArchitectures = p.extraMeta.Architectures
+		entity.CharmLicense = p.extraMeta.License
+		entity.CharmContainers, entity.CharmContainerImages = containers(p.extraMeta)
+	}
 	denormalizeEntity(entity)
 	setEntityChannels(entity, p.chans)
 
@@ -526,20 +1018,17 @@ func (s *Store) addCharm(c charm.Charm, p addParams) (err error) {
 	// that would be replaced by this one.
 	entities, err := s.FindEntities(entity.BaseURL, nil)
 	if err != nil {
-		return errgo.Notef(err, "cannot check for existing entities")
+		return nil, errgo.Notef(err, "cannot check for existing entities")
 	}
 	for _, entity := range entities {
 		if entity.URL.Series == "bundle" {
-			return errgo.WithCausef(err, params.ErrEntityIdNotAllowed, "charm name duplicates bundle name %v", entity.URL)
+			return nil, errgo.WithCausef(err, params.ErrEntityIdNotAllowed, "charm name duplicates bundle name %v", entity.URL)
 		}
 		if id.Series != "" && entity.URL.Series == "" {
-			return errgo.WithCausef(err, params.ErrEntityIdNotAllowed, "charm name duplicates multi-series charm name %v", entity.URL)
+			return nil, errgo.WithCausef(err, params.ErrEntityIdNotAllowed, "charm name duplicates multi-series charm name %v", entity.URL)
 		}
 	}
-	if err := s.addEntity(entity); err != nil {
-		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload))
-	}
-	return nil
+	return entity, nil
 }
 
 // setEntityChannels associates the entity with the given channels, ignoring
@@ -606,6 +1095,137 @@ func (s *Store) addBundle(b charm.Bundle, p addParams) error {
 // entity has already been validated and stored.
 func (s *Store) addEntity(entity *mongodoc.Entity) (err error) {
 	// Add the base entity to the database.
+	err = s.DB.BaseEntities().Insert(newBaseEntity(entity))
+	if err != nil && !mgo.IsDup(err) {
+		return errgo.Notef(err, "cannot insert base entity")
+	}
+
+	// Add the entity to the database.
+	err = s.DB.Entities().Insert(entity)
+	if mgo.IsDup(err) {
+		return params.ErrDuplicateUpload
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot insert entity")
+	}
+
+	// Record the new revision in the base entity.
+	err = s.DB.BaseEntities().UpdateId(entity.BaseURL, bson.D{{
+		"$inc", bson.D{{"revisioncount", 1}},
+	}})
+	if err != nil {
+		return errgo.Notef(err, "cannot update revision count")
+	}
+	return nil
+}
+
+// addEntities is like addEntity except that it adds all the given
+// entities using bulk database operations. It returns the error (or
+// nil) for each entity, in the same order as the entities.
+func (s *Store) addEntities(entities []*mongodoc.Entity) []error {
+	errs := make([]error, len(entities))
+	if len(entities) == 0 {
+		return errs
+	}
+	// Add the base entities to the database. Base entities that
+	// already exist are ignored.
+	bulk := s.DB.BaseEntities().Bulk()
+	bulk.Unordered()
+	for _, entity := range entities {
+		bulk.Insert(newBaseEntity(entity))
+	}
+	if _, err := bulk.Run(); err != nil {
+		setBulkErrors(errs, err, func(err error) error {
+			if mgo.IsDup(err) {
+				return nil
+			}
+			return errgo.Notef(err, "cannot insert base entity")
+		})
+	}
+
+	// Add the entities to the database.
+	bulk = s.DB.Entities().Bulk()
+	bulk.Unordered()
+	// indexes holds the index in entities of each inserted entity.
+	indexes := make([]int, 0, len(entities))
+	for i, entity := range entities {
+		if errs[i] != nil {
+			continue
+		}
+		bulk.Insert(entity)
+		indexes = append(indexes, i)
+	}
+	if _, err := bulk.Run(); err != nil {
+		insertErrs := make([]error, len(indexes))
+		setBulkErrors(insertErrs, err, func(err error) error {
+			if mgo.IsDup(err) {
+				return params.ErrDuplicateUpload
+			}
+			return errgo.Notef(err, "cannot insert entity")
+		})
+		for i, err := range insertErrs {
+			errs[indexes[i]] = err
+		}
+	}
+
+	// Record the new revisions in the base entities.
+	bulk = s.DB.BaseEntities().Bulk()
+	bulk.Unordered()
+	indexes = indexes[:0]
+	for i, entity := range entities {
+		if errs[i] != nil {
+			continue
+		}
+		bulk.Update(bson.D{{"_id", entity.BaseURL}}, bson.D{{
+			"$inc", bson.D{{"revisioncount", 1}},
+		}})
+		indexes = append(indexes, i)
+	}
+	if len(indexes) == 0 {
+		return errs
+	}
+	if _, err := bulk.Run(); err != nil {
+		updateErrs := make([]error, len(indexes))
+		setBulkErrors(updateErrs, err, func(err error) error {
+			return errgo.Notef(err, "cannot update revision count")
+		})
+		for i, err := range updateErrs {
+			errs[indexes[i]] = err
+		}
+	}
+	return errs
+}
+
+// setBulkErrors sets the elements of errs that correspond to the
+// operations that failed in the bulk operation that returned
+// the given error. Each per-operation error is transformed
+// by the given function before it is stored.
+// If the error does not describe individual operations, all
+// elements of errs are set.
+func setBulkErrors(errs []error, err error, f func(error) error) {
+	bulkErr, ok := err.(*mgo.BulkError)
+	if !ok {
+		for i := range errs {
+			errs[i] = f(err)
+		}
+		return
+	}
+	for _, c := range bulkErr.Cases() {
+		if c.Index < 0 || c.Index >= len(errs) {
+			// The error cannot be attributed to a single
+			// operation, so it applies to them all.
+			for i := range errs {
+				errs[i] = f(c.Err)
+			}
+			continue
+		}
+		errs[c.Index] = f(c.Err)
+	}
+}
+
+// newBaseEntity returns the base entity to be created
+// when the given entity is added to the database.
+func newBaseEntity(entity *mongodoc.Entity) *mongodoc.BaseEntity {
 	perms := []string{entity.User}
 	channelACLs := make(map[params.Channel]mongodoc.ACL, len(params.OrderedChannels))
 	for _, ch := range params.OrderedChannels {
@@ -614,27 +1234,13 @@ func (s *Store) addEntity(entity *mongodoc.Entity) (err error) {
 			Write: perms,
 		}
 	}
-	baseEntity := &mongodoc.BaseEntity{
+	return &mongodoc.BaseEntity{
 		URL:         entity.BaseURL,
 		User:        entity.User,
 		Name:        entity.Name,
 		ChannelACLs: channelACLs,
 		Promulgated: entity.PromulgatedURL != nil,
 	}
-	err = s.DB.BaseEntities().Insert(baseEntity)
-	if err != nil && !mgo.IsDup(err) {
-		return errgo.Notef(err, "cannot insert base entity")
-	}
-
-	// Add the entity to the database.
-	err = s.DB.Entities().Insert(entity)
-	if mgo.IsDup(err) {
-		return params.ErrDuplicateUpload
-	}
-	if err != nil {
-		return errgo.Notef(err, "cannot insert entity")
-	}
-	return nil
 }
 
 // denormalizeEntity sets all denormalized fields in e
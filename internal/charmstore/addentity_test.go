@@ -18,6 +18,7 @@ import (
 	gc "gopkg.in/check.v1"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6"
+	"gopkg.in/juju/charm.v6/resource"
 	"gopkg.in/juju/charmrepo.v3/csclient/params"
 
 	"gopkg.in/juju/charmstore.v5/internal/blobstore"
@@ -163,6 +164,65 @@ func (s *AddEntitySuite) TestAddCharmDuplicatingBundle(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, "charm name duplicates bundle name cs:~charmers/bundle/wordpress-simple-2")
 }
 
+func (s *AddEntitySuite) TestAddCharms(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.AddCharmWithArchive(router.MustNewResolvedURL("~charmers/trusty/mysql-1", -1), storetesting.Charms.CharmDir("mysql"))
+	c.Assert(err, gc.Equals, nil)
+
+	errs := store.AddCharms([]CharmToAdd{{
+		URL:   router.MustNewResolvedURL("~charmers/trusty/wordpress-1", -1),
+		Charm: storetesting.Charms.CharmDir("wordpress"),
+	}, {
+		URL:   router.MustNewResolvedURL("~charmers/trusty/mysql-1", -1),
+		Charm: storetesting.Charms.CharmDir("mysql"),
+	}, {
+		URL:   router.MustNewResolvedURL("~charmers/trusty/wordpress-1", -1),
+		Charm: storetesting.Charms.CharmDir("wordpress"),
+	}, {
+		URL:   router.MustNewResolvedURL("~charmers/trusty/wordpress-2", -1),
+		Charm: storetesting.Charms.CharmDir("wordpress"),
+	}, {
+		URL:   router.MustNewResolvedURL("~charmers/trusty/varnish-1", -1),
+		Charm: storetesting.Charms.CharmDir("varnish"),
+	}})
+	c.Assert(errs, gc.HasLen, 5)
+	c.Assert(errs[0], gc.Equals, nil)
+	c.Assert(errgo.Cause(errs[1]), gc.Equals, params.ErrDuplicateUpload)
+	c.Assert(errs[1], gc.ErrorMatches, `cs:~charmers/trusty/mysql-1 already exists`)
+	c.Assert(errgo.Cause(errs[2]), gc.Equals, params.ErrDuplicateUpload)
+	c.Assert(errs[2], gc.ErrorMatches, `cs:~charmers/trusty/wordpress-1 duplicates an earlier item in the batch`)
+	c.Assert(errs[3], gc.Equals, nil)
+	c.Assert(errs[4], gc.Equals, nil)
+
+	for _, id := range []string{"~charmers/trusty/wordpress-1", "~charmers/trusty/wordpress-2", "~charmers/trusty/varnish-1"} {
+		_, err := store.FindEntity(router.MustNewResolvedURL(id, -1), nil)
+		c.Assert(err, gc.Equals, nil, gc.Commentf("id %s", id))
+	}
+	be, err := store.FindBaseEntity(charm.MustParseURL("~charmers/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.RevisionCount, gc.Equals, 2)
+	be, err = store.FindBaseEntity(charm.MustParseURL("~charmers/mysql"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(be.RevisionCount, gc.Equals, 1)
+}
+
+func (s *AddEntitySuite) TestAddCharmsWithInvalidItem(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	errs := store.AddCharms([]CharmToAdd{{
+		URL:   router.MustNewResolvedURL("~charmers/trusty/wordpress-1", -1),
+		Charm: storetesting.Charms.CharmDir("wordpress"),
+	}, {
+		URL:   router.MustNewResolvedURL("~charmers/bundle/mysql-1", -1),
+		Charm: storetesting.Charms.CharmDir("mysql"),
+	}})
+	c.Assert(errs, gc.HasLen, 2)
+	c.Assert(errs[0], gc.Equals, nil)
+	c.Assert(errs[1], gc.ErrorMatches, `cs:~charmers/bundle/mysql-1 is not a charm id`)
+	c.Assert(errgo.Cause(errs[1]), gc.Equals, params.ErrEntityIdNotAllowed)
+}
+
 var uploadEntityErrorsTests = []struct {
 	about       string
 	url         string
@@ -321,6 +381,181 @@ func (s *AddEntitySuite) TestUploadEntityErrors(c *gc.C) {
 	}
 }
 
+func (s *AddEntitySuite) TestAddCharmIdempotentRetry(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-1", -1)
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+	err := store.AddCharmWithArchive(url, ch)
+	c.Assert(err, gc.Equals, nil)
+	entity, err := store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	// Without the idempotent option, adding the charm
+	// again fails.
+	err = store.AddEntityWithArchiveOptions(url, ch, AddOptions{})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrDuplicateUpload)
+
+	// With it, adding the same charm again succeeds and
+	// leaves the entity unchanged.
+	err = store.AddEntityWithArchiveOptions(url, ch, AddOptions{
+		Idempotent: true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	entity1, err := store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity1, jc.DeepEquals, entity)
+}
+
+func (s *AddEntitySuite) TestAddCharmIdempotentConflict(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-1", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmArchive(c.MkDir(), "wordpress"))
+	c.Assert(err, gc.Equals, nil)
+
+	// Adding a different charm with the same id fails
+	// even when the idempotent option is set.
+	err = store.AddEntityWithArchiveOptions(url, storetesting.Charms.CharmArchive(c.MkDir(), "mysql"), AddOptions{
+		Idempotent: true,
+	})
+	c.Assert(err, gc.ErrorMatches, `cs:~charmers/precise/wordpress-1 already exists with different content`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrDuplicateUpload)
+}
+
+var checkCharmIsValidTests = []struct {
+	about       string
+	meta        *charm.Meta
+	expectError string
+	expectInfo  map[string]*params.Error
+}{{
+	about: "valid charm",
+	meta: &charm.Meta{
+		Series: []string{"trusty", "xenial"},
+		Provides: map[string]charm.Relation{
+			"website": {
+				Name:      "website",
+				Role:      charm.RoleProvider,
+				Interface: "http",
+				Scope:     charm.ScopeGlobal,
+			},
+		},
+		Resources: map[string]resource.Meta{
+			"data": {
+				Name: "data",
+				Type: resource.TypeFile,
+				Path: "data.tgz",
+			},
+		},
+	},
+}, {
+	about: "relation without an interface",
+	meta: &charm.Meta{
+		Requires: map[string]charm.Relation{
+			"db": {
+				Name:  "db",
+				Role:  charm.RoleRequirer,
+				Scope: charm.ScopeGlobal,
+			},
+		},
+	},
+	expectError: `relation db does not specify an interface`,
+	expectInfo: map[string]*params.Error{
+		"requires.db": {
+			Code:    params.ErrInvalidEntity,
+			Message: "relation db does not specify an interface",
+		},
+	},
+}, {
+	about: "file resource without a filename",
+	meta: &charm.Meta{
+		Resources: map[string]resource.Meta{
+			"data": {
+				Name: "data",
+				Type: resource.TypeFile,
+			},
+		},
+	},
+	expectError: `resource data does not specify a filename`,
+	expectInfo: map[string]*params.Error{
+		"resources.data": {
+			Code:    params.ErrInvalidEntity,
+			Message: "resource data does not specify a filename",
+		},
+	},
+}, {
+	about: "several problems",
+	meta: &charm.Meta{
+		Series: []string{"trusty", "badseries"},
+		Provides: map[string]charm.Relation{
+			"relation-name": {
+				Name:      "relation-name",
+				Role:      charm.RoleProvider,
+				Interface: "http",
+				Scope:     charm.ScopeGlobal,
+			},
+		},
+		Resources: map[string]resource.Meta{
+			"data": {
+				Name: "other",
+				Type: resource.TypeFile,
+				Path: "data.tgz",
+			},
+		},
+	},
+	expectError: `charm validation failed: \["relation relation-name has almost certainly not been changed from the template","resource data has mismatched name \\"other\\"","unrecognized series \\"badseries\\" in metadata"\]`,
+	expectInfo: map[string]*params.Error{
+		"provides.relation-name": {
+			Code:    params.ErrInvalidEntity,
+			Message: "relation relation-name has almost certainly not been changed from the template",
+		},
+		"resources.data": {
+			Code:    params.ErrInvalidEntity,
+			Message: `resource data has mismatched name "other"`,
+		},
+		"series": {
+			Code:    params.ErrInvalidEntity,
+			Message: `unrecognized series "badseries" in metadata`,
+		},
+	},
+}}
+
+func (s *AddEntitySuite) TestCheckCharmIsValid(c *gc.C) {
+	for i, test := range checkCharmIsValidTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := checkCharmIsValid(storetesting.NewCharm(test.meta))
+		if test.expectError == "" {
+			c.Assert(err, gc.Equals, nil)
+			continue
+		}
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrInvalidEntity)
+		verr, ok := err.(*errgo.Err).Underlying().(charmValidationError)
+		c.Assert(ok, gc.Equals, true)
+		c.Assert(verr.ErrorInfo(), jc.DeepEquals, test.expectInfo)
+	}
+}
+
+func (s *AddEntitySuite) TestAddCharmWithInvalidMetadataForce(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/foo-0", -1)
+	ch := storetesting.NewCharm(storetesting.RelationMeta("requires relation-name foo"))
+
+	// By default, the charm is rejected.
+	err := store.AddCharmWithArchive(url, ch)
+	c.Assert(err, gc.ErrorMatches, `relation relation-name has almost certainly not been changed from the template`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrInvalidEntity)
+
+	// With the force option, it is added anyway.
+	err = store.AddEntityWithArchiveOptions(url, ch, AddOptions{
+		Force: true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+}
+
 func (s *AddEntitySuite) TestUploadBundleWithServices(c *gc.C) {
 	store := s.newStore(c, true)
 	defer store.Close()
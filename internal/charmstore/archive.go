@@ -6,6 +6,8 @@ package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"fmt"
 	"io"
 	"os"
 	"path"
@@ -31,12 +33,18 @@ type Blob struct {
 
 	// Hash holds the hash checksum of the blob.
 	Hash string
+
+	// Hash256 holds the SHA256 hash checksum of the blob,
+	// in hexadecimal format.
+	Hash256 string
 }
 
 var preV5ArchiveFields = []string{
 	"size",
 	"blobhash",
+	"blobhash256",
 	"prev5blobhash",
+	"prev5blobhash256",
 	"prev5blobsize",
 	"prev5blobextrahash",
 }
@@ -63,6 +71,11 @@ func (s *Store) openBlob(id *router.ResolvedURL, preV5 bool) (*Blob, error) {
 		return nil, errgo.Notef(err, "cannot open archive data for %s", id)
 	}
 	hash := entity.BlobHash
+	hash256, err := s.BlobHash256(entity)
+	if err != nil {
+		r.Close()
+		return nil, errgo.Mask(err)
+	}
 
 	if preV5 && entity.PreV5BlobExtraHash != "" {
 		// There's a v5 blob so we open the blob suffix that
@@ -75,14 +88,44 @@ func (s *Store) openBlob(id *router.ResolvedURL, preV5 bool) (*Blob, error) {
 		r = newMultiReadSeekCloser(r, r2)
 		size += size2
 		hash = entity.PreV5BlobHash
+		hash256 = entity.PreV5BlobHash256
 	}
 	return &Blob{
 		ReadSeekCloser: r,
 		Size:           size,
 		Hash:           hash,
+		Hash256:        hash256,
 	}, nil
 }
 
+// BlobHash256 returns the SHA256 hash checksum of the archive blob
+// of the given entity, which must include at least the URL, BlobHash
+// and BlobHash256 fields. Entities created before the checksum was
+// recorded at upload time do not hold it, so it is calculated from
+// the blob and stored in the entity the first time it is required.
+func (s *Store) BlobHash256(entity *mongodoc.Entity) (string, error) {
+	if entity.BlobHash256 != "" {
+		return entity.BlobHash256, nil
+	}
+	r, _, err := s.BlobStore.Open(entity.BlobHash, nil)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot open archive data for %s", entity.URL)
+	}
+	defer r.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", errgo.Notef(err, "cannot read archive data for %s", entity.URL)
+	}
+	sum := fmt.Sprintf("%x", hash.Sum(nil))
+	if err := s.DB.Entities().UpdateId(entity.URL, bson.D{{
+		"$set", bson.D{{"blobhash256", sum}},
+	}}); err != nil {
+		return "", errgo.Notef(err, "cannot update SHA256 hash for %s", entity.URL)
+	}
+	entity.BlobHash256 = sum
+	return sum, nil
+}
+
 type multiReadSeekCloser struct {
 	readers []blobstore.ReadSeekCloser
 	io.ReadSeeker
@@ -14,6 +14,11 @@ import (
 
 var gcInterval = time.Hour
 
+// gcGracePeriod holds how long a blob must have gone without
+// being put before it may be garbage collected. This allows
+// time for an uploaded blob to be referenced by its entity.
+const gcGracePeriod = 30 * time.Minute
+
 // blobstoreGC implements the worker that runs the blobstore
 // garbage collector.
 type blobstoreGC struct {
@@ -67,9 +72,10 @@ func (gc *blobstoreGC) doGC() error {
 	if err != nil {
 		return errgo.Notef(err, "expired-upload garbage collection failed")
 	}
-	err = store.BlobStoreGC(time.Now().Add(-30 * time.Minute))
+	result, err := store.GCBlobs(gcGracePeriod)
 	if err != nil {
 		return errgo.Notef(err, "blob garbage collection failed")
 	}
+	logger.Infof("removed %d garbage blobs (%d bytes)", result.Count, result.Size)
 	return nil
 }
@@ -29,7 +29,7 @@ func (s *commonSuite) addRequiredCharms(c *gc.C, bundle charm.Bundle) {
 func (s *commonSuite) newStore(c *gc.C, withElasticSearch bool) *Store {
 	var si *SearchIndex
 	if withElasticSearch {
-		si = &SearchIndex{s.ES, s.TestIndex}
+		si = &SearchIndex{Database: s.ES, Index: s.TestIndex}
 	}
 	p, err := NewPool(s.Session.DB("juju_test"), si, &bakery.NewServiceParams{}, ServerParams{
 		MinUploadPartSize: 10,
@@ -10,7 +10,7 @@ var (
 	esMapping = mustParseJSON(esMappingJSON)
 )
 
-const esSettingsVersion = 12
+const esSettingsVersion = 31
 
 func mustParseJSON(s string) interface{} {
 	var j json.RawMessage
@@ -123,6 +123,9 @@ const esMappingJSON = `
         "omit_norms": true,
         "index_options": "docs"
       },
+      "RevisionCount": {
+        "type": "integer"
+      },
       "TotalDownloads": {
         "type": "long"
       },
@@ -136,6 +139,10 @@ const esMappingJSON = `
         "type": "date",
         "format": "dateOptionalTime"
       },
+      "StablePublishTime": {
+        "type": "date",
+        "format": "dateOptionalTime"
+      },
       "CharmMeta": {
         "dynamic": "false",
         "properties": {
@@ -295,6 +302,91 @@ const esMappingJSON = `
         "omit_norms": true,
         "index_options": "docs"
       },
+      "CharmAssumes": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "CharmArchitectures": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "Platforms": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "License": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "Actions": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "SupportedArchitectures": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "ConfigOptions": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "Resources": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "StorageTypes": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "Metrics": {
+        "type": "multi_field",
+        "fields": {
+          "Metrics": {
+            "type": "string",
+            "index": "not_analyzed",
+            "omit_norms": true,
+            "index_options": "docs"
+          },
+          "tok": {
+            "type": "string",
+            "analyzer": "lowercase_words",
+            "include_in_all": false
+          }
+        }
+      },
+      "Origin": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "Containers": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
+      "MinJujuVersion": {
+        "type": "long"
+      },
       "BundleData": {
         "type": "object",
         "dynamic": "false",
@@ -334,6 +426,9 @@ const esMappingJSON = `
           "Series": {
             "type": "string"
           },
+          "Description": {
+            "type": "string"
+          },
           "Relations": {
             "type": "string",
             "index": "not_analyzed"
@@ -357,12 +452,18 @@ const esMappingJSON = `
         }
       },
       "BundleReadMe": {
+        "type": "string"
+      },
+      "Docs": {
+        "type": "string"
+      },
+      "BundleCharms": {
         "type": "string",
         "index": "not_analyzed",
         "omit_norms": true,
         "index_options": "docs"
       },
-      "BundleCharms": {
+      "BundleCharmNames": {
         "type": "string",
         "index": "not_analyzed",
         "omit_norms": true,
@@ -386,6 +487,12 @@ const esMappingJSON = `
         "omit_norms": true,
         "index_options": "docs"
       },
+      "Channel": {
+        "type": "string",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
+      },
       "SingleSeries": {
         "type": "boolean",
         "index": "not_analyzed",
@@ -397,6 +504,12 @@ const esMappingJSON = `
         "index": "not_analyzed",
         "omit_norms": true,
         "index_options": "docs"
+      },
+      "Deprecated": {
+        "type": "boolean",
+        "index": "not_analyzed",
+        "omit_norms": true,
+        "index_options": "docs"
       }
     }
   }
@@ -10,6 +10,7 @@ import (
 	"github.com/juju/utils/parallel"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6"
+	"gopkg.in/juju/charmrepo.v3/csclient/params"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
@@ -31,6 +32,9 @@ const (
 	migrationCandidateBetaChannels   mongodoc.MigrationName = "populate candidate and beta channel ACLs"
 	migrationRevisionsCollection     mongodoc.MigrationName = "populate revisions collection"
 	migrationBlobRefs                mongodoc.MigrationName = "populate blobref table"
+	migrationRevisionCounts          mongodoc.MigrationName = "populate base entity revision counts"
+	migrationDownloadTotal           mongodoc.MigrationName = "populate archive download total"
+	migrationStablePublishTime       mongodoc.MigrationName = "populate stable publish time"
 )
 
 // migrations holds all the migration functions that are executed in the order
@@ -87,6 +91,15 @@ var migrations = []migration{{
 }, {
 	name:    migrationBlobRefs,
 	migrate: migrateBlobRefs,
+}, {
+	name:    migrationRevisionCounts,
+	migrate: migrateRevisionCounts,
+}, {
+	name:    migrationDownloadTotal,
+	migrate: migrateDownloadTotal,
+}, {
+	name:    migrationStablePublishTime,
+	migrate: migrateStablePublishTime,
 }}
 
 // migration holds a migration function with its corresponding name.
@@ -215,6 +228,108 @@ func migrateRevisionsCollection(db StoreDatabase) error {
 	return nil
 }
 
+// migrateRevisionCounts populates the revision count of each base
+// entity from the entities in the database.
+func migrateRevisionCounts(db StoreDatabase) error {
+	var counts []struct {
+		BaseURL *charm.URL `bson:"_id"`
+		Count   int        `bson:"count"`
+	}
+	err := db.Entities().Pipe([]bson.D{{{
+		"$group", bson.D{
+			{"_id", "$baseurl"},
+			{"count", bson.D{{"$sum", 1}}},
+		},
+	}}}).All(&counts)
+	if err != nil {
+		return errgo.Notef(err, "cannot count revisions")
+	}
+	col := db.BaseEntities()
+	run := parallel.NewRun(20)
+	for _, count := range counts {
+		count := count
+		run.Do(func() error {
+			err := col.UpdateId(count.BaseURL, bson.D{{
+				"$set", bson.D{{"revisioncount", count.Count}},
+			}})
+			if err != nil && err != mgo.ErrNotFound {
+				return errgo.Notef(err, "update %v failed", count.BaseURL)
+			}
+			return nil
+		})
+	}
+	if err := run.Wait(); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// migrateDownloadTotal sets the running total of archive downloads
+// from the existing download counters. Afterwards the total is kept up
+// to date by Store.IncrementDownloadCountsAtTime.
+func migrateDownloadTotal(db StoreDatabase) error {
+	var st stats
+	key, err := st.key(db, []string{params.StatsArchiveDownload}, false)
+	if errgo.Cause(err) == params.ErrNotFound {
+		// There have been no downloads.
+		return nil
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	var result struct {
+		Count int64 `bson:"count"`
+	}
+	err = db.StatCounters().Pipe([]bson.D{
+		{{"$match", bson.D{{"k", bson.D{{"$regex", "^" + key + ".+"}}}}}},
+		{{"$group", bson.D{{"_id", nil}, {"count", bson.D{{"$sum", "$c"}}}}}},
+	}).One(&result)
+	if err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot count downloads")
+	}
+	if _, err := db.StatTotals().UpsertId(archiveDownloadTotalId, bson.D{{
+		"$set", bson.D{{"c", result.Count}},
+	}}); err != nil {
+		return errgo.Notef(err, "cannot set total download count")
+	}
+	return nil
+}
+
+// migrateStablePublishTime sets the stable publish time of every
+// entity that was published to the stable channel before the time was
+// recorded. The time of the original publish is not known, so the
+// upload time is used instead. The search index is updated with the
+// new times when it is next synchronised.
+func migrateStablePublishTime(db StoreDatabase) error {
+	entities := db.Entities()
+	iter := entities.Find(bson.D{
+		{"published.stable", true},
+		{"stablepublishtime", bson.D{{"$exists", false}}},
+	}).Select(FieldSelector("uploadtime")).Iter()
+	run := parallel.NewRun(20)
+	var entity mongodoc.Entity
+	for iter.Next(&entity) {
+		url, uploadTime := entity.URL, entity.UploadTime
+		run.Do(func() error {
+			err := entities.UpdateId(url, bson.D{{
+				"$set", bson.D{{"stablepublishtime", uploadTime}},
+			}})
+			if err != nil && err != mgo.ErrNotFound {
+				return errgo.Notef(err, "update %v failed", url)
+			}
+			return nil
+		})
+	}
+	if err := iter.Close(); err != nil {
+		run.Wait()
+		return errgo.Notef(err, "could not iterate through all entities")
+	}
+	if err := run.Wait(); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
 // blobRefDoc holds a mapping from blob hash to
 // backend blob name.
 // This is duplicated from internal/blobstore.
@@ -5,12 +5,16 @@ package charmstore
 
 import (
 	"net/http"
+	"time"
 
 	jujutesting "github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6"
+	"gopkg.in/juju/charmrepo.v3/csclient/params"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
 )
@@ -182,6 +186,77 @@ func (s *migrationsSuite) TestMigrateMigrationList(c *gc.C) {
 	}
 }
 
+func (s *migrationsSuite) TestMigrateDownloadTotal(c *gc.C) {
+	// With no downloads, no total is recorded.
+	err := migrateDownloadTotal(s.db)
+	c.Assert(err, gc.Equals, nil)
+	n, err := s.db.StatTotals().Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 0)
+
+	var st stats
+	for _, counter := range []struct {
+		key   []string
+		t     int32
+		count int64
+	}{
+		{[]string{params.StatsArchiveDownload, "trusty", "wordpress", "", "1"}, 0, 3},
+		{[]string{params.StatsArchiveDownload, "trusty", "wordpress", "", "1"}, 60, 2},
+		{[]string{params.StatsArchiveDownload, "bundle", "mongo", "bob", "0"}, 0, 1},
+		{[]string{params.StatsArchiveDownloadSeries, "wordpress", "", "1", "trusty"}, 0, 10},
+	} {
+		key, err := st.key(s.db, counter.key, true)
+		c.Assert(err, gc.Equals, nil)
+		_, err = s.db.StatCounters().Upsert(bson.D{{"k", key}, {"t", counter.t}}, bson.D{{"$inc", bson.D{{"c", counter.count}}}})
+		c.Assert(err, gc.Equals, nil)
+	}
+	err = migrateDownloadTotal(s.db)
+	c.Assert(err, gc.Equals, nil)
+	var total statTotal
+	err = s.db.StatTotals().FindId(archiveDownloadTotalId).One(&total)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(total.Count, gc.Equals, int64(6))
+}
+
+func (s *migrationsSuite) TestMigrateStablePublishTime(c *gc.C) {
+	uploadTime := time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+	publishTime := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, e := range []*mongodoc.Entity{{
+		URL:        charm.MustParseURL("~bob/trusty/wordpress-0"),
+		UploadTime: uploadTime,
+		Published:  map[params.Channel]bool{params.StableChannel: true},
+	}, {
+		URL:               charm.MustParseURL("~bob/trusty/wordpress-1"),
+		UploadTime:        uploadTime,
+		Published:         map[params.Channel]bool{params.StableChannel: true},
+		StablePublishTime: publishTime,
+	}, {
+		URL:        charm.MustParseURL("~bob/trusty/wordpress-2"),
+		UploadTime: uploadTime,
+		Published:  map[params.Channel]bool{params.EdgeChannel: true},
+	}} {
+		err := s.db.Entities().Insert(e)
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := migrateStablePublishTime(s.db)
+	c.Assert(err, gc.Equals, nil)
+
+	for i, test := range []struct {
+		url  string
+		want time.Time
+	}{
+		{"~bob/trusty/wordpress-0", uploadTime},
+		{"~bob/trusty/wordpress-1", publishTime},
+		{"~bob/trusty/wordpress-2", time.Time{}},
+	} {
+		c.Logf("test %d: %s", i, test.url)
+		var e mongodoc.Entity
+		err := s.db.Entities().FindId(charm.MustParseURL(test.url)).One(&e)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(e.StablePublishTime.Equal(test.want), jc.IsTrue, gc.Commentf("got %v", e.StablePublishTime))
+	}
+}
+
 func (s *migrationsSuite) checkExecuted(c *gc.C, expected ...mongodoc.MigrationName) {
 	var obtained []mongodoc.MigrationName
 	var doc mongodoc.Migration
@@ -141,9 +141,10 @@ func mapRevisions(resourceRevisions []mongodoc.ResourceRevision) map[string]int
 // the given name to the entity with the given id. If revision is -1, the revision of the new resource
 // will be calculated to be one higher than any existing resources.
 //
-// TODO consider restricting uploads so that if the hash matches the
-// latest revision then a new revision isn't created. This would match
-// the behaviour for charms and bundles.
+// If revision is -1 and the blob has the same hash as the latest
+// revision of the resource, no new revision is created and the latest
+// revision is returned instead. This matches the behaviour for charms
+// and bundles.
 func (s *Store) UploadResource(id *router.ResolvedURL, name string, revision int, blob io.Reader, blobHash string, size int64) (*mongodoc.Resource, error) {
 	entity, err := s.FindEntity(id, FieldSelector("charmmeta", "baseurl"))
 	if err != nil {
@@ -152,6 +153,15 @@ func (s *Store) UploadResource(id *router.ResolvedURL, name string, revision int
 	if !charmHasResource(entity.CharmMeta, name) {
 		return nil, errgo.Newf("charm does not have resource %q", name)
 	}
+	if revision < 0 {
+		latest, err := s.latestResource(entity.BaseURL, name)
+		if err != nil && errgo.Cause(err) != params.ErrNotFound {
+			return nil, errgo.Mask(err)
+		}
+		if latest != nil && latest.BlobHash == blobHash && latest.Size == size {
+			return latest, nil
+		}
+	}
 	if _, err := s.putArchive(blob, size, blobHash); err != nil {
 		return nil, errgo.Mask(err)
 	}
@@ -282,14 +292,29 @@ func (s *Store) addResource(r *mongodoc.Resource, uploadId string) (*mongodoc.Re
 // nextRevisionNumber calculates the next revision number to use for a
 // resource.
 func (s *Store) nextResourceRevision(baseURL *charm.URL, name string) (int, error) {
+	r, err := s.latestResource(baseURL, name)
+	if err != nil {
+		if errgo.Cause(err) == params.ErrNotFound {
+			return 0, nil
+		}
+		return -1, errgo.Mask(err)
+	}
+	return r.Revision + 1, nil
+}
+
+// latestResource returns the resource with the given name and the
+// highest revision number for the given base URL. If there are no
+// revisions of the resource, an error with a params.ErrNotFound cause
+// is returned.
+func (s *Store) latestResource(baseURL *charm.URL, name string) (*mongodoc.Resource, error) {
 	var r mongodoc.Resource
 	if err := s.DB.Resources().Find(newResourceQuery(baseURL, name, -1)).Sort("-revision").One(&r); err != nil {
 		if err == mgo.ErrNotFound {
-			return 0, nil
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "resource %q not found", name)
 		}
-		return -1, err
+		return nil, errgo.Notef(err, "cannot get resource")
 	}
-	return r.Revision + 1, nil
+	return &r, nil
 }
 
 // ResolveResource finds the resource specified. If a matching resource
@@ -273,6 +273,41 @@ func (s *resourceSuite) TestUploadResource(c *gc.C) {
 	checkResourceDocs(c, store, id, []string{"someResource/1"}, []*mongodoc.Resource{res})
 }
 
+func (s *resourceSuite) TestUploadResourceSameContent(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := MustParseResolvedURL("cs:~charmers/precise/wordpress-3")
+	meta := storetesting.MetaWithResources(nil, "someResource")
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(meta))
+	c.Assert(err, gc.Equals, nil)
+
+	blob := "content 1"
+	res0, err := store.UploadResource(id, "someResource", -1, strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res0.Revision, gc.Equals, 0)
+
+	// Uploading the same content again does not create
+	// a new revision.
+	res1, err := store.UploadResource(id, "someResource", -1, strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res1.Revision, gc.Equals, 0)
+	c.Assert(res1.BlobHash, gc.Equals, res0.BlobHash)
+	n, err := store.DB.Resources().Find(newResourceQuery(&id.URL, "someResource", -1)).Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(n, gc.Equals, 1)
+
+	// Different content creates a new revision, after which
+	// uploading the original content creates another one.
+	blob2 := "content 2"
+	res2, err := store.UploadResource(id, "someResource", -1, strings.NewReader(blob2), hashOfString(blob2), int64(len(blob2)))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res2.Revision, gc.Equals, 1)
+	res3, err := store.UploadResource(id, "someResource", -1, strings.NewReader(blob), hashOfString(blob), int64(len(blob)))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res3.Revision, gc.Equals, 2)
+}
+
 func (s *resourceSuite) TestUploadResourceWithSpecificRevisionId(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
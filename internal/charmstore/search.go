@@ -8,8 +8,13 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"github.com/juju/utils"
 	"gopkg.in/errgo.v1"
@@ -26,6 +31,38 @@ import (
 type SearchIndex struct {
 	*elasticsearch.Database
 	Index string
+
+	// retries holds the maximum number of times a request that
+	// fails with a transient error is retried. NewPool sets it
+	// from ServerParams.SearchRetries in its own copy of the
+	// SearchIndex.
+	retries int
+
+	// bulk, if not nil, collects the documents written by update
+	// so that they can be sent to the index with a single request
+	// by flushBulk.
+	bulk *[]elasticsearch.BulkIndexItem
+}
+
+// searchRetryDelay holds the time to wait before the first retry of a
+// failed search index request. The delay doubles for each subsequent
+// retry. It is a variable so that it can be changed in tests.
+var searchRetryDelay = 100 * time.Millisecond
+
+// retry calls f, retrying it with increasing delays while it fails
+// with a transient error, up to si.retries times. The error from the
+// last call is returned.
+func (si *SearchIndex) retry(f func() error) error {
+	delay := searchRetryDelay
+	for i := 0; ; i++ {
+		err := f()
+		if err == nil || i >= si.retries || !elasticsearch.IsTransient(errgo.Cause(err)) {
+			return err
+		}
+		logger.Warningf("search index request failed, retrying in %v: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
 }
 
 const typeName = "entity"
@@ -45,6 +82,22 @@ var seriesBoost = func() map[string]float64 {
 	return m
 }()
 
+// relatedInterfaceBoost and relatedTagBoost define how much the
+// results that share a relation interface or a tag with the
+// entities in SearchParams.Downloaded will be boosted.
+const (
+	relatedInterfaceBoost = 1.5
+	relatedTagBoost       = 1.2
+)
+
+// defaultDownloadBoost and defaultPromulgatedBoost define the ranking
+// weights used when ServerParams.DownloadBoost and
+// ServerParams.PromulgatedBoost are not set.
+const (
+	defaultDownloadBoost    = 0.000001
+	defaultPromulgatedBoost = 1.25
+)
+
 // SearchDoc is a mongodoc.Entity with additional fields useful for searching.
 // This is the document that is stored in the search index.
 type SearchDoc struct {
@@ -53,6 +106,67 @@ type SearchDoc struct {
 	ReadACLs       []string
 	Series         []string
 
+	// RevisionCount holds the number of revisions of the
+	// base entity.
+	RevisionCount int
+
+	// Platforms holds an entry of the form "series/arch" for each
+	// combination of series and architecture supported by the
+	// charm. If the charm supports all architectures, arch is
+	// "all".
+	Platforms []string `json:",omitempty"`
+
+	// SupportedArchitectures holds the architectures declared by
+	// the charm. It is empty if the charm supports all
+	// architectures.
+	SupportedArchitectures []string `json:",omitempty"`
+
+	// License holds the license declared by the charm. It is
+	// empty for bundles and for charms that do not declare a
+	// license.
+	License string `json:",omitempty"`
+
+	// Containers holds the names and upstream images of the
+	// containers declared by a Kubernetes charm.
+	Containers []string `json:",omitempty"`
+
+	// MinJujuVersion holds the minimum version of Juju required
+	// by the charm, encoded by encodeJujuVersion so that versions
+	// can be compared numerically. It is zero if the charm does
+	// not declare a minimum version.
+	MinJujuVersion int `json:",omitempty"`
+
+	// ConfigOptions holds the names of the configuration
+	// options of the charm.
+	ConfigOptions []string `json:",omitempty"`
+
+	// Actions holds the names of the actions provided
+	// by the charm.
+	Actions []string `json:",omitempty"`
+
+	// Resources holds the names of the resources declared
+	// by the charm.
+	Resources []string `json:",omitempty"`
+
+	// StorageTypes holds the distinct types of storage, such
+	// as "block" or "filesystem", requested by the charm.
+	StorageTypes []string `json:",omitempty"`
+
+	// Metrics holds the names of the metrics declared by
+	// the charm.
+	Metrics []string `json:",omitempty"`
+
+	// BundleCharmNames holds the distinct names of the charms
+	// used by the applications in a bundle. It is empty for
+	// charms.
+	BundleCharmNames []string `json:",omitempty"`
+
+	// Channel holds the channel that the entity is published in.
+	// An entity published in more than one of the searchChannels
+	// has a separate document for each channel, holding the read
+	// ACLs for that channel in ReadACLs.
+	Channel params.Channel
+
 	// SingleSeries is true if the document referes to an entity that
 	// describes a single series. This will either be a bundle, a
 	// single-series charm or an expanded record for a multi-series
@@ -81,12 +195,18 @@ func (s *Store) UpdateSearchAsync(r *router.ResolvedURL) {
 // so the latest stable revision of the charm specified by r will be
 // indexed.
 func (s *Store) UpdateSearch(r *router.ResolvedURL) error {
-	if s.ES == nil || s.ES.Database == nil {
+	return s.updateSearch(s.ES, r)
+}
+
+// updateSearch updates the search record for the entity reference r
+// in the given search index.
+func (s *Store) updateSearch(si *SearchIndex, r *router.ResolvedURL) error {
+	if si == nil || si.Database == nil {
 		return nil
 	}
 	// For multi-series charms update the whole base URL.
 	if r.URL.Series == "" {
-		return s.UpdateSearchBaseURL(&r.URL)
+		return s.updateSearchBaseURL(si, &r.URL)
 	}
 
 	if !series.Series[r.URL.Series].SearchIndex {
@@ -97,59 +217,94 @@ func (s *Store) UpdateSearch(r *router.ResolvedURL) error {
 		return errgo.NoteMask(err, fmt.Sprintf("cannot update search record for %q", &r.URL), errgo.Is(params.ErrNotFound))
 	}
 	series := r.URL.Series
-	entityURL := baseEntity.ChannelEntities[params.StableChannel][series]
-	if entityURL == nil {
-		// There is no stable version of the entity to index.
-		return nil
-	}
-	entity, err := s.FindEntity(&router.ResolvedURL{URL: *entityURL}, nil)
-	if err != nil {
-		return errgo.Notef(err, "cannot update search record for %q", entityURL)
-	}
-	if err := s.updateSearchEntity(entity, baseEntity); err != nil {
-		return errgo.Notef(err, "cannot update search record for %q", entityURL)
+	for _, ch := range searchChannels {
+		entityURL := baseEntity.ChannelEntities[ch][series]
+		if entityURL == nil {
+			// There is no version of the entity to index
+			// in this channel.
+			continue
+		}
+		entity, err := s.FindEntityIncludingArchived(&router.ResolvedURL{URL: *entityURL}, nil)
+		if err != nil {
+			return errgo.Notef(err, "cannot update search record for %q", entityURL)
+		}
+		if entity.Archived {
+			continue
+		}
+		if err := s.updateSearchEntity(si, entity, baseEntity, ch); err != nil {
+			return errgo.Notef(err, "cannot update search record for %q", entityURL)
+		}
 	}
 	return nil
 }
 
+// searchChannels holds the channels whose entities are indexed for
+// searching. Searches use the stable channel unless
+// SearchParams.Channel specifies otherwise.
+var searchChannels = []params.Channel{
+	params.StableChannel,
+	params.EdgeChannel,
+}
+
+// isSearchChannel reports whether ch is one of the searchChannels.
+func isSearchChannel(ch params.Channel) bool {
+	for _, c := range searchChannels {
+		if c == ch {
+			return true
+		}
+	}
+	return false
+}
+
 // UpdateSearchBaseURL updates the search record for all entities with
 // the specified base URL. It must be called whenever the entry for the
 // given URL in the BaseEntitites collection has changed.
 func (s *Store) UpdateSearchBaseURL(baseURL *charm.URL) error {
-	if s.ES == nil || s.ES.Database == nil {
+	return s.updateSearchBaseURL(s.ES, baseURL)
+}
+
+// updateSearchBaseURL updates the search record for all entities with
+// the specified base URL in the given search index.
+func (s *Store) updateSearchBaseURL(si *SearchIndex, baseURL *charm.URL) error {
+	if si == nil || si.Database == nil {
 		return nil
 	}
 	baseEntity, err := s.FindBaseEntity(baseURL, nil)
 	if err != nil {
 		return errgo.NoteMask(err, fmt.Sprintf("cannot index %s", baseURL), errgo.Is(params.ErrNotFound))
 	}
-	stableEntities := baseEntity.ChannelEntities[params.StableChannel]
-	updated := make(map[string]bool, len(stableEntities))
-	for urlSeries, url := range stableEntities {
-		if !series.Series[urlSeries].SearchIndex {
-			continue
-		}
-		if updated[url.String()] {
-			continue
-		}
-		updated[url.String()] = true
-		entity, err := s.FindEntity(&router.ResolvedURL{URL: *url}, nil)
-		if err != nil {
-			return errgo.Notef(err, "cannot update search record for %q", url)
-		}
-		if err := s.updateSearchEntity(entity, baseEntity); err != nil {
-			return errgo.Notef(err, "cannot update search record for %q", url)
+	for _, ch := range searchChannels {
+		channelEntities := baseEntity.ChannelEntities[ch]
+		updated := make(map[string]bool, len(channelEntities))
+		for urlSeries, url := range channelEntities {
+			if !series.Series[urlSeries].SearchIndex {
+				continue
+			}
+			if updated[url.String()] {
+				continue
+			}
+			updated[url.String()] = true
+			entity, err := s.FindEntityIncludingArchived(&router.ResolvedURL{URL: *url}, nil)
+			if err != nil {
+				return errgo.Notef(err, "cannot update search record for %q", url)
+			}
+			if entity.Archived {
+				continue
+			}
+			if err := s.updateSearchEntity(si, entity, baseEntity, ch); err != nil {
+				return errgo.Notef(err, "cannot update search record for %q", url)
+			}
 		}
 	}
 	return nil
 }
 
-func (s *Store) updateSearchEntity(entity *mongodoc.Entity, baseEntity *mongodoc.BaseEntity) error {
-	doc, err := s.searchDocFromEntity(entity, baseEntity)
+func (s *Store) updateSearchEntity(si *SearchIndex, entity *mongodoc.Entity, baseEntity *mongodoc.BaseEntity, ch params.Channel) error {
+	doc, err := s.searchDocFromEntity(entity, baseEntity, ch)
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	if err := s.ES.update(doc); err != nil {
+	if err := si.update(doc); err != nil {
 		return errgo.Notef(err, "cannot update search index")
 	}
 	return nil
@@ -157,10 +312,11 @@ func (s *Store) updateSearchEntity(entity *mongodoc.Entity, baseEntity *mongodoc
 
 // searchDocFromEntity performs the processing required to convert a
 // mongodoc.Entity and the corresponding mongodoc.BaseEntity to an esDoc
-// for indexing.
-func (s *Store) searchDocFromEntity(e *mongodoc.Entity, be *mongodoc.BaseEntity) (*SearchDoc, error) {
-	doc := SearchDoc{Entity: e}
-	doc.ReadACLs = be.ChannelACLs[params.StableChannel].Read
+// for indexing in the given channel.
+func (s *Store) searchDocFromEntity(e *mongodoc.Entity, be *mongodoc.BaseEntity, ch params.Channel) (*SearchDoc, error) {
+	doc := SearchDoc{Entity: e, Channel: ch}
+	doc.ReadACLs = be.ChannelACLs[ch].Read
+	doc.RevisionCount = be.RevisionCount
 	// There should only be one record for the promulgated entity, which
 	// should be the latest promulgated revision. In the case that the base
 	// entity is not promulgated assume that there is a later promulgated
@@ -176,14 +332,98 @@ func (s *Store) searchDocFromEntity(e *mongodoc.Entity, be *mongodoc.BaseEntity)
 	doc.TotalDownloads = allRevisions.Total
 	if doc.Entity.Series == "bundle" {
 		doc.Series = []string{"bundle"}
+		doc.BundleCharmNames = bundleCharmNames(doc.Entity.BundleData)
 	} else {
 		doc.Series = doc.Entity.SupportedSeries
+		doc.Platforms = platforms(doc.Series, doc.Entity.CharmArchitectures)
+		doc.SupportedArchitectures = doc.Entity.CharmArchitectures
+		doc.License = doc.Entity.CharmLicense
+		doc.Containers = append(doc.Containers, doc.Entity.CharmContainers...)
+		doc.Containers = append(doc.Containers, doc.Entity.CharmContainerImages...)
+		if m := doc.Entity.CharmMeta; m != nil {
+			v := m.MinJujuVersion
+			doc.MinJujuVersion = encodeJujuVersion(v.Major, v.Minor, v.Patch)
+			for name := range m.Resources {
+				doc.Resources = append(doc.Resources, name)
+			}
+			sort.Strings(doc.Resources)
+			storageTypes := make(map[string]bool)
+			for _, s := range m.Storage {
+				if t := string(s.Type); !storageTypes[t] {
+					storageTypes[t] = true
+					doc.StorageTypes = append(doc.StorageTypes, t)
+				}
+			}
+			sort.Strings(doc.StorageTypes)
+		}
+		if config := doc.Entity.CharmConfig; config != nil {
+			for name := range config.Options {
+				doc.ConfigOptions = append(doc.ConfigOptions, name)
+			}
+			sort.Strings(doc.ConfigOptions)
+		}
+		if actions := doc.Entity.CharmActions; actions != nil {
+			for name := range actions.ActionSpecs {
+				doc.Actions = append(doc.Actions, name)
+			}
+			sort.Strings(doc.Actions)
+		}
+		if metrics := doc.Entity.CharmMetrics; metrics != nil {
+			for name := range metrics.Metrics {
+				doc.Metrics = append(doc.Metrics, name)
+			}
+			sort.Strings(doc.Metrics)
+		}
 	}
 	doc.AllSeries = true
 	doc.SingleSeries = doc.Entity.Series != ""
 	return &doc, nil
 }
 
+// bundleCharmNames returns the sorted distinct names of the charms used
+// by the applications in the given bundle. Charm references that cannot
+// be parsed are ignored.
+func bundleCharmNames(bd *charm.BundleData) []string {
+	if bd == nil {
+		return nil
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, app := range bd.Applications {
+		if app == nil {
+			continue
+		}
+		url, err := charm.ParseURL(app.Charm)
+		if err != nil || seen[url.Name] {
+			continue
+		}
+		seen[url.Name] = true
+		names = append(names, url.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// platforms returns the "series/arch" platform names for all the
+// combinations of the given series and architectures. If no
+// architectures are given, the architecture "all" is used.
+func platforms(series, archs []string) []string {
+	if len(archs) == 0 {
+		archs = []string{allArchitectures}
+	}
+	ps := make([]string, 0, len(series)*len(archs))
+	for _, s := range series {
+		for _, a := range archs {
+			ps = append(ps, s+"/"+a)
+		}
+	}
+	return ps
+}
+
+// allArchitectures is the architecture used in platform names
+// for charms that do not restrict the architectures they support.
+const allArchitectures = "all"
+
 // update inserts an entity into elasticsearch if elasticsearch
 // is configured. The entity with id r is extracted from mongodb
 // and written into elasticsearch.
@@ -191,15 +431,34 @@ func (si *SearchIndex) update(doc *SearchDoc) error {
 	if si == nil || si.Database == nil {
 		return nil
 	}
-	err := si.PutDocumentVersionWithType(
-		si.Index,
-		typeName,
-		si.getID(doc.URL),
-		int64(doc.URL.Revision),
-		elasticsearch.ExternalGTE,
-		doc)
-	if err != nil && err != elasticsearch.ErrConflict {
-		return errgo.Mask(err)
+	id := si.getChannelID(doc.URL, doc.Channel)
+	if si.bulk != nil {
+		// The document is modified below, so marshal it now.
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return errgo.Notef(err, "cannot marshal search document")
+		}
+		*si.bulk = append(*si.bulk, elasticsearch.BulkIndexItem{
+			Index:       si.Index,
+			Type:        typeName,
+			ID:          id,
+			Version:     int64(doc.URL.Revision),
+			VersionType: elasticsearch.ExternalGTE,
+			Doc:         json.RawMessage(data),
+		})
+	} else {
+		err := si.retry(func() error {
+			return si.PutDocumentVersionWithType(
+				si.Index,
+				typeName,
+				id,
+				int64(doc.URL.Revision),
+				elasticsearch.ExternalGTE,
+				doc)
+		})
+		if err != nil && err != elasticsearch.ErrConflict {
+			return errgo.Mask(err)
+		}
 	}
 	if doc.Entity.URL.Series != "" {
 		return nil
@@ -216,6 +475,7 @@ func (si *SearchIndex) update(doc *SearchDoc) error {
 			doc.Entity.PromulgatedURL = &u
 		}
 		doc.Series = []string{series}
+		doc.Platforms = platforms(doc.Series, doc.Entity.CharmArchitectures)
 		doc.AllSeries = false
 		doc.SingleSeries = true
 		if err := si.update(doc); err != nil {
@@ -225,6 +485,42 @@ func (si *SearchIndex) update(doc *SearchDoc) error {
 	return nil
 }
 
+// flushBulk sends the documents collected in si.bulk to the index
+// with a single request.
+func (si *SearchIndex) flushBulk() error {
+	items := *si.bulk
+	*si.bulk = nil
+	err := si.retry(func() error {
+		return si.BulkIndex(items)
+	})
+	return errgo.Mask(err)
+}
+
+// deleteEntity removes the documents for the entity e as published
+// in the channel ch from the search index.
+func (si *SearchIndex) deleteEntity(e *mongodoc.Entity, ch params.Channel) error {
+	if si == nil || si.Database == nil {
+		return nil
+	}
+	urls := []*charm.URL{e.URL}
+	if e.URL.Series == "" {
+		// Multi-series charms also have a document for each
+		// supported series.
+		for _, series := range e.SupportedSeries {
+			u := *e.URL
+			u.Series = series
+			urls = append(urls, &u)
+		}
+	}
+	for _, u := range urls {
+		err := si.DeleteDocument(si.Index, typeName, si.getChannelID(u, ch))
+		if err != nil && errgo.Cause(err) != elasticsearch.ErrNotFound {
+			return errgo.Mask(err)
+		}
+	}
+	return nil
+}
+
 // getID returns an ID for the elasticsearch document based on the contents of the
 // mongoDB document. This is to allow elasticsearch documents to be replaced with
 // updated versions when charm data is changed.
@@ -237,6 +533,17 @@ func (si *SearchIndex) getID(r *charm.URL) string {
 	return strings.TrimRight(s, "=")
 }
 
+// getChannelID returns the ID for the elasticsearch document holding
+// the entity r as published in the channel ch. The documents for the
+// stable channel use the IDs returned by getID.
+func (si *SearchIndex) getChannelID(r *charm.URL, ch params.Channel) string {
+	id := si.getID(r)
+	if ch == "" || ch == params.StableChannel {
+		return id
+	}
+	return id + "-" + string(ch)
+}
+
 // Search searches for matching entities in the configured elasticsearch index.
 // If there is no elasticsearch index configured then it will return an empty
 // SearchResult, as if no results were found.
@@ -245,28 +552,665 @@ func (si *SearchIndex) search(sp SearchParams) (SearchResult, error) {
 		return SearchResult{}, nil
 	}
 	q := createSearchDSL(sp)
-	esr, err := si.Search(si.Index, typeName, q)
+	if sp.Cursor != "" {
+		after, err := parseCursor(sp)
+		if err != nil {
+			return SearchResult{}, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		q.From = 0
+		q.SearchAfter = after
+	}
+	var esr elasticsearch.SearchResult
+	err := si.retry(func() error {
+		var err error
+		esr, err = si.Search(si.Index, typeName, q)
+		return err
+	})
 	if err != nil {
-		return SearchResult{}, errgo.Mask(err)
+		return SearchResult{}, errgo.Mask(err, elasticsearch.IsTransient)
 	}
 	r := SearchResult{
 		SearchTime: time.Duration(esr.Took) * time.Millisecond,
 		Total:      esr.Hits.Total,
 		Results:    make([]*mongodoc.Entity, 0, len(esr.Hits.Hits)),
+		Scores:     make([]float64, 0, len(esr.Hits.Hits)),
 	}
 	for _, h := range esr.Hits.Hits {
-		var d SearchDoc
-		if err := json.Unmarshal(h.Source, &d); err != nil {
+		e, err := hitEntity(h)
+		if err != nil {
+			return SearchResult{}, errgo.Mask(err)
+		}
+		r.Results = append(r.Results, e)
+		r.Scores = append(r.Scores, h.Score)
+		if sp.Highlight {
+			r.Highlights = append(r.Highlights, h.Highlight)
+		}
+	}
+	if n := len(esr.Hits.Hits); sp.Limit > 0 && n == sp.Limit {
+		r.NextCursor, err = makeCursor(sp, esr.Hits.Hits[n-1].Sort)
+		if err != nil {
 			return SearchResult{}, errgo.Mask(err)
 		}
-		if d.SingleSeries && d.AllSeries {
-			d.Entity.Series = d.Series[0]
+	}
+	if len(sp.Facets) > 0 {
+		r.Facets, err = facetCounts(sp, esr)
+		if err != nil {
+			return SearchResult{}, errgo.Mask(err)
+		}
+	}
+	if sp.TypeCounts {
+		r.TypeCounts, err = si.typeCounts(sp)
+		if err != nil {
+			return SearchResult{}, errgo.Mask(err)
+		}
+	}
+	if sp.Suggest && r.Total == 0 {
+		r.Suggestions, err = si.suggestions(sp, esr)
+		if err != nil {
+			return SearchResult{}, errgo.Mask(err)
+		}
+	}
+	if sp.Collapse != CollapseNone {
+		n := len(r.Results)
+		collapseResults(&r, sp.Collapse)
+		r.Total -= n - len(r.Results)
+	}
+	return r, nil
+}
+
+// hitEntity returns the entity held in the search document of the
+// given hit.
+func hitEntity(h elasticsearch.Hit) (*mongodoc.Entity, error) {
+	var d SearchDoc
+	if err := json.Unmarshal(h.Source, &d); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if d.SingleSeries && d.AllSeries {
+		d.Entity.Series = d.Series[0]
+	}
+	return d.Entity, nil
+}
+
+// searchScrollKeepAlive holds how long the search index keeps the
+// context of a scrolled search alive between pages.
+const searchScrollKeepAlive = time.Minute
+
+// searchStream calls f with each entity matching sp in turn. The
+// entities are fetched pageSize at a time with a scrolled search. If
+// limit is non-zero, at most limit entities are returned. If f returns
+// an error, the search stops and searchStream returns that error
+// with its cause unchanged.
+func (si *SearchIndex) searchStream(sp SearchParams, pageSize, limit int, f func(*mongodoc.Entity) error) error {
+	if si == nil || si.Database == nil {
+		return nil
+	}
+	q := createSearchDSL(sp)
+	q.From = 0
+	q.Size = pageSize
+	if limit > 0 && limit < pageSize {
+		q.Size = limit
+	}
+	var esr elasticsearch.SearchResult
+	err := si.retry(func() error {
+		var err error
+		esr, err = si.Scroll(si.Index, typeName, q, searchScrollKeepAlive)
+		return err
+	})
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer func() {
+		if err := si.ClearScroll(esr.ScrollID); err != nil {
+			logger.Warningf("cannot clear search scroll: %v", err)
+		}
+	}()
+	n := 0
+	for len(esr.Hits.Hits) > 0 {
+		for _, h := range esr.Hits.Hits {
+			e, err := hitEntity(h)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if err := f(e); err != nil {
+				return errgo.Mask(err, errgo.Any)
+			}
+			n++
+			if limit > 0 && n >= limit {
+				return nil
+			}
+		}
+		var next elasticsearch.SearchResult
+		err := si.retry(func() error {
+			var err error
+			next, err = si.ScrollNext(esr.ScrollID, searchScrollKeepAlive)
+			return err
+		})
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		esr = next
+	}
+	return nil
+}
+
+// suggestions returns the names suggested by the name suggester in
+// esr, most similar first, leaving out any names that do not belong
+// to at least one charm or bundle that the searcher described by sp
+// is allowed to see.
+func (si *SearchIndex) suggestions(sp SearchParams, esr elasticsearch.SearchResult) ([]string, error) {
+	var names []string
+	seen := make(map[string]bool)
+	for _, s := range esr.Suggest[nameSuggester] {
+		for _, o := range s.Options {
+			if !seen[o.Text] {
+				seen[o.Text] = true
+				names = append(names, o.Text)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	// The suggester considers every name in the index, so find
+	// out which of the names are visible to the searcher.
+	q := elasticsearch.QueryDSL{
+		Query: elasticsearch.FilteredQuery{
+			Query: elasticsearch.MatchAllQuery{},
+			Filter: createFilters(SearchParams{
+				Filters: map[string][]string{"name": names},
+				Groups:  sp.Groups,
+				Admin:   sp.Admin,
+				Channel: sp.Channel,
+			}),
+		},
+		Aggregations: map[string]elasticsearch.Aggregation{
+			"names": elasticsearch.TermsAggregation{
+				Field: "Name",
+				Size:  len(names),
+			},
+		},
+	}
+	esr, err := si.Search(si.Index, typeName, q)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var agg elasticsearch.BucketAggregationResult
+	if err := json.Unmarshal(esr.Aggregations["names"], &agg); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal name aggregation")
+	}
+	visible := make(map[string]bool)
+	for _, b := range agg.Buckets {
+		visible[b.Key] = true
+	}
+	var suggestions []string
+	for _, name := range names {
+		if visible[name] {
+			suggestions = append(suggestions, name)
+		}
+	}
+	return suggestions, nil
+}
+
+// SearchExplanation holds the explanation of whether a charm or
+// bundle is found by a search.
+type SearchExplanation struct {
+	// Found holds whether the charm or bundle is found by
+	// the search.
+	Found bool
+
+	// Reason holds a human readable description of why the
+	// charm or bundle is or is not found by the search.
+	Reason string
+}
+
+// ExplainSearch explains whether the charm or bundle with the given id
+// is found by the search specified by sp, and if not, why not. The
+// reason is one of:
+//
+//	not indexed: <why the entity is not in the search index>
+//	filtered by ACL
+//	does not match text
+//	filtered by "<name>" filter
+//	excluded by "<name>" filter
+//
+// The parts of the search are checked in that order, and the first one
+// that excludes the entity is reported. The explanation does not take
+// account of the Skip and Limit parameters, so a charm or bundle that
+// is found may be on a different page of results.
+func (s *Store) ExplainSearch(sp SearchParams, id *router.ResolvedURL) (SearchExplanation, error) {
+	ch := sp.Channel
+	if ch == "" {
+		ch = params.StableChannel
+	}
+	if !isSearchChannel(ch) {
+		return SearchExplanation{}, errgo.WithCausef(nil, params.ErrBadRequest, "cannot search channel %q", ch)
+	}
+	entity, err := s.FindEntity(id, FieldSelector("published"))
+	if err != nil {
+		return SearchExplanation{}, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	baseEntity, err := s.FindBaseEntity(&id.URL, FieldSelector("channelentities"))
+	if err != nil {
+		return SearchExplanation{}, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	current, indexed := false, false
+	for urlSeries, url := range baseEntity.ChannelEntities[ch] {
+		if *url == id.URL {
+			current = true
+			indexed = indexed || series.Series[urlSeries].SearchIndex
+		}
+	}
+	switch {
+	case !entity.Published[ch]:
+		return notIndexed("not published on %s", ch), nil
+	case !current:
+		return notIndexed("not the current %s revision", ch), nil
+	case !indexed:
+		return notIndexed("series not indexed"), nil
+	}
+	if s.ES == nil || s.ES.Database == nil {
+		return notIndexed("no search index"), nil
+	}
+	present, err := s.ES.HasDocument(s.ES.Index, typeName, s.ES.getChannelID(&id.URL, ch))
+	if err != nil {
+		return SearchExplanation{}, errgo.Mask(err)
+	}
+	if !present {
+		return notIndexed("missing from search index"), nil
+	}
+	// Check each part of the search in isolation.
+	type searchCheck struct {
+		sp     SearchParams
+		reason string
+	}
+	checks := []searchCheck{{
+		sp: SearchParams{
+			Groups: sp.Groups,
+			Admin:  sp.Admin,
+		},
+		reason: "filtered by ACL",
+	}, {
+		sp: SearchParams{
+			Text:               sp.Text,
+			AutoComplete:       sp.AutoComplete,
+			MatchAllTerms:      sp.MatchAllTerms,
+			MinimumShouldMatch: sp.MinimumShouldMatch,
+			Fuzzy:              sp.Fuzzy,
+			Admin:              true,
+		},
+		reason: "does not match text",
+	}}
+	for _, k := range sortedKeys(sp.Filters) {
+		checks = append(checks, searchCheck{
+			sp: SearchParams{
+				Filters: map[string][]string{k: sp.Filters[k]},
+				Admin:   true,
+			},
+			reason: fmt.Sprintf("filtered by %q filter", k),
+		})
+	}
+	for _, k := range sortedKeys(sp.FiltersAll) {
+		checks = append(checks, searchCheck{
+			sp: SearchParams{
+				FiltersAll: map[string][]string{k: sp.FiltersAll[k]},
+				Admin:      true,
+			},
+			reason: fmt.Sprintf("filtered by %q filter", k+"-all"),
+		})
+	}
+	for _, k := range sortedKeys(sp.Exclude) {
+		checks = append(checks, searchCheck{
+			sp: SearchParams{
+				Exclude: map[string][]string{k: sp.Exclude[k]},
+				Admin:   true,
+			},
+			reason: fmt.Sprintf("excluded by %q filter", k),
+		})
+	}
+	for _, check := range checks {
+		check.sp.Channel = ch
+		check.sp.ExpandedMultiSeries = sp.ExpandedMultiSeries
+		found, err := s.ES.findsEntity(check.sp, &id.URL)
+		if err != nil {
+			return SearchExplanation{}, errgo.Mask(err)
+		}
+		if !found {
+			return SearchExplanation{Reason: check.reason}, nil
+		}
+	}
+	return SearchExplanation{
+		Found:  true,
+		Reason: "matches search",
+	}, nil
+}
+
+// notIndexed returns an explanation for an entity that is
+// not in the search index.
+func notIndexed(f string, a ...interface{}) SearchExplanation {
+	return SearchExplanation{
+		Reason: "not indexed: " + fmt.Sprintf(f, a...),
+	}
+}
+
+// sortedKeys returns the keys of m in sorted order.
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// findsEntity reports whether the search specified by sp
+// finds the entity with the given URL.
+func (si *SearchIndex) findsEntity(sp SearchParams, url *charm.URL) (bool, error) {
+	q := createSearchDSL(sp)
+	q.Query = elasticsearch.FilteredQuery{
+		Query: q.Query,
+		Filter: elasticsearch.TermFilter{
+			Field: "URL",
+			Value: url.String(),
+		},
+	}
+	esr, err := si.Search(si.Index, typeName, q)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return esr.Hits.Total > 0, nil
+}
+
+// databaseSearchFilters holds the filters supported by searchDatabase.
+var databaseSearchFilters = map[string]bool{
+	"name":   true,
+	"owner":  true,
+	"series": true,
+}
+
+// DefaultMaxSearchLimit holds the maximum number of results returned
+// by a single search when ServerParams.MaxSearchLimit is not set.
+const DefaultMaxSearchLimit = 1000
+
+// DefaultSearchRetries holds the number of times a search index
+// request that fails with a transient error is retried when
+// ServerParams.SearchRetries is not set.
+const DefaultSearchRetries = 2
+
+// defaultSearchLimit holds the number of results returned by
+// searchDatabase when no limit is specified, which is the same as
+// the number returned by elasticsearch.
+const defaultSearchLimit = 10
+
+// canSearchDatabase reports whether the search specified by sp can be
+// performed by searchDatabase. Only searches without text that filter
+// by name, owner and series and use the default ordering are
+// supported.
+func canSearchDatabase(sp SearchParams) bool {
+	if sp.Text != "" || sp.Cursor != "" || len(sp.Sort) > 0 || len(sp.Exclude) > 0 || len(sp.FiltersAll) > 0 {
+		return false
+	}
+	if sp.Channel != "" && sp.Channel != params.StableChannel {
+		return false
+	}
+	if len(sp.Facets) > 0 || len(sp.Downloaded) > 0 || sp.Collapse != CollapseNone || sp.TypeCounts {
+		return false
+	}
+	for k := range sp.Filters {
+		if !databaseSearchFilters[k] {
+			return false
+		}
+	}
+	return true
+}
+
+// searchDatabase performs the search specified by sp directly on the
+// database rather than the search index. It is used when the search
+// index is unavailable and must only be used for searches allowed by
+// canSearchDatabase. As with the search index, only the stable
+// revisions of charms and bundles are returned, ordered by id.
+// Multi-series charms are returned once even if
+// sp.ExpandedMultiSeries is set.
+func (s *Store) searchDatabase(sp SearchParams) (SearchResult, error) {
+	start := time.Now()
+	query := make(bson.D, 0, 3)
+	if names := sp.Filters["name"]; len(names) > 0 {
+		query = append(query, bson.DocElem{"name", bson.D{{"$in", names}}})
+	}
+	if owners := sp.Filters["owner"]; len(owners) > 0 {
+		// As with ownerFilter, an empty owner matches
+		// promulgated charms and bundles.
+		var or []bson.D
+		for _, owner := range owners {
+			if owner == "" {
+				or = append(or, bson.D{{"promulgated", 1}})
+			} else {
+				or = append(or, bson.D{{"user", owner}})
+			}
+		}
+		query = append(query, bson.DocElem{"$or", or})
+	}
+	if !sp.Admin {
+		acl := append([]string{params.Everyone}, sp.Groups...)
+		query = append(query, bson.DocElem{"channelacls.stable.read", bson.D{{"$in", acl}}})
+	}
+	var baseEntities []*mongodoc.BaseEntity
+	if err := s.DB.BaseEntities().Find(query).Select(bson.D{{"promulgated", 1}, {"channelentities", 1}}).All(&baseEntities); err != nil {
+		return SearchResult{}, errgo.Mask(err)
+	}
+	wantSeries := make(map[string]bool)
+	for _, v := range sp.Filters["series"] {
+		wantSeries[v] = true
+	}
+	var ids []*charm.URL
+	promulgated := make(map[string]bool)
+	for _, be := range baseEntities {
+		for urlSeries, url := range be.ChannelEntities[params.StableChannel] {
+			if !series.Series[urlSeries].SearchIndex {
+				continue
+			}
+			if len(wantSeries) > 0 && !wantSeries[urlSeries] {
+				continue
+			}
+			if _, ok := promulgated[url.String()]; ok {
+				continue
+			}
+			promulgated[url.String()] = bool(be.Promulgated)
+			ids = append(ids, url)
+		}
+	}
+	limit := sp.Limit
+	if limit == 0 {
+		limit = defaultSearchLimit
+	}
+	entityQuery := append(bson.D{{"_id", bson.D{{"$in", ids}}}}, notArchived...)
+	if !sp.IncludeDeprecated {
+		entityQuery = append(entityQuery, bson.DocElem{"deprecated", bson.D{{"$ne", true}}})
+	}
+	q := s.DB.Entities().Find(entityQuery)
+	total, err := q.Count()
+	if err != nil {
+		return SearchResult{}, errgo.Mask(err)
+	}
+	var entities []*mongodoc.Entity
+	if err := q.Sort("_id").Skip(sp.Skip).Limit(limit).All(&entities); err != nil {
+		return SearchResult{}, errgo.Mask(err)
+	}
+	r := SearchResult{
+		Total:   total,
+		Results: entities,
+		Scores:  make([]float64, len(entities)),
+	}
+	for _, e := range r.Results {
+		// As with the search index, entities are only
+		// promulgated if their base entity is.
+		if !promulgated[e.URL.String()] {
+			e.PromulgatedURL = nil
+			e.PromulgatedRevision = -1
 		}
-		r.Results = append(r.Results, d.Entity)
 	}
+	r.SearchTime = time.Since(start)
 	return r, nil
 }
 
+// searchCursor holds the information encoded in a search cursor.
+type searchCursor struct {
+	// Sort holds the sort order of the search that
+	// created the cursor.
+	Sort []SortParam `json:"s,omitempty"`
+
+	// After holds the values of the sort fields, which always
+	// end with the entity URL, of the last result returned.
+	After []json.RawMessage `json:"a"`
+}
+
+// makeCursor returns a cursor that continues the search specified by sp
+// after the hit with the given sort values.
+func makeCursor(sp SearchParams, after []json.RawMessage) (string, error) {
+	data, err := json.Marshal(searchCursor{
+		Sort:  sp.Sort,
+		After: after,
+	})
+	if err != nil {
+		return "", errgo.Notef(err, "cannot marshal search cursor")
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// parseCursor returns the sort values encoded in sp.Cursor. An error
+// with a params.ErrBadRequest cause is returned if the cursor is
+// invalid or was created by a search with a different sort order.
+func parseCursor(sp SearchParams) ([]json.RawMessage, error) {
+	data, err := base64.RawURLEncoding.DecodeString(sp.Cursor)
+	if err != nil {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid cursor")
+	}
+	var sc searchCursor
+	if err := json.Unmarshal(data, &sc); err != nil || len(sc.After) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid cursor")
+	}
+	if !sortParamsEqual(sc.Sort, sp.Sort) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "cursor does not match sort order")
+	}
+	return sc.After, nil
+}
+
+// sortParamsEqual reports whether a and b specify the same sort order.
+func sortParamsEqual(a, b []SortParam) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// collapseResults removes the entities, and their scores, from r that
+// are superseded by another entity of the same name according to the
+// given collapse mode. The order of the remaining entities is
+// preserved. Note that only the given results are considered, so an
+// entity may not be collapsed if the other form of it is on a
+// different page of the results.
+func collapseResults(r *SearchResult, mode CollapseMode) {
+	type collapseKey struct {
+		name   string
+		bundle bool
+	}
+	key := func(e *mongodoc.Entity) collapseKey {
+		return collapseKey{e.Name, e.URL.Series == "bundle"}
+	}
+	promulgated := make(map[collapseKey]bool)
+	owned := make(map[collapseKey]bool)
+	for _, e := range r.Results {
+		if e.PromulgatedURL != nil {
+			promulgated[key(e)] = true
+		} else {
+			owned[key(e)] = true
+		}
+	}
+	j := 0
+	for i, e := range r.Results {
+		k := key(e)
+		switch {
+		case mode == CollapsePromulgated && e.PromulgatedURL == nil && promulgated[k]:
+			continue
+		case mode == CollapseOwner && e.PromulgatedURL != nil && owned[k]:
+			continue
+		}
+		r.Results[j] = e
+		r.Scores[j] = r.Scores[i]
+		if r.Highlights != nil {
+			r.Highlights[j] = r.Highlights[i]
+		}
+		j++
+	}
+	r.Results = r.Results[:j]
+	r.Scores = r.Scores[:j]
+	if r.Highlights != nil {
+		r.Highlights = r.Highlights[:j]
+	}
+}
+
+// OwnerCount holds the number of matching charms and bundles
+// published by an owner.
+type OwnerCount struct {
+	Owner string
+	Count int
+}
+
+// searchOwners returns the distinct owners of the entities matching sp.
+// See Store.SearchOwners for details.
+func (si *SearchIndex) searchOwners(sp SearchParams) ([]OwnerCount, error) {
+	if si == nil || si.Database == nil {
+		return nil, nil
+	}
+	q := createSearchDSL(sp)
+	// Only the aggregation is of interest, so avoid
+	// fetching the matching documents.
+	q.From = 0
+	q.Size = 0
+	q.Fields = []string{}
+	q.Sort = nil
+	// Terms aggregations cannot skip buckets, so request enough
+	// buckets to cover the skipped ones and discard them below.
+	// Buckets are ordered by descending count and then by owner,
+	// so the pages are stable.
+	size := 0
+	if sp.Limit > 0 {
+		size = sp.Skip + sp.Limit
+	}
+	q.Aggregations = map[string]elasticsearch.Aggregation{
+		"owners": elasticsearch.TermsAggregation{
+			Field: "User",
+			Size:  size,
+		},
+	}
+	esr, err := si.Search(si.Index, typeName, q)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var agg elasticsearch.BucketAggregationResult
+	if err := json.Unmarshal(esr.Aggregations["owners"], &agg); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal owners aggregation")
+	}
+	buckets := agg.Buckets
+	if sp.Skip < len(buckets) {
+		buckets = buckets[sp.Skip:]
+	} else {
+		buckets = nil
+	}
+	owners := make([]OwnerCount, len(buckets))
+	for i, b := range buckets {
+		owners[i] = OwnerCount{
+			Owner: b.Key,
+			Count: b.DocCount,
+		}
+	}
+	return owners, nil
+}
+
 // GetSearchDocument retrieves the current search record for the charm
 // reference id.
 func (si *SearchIndex) GetSearchDocument(id *charm.URL) (*SearchDoc, error) {
@@ -309,6 +1253,17 @@ func (si *SearchIndex) ensureIndexes(force bool) error {
 	if err != nil {
 		return errgo.Notef(err, "cannot create index")
 	}
+	if err := si.activateIndex(index, old, dv); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// activateIndex makes index the current index for si, replacing the
+// index described by the old version, which has the document version
+// dv. If the version has been updated concurrently then the new index
+// is deleted instead.
+func (si *SearchIndex) activateIndex(index string, old version, dv int64) error {
 	new := version{
 		Version: esSettingsVersion,
 		Index:   index,
@@ -337,6 +1292,31 @@ func (si *SearchIndex) ensureIndexes(force bool) error {
 	return nil
 }
 
+// deleteIndex deletes the given unused index, logging any error.
+func (si *SearchIndex) deleteIndex(index string) {
+	if err := si.DeleteIndex(index); err != nil {
+		logger.Errorf("cannot delete index %q: %v", index, err)
+	}
+}
+
+// checkDocumentCount checks that the index holds exactly n documents.
+func (si *SearchIndex) checkDocumentCount(n int) error {
+	if err := si.RefreshIndex(si.Index); err != nil {
+		return errgo.Notef(err, "cannot refresh index")
+	}
+	esr, err := si.Search(si.Index, typeName, elasticsearch.QueryDSL{
+		Query: elasticsearch.MatchAllQuery{},
+		Size:  0,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot count documents")
+	}
+	if esr.Hits.Total != n {
+		return errgo.Newf("index %s holds %d documents, expected %d", si.Index, esr.Hits.Total, n)
+	}
+	return nil
+}
+
 // getCurrentVersion gets the version of elasticsearch settings, if any
 // that are deployed to elasticsearch.
 func (si *SearchIndex) getCurrentVersion() (version, int64, error) {
@@ -393,19 +1373,45 @@ func (si *SearchIndex) updateVersion(v version, dv int64) (bool, error) {
 // syncSearch populates the SearchIndex with all the data currently stored in
 // mongodb. If the SearchIndex is not configured then this method returns a nil error.
 func (s *Store) syncSearch() error {
-	if s.ES == nil || s.ES.Database == nil {
+	return s.syncSearchIndex(s.ES, nil)
+}
+
+// syncSearchHook is called before each entity is indexed by
+// syncSearchIndex. It is provided for testing purposes.
+var syncSearchHook = func() {}
+
+// syncSearchIndex populates the given search index with all the data
+// currently stored in mongodb. If cancel is closed before the
+// synchronisation has completed, syncSearchIndex stops and returns an
+// error with an ErrReindexCancelled cause. The progress of the
+// synchronisation is reported by Store.ReindexProgress.
+func (s *Store) syncSearchIndex(si *SearchIndex, cancel <-chan struct{}) error {
+	if si == nil || si.Database == nil {
 		return nil
 	}
+	total, err := s.DB.Entities().Count()
+	if err != nil {
+		return errgo.Notef(err, "cannot count entities")
+	}
+	s.pool.startReindexProgress(total)
+	defer s.pool.endReindexProgress()
 	var result mongodoc.Entity
 	// Only get the IDs here, UpdateSearch will get the full document
 	// if it is in a series that is indexed.
 	iter := s.DB.Entities().Find(nil).Select(bson.M{"_id": 1, "promulgated-url": 1}).Iter()
 	defer iter.Close() // Make sure we always close on error.
 	for iter.Next(&result) {
+		syncSearchHook()
+		select {
+		case <-cancel:
+			return errgo.WithCausef(nil, ErrReindexCancelled, "")
+		default:
+		}
 		rurl := EntityResolvedURL(&result)
-		if err := s.UpdateSearch(rurl); err != nil {
+		if err := s.updateSearch(si, rurl); err != nil {
 			return errgo.Notef(err, "cannot index %s", rurl)
 		}
+		s.pool.addReindexProgress()
 	}
 	logger.Infof("finished sync search")
 	if err := iter.Close(); err != nil {
@@ -414,9 +1420,57 @@ func (s *Store) syncSearch() error {
 	return nil
 }
 
+// searchDocumentCount returns the number of documents that a fully
+// populated search index should hold, as determined from the base
+// entities and entities in the database.
+func (s *Store) searchDocumentCount(si *SearchIndex) (int, error) {
+	ids := make(map[string]bool)
+	iter := s.DB.BaseEntities().Find(nil).Select(bson.D{{"channelentities", 1}}).Iter()
+	defer iter.Close()
+	for {
+		var be mongodoc.BaseEntity
+		if !iter.Next(&be) {
+			break
+		}
+		for _, ch := range searchChannels {
+			seen := make(map[string]bool)
+			for urlSeries, url := range be.ChannelEntities[ch] {
+				if !series.Series[urlSeries].SearchIndex || seen[url.String()] {
+					continue
+				}
+				seen[url.String()] = true
+				entity, err := s.FindEntityIncludingArchived(&router.ResolvedURL{URL: *url}, FieldSelector("archived", "supportedseries"))
+				if err != nil {
+					return 0, errgo.Notef(err, "cannot find %q", url)
+				}
+				if entity.Archived {
+					continue
+				}
+				ids[si.getChannelID(url, ch)] = true
+				if url.Series != "" {
+					continue
+				}
+				// Multi-series charms also have a document
+				// for each supported series.
+				for _, series := range entity.SupportedSeries {
+					u := *url
+					u.Series = series
+					ids[si.getChannelID(&u, ch)] = true
+				}
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, errgo.Notef(err, "cannot iterate over base entities")
+	}
+	return len(ids), nil
+}
+
 // SearchParams represents the search parameters used to search the store.
 type SearchParams struct {
-	// The text to use in the full text search query.
+	// The text to use in the full text search query. If the text
+	// ends with "*", only charms and bundles with a name that has
+	// the preceding text as a prefix are returned.
 	Text string
 	// If autocomplete is specified, the search will return only charms and
 	// bundles with a name that has text as a prefix.
@@ -429,6 +1483,12 @@ type SearchParams struct {
 	Include []string
 	// Start the the returned items at a specific offset.
 	Skip int
+	// Cursor holds a cursor returned in SearchResult.NextCursor by
+	// a previous search with the same parameters. When it is set,
+	// the results start immediately after the last result of that
+	// search and Skip is ignored. Cursors are not valid after the
+	// search index has been rebuilt.
+	Cursor string
 	// ACL values to search in addition to everyone. ACL values may represent user names
 	// or group names.
 	Groups []string
@@ -437,9 +1497,204 @@ type SearchParams struct {
 	Admin bool
 	// Sort the returned items.
 	Sort []SortParam
+	// MatchAllTerms requires every term in the text to match at
+	// least one of the searched fields. By default, all the terms
+	// must match within a single field.
+	MatchAllTerms bool
+	// MinimumShouldMatch holds the number or percentage of the
+	// terms in the text that must match within a single field,
+	// in the form accepted by ParseMinimumShouldMatch. If it is
+	// empty, all the terms must match. It is ignored if
+	// MatchAllTerms is set.
+	MinimumShouldMatch string
+	// Fuzzy allows terms in the text to match terms that differ
+	// by a small number of edits, so that misspelled
+	// text still finds results. When set, the name is matched
+	// by whole words even if AutoComplete is set.
+	Fuzzy bool
 	// ExpandedMultiSeries returns a number of entries for
 	// multi-series charms, one for each entity.
 	ExpandedMultiSeries bool
+	// IncludeDeprecated includes entities that have been
+	// marked as deprecated, which are otherwise excluded.
+	IncludeDeprecated bool
+	// Collapse specifies how to return results when both a
+	// promulgated and an owner-scoped charm or bundle with the
+	// same name match.
+	Collapse CollapseMode
+	// Downloaded holds the ids of charms and bundles previously
+	// downloaded by the caller. Charms and bundles related to
+	// them, by sharing a relation interface or a tag, are ranked
+	// higher in the results. Ids that cannot be found are ignored.
+	Downloaded []*charm.URL
+	// Facets holds the names of the facets to count over all the
+	// matching charms and bundles. Unknown facet names are ignored.
+	// See facetAggregations for the supported facets.
+	Facets []string
+	// FacetPages holds the page of values to return for each
+	// facet, keyed by facet name. Facets without an entry return
+	// their first values. Paging does not apply to the type facet.
+	FacetPages map[string]FacetPage
+	// Highlight requests fragments of the summary, description and
+	// README of each result that match the text, returned in
+	// SearchResult.Highlights. Matches are wrapped in <em> and
+	// </em>. Highlighting has a cost, so it is off by default.
+	Highlight bool
+	// Suggest requests suggestions of similar names, returned in
+	// SearchResult.Suggestions, when no charms or bundles match
+	// the text.
+	Suggest bool
+	// TypeCounts requests the number of matching charms and
+	// bundles, returned in SearchResult.TypeCounts. The counts
+	// ignore any type filter so that they can be shown
+	// regardless of the type being searched for. Counting
+	// requires an additional query, so it is off by default.
+	TypeCounts bool
+	// Channel holds the channel to search, which must be one of
+	// the searchChannels. Only the entities published in that
+	// channel are found, and the read ACLs for that channel are
+	// used. If it is empty, the stable channel is searched.
+	Channel params.Channel
+	// Exclude holds filters that remove matching charms and bundles
+	// from the results. The keys are the same as for Filters. An item
+	// is excluded if it matches any of the values for any of the
+	// keys. Excluded items are removed in addition to those hidden
+	// by the ACL.
+	Exclude map[string][]string
+	// FiltersAll holds filters for which every one of the values
+	// must match, rather than any one of them as for Filters. The
+	// keys are the same as for Filters.
+	FiltersAll map[string][]string
+
+	// related holds the terms derived from Downloaded.
+	// It is filled in by Store.Search.
+	related relatedTerms
+
+	// boosts holds the ranking weights configured for the
+	// store. It is filled in by Store.Search.
+	boosts searchBoosts
+}
+
+// searchBoosts holds the weights used to rank search results. Zero
+// weights are replaced by the defaults.
+type searchBoosts struct {
+	downloads   float64
+	promulgated float64
+}
+
+// relatedTerms holds the relation interfaces and tags of a set of
+// charms and bundles. They are used to boost the ranking of related
+// charms and bundles in search results.
+type relatedTerms struct {
+	interfaces []string
+	tags       []string
+}
+
+// relatedTerms returns the relation interfaces and tags of the
+// entities with the given ids, as found in the stable channel.
+func (s *Store) relatedTerms(ids []*charm.URL) (relatedTerms, error) {
+	var terms relatedTerms
+	interfaces := make(map[string]bool)
+	tags := make(map[string]bool)
+	for _, id := range ids {
+		e, err := s.FindBestEntity(id, params.StableChannel, FieldSelector(
+			"charmprovidedinterfaces",
+			"charmrequiredinterfaces",
+			"charmmeta",
+			"bundledata",
+		))
+		if errgo.Cause(err) == params.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return relatedTerms{}, errgo.Mask(err)
+		}
+		for _, i := range e.CharmProvidedInterfaces {
+			interfaces[i] = true
+		}
+		for _, i := range e.CharmRequiredInterfaces {
+			interfaces[i] = true
+		}
+		if e.CharmMeta != nil {
+			for _, t := range e.CharmMeta.Tags {
+				tags[t] = true
+			}
+			for _, t := range e.CharmMeta.Categories {
+				tags[t] = true
+			}
+		}
+		if e.BundleData != nil {
+			for _, t := range e.BundleData.Tags {
+				tags[t] = true
+			}
+		}
+	}
+	for i := range interfaces {
+		terms.interfaces = append(terms.interfaces, i)
+	}
+	for t := range tags {
+		terms.tags = append(terms.tags, t)
+	}
+	// Sort so that the generated query is deterministic.
+	sort.Strings(terms.interfaces)
+	sort.Strings(terms.tags)
+	return terms, nil
+}
+
+// minimumShouldMatchPattern matches the minimum_should_match forms
+// that are allowed in search parameters: an integer or a percentage,
+// either of which may be negative, or a space-separated list of
+// conditional specifications of the form "n<m" where m is an integer
+// or a percentage.
+var minimumShouldMatchPattern = regexp.MustCompile(`^(-?[0-9]+%?|[0-9]+<-?[0-9]+%?( [0-9]+<-?[0-9]+%?)*)$`)
+
+// ParseMinimumShouldMatch checks that s is a valid value for
+// SearchParams.MinimumShouldMatch (for example "2", "75%", "-1" or
+// "2<75%"). See
+// https://www.elastic.co/guide/en/elasticsearch/reference/current/query-dsl-minimum-should-match.html
+// for the meaning of the values.
+func ParseMinimumShouldMatch(s string) (string, error) {
+	if !minimumShouldMatchPattern.MatchString(s) {
+		return "", errgo.Newf("invalid minimum should match value %q", s)
+	}
+	return s, nil
+}
+
+// CollapseMode specifies how search results are combined when both a
+// promulgated entity and a non-promulgated entity with the same
+// name are found.
+type CollapseMode int
+
+const (
+	// CollapseNone returns all matching entities.
+	CollapseNone CollapseMode = iota
+
+	// CollapsePromulgated returns only the promulgated entity
+	// when a non-promulgated entity with the same name also
+	// matches.
+	CollapsePromulgated
+
+	// CollapseOwner returns only the non-promulgated entities
+	// when a promulgated entity with the same name also
+	// matches.
+	CollapseOwner
+)
+
+var collapseModes = map[string]CollapseMode{
+	"":            CollapseNone,
+	"none":        CollapseNone,
+	"promulgated": CollapsePromulgated,
+	"owner":       CollapseOwner,
+}
+
+// ParseCollapseMode returns the CollapseMode with the given name,
+// which must be one of "none", "promulgated" or "owner".
+func ParseCollapseMode(s string) (CollapseMode, error) {
+	m, ok := collapseModes[s]
+	if !ok {
+		return CollapseNone, errgo.Newf("unrecognized collapse mode %q", s)
+	}
+	return m, nil
 }
 
 var allowedSortFields = map[string]bool{
@@ -447,8 +1702,14 @@ var allowedSortFields = map[string]bool{
 	"owner":     true,
 	"series":    true,
 	"downloads": true,
+	"updated":   true,
+	"created":   true,
 }
 
+// ParseSortFields parses the given comma-separated lists of sort fields
+// and appends them, in order, to sp.Sort. Each field may be prefixed
+// with a hyphen (-) to sort in descending order. Each field may only
+// be specified once.
 func (sp *SearchParams) ParseSortFields(f ...string) error {
 	for _, s := range f {
 		for _, s := range strings.Split(s, ",") {
@@ -460,6 +1721,11 @@ func (sp *SearchParams) ParseSortFields(f ...string) error {
 			if !allowedSortFields[s] {
 				return errgo.Newf("unrecognized sort parameter %q", s)
 			}
+			for _, prev := range sp.Sort {
+				if prev.Field == s {
+					return errgo.Newf("sort parameter %q specified more than once", s)
+				}
+			}
 			sort.Field = s
 			sp.Sort = append(sp.Sort, sort)
 		}
@@ -487,6 +1753,85 @@ type SearchResult struct {
 	SearchTime time.Duration
 	Total      int
 	Results    []*mongodoc.Entity
+
+	// Scores holds the relevance score of each entity in Results,
+	// including any boosting applied to the text relevance.
+	// Scores are only meaningful relative to the other scores
+	// returned by the same index; their range is not stable
+	// across index rebuilds.
+	Scores []float64
+
+	// Highlights holds the highlighted fragments for each entity
+	// in Results, keyed by the name of the field they came from.
+	// It is only set when SearchParams.Highlight is set.
+	Highlights []map[string][]string
+
+	// Suggestions holds names of charms and bundles similar to the
+	// search text, most similar first. It is only set when
+	// SearchParams.Suggest is set and nothing matched the search.
+	// Only names of charms and bundles visible to the searcher
+	// are suggested.
+	Suggestions []string
+
+	// Facets holds the counts for each facet requested in
+	// SearchParams.Facets, keyed by facet name. The counts
+	// cover all the matching charms and bundles visible to the
+	// caller, not just the returned page of results.
+	Facets map[string][]FacetCount
+
+	// TypeCounts holds the number of matching charms and bundles
+	// visible to the caller, keyed by "charm" and "bundle", when
+	// SearchParams.TypeCounts is set. Type filters are ignored
+	// when counting.
+	TypeCounts map[string]int
+
+	// NextCursor holds a cursor that can be used in
+	// SearchParams.Cursor to fetch the next page of results. It
+	// is only set when a Limit was specified and the page is full.
+	NextCursor string
+}
+
+// FacetPage specifies a page of the values of a facet. The values
+// of a facet are ordered by descending count and then by value, so
+// the pages of a facet are disjoint and together cover all its
+// values.
+type FacetPage struct {
+	// Skip holds the number of values to skip.
+	Skip int
+	// Limit holds the maximum number of values to return.
+	// If it is zero, maxFacetValues is used.
+	Limit int
+}
+
+// End returns the position just after the last value in the page,
+// which is the number of buckets that must be requested from the
+// search index to fill the page.
+func (p FacetPage) End() int {
+	limit := p.Limit
+	if limit == 0 {
+		limit = maxFacetValues
+	}
+	return p.Skip + limit
+}
+
+// apply returns the counts in the page from counts, which must hold
+// all the counts up to p.End().
+func (p FacetPage) apply(counts []FacetCount) []FacetCount {
+	if p.Skip >= len(counts) {
+		return []FacetCount{}
+	}
+	counts = counts[p.Skip:]
+	if p.Limit > 0 && len(counts) > p.Limit {
+		counts = counts[:p.Limit]
+	}
+	return counts
+}
+
+// FacetCount holds the number of matching charms and bundles
+// that have a particular value of a facet.
+type FacetCount struct {
+	Value string
+	Count int
 }
 
 // ListResult represents the result of performing a list.
@@ -505,53 +1850,350 @@ func encodeFields(fields map[string]float64) []string {
 }
 
 // createSearchDSL builds an elasticsearch query from the query parameters.
+// The parts of the query that only depend on the shape of the search
+// are prepared once and reused by later searches of the same shape.
 // http://www.elasticsearch.org/guide/en/elasticsearch/reference/current/query-dsl.html
 func createSearchDSL(sp SearchParams) elasticsearch.QueryDSL {
-	qdsl := elasticsearch.QueryDSL{
-		From: sp.Skip,
-		Size: sp.Limit,
+	return createSearchDSLFromTemplate(sp, preparedQueryTemplate(sp))
+}
+
+// wildcardPrefix reports whether text is a wildcard search of the form
+// "prefix*" and, if so, returns the lower-cased prefix.
+func wildcardPrefix(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if !strings.HasSuffix(text, "*") {
+		return "", false
+	}
+	return strings.ToLower(strings.TrimRight(text, "*")), true
+}
+
+// splitNegatedTerms splits the negated terms, those starting with a
+// "-", from the search text. It returns the text with the negated terms
+// removed and the negated terms without their leading "-". Terms are
+// separated by white space, except within double quotes, so a
+// quoted phrase is negated as a whole. A hyphen within a term, as in
+// "squid-forwardproxy", or within quotes does not negate it. If there
+// are no negated terms, text is returned unchanged.
+func splitNegatedTerms(text string) (string, []string) {
+	var positive, negated []string
+	for _, term := range searchTerms(text) {
+		if len(term) > 1 && term[0] == '-' {
+			negated = append(negated, term[1:])
+		} else {
+			positive = append(positive, term)
+		}
+	}
+	if len(negated) == 0 {
+		return text, nil
 	}
+	return strings.Join(positive, " "), negated
+}
 
-	// Full text search
-	var q elasticsearch.Query
+// splitPhrases splits the phrases in double quotes from the search
+// text. It returns the text with the phrases removed and the phrases
+// without their quotes. If there are no phrases, text is returned
+// unchanged.
+func splitPhrases(text string) (string, []string) {
+	var loose, phrases []string
+	for _, term := range searchTerms(text) {
+		if phrase, ok := quotedPhrase(term); ok {
+			phrases = append(phrases, phrase)
+		} else {
+			loose = append(loose, term)
+		}
+	}
+	if len(phrases) == 0 {
+		return text, nil
+	}
+	return strings.Join(loose, " "), phrases
+}
+
+// quotedPhrase reports whether term is a phrase in double quotes and,
+// if so, returns the phrase without the quotes.
+func quotedPhrase(term string) (string, bool) {
+	if len(term) < 2 || term[0] != '"' || term[len(term)-1] != '"' {
+		return "", false
+	}
+	return term[1 : len(term)-1], true
+}
+
+// phraseQuery returns a query that matches the given phrase, in order,
+// in any of the given fields.
+func phraseQuery(phrase string, fields []string) elasticsearch.Query {
+	return elasticsearch.MultiMatchQuery{
+		Query:  phrase,
+		Fields: fields,
+		Type:   "phrase",
+	}
+}
+
+// searchTerms splits text into terms separated by white space. White
+// space within double quotes does not separate terms, and the quotes
+// are retained. An unbalanced quote is treated as a literal character.
+func searchTerms(text string) []string {
+	var terms []string
+	start, quoted := -1, false
+	for i, r := range text {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			if start == -1 {
+				start = i
+			}
+		case unicode.IsSpace(r) && !quoted:
+			if start != -1 {
+				terms = append(terms, text[start:i])
+				start = -1
+			}
+		case start == -1:
+			start = i
+		}
+	}
+	switch {
+	case quoted:
+		// The last quote is unbalanced, so the rest of the
+		// text is split at all white space.
+		terms = append(terms, strings.Fields(text[start:])...)
+	case start != -1:
+		terms = append(terms, text[start:])
+	}
+	return terms
+}
+
+// queryShape holds the properties of a search that determine the
+// parts of the query that do not depend on the search values.
+type queryShape struct {
+	// nameField holds the field used to match the name.
+	nameField string
+
+	// boosts holds the weights used to rank the results.
+	boosts searchBoosts
+}
+
+// queryTemplate holds the parts of a search query that are the same
+// for all searches of the same shape. Templates are shared, so they
+// must not be modified once created.
+type queryTemplate struct {
+	// fields holds the weighted fields to search for the text.
+	fields []string
+
+	// phraseFields holds the weighted fields to search for
+	// quoted phrases in the text.
+	phraseFields []string
+
+	// functions holds the boost functions applied to all searches.
+	functions []elasticsearch.Function
+}
+
+// queryTemplates holds the query templates created so far,
+// keyed by shape.
+var queryTemplates = struct {
+	mu sync.Mutex
+	m  map[queryShape]*queryTemplate
+}{
+	m: make(map[queryShape]*queryTemplate),
+}
+
+// searchQueryShape returns the shape of the query for sp.
+func searchQueryShape(sp SearchParams) queryShape {
 	nameField := "Name.tok"
-	if sp.AutoComplete {
+	// Fuzzy matching of ngrams would match almost
+	// everything, so always use whole words.
+	if sp.AutoComplete && !sp.Fuzzy {
 		nameField = "Name.ngrams"
 	}
-	if sp.Text == "" {
-		q = elasticsearch.MatchAllQuery{}
-	} else {
-		q = elasticsearch.MultiMatchQuery{
-			Query: sp.Text,
-			Fields: encodeFields(map[string]float64{
-				nameField:                  10,
-				"User.tok":                 7,
-				"CharmMeta.Categories.tok": 5,
-				"CharmMeta.Tags.tok":       5,
-				"BundleData.Tags.tok":      5,
-			}),
-			MinimumShouldMatch: "100%",
-		}
+	boosts := sp.boosts
+	if boosts.downloads == 0 {
+		boosts.downloads = defaultDownloadBoost
+	}
+	if boosts.promulgated == 0 {
+		boosts.promulgated = defaultPromulgatedBoost
 	}
+	return queryShape{
+		nameField: nameField,
+		boosts:    boosts,
+	}
+}
 
-	// Boosting
+// preparedQueryTemplate returns the query template for searches with
+// the same shape as sp, creating it if necessary.
+func preparedQueryTemplate(sp SearchParams) *queryTemplate {
+	shape := searchQueryShape(sp)
+	queryTemplates.mu.Lock()
+	defer queryTemplates.mu.Unlock()
+	t := queryTemplates.m[shape]
+	if t == nil {
+		t = newQueryTemplate(shape)
+		queryTemplates.m[shape] = t
+	}
+	return t
+}
+
+// newQueryTemplate creates the query template for searches with the
+// given shape.
+func newQueryTemplate(shape queryShape) *queryTemplate {
+	weights := map[string]float64{
+		shape.nameField:            10,
+		"User.tok":                 7,
+		"CharmMeta.Categories.tok": 5,
+		"CharmMeta.Tags.tok":       5,
+		"BundleData.Tags.tok":      5,
+		"BundleData.Description":   1,
+		"BundleReadMe":             0.5,
+		"Docs":                     0.5,
+		"Metrics.tok":              1,
+	}
+	fields := encodeFields(weights)
+	sort.Strings(fields)
+	// Phrases are precise enough to be matched
+	// against the charm summary and description too.
+	weights["CharmMeta.Summary"] = 1
+	weights["CharmMeta.Description"] = 0.5
+	phraseFields := encodeFields(weights)
+	sort.Strings(phraseFields)
 	f := []elasticsearch.Function{
 		// TODO(mhilton) review this function in future if downloads get sufficiently
 		// large that the order becomes undesirable.
 		elasticsearch.FieldValueFactorFunction{
 			Field:    "TotalDownloads",
-			Factor:   0.000001,
+			Factor:   shape.boosts.downloads,
 			Modifier: "ln2p",
 		},
 		elasticsearch.BoostFactorFunction{
 			Filter:      promulgatedFilter("1"),
-			BoostFactor: 1.25,
+			BoostFactor: shape.boosts.promulgated,
 		},
 	}
-	for k, v := range seriesBoost {
+	boostedSeries := make([]string, 0, len(seriesBoost))
+	for k := range seriesBoost {
+		boostedSeries = append(boostedSeries, k)
+	}
+	sort.Strings(boostedSeries)
+	for _, k := range boostedSeries {
 		f = append(f, elasticsearch.BoostFactorFunction{
 			Filter:      seriesFilter(k),
-			BoostFactor: v,
+			BoostFactor: seriesBoost[k],
+		})
+	}
+	return &queryTemplate{
+		fields:       fields,
+		phraseFields: phraseFields,
+		functions:    f,
+	}
+}
+
+// createSearchDSLFromTemplate creates the query for sp using the parts
+// of the query held in t, which must have the same shape as sp.
+func createSearchDSLFromTemplate(sp SearchParams, t *queryTemplate) elasticsearch.QueryDSL {
+	qdsl := elasticsearch.QueryDSL{
+		From: sp.Skip,
+		Size: sp.Limit,
+		// Make sure that scores are returned even when
+		// sorting on other fields.
+		TrackScores: true,
+	}
+
+	// Full text search
+	var q elasticsearch.Query
+	fields := t.fields
+	fuzziness := ""
+	if sp.Fuzzy {
+		fuzziness = "AUTO"
+	}
+	text, negated := splitNegatedTerms(sp.Text)
+	loose, phrases := splitPhrases(text)
+	prefix, isPrefix := wildcardPrefix(loose)
+	switch {
+	case text == "":
+		q = elasticsearch.MatchAllQuery{}
+	case loose == "":
+		// Only phrases are matched.
+	case isPrefix:
+		q = elasticsearch.PrefixQuery{
+			Field:  "Name",
+			Prefix: prefix,
+		}
+	case sp.MatchAllTerms:
+		// Each term must match in at least one field, but
+		// the terms need not all match in the same field.
+		var bq elasticsearch.BoolQuery
+		for _, term := range strings.Fields(loose) {
+			bq.Must = append(bq.Must, elasticsearch.MultiMatchQuery{
+				Query:     term,
+				Fields:    fields,
+				Fuzziness: fuzziness,
+			})
+		}
+		q = bq
+	default:
+		msm := sp.MinimumShouldMatch
+		if msm == "" {
+			msm = "100%"
+		}
+		q = elasticsearch.MultiMatchQuery{
+			Query:              loose,
+			Fields:             fields,
+			MinimumShouldMatch: msm,
+			Fuzziness:          fuzziness,
+		}
+	}
+	if len(phrases) > 0 {
+		// Each phrase must match in order in a
+		// single field.
+		var bq elasticsearch.BoolQuery
+		if q != nil {
+			bq.Must = append(bq.Must, q)
+		}
+		for _, phrase := range phrases {
+			bq.Must = append(bq.Must, phraseQuery(phrase, t.phraseFields))
+		}
+		q = bq
+	}
+	if len(negated) > 0 {
+		// Exclude anything matching any negated term,
+		// either as a phrase or by matching all its words.
+		bq := elasticsearch.BoolQuery{
+			Must: []elasticsearch.Query{q},
+		}
+		for _, term := range negated {
+			if phrase, ok := quotedPhrase(term); ok {
+				bq.MustNot = append(bq.MustNot, phraseQuery(phrase, t.phraseFields))
+				continue
+			}
+			bq.MustNot = append(bq.MustNot, elasticsearch.MultiMatchQuery{
+				Query:              term,
+				Fields:             fields,
+				MinimumShouldMatch: "100%",
+			})
+		}
+		q = bq
+	}
+
+	// Boosting
+	// Limit the capacity of the shared functions so that
+	// appending to them does not modify the template.
+	f := t.functions[:len(t.functions):len(t.functions)]
+	if len(sp.related.interfaces) > 0 {
+		var of elasticsearch.OrFilter
+		for _, i := range sp.related.interfaces {
+			of = append(of,
+				elasticsearch.TermFilter{Field: "CharmProvidedInterfaces", Value: i},
+				elasticsearch.TermFilter{Field: "CharmRequiredInterfaces", Value: i},
+			)
+		}
+		f = append(f, elasticsearch.BoostFactorFunction{
+			Filter:      of,
+			BoostFactor: relatedInterfaceBoost,
+		})
+	}
+	if len(sp.related.tags) > 0 {
+		var of elasticsearch.OrFilter
+		for _, t := range sp.related.tags {
+			of = append(of, tagsFilter(t))
+		}
+		f = append(f, elasticsearch.BoostFactorFunction{
+			Filter:      of,
+			BoostFactor: relatedTagBoost,
 		})
 	}
 	q = elasticsearch.FunctionScoreQuery{
@@ -569,10 +2211,212 @@ func createSearchDSL(sp SearchParams) elasticsearch.QueryDSL {
 	for _, s := range sp.Sort {
 		qdsl.Sort = append(qdsl.Sort, createElasticSort(s))
 	}
+	if len(sp.Sort) == 0 {
+		qdsl.Sort = append(qdsl.Sort, elasticsearch.Sort{
+			Field: "_score",
+			Order: elasticsearch.Descending,
+		})
+	}
+	// Always finish with a sort on the URL so that results that
+	// would otherwise be equal are returned in a consistent order.
+	// Only one document per URL matches any search, so the URL is a
+	// unique tiebreaker and the sort values of a hit identify its
+	// position exactly, as search cursors require.
+	qdsl.Sort = append(qdsl.Sort, elasticsearch.Sort{
+		Field: "URL",
+		Order: elasticsearch.Ascending,
+	})
+
+	// Facets
+	for _, name := range sp.Facets {
+		agg, ok := facetAggregations[name]
+		if !ok {
+			continue
+		}
+		if page, ok := sp.FacetPages[name]; ok {
+			if terms, ok := agg.(elasticsearch.TermsAggregation); ok {
+				// Terms aggregations cannot skip buckets, so
+				// request enough buckets to cover the skipped
+				// ones; facetCounts discards them.
+				terms.Size = page.End()
+				agg = terms
+			}
+		}
+		if qdsl.Aggregations == nil {
+			qdsl.Aggregations = make(map[string]elasticsearch.Aggregation)
+		}
+		qdsl.Aggregations[name] = agg
+	}
+
+	// Highlighting
+	if sp.Highlight && text != "" {
+		qdsl.Highlight = searchHighlight
+	}
+
+	// Suggestions
+	if sp.Suggest && text != "" {
+		qdsl.Suggest = map[string]elasticsearch.Suggester{
+			nameSuggester: elasticsearch.TermSuggester{
+				// Names are always lower case.
+				Text:  strings.ToLower(text),
+				Field: "Name",
+				Size:  maxSuggestions,
+			},
+		}
+	}
 
 	return qdsl
 }
 
+// nameSuggester holds the name of the suggester used to
+// suggest alternative names when SearchParams.Suggest is set.
+const nameSuggester = "name"
+
+// maxSuggestions holds the maximum number of alternative
+// names suggested for a search.
+const maxSuggestions = 5
+
+// searchHighlight holds the highlighting used when
+// SearchParams.Highlight is set. Only the public descriptive text of
+// charms and bundles is highlighted, so fragments never reveal
+// anything that the metadata of a result does not.
+var searchHighlight = &elasticsearch.Highlight{
+	Fields: map[string]elasticsearch.HighlightField{
+		"CharmMeta.Summary":      {},
+		"CharmMeta.Description":  {FragmentSize: 150, NumberOfFragments: 3},
+		"BundleData.Description": {FragmentSize: 150, NumberOfFragments: 3},
+		"BundleReadMe":           {FragmentSize: 150, NumberOfFragments: 3},
+	},
+}
+
+// maxFacetValues holds the maximum number of distinct values
+// returned for a facet.
+const maxFacetValues = 100
+
+// MaxFacetPageEnd holds the largest permitted value of FacetPage.End.
+// Each page is computed by counting all the values up to its end, so
+// this bounds the cost of deep pages.
+const MaxFacetPageEnd = 100 * maxFacetValues
+
+// facetAggregations holds the aggregation used to count each facet
+// that may be requested in SearchParams.Facets.
+var facetAggregations = map[string]elasticsearch.Aggregation{
+	"owner": elasticsearch.TermsAggregation{
+		Field: "User",
+		Size:  maxFacetValues,
+	},
+	"series": elasticsearch.TermsAggregation{
+		Field: "Series",
+		Size:  maxFacetValues,
+	},
+	"type": elasticsearch.FilterAggregation{
+		Filter: bundleFilter,
+	},
+}
+
+// facetCounts converts the facet aggregations in esr into
+// counts for each facet requested in sp.
+func facetCounts(sp SearchParams, esr elasticsearch.SearchResult) (map[string][]FacetCount, error) {
+	facets := make(map[string][]FacetCount)
+	for _, name := range sp.Facets {
+		data, ok := esr.Aggregations[name]
+		if !ok {
+			continue
+		}
+		if name == "type" {
+			// The type facet only counts the bundles; everything
+			// else must be a charm.
+			var agg elasticsearch.SingleBucketAggregationResult
+			if err := json.Unmarshal(data, &agg); err != nil {
+				return nil, errgo.Notef(err, "cannot unmarshal %s facet", name)
+			}
+			facets[name] = typeFacetCounts(esr.Hits.Total-agg.DocCount, agg.DocCount)
+			continue
+		}
+		var agg elasticsearch.BucketAggregationResult
+		if err := json.Unmarshal(data, &agg); err != nil {
+			return nil, errgo.Notef(err, "cannot unmarshal %s facet", name)
+		}
+		counts := make([]FacetCount, len(agg.Buckets))
+		for i, b := range agg.Buckets {
+			counts[i] = FacetCount{
+				Value: b.Key,
+				Count: b.DocCount,
+			}
+		}
+		if page, ok := sp.FacetPages[name]; ok {
+			counts = page.apply(counts)
+		}
+		facets[name] = counts
+	}
+	return facets, nil
+}
+
+// typeCounts returns the number of charms and bundles matching sp,
+// ignoring any type filters. See SearchParams.TypeCounts.
+func (si *SearchIndex) typeCounts(sp SearchParams) (map[string]int, error) {
+	sp.Filters = withoutFilter(sp.Filters, "type")
+	sp.Exclude = withoutFilter(sp.Exclude, "type")
+	sp.FiltersAll = withoutFilter(sp.FiltersAll, "type")
+	q := createSearchDSL(sp)
+	// Only the totals are of interest, so avoid
+	// fetching the matching documents.
+	q.From = 0
+	q.Size = 0
+	q.Fields = []string{}
+	q.Sort = nil
+	q.Highlight = nil
+	q.Aggregations = map[string]elasticsearch.Aggregation{
+		"bundles": elasticsearch.FilterAggregation{
+			Filter: bundleFilter,
+		},
+	}
+	esr, err := si.Search(si.Index, typeName, q)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var agg elasticsearch.SingleBucketAggregationResult
+	if err := json.Unmarshal(esr.Aggregations["bundles"], &agg); err != nil {
+		return nil, errgo.Notef(err, "cannot unmarshal bundles aggregation")
+	}
+	return map[string]int{
+		"charm":  esr.Hits.Total - agg.DocCount,
+		"bundle": agg.DocCount,
+	}, nil
+}
+
+// withoutFilter returns filters without the given key. The original
+// map is not modified.
+func withoutFilter(filters map[string][]string, key string) map[string][]string {
+	if _, ok := filters[key]; !ok {
+		return filters
+	}
+	fs := make(map[string][]string, len(filters))
+	for k, v := range filters {
+		if k != key {
+			fs[k] = v
+		}
+	}
+	return fs
+}
+
+// typeFacetCounts returns the type facet counts for the given
+// numbers of charms and bundles, ordered by descending count like
+// the other facets. Types with no matches are omitted.
+func typeFacetCounts(charms, bundles int) []FacetCount {
+	counts := make([]FacetCount, 0, 2)
+	if charms > 0 {
+		counts = append(counts, FacetCount{"charm", charms})
+	}
+	if bundles > 0 {
+		counts = append(counts, FacetCount{"bundle", bundles})
+	}
+	if len(counts) == 2 && bundles >= charms {
+		counts[0], counts[1] = counts[1], counts[0]
+	}
+	return counts
+}
+
 // createFilters converts the filters requested with the search API into
 // filters in the elasticsearch query DSL.
 // See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-search
@@ -580,9 +2424,20 @@ func createSearchDSL(sp SearchParams) elasticsearch.QueryDSL {
 // filter is created that matches any one of the set of values specified for
 // that key. The created filter will only match when at least one of the
 // requested values matches for all of the requested keys. Any filter names
-// that are not defined in the filters map will be silently skipped
+// that are not defined in the filters map will be silently skipped. The
+// filters in sp.Exclude are negated, so that any item matching one of their
+// values does not match. For each key in sp.FiltersAll, all of the values
+// must match.
 func createFilters(sp SearchParams) elasticsearch.Filter {
-	af := make(elasticsearch.AndFilter, 1, len(sp.Filters)+2)
+	af := make(elasticsearch.AndFilter, 2, len(sp.Filters)+len(sp.Exclude)+len(sp.FiltersAll)+4)
+	channel := sp.Channel
+	if channel == "" {
+		channel = params.StableChannel
+	}
+	af[1] = elasticsearch.TermFilter{
+		Field: "Channel",
+		Value: string(channel),
+	}
 	if sp.ExpandedMultiSeries {
 		af[0] = elasticsearch.TermFilter{
 			Field: "SingleSeries",
@@ -594,7 +2449,10 @@ func createFilters(sp SearchParams) elasticsearch.Filter {
 			Value: "true",
 		}
 	}
-	for k, vals := range sp.Filters {
+	// Iterate over the keys in order so that the same search
+	// parameters always produce the same filter.
+	for _, k := range sortedKeys(sp.Filters) {
+		vals := sp.Filters[k]
 		filter, ok := filters[k]
 		if !ok {
 			continue
@@ -605,6 +2463,34 @@ func createFilters(sp SearchParams) elasticsearch.Filter {
 		}
 		af = append(af, of)
 	}
+	for _, k := range sortedKeys(sp.FiltersAll) {
+		vals := sp.FiltersAll[k]
+		filter, ok := filters[k]
+		if !ok {
+			continue
+		}
+		for _, v := range vals {
+			af = append(af, filter(v))
+		}
+	}
+	for _, k := range sortedKeys(sp.Exclude) {
+		vals := sp.Exclude[k]
+		filter, ok := filters[k]
+		if !ok {
+			continue
+		}
+		of := make(elasticsearch.OrFilter, 0, len(vals))
+		for _, v := range vals {
+			of = append(of, filter(v))
+		}
+		af = append(af, elasticsearch.NotFilter{of})
+	}
+	if !sp.IncludeDeprecated {
+		af = append(af, elasticsearch.NotFilter{elasticsearch.TermFilter{
+			Field: "Deprecated",
+			Value: "true",
+		}})
+	}
 	if sp.Admin {
 		return af
 	}
@@ -627,16 +2513,40 @@ func createFilters(sp SearchParams) elasticsearch.Filter {
 // function that will generate an elasticsearch query DSL filter for the
 // given value.
 var filters = map[string]func(string) elasticsearch.Filter{
-	"description": descriptionFilter,
-	"name":        nameFilter,
-	"owner":       ownerFilter,
-	"promulgated": promulgatedFilter,
-	"provides":    termFilter("CharmProvidedInterfaces"),
-	"requires":    termFilter("CharmRequiredInterfaces"),
-	"series":      seriesFilter,
-	"summary":     summaryFilter,
-	"tags":        tagsFilter,
-	"type":        typeFilter,
+	"action":           termFilter("Actions"),
+	"arch":             archFilter,
+	"assumes":          termFilter("CharmAssumes"),
+	"config-option":    termFilter("ConfigOptions"),
+	"container":        termFilter("Containers"),
+	"contains-charm":   termFilter("BundleCharmNames"),
+	"description":      descriptionFilter,
+	"downloads-max":    downloadsFilter(false),
+	"downloads-min":    downloadsFilter(true),
+	"license":          termFilter("License"),
+	"metric":           termFilter("Metrics"),
+	"min-juju-version": minJujuVersionFilter,
+	"name":             nameFilter,
+	"origin":           originFilter,
+	"owner":            ownerFilter,
+	"platform":         platformFilter,
+	"promulgated":      promulgatedFilter,
+	"readable-by":      termFilter("ReadACLs"),
+	"provides":         termFilter("CharmProvidedInterfaces"),
+	"requires":         termFilter("CharmRequiredInterfaces"),
+	"resource":         termFilter("Resources"),
+	"revision-count":   intFilter("RevisionCount"),
+	"series":           seriesFilter,
+	"storage":          termFilter("StorageTypes"),
+	"summary":          summaryFilter,
+	"tags":             tagsFilter,
+	"type":             typeFilter,
+}
+
+// adminOnlyFilters holds the filters that may only be used in admin
+// searches because they reveal information, such as the permissions
+// of an entity, that other users are not allowed to see.
+var adminOnlyFilters = map[string]bool{
+	"readable-by": true,
 }
 
 // descriptionFilter generates a filter that will match against the
@@ -759,6 +2669,194 @@ func termFilter(field string) func(string) elasticsearch.Filter {
 	}
 }
 
+// matchNothingFilter is a filter that does not match any document.
+var matchNothingFilter = elasticsearch.NotFilter{
+	Filter: elasticsearch.QueryFilter{
+		Query: elasticsearch.MatchAllQuery{},
+	},
+}
+
+// platformFilter generates a filter that will match charms that can
+// be deployed on the given platform, which is of the form
+// "series/arch". See ParsePlatform.
+func platformFilter(value string) elasticsearch.Filter {
+	series, arch, err := ParsePlatform(value)
+	if err != nil {
+		return matchNothingFilter
+	}
+	return elasticsearch.OrFilter{
+		elasticsearch.TermFilter{
+			Field: "Platforms",
+			Value: series + "/" + arch,
+		},
+		elasticsearch.TermFilter{
+			Field: "Platforms",
+			Value: series + "/" + allArchitectures,
+		},
+	}
+}
+
+// ParsePlatform parses the value of a platform search filter, which
+// is of the form "series/arch" (for example "bionic/arm64").
+func ParsePlatform(value string) (series, arch string, err error) {
+	i := strings.Index(value, "/")
+	if i <= 0 || i == len(value)-1 || strings.Count(value, "/") != 1 {
+		return "", "", errgo.Newf("invalid platform %q", value)
+	}
+	return value[:i], value[i+1:], nil
+}
+
+// intFilter creates a function that generates a filter on the specified
+// integer document field. See ParseIntFilter for the allowed filter
+// values. Values that cannot be parsed do not match any document.
+func intFilter(field string) func(string) elasticsearch.Filter {
+	return func(value string) elasticsearch.Filter {
+		op, n, err := ParseIntFilter(value)
+		if err != nil {
+			return matchNothingFilter
+		}
+		f := elasticsearch.RangeFilter{
+			Field: field,
+		}
+		switch op {
+		case "<":
+			f.LT = n
+		case "<=":
+			f.LTE = n
+		case ">":
+			f.GT = n
+		case ">=":
+			f.GTE = n
+		default:
+			f.GTE = n
+			f.LTE = n
+		}
+		return f
+	}
+}
+
+// downloadsFilter creates a function that generates a filter matching
+// the charms and bundles that have been downloaded at least (if min is
+// true) or at most the given number of times in total. Values that are
+// not non-negative integers do not match any document.
+func downloadsFilter(min bool) func(string) elasticsearch.Filter {
+	return func(value string) elasticsearch.Filter {
+		n, err := ParseDownloadCount(value)
+		if err != nil {
+			return matchNothingFilter
+		}
+		f := elasticsearch.RangeFilter{
+			Field: "TotalDownloads",
+		}
+		if min {
+			f.GTE = n
+		} else {
+			f.LTE = n
+		}
+		return f
+	}
+}
+
+// ParseDownloadCount parses a download count used in the downloads-min
+// and downloads-max filters.
+func ParseDownloadCount(value string) (int64, error) {
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errgo.Newf("invalid download count %q: expected non-negative integer", value)
+	}
+	return n, nil
+}
+
+// minJujuVersionFilter generates a filter that matches the charms and
+// bundles that can be deployed with the given version of Juju. Charms
+// and bundles that do not declare a minimum version always match.
+func minJujuVersionFilter(value string) elasticsearch.Filter {
+	n, err := ParseJujuVersion(value)
+	if err != nil {
+		return matchNothingFilter
+	}
+	return elasticsearch.OrFilter{
+		elasticsearch.NotFilter{elasticsearch.ExistsFilter("MinJujuVersion")},
+		elasticsearch.RangeFilter{
+			Field: "MinJujuVersion",
+			LTE:   n,
+		},
+	}
+}
+
+// archFilter generates a filter that matches charms that support the
+// given architecture. Entities that do not declare any architectures
+// are assumed to support all of them.
+func archFilter(value string) elasticsearch.Filter {
+	return elasticsearch.OrFilter{
+		elasticsearch.TermFilter{
+			Field: "SupportedArchitectures",
+			Value: value,
+		},
+		elasticsearch.NotFilter{elasticsearch.ExistsFilter("SupportedArchitectures")},
+	}
+}
+
+// originFilter generates a filter that matches entities with the given
+// origin. Entities without a recorded origin are native.
+func originFilter(value string) elasticsearch.Filter {
+	if value == OriginNative {
+		return elasticsearch.NotFilter{elasticsearch.ExistsFilter("Origin")}
+	}
+	return elasticsearch.TermFilter{
+		Field: "Origin",
+		Value: value,
+	}
+}
+
+// ParseJujuVersion parses a Juju version of the form major.minor or
+// major.minor.patch (for example "2.9") and returns it encoded as an
+// integer such that later versions have larger values.
+func ParseJujuVersion(value string) (int, error) {
+	parts := strings.Split(value, ".")
+	if len(parts) < 2 || len(parts) > 3 {
+		return 0, errgo.Newf("invalid Juju version %q", value)
+	}
+	var nums [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n >= jujuVersionPartLimit {
+			return 0, errgo.Newf("invalid Juju version %q", value)
+		}
+		nums[i] = n
+	}
+	return encodeJujuVersion(nums[0], nums[1], nums[2]), nil
+}
+
+// jujuVersionPartLimit holds the limit on the minor and patch parts
+// of a Juju version that can be encoded by encodeJujuVersion.
+const jujuVersionPartLimit = 1000
+
+// encodeJujuVersion encodes a Juju version number as an integer such
+// that later versions have larger values.
+func encodeJujuVersion(major, minor, patch int) int {
+	return (major*jujuVersionPartLimit+minor)*jujuVersionPartLimit + patch
+}
+
+// ParseIntFilter parses the value of an integer search filter. The
+// value takes the form [op]n where n is an integer and op is one of
+// "<", "<=", ">", ">=" or "=". If op is omitted, "=" is assumed.
+func ParseIntFilter(value string) (op string, n int, err error) {
+	op = "="
+	for _, prefix := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(value, prefix) {
+			op = prefix
+			value = value[len(prefix):]
+			break
+		}
+	}
+	n, err = strconv.Atoi(value)
+	if err != nil {
+		return "", 0, errgo.Newf("invalid integer filter value %q", value)
+	}
+	return op, n, nil
+}
+
 // bundleFilter is a filter that matches against bundles, based on
 // the URL.
 var bundleFilter = seriesFilter("bundle")
@@ -778,6 +2876,8 @@ var sortESFields = map[string]string{
 	"owner":     "User",
 	"series":    "Series",
 	"downloads": "TotalDownloads",
+	"updated":   "UploadTime",
+	"created":   "StablePublishTime",
 }
 
 // createSort creates an elasticsearch.Sort query parameter out of a Sort parameter.
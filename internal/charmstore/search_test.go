@@ -5,15 +5,23 @@ package charmstore
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	jc "github.com/juju/testing/checkers"
+	jujuversion "github.com/juju/version"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v6"
 	"gopkg.in/juju/charmrepo.v3/csclient/params"
+	"gopkg.in/mgo.v2/bson"
 
+	"gopkg.in/juju/charmstore.v5/elasticsearch"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v5/internal/router"
 	"gopkg.in/juju/charmstore.v5/internal/storetesting"
@@ -30,7 +38,7 @@ var _ = gc.Suite(&StoreSearchSuite{})
 
 func (s *StoreSearchSuite) SetUpTest(c *gc.C) {
 	s.IsolatedMgoESSuite.SetUpTest(c)
-	s.index = SearchIndex{s.ES, s.TestIndex}
+	s.index = SearchIndex{Database: s.ES, Index: s.TestIndex}
 	s.ES.RefreshIndex(".versions")
 	pool, err := NewPool(s.Session.DB("foo"), &s.index, nil, ServerParams{})
 	c.Assert(err, gc.Equals, nil)
@@ -220,9 +228,14 @@ func (s *StoreSearchSuite) TestSuccessfulExport(c *gc.C) {
 			TotalDownloads: int64(ent.downloads),
 			ReadACLs:       ent.acl,
 			Series:         series,
+			RevisionCount:  1,
+			Channel:        params.StableChannel,
 			AllSeries:      true,
 			SingleSeries:   true,
 		}
+		if ent.bundleData == nil {
+			doc.Platforms = platforms(series, entity.CharmArchitectures)
+		}
 		c.Assert(string(actual), jc.JSONEquals, doc)
 	}
 }
@@ -272,11 +285,14 @@ func (s *StoreSearchSuite) TestExportOnlyLatest(c *gc.C) {
 	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(old.URL), &actual)
 	c.Assert(err, gc.Equals, nil)
 	doc := SearchDoc{
-		Entity:       expected,
-		ReadACLs:     []string{"charmers", params.Everyone},
-		Series:       expected.SupportedSeries,
-		SingleSeries: true,
-		AllSeries:    true,
+		Entity:        expected,
+		ReadACLs:      []string{"charmers", params.Everyone},
+		Series:        expected.SupportedSeries,
+		RevisionCount: 2,
+		Platforms:     platforms(expected.SupportedSeries, nil),
+		Channel:       params.StableChannel,
+		SingleSeries:  true,
+		AllSeries:     true,
 	}
 	c.Assert(string(actual), jc.JSONEquals, doc)
 }
@@ -311,24 +327,85 @@ func (s *StoreSearchSuite) TestExportMultiSeriesCharmsCreateExpandedVersions(c *
 	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(expected.URL), &actual)
 	c.Assert(err, gc.Equals, nil)
 	doc := SearchDoc{
-		Entity:       expected,
-		ReadACLs:     []string{"charmers"},
-		Series:       expected.SupportedSeries,
-		SingleSeries: false,
-		AllSeries:    true,
+		Entity:        expected,
+		ReadACLs:      []string{"charmers"},
+		Series:        expected.SupportedSeries,
+		RevisionCount: 2,
+		Platforms:     platforms(expected.SupportedSeries, nil),
+		Channel:       params.StableChannel,
+		SingleSeries:  false,
+		AllSeries:     true,
 	}
 	c.Assert(string(actual), jc.JSONEquals, doc)
 	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(old.URL), &actual)
 	c.Assert(err, gc.Equals, nil)
 	expected.URL.Series = old.URL.Series
 	doc = SearchDoc{
-		Entity:       expected,
-		ReadACLs:     []string{"charmers"},
-		Series:       []string{old.URL.Series},
-		SingleSeries: true,
-		AllSeries:    false,
+		Entity:        expected,
+		ReadACLs:      []string{"charmers"},
+		Series:        []string{old.URL.Series},
+		RevisionCount: 2,
+		Platforms:     platforms([]string{old.URL.Series}, nil),
+		Channel:       params.StableChannel,
+		SingleSeries:  true,
+		AllSeries:     false,
+	}
+	c.Assert(string(actual), jc.JSONEquals, doc)
+}
+
+func (s *StoreSearchSuite) TestExportMultiArchCharmsCreateExpandedVersions(c *gc.C) {
+	archs := []string{"amd64", "arm64"}
+	charmArchive := storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, "xenial", "bionic")).WithExtraMeta(map[string]interface{}{
+		"architectures": archs,
+	})
+	url := router.MustNewResolvedURL("cs:~charmers/multi-arch-1", -1)
+	addCharmForSearch(
+		c,
+		s.store,
+		url,
+		charmArchive,
+		[]string{"charmers"},
+		0,
+	)
+	var expected *mongodoc.Entity
+	var actual json.RawMessage
+	err := s.store.DB.Entities().FindId("cs:~charmers/multi-arch-1").One(&expected)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(expected.CharmArchitectures, jc.DeepEquals, archs)
+	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(expected.URL), &actual)
+	c.Assert(err, gc.Equals, nil)
+	doc := SearchDoc{
+		Entity:                 expected,
+		ReadACLs:               []string{"charmers"},
+		Series:                 expected.SupportedSeries,
+		RevisionCount:          1,
+		Platforms:              platforms(expected.SupportedSeries, archs),
+		SupportedArchitectures: archs,
+		Channel:                params.StableChannel,
+		SingleSeries:           false,
+		AllSeries:              true,
 	}
 	c.Assert(string(actual), jc.JSONEquals, doc)
+	for _, series := range expected.SupportedSeries {
+		u := *expected.URL
+		u.Series = series
+		err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(&u), &actual)
+		c.Assert(err, gc.Equals, nil)
+		e := *expected
+		e.URL = &u
+		doc = SearchDoc{
+			Entity:                 &e,
+			ReadACLs:               []string{"charmers"},
+			Series:                 []string{series},
+			RevisionCount:          1,
+			Platforms:              platforms([]string{series}, archs),
+			SupportedArchitectures: archs,
+			Channel:                params.StableChannel,
+			SingleSeries:           true,
+			AllSeries:              false,
+		}
+		c.Assert(string(actual), jc.JSONEquals, doc)
+	}
 }
 
 func (s *StoreSearchSuite) TestExportSearchDocument(c *gc.C) {
@@ -542,6 +619,80 @@ var searchTests = []struct {
 			searchEntities["varnish"],
 			searchEntities["squid-forwardproxy"],
 		},
+	}, {
+		about: "charm type filter with excluded owner",
+		sp: SearchParams{
+			Filters: map[string][]string{
+				"type": {"charm"},
+			},
+			Exclude: map[string][]string{
+				"owner": {"charmers"},
+			},
+		},
+		results: []searchEntity{
+			searchEntities["cloud-controller-worker-v2"],
+			searchEntities["mysql"],
+			searchEntities["varnish"],
+		},
+	}, {
+		about: "included and excluded owners",
+		sp: SearchParams{
+			Filters: map[string][]string{
+				"owner": {"charmers", "foo"},
+			},
+			Exclude: map[string][]string{
+				"owner": {"foo"},
+			},
+		},
+		results: []searchEntity{
+			searchEntities["wordpress"],
+			searchEntities["squid-forwardproxy"],
+			searchEntities["wordpress-simple"],
+		},
+	}, {
+		about: "excluded type does not reveal hidden charms",
+		sp: SearchParams{
+			Exclude: map[string][]string{
+				"type":  {"bundle"},
+				"owner": {"foo"},
+			},
+		},
+		results: []searchEntity{
+			searchEntities["cloud-controller-worker-v2"],
+			searchEntities["wordpress"],
+			searchEntities["mysql"],
+			searchEntities["squid-forwardproxy"],
+		},
+	}, {
+		about: "downloads range search",
+		sp: SearchParams{
+			Filters: map[string][]string{
+				"downloads-min": {"3"},
+				"downloads-max": {"4"},
+			},
+		},
+		results: []searchEntity{
+			searchEntities["cloud-controller-worker-v2"],
+			searchEntities["mysql"],
+		},
+	}, {
+		about: "downloads minimum search",
+		sp: SearchParams{
+			Filters: map[string][]string{
+				"downloads-min": {"4"},
+			},
+		},
+		results: []searchEntity{
+			searchEntities["cloud-controller-worker-v2"],
+			searchEntities["varnish"],
+		},
+	}, {
+		about: "invalid downloads minimum search",
+		sp: SearchParams{
+			Filters: map[string][]string{
+				"downloads-min": {"lots"},
+			},
+		},
 	}, {
 		about: "charm & bundle type filter search",
 		sp: SearchParams{
@@ -789,6 +940,508 @@ func (s *StoreSearchSuite) TestPaginatedSearch(c *gc.C) {
 	c.Assert(res.Total, gc.Equals, 2)
 }
 
+func (s *StoreSearchSuite) TestSearchCursor(c *gc.C) {
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	order := []SortParam{{Field: "name"}}
+	all, err := s.store.Search(SearchParams{
+		Sort: order,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(all.NextCursor, gc.Equals, "")
+
+	// Page through the results using cursors. Skip is
+	// ignored when a cursor is given.
+	var paged []*mongodoc.Entity
+	sp := SearchParams{
+		Sort:  order,
+		Limit: 2,
+	}
+	for i := 0; ; i++ {
+		c.Assert(i, jc.LessThan, 10)
+		res, err := s.store.Search(sp)
+		c.Assert(err, gc.Equals, nil)
+		paged = append(paged, res.Results...)
+		if res.NextCursor == "" {
+			c.Assert(len(res.Results), jc.LessThan, 2)
+			break
+		}
+		sp.Cursor = res.NextCursor
+		sp.Skip = 100
+	}
+	c.Assert(Entities(paged), jc.DeepEquals, Entities(all.Results))
+
+	// A cursor cannot be used with a different sort order.
+	res, err := s.store.Search(SearchParams{
+		Sort:  order,
+		Limit: 2,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.NextCursor, gc.Not(gc.Equals), "")
+	_, err = s.store.Search(SearchParams{
+		Sort:   []SortParam{{Field: "name", Descending: true}},
+		Limit:  2,
+		Cursor: res.NextCursor,
+	})
+	c.Assert(err, gc.ErrorMatches, "cursor does not match sort order")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	_, err = s.store.Search(SearchParams{
+		Limit:  2,
+		Cursor: "not a cursor",
+	})
+	c.Assert(err, gc.ErrorMatches, "invalid cursor")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *StoreSearchSuite) TestSearchStream(c *gc.C) {
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	s.PatchValue(&searchStreamPageSize, 2)
+	order := []SortParam{{Field: "name"}}
+	all, err := s.store.Search(SearchParams{
+		Sort: order,
+	})
+	c.Assert(err, gc.Equals, nil)
+	// Make sure that the results span several pages.
+	c.Assert(len(all.Results), jc.GreaterThan, 2*searchStreamPageSize)
+
+	var streamed []*mongodoc.Entity
+	err = s.store.SearchStream(SearchParams{
+		Sort: order,
+	}, func(e *mongodoc.Entity) error {
+		streamed = append(streamed, e)
+		return nil
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(Entities(streamed), jc.DeepEquals, Entities(all.Results))
+
+	// The limit bounds the number of results even when
+	// it is not a multiple of the page size.
+	streamed = nil
+	err = s.store.SearchStream(SearchParams{
+		Sort:  order,
+		Limit: 3,
+	}, func(e *mongodoc.Entity) error {
+		streamed = append(streamed, e)
+		return nil
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(Entities(streamed), jc.DeepEquals, Entities(all.Results[:3]))
+
+	// An error from the callback stops the search.
+	n := 0
+	err = s.store.SearchStream(SearchParams{
+		Sort: order,
+	}, func(e *mongodoc.Entity) error {
+		n++
+		return errgo.New("stop")
+	})
+	c.Assert(err, gc.ErrorMatches, "stop")
+	c.Assert(n, gc.Equals, 1)
+}
+
+// preparedQueryTests holds the queries expected for searches of
+// various shapes. The expected queries were captured from the query
+// builder before query templates were introduced, with later
+// additions to the query merged in, so they check that using a
+// prepared template does not change the query sent to
+// elasticsearch.
+var preparedQueryTests = []struct {
+	about  string
+	sp     SearchParams
+	expect string
+}{{
+	about: "no text",
+	sp:    SearchParams{},
+	expect: `{
+		"fields": null,
+		"track_scores": true,
+		"query": {"filtered": {
+			"query": {"function_score": {
+				"query": {"match_all": {}},
+				"functions": [` + goldenBoostFunctions + `]
+			}},
+			"filter": {"and": {"filters": [` + goldenFilters + `]}}
+		}},
+		"sort": [{"_score": {"order": "desc"}}, {"URL": {"order": "asc"}}]
+	}`,
+}, {
+	about: "text",
+	sp: SearchParams{
+		Text: "wordpress",
+	},
+	expect: `{
+		"fields": null,
+		"track_scores": true,
+		"query": {"filtered": {
+			"query": {"function_score": {
+				"query": {"multi_match": {
+					"query": "wordpress",
+					"fields": [` + goldenSearchFields + `],
+					"minimum_should_match": "100%"
+				}},
+				"functions": [` + goldenBoostFunctions + `]
+			}},
+			"filter": {"and": {"filters": [` + goldenFilters + `]}}
+		}},
+		"sort": [{"_score": {"order": "desc"}}, {"URL": {"order": "asc"}}]
+	}`,
+}, {
+	about: "autocomplete",
+	sp: SearchParams{
+		Text:         "word",
+		AutoComplete: true,
+	},
+	expect: `{
+		"fields": null,
+		"track_scores": true,
+		"query": {"filtered": {
+			"query": {"function_score": {
+				"query": {"multi_match": {
+					"query": "word",
+					"fields": [
+						"BundleData.Description^1.000000",
+						"BundleData.Tags.tok^5.000000",
+						"BundleReadMe^0.500000",
+						"CharmMeta.Categories.tok^5.000000",
+						"CharmMeta.Tags.tok^5.000000",
+						"Docs^0.500000",
+						"Metrics.tok^1.000000",
+						"Name.ngrams^10.000000",
+						"User.tok^7.000000"
+					],
+					"minimum_should_match": "100%"
+				}},
+				"functions": [` + goldenBoostFunctions + `]
+			}},
+			"filter": {"and": {"filters": [` + goldenFilters + `]}}
+		}},
+		"sort": [{"_score": {"order": "desc"}}, {"URL": {"order": "asc"}}]
+	}`,
+}, {
+	about: "fuzzy autocomplete",
+	sp: SearchParams{
+		Text:         "wordpres",
+		AutoComplete: true,
+		Fuzzy:        true,
+	},
+	expect: `{
+		"fields": null,
+		"track_scores": true,
+		"query": {"filtered": {
+			"query": {"function_score": {
+				"query": {"multi_match": {
+					"query": "wordpres",
+					"fields": [` + goldenSearchFields + `],
+					"minimum_should_match": "100%",
+					"fuzziness": "AUTO"
+				}},
+				"functions": [` + goldenBoostFunctions + `]
+			}},
+			"filter": {"and": {"filters": [` + goldenFilters + `]}}
+		}},
+		"sort": [{"_score": {"order": "desc"}}, {"URL": {"order": "asc"}}]
+	}`,
+}, {
+	about: "match all terms with a filter",
+	sp: SearchParams{
+		Text:          "blog mysql",
+		MatchAllTerms: true,
+		Filters: map[string][]string{
+			"type": {"charm"},
+		},
+	},
+	expect: `{
+		"fields": null,
+		"track_scores": true,
+		"query": {"filtered": {
+			"query": {"function_score": {
+				"query": {"bool": {"must": [
+					{"multi_match": {
+						"query": "blog",
+						"fields": [` + goldenSearchFields + `]
+					}},
+					{"multi_match": {
+						"query": "mysql",
+						"fields": [` + goldenSearchFields + `]
+					}}
+				]}},
+				"functions": [` + goldenBoostFunctions + `]
+			}},
+			"filter": {"and": {"filters": [
+				{"term": {"AllSeries": "true"}},
+				{"term": {"Channel": "stable"}},
+				{"or": {"filters": [
+					{"not": {"query": {"match": {"Series": {"query": "bundle", "type": "phrase"}}}}}
+				]}},
+				{"not": {"term": {"Deprecated": "true"}}},
+				{"or": {"filters": [{"term": {"ReadACLs": "everyone"}}]}}
+			]}}
+		}},
+		"sort": [{"_score": {"order": "desc"}}, {"URL": {"order": "asc"}}]
+	}`,
+}, {
+	about: "sort and limit",
+	sp: SearchParams{
+		Filters: map[string][]string{
+			"owner": {"charmers"},
+		},
+		Sort:  []SortParam{{Field: "name"}},
+		Limit: 2,
+	},
+	expect: `{
+		"fields": null,
+		"size": 2,
+		"track_scores": true,
+		"query": {"filtered": {
+			"query": {"function_score": {
+				"query": {"match_all": {}},
+				"functions": [` + goldenBoostFunctions + `]
+			}},
+			"filter": {"and": {"filters": [
+				{"term": {"AllSeries": "true"}},
+				{"term": {"Channel": "stable"}},
+				{"or": {"filters": [
+					{"query": {"match": {"User": {"query": "charmers", "type": "phrase"}}}}
+				]}},
+				{"not": {"term": {"Deprecated": "true"}}},
+				{"or": {"filters": [{"term": {"ReadACLs": "everyone"}}]}}
+			]}}
+		}},
+		"sort": [{"Name": {"order": "asc"}}, {"URL": {"order": "asc"}}]
+	}`,
+}, {
+	about: "config-option filter",
+	sp: SearchParams{
+		Filters: map[string][]string{
+			"config-option": {"proxy-url", "port"},
+		},
+	},
+	expect: `{
+		"fields": null,
+		"track_scores": true,
+		"query": {"filtered": {
+			"query": {"function_score": {
+				"query": {"match_all": {}},
+				"functions": [` + goldenBoostFunctions + `]
+			}},
+			"filter": {"and": {"filters": [
+				{"term": {"AllSeries": "true"}},
+				{"term": {"Channel": "stable"}},
+				{"or": {"filters": [
+					{"and": {"filters": [{"term": {"ConfigOptions": "proxy-url"}}]}},
+					{"and": {"filters": [{"term": {"ConfigOptions": "port"}}]}}
+				]}},
+				{"not": {"term": {"Deprecated": "true"}}},
+				{"or": {"filters": [{"term": {"ReadACLs": "everyone"}}]}}
+			]}}
+		}},
+		"sort": [{"_score": {"order": "desc"}}, {"URL": {"order": "asc"}}]
+	}`,
+}, {
+	about: "action and type filters",
+	sp: SearchParams{
+		Filters: map[string][]string{
+			"type":   {"charm"},
+			"action": {"backup", "flush"},
+		},
+	},
+	expect: `{
+		"fields": null,
+		"track_scores": true,
+		"query": {"filtered": {
+			"query": {"function_score": {
+				"query": {"match_all": {}},
+				"functions": [` + goldenBoostFunctions + `]
+			}},
+			"filter": {"and": {"filters": [
+				{"term": {"AllSeries": "true"}},
+				{"term": {"Channel": "stable"}},
+				{"or": {"filters": [
+					{"and": {"filters": [{"term": {"Actions": "backup"}}]}},
+					{"and": {"filters": [{"term": {"Actions": "flush"}}]}}
+				]}},
+				{"or": {"filters": [
+					{"not": {"query": {"match": {"Series": {"query": "bundle", "type": "phrase"}}}}}
+				]}},
+				{"not": {"term": {"Deprecated": "true"}}},
+				{"or": {"filters": [{"term": {"ReadACLs": "everyone"}}]}}
+			]}}
+		}},
+		"sort": [{"_score": {"order": "desc"}}, {"URL": {"order": "asc"}}]
+	}`,
+}, {
+	about: "related terms",
+	sp: SearchParams{
+		Text: "database",
+		related: relatedTerms{
+			interfaces: []string{"mysql"},
+			tags:       []string{"wordpressTAG"},
+		},
+	},
+	expect: `{
+		"fields": null,
+		"track_scores": true,
+		"query": {"filtered": {
+			"query": {"function_score": {
+				"query": {"multi_match": {
+					"query": "database",
+					"fields": [` + goldenSearchFields + `],
+					"minimum_should_match": "100%"
+				}},
+				"functions": [` + goldenBoostFunctions + `,
+					{
+						"filter": {"or": {"filters": [
+							{"term": {"CharmProvidedInterfaces": "mysql"}},
+							{"term": {"CharmRequiredInterfaces": "mysql"}}
+						]}},
+						"boost_factor": 1.5
+					},
+					{
+						"filter": {"or": {"filters": [
+							{"and": {"filters": [
+								{"or": {"filters": [
+									{"term": {"CharmMeta.Categories": "wordpressTAG"}},
+									{"term": {"CharmMeta.Tags": "wordpressTAG"}},
+									{"term": {"BundleData.Tags": "wordpressTAG"}}
+								]}}
+							]}}
+						]}},
+						"boost_factor": 1.2
+					}
+				]
+			}},
+			"filter": {"and": {"filters": [` + goldenFilters + `]}}
+		}},
+		"sort": [{"_score": {"order": "desc"}}, {"URL": {"order": "asc"}}]
+	}`,
+}}
+
+// goldenSearchFields holds the weighted fields searched for text
+// when not auto-completing.
+const goldenSearchFields = `
+	"BundleData.Description^1.000000",
+	"BundleData.Tags.tok^5.000000",
+	"BundleReadMe^0.500000",
+	"CharmMeta.Categories.tok^5.000000",
+	"CharmMeta.Tags.tok^5.000000",
+	"Docs^0.500000",
+	"Metrics.tok^1.000000",
+	"Name.tok^10.000000",
+	"User.tok^7.000000"`
+
+// goldenBoostFunctions holds the boost functions applied to every
+// search with the default boosts.
+const goldenBoostFunctions = `
+	{"field_value_factor": {"field": "TotalDownloads", "factor": 0.000001, "modifier": "ln2p"}},
+	{"filter": {"exists": {"field": "PromulgatedURL"}}, "boost_factor": 1.25},
+	{"filter": {"query": {"match": {"Series": {"query": "artful", "type": "phrase"}}}}, "boost_factor": 1.105},
+	{"filter": {"query": {"match": {"Series": {"query": "bionic", "type": "phrase"}}}}, "boost_factor": 1.15},
+	{"filter": {"query": {"match": {"Series": {"query": "bundle", "type": "phrase"}}}}, "boost_factor": 1.138},
+	{"filter": {"query": {"match": {"Series": {"query": "centos7", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "cosmic", "type": "phrase"}}}}, "boost_factor": 0},
+	{"filter": {"query": {"match": {"Series": {"query": "kubernetes", "type": "phrase"}}}}, "boost_factor": 0},
+	{"filter": {"query": {"match": {"Series": {"query": "precise", "type": "phrase"}}}}, "boost_factor": 1.1125},
+	{"filter": {"query": {"match": {"Series": {"query": "trusty", "type": "phrase"}}}}, "boost_factor": 1.125},
+	{"filter": {"query": {"match": {"Series": {"query": "win10", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "win2012", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "win2012hv", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "win2012hvr2", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "win2012r2", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "win2016", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "win2016hv", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "win2016nano", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "win7", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "win8", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "win81", "type": "phrase"}}}}, "boost_factor": 1.1},
+	{"filter": {"query": {"match": {"Series": {"query": "xenial", "type": "phrase"}}}}, "boost_factor": 1.1375}`
+
+// goldenFilters holds the filters applied to an anonymous search of
+// the stable channel with no other filters.
+const goldenFilters = `
+	{"term": {"AllSeries": "true"}},
+	{"term": {"Channel": "stable"}},
+	{"not": {"term": {"Deprecated": "true"}}},
+	{"or": {"filters": [{"term": {"ReadACLs": "everyone"}}]}}`
+
+func (s *StoreSearchSuite) TestPreparedQueryMatchesUnprepared(c *gc.C) {
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	for i, test := range preparedQueryTests {
+		c.Logf("test %d: %s", i, test.about)
+		// Build each query twice so that the second query
+		// uses the template prepared by the first.
+		for j := 0; j < 2; j++ {
+			q := createSearchDSL(test.sp)
+			data, err := json.Marshal(q)
+			c.Assert(err, gc.Equals, nil)
+			c.Assert(string(data), jc.JSONEquals, json.RawMessage(test.expect))
+		}
+		// Check that elasticsearch accepts the query.
+		_, err := s.store.ES.Search(s.store.ES.Index, typeName, createSearchDSL(test.sp))
+		c.Assert(err, gc.Equals, nil)
+	}
+}
+
+func (s *StoreSearchSuite) TestPreparedQueryTemplateNotModified(c *gc.C) {
+	sp := SearchParams{
+		Text: "wordpress",
+	}
+	t := preparedQueryTemplate(sp)
+	n := len(t.functions)
+	sp.related.tags = []string{"blog"}
+	createSearchDSL(sp)
+	c.Assert(preparedQueryTemplate(sp), gc.Equals, t)
+	c.Assert(t.functions, gc.HasLen, n)
+}
+
+func (s *StoreSearchSuite) TestCreateFiltersDeterministic(c *gc.C) {
+	sp := SearchParams{
+		Filters: map[string][]string{
+			"type":   {"charm"},
+			"name":   {"wordpress"},
+			"owner":  {"charmers"},
+			"series": {"trusty"},
+		},
+		Exclude: map[string][]string{
+			"tags":  {"databases"},
+			"owner": {"bob"},
+		},
+	}
+	expect, err := json.Marshal(createFilters(sp))
+	c.Assert(err, gc.Equals, nil)
+	for i := 0; i < 20; i++ {
+		data, err := json.Marshal(createFilters(sp))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(string(data), gc.Equals, string(expect))
+	}
+}
+
+func (s *StoreSearchSuite) BenchmarkCreateSearchDSL(c *gc.C) {
+	sp := SearchParams{
+		Text: "wordpress",
+		Filters: map[string][]string{
+			"type": {"charm"},
+		},
+	}
+	for i := 0; i < c.N; i++ {
+		createSearchDSL(sp)
+	}
+}
+
+func (s *StoreSearchSuite) BenchmarkCreateSearchDSLUnprepared(c *gc.C) {
+	sp := SearchParams{
+		Text: "wordpress",
+		Filters: map[string][]string{
+			"type": {"charm"},
+		},
+	}
+	for i := 0; i < c.N; i++ {
+		createSearchDSLFromTemplate(sp, newQueryTemplate(searchQueryShape(sp)))
+	}
+}
+
 func (s *StoreSearchSuite) TestLimitTestSearch(c *gc.C) {
 	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
 	c.Assert(err, gc.Equals, nil)
@@ -826,384 +1479,3284 @@ func (s *StoreSearchSuite) TestPromulgatedRank(c *gc.C) {
 	})
 }
 
-func (s *StoreSearchSuite) TestSorting(c *gc.C) {
+func (s *StoreSearchSuite) TestWildcardSearch(c *gc.C) {
 	s.store.ES.Database.RefreshIndex(s.TestIndex)
 	tests := []struct {
-		about     string
-		sortQuery string
-		results   []searchEntity
+		about  string
+		text   string
+		groups []string
+		expect []string
 	}{{
-		about:     "name ascending",
-		sortQuery: "name",
-		results: []searchEntity{
-			searchEntities["cloud-controller-worker-v2"],
-			searchEntities["mysql"],
-			searchEntities["squid-forwardproxy"],
-			searchEntities["varnish"],
-			searchEntities["wordpress"],
-			searchEntities["wordpress-simple"],
+		about: "prefix matching two entities",
+		text:  "word*",
+		expect: []string{
+			"cs:~charmers/precise/wordpress-23",
+			"cs:~charmers/bundle/wordpress-simple-4",
 		},
 	}, {
-		about:     "name descending",
-		sortQuery: "-name",
-		results: []searchEntity{
-			searchEntities["wordpress-simple"],
-			searchEntities["wordpress"],
-			searchEntities["varnish"],
-			searchEntities["squid-forwardproxy"],
-			searchEntities["mysql"],
-			searchEntities["cloud-controller-worker-v2"],
+		about: "prefix is case insensitive",
+		text:  "WordP*",
+		expect: []string{
+			"cs:~charmers/precise/wordpress-23",
+			"cs:~charmers/bundle/wordpress-simple-4",
 		},
 	}, {
-		about:     "series ascending",
-		sortQuery: "series,name",
-		results: []searchEntity{
-			searchEntities["squid-forwardproxy"],
-			searchEntities["wordpress-simple"],
-			searchEntities["wordpress"],
-			searchEntities["cloud-controller-worker-v2"],
-			searchEntities["mysql"],
-			searchEntities["varnish"],
-		},
+		about: "prefix matching nothing",
+		text:  "nothing*",
 	}, {
-		about:     "series descending",
-		sortQuery: "-series,name",
-		results: []searchEntity{
-			searchEntities["mysql"],
-			searchEntities["varnish"],
-			searchEntities["cloud-controller-worker-v2"],
-			searchEntities["wordpress"],
-			searchEntities["wordpress-simple"],
-			searchEntities["squid-forwardproxy"],
-		},
+		about: "prefix matching entity without read access",
+		text:  "ria*",
 	}, {
-		about:     "owner ascending",
-		sortQuery: "owner,name",
-		results: []searchEntity{
-			searchEntities["cloud-controller-worker-v2"],
-			searchEntities["squid-forwardproxy"],
-			searchEntities["wordpress"],
-			searchEntities["wordpress-simple"],
-			searchEntities["varnish"],
-			searchEntities["mysql"],
-		},
+		about:  "prefix matching entity with read access",
+		text:   "ria*",
+		groups: []string{"charmers"},
+		expect: []string{"cs:~charmers/xenial/riak-67"},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		res, err := s.store.Search(SearchParams{
+			Text:   test.text,
+			Groups: test.groups,
+			Sort:   []SortParam{{Field: "name"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		var urls []string
+		for _, e := range res.Results {
+			urls = append(urls, e.URL.String())
+		}
+		c.Assert(urls, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestWildcardSearchWithoutPrefix(c *gc.C) {
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	_, err := s.store.Search(SearchParams{
+		Text: "*",
+	})
+	c.Assert(err, gc.ErrorMatches, "wildcard search requires a prefix")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *StoreSearchSuite) TestMatchAllTerms(c *gc.C) {
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		about         string
+		text          string
+		matchAllTerms bool
+		expect        []string
+	}{{
+		about:         "terms in one field",
+		text:          "wordpress simple",
+		matchAllTerms: true,
+		expect:        []string{"cs:~charmers/bundle/wordpress-simple-4"},
 	}, {
-		about:     "owner descending",
-		sortQuery: "-owner,name",
-		results: []searchEntity{
-			searchEntities["mysql"],
-			searchEntities["varnish"],
-			searchEntities["squid-forwardproxy"],
-			searchEntities["wordpress"],
-			searchEntities["wordpress-simple"],
-			searchEntities["cloud-controller-worker-v2"],
+		about:  "terms in different fields, default",
+		text:   "wordpress charmers",
+		expect: []string{},
+	}, {
+		about:         "terms in different fields",
+		text:          "wordpress charmers",
+		matchAllTerms: true,
+		expect: []string{
+			"cs:~charmers/precise/wordpress-23",
+			"cs:~charmers/bundle/wordpress-simple-4",
 		},
 	}, {
-		about:     "downloads ascending",
-		sortQuery: "downloads",
+		about:         "unmatched term",
+		text:          "wordpress mysql",
+		matchAllTerms: true,
+		expect:        []string{},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		res, err := s.store.Search(SearchParams{
+			Text:          test.text,
+			MatchAllTerms: test.matchAllTerms,
+			Sort:          []SortParam{{Field: "name"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		expect := make(Entities, len(test.expect))
+		for i, url := range test.expect {
+			expect[i] = s.entity(c, url)
+		}
+		c.Assert(Entities(res.Results), jc.DeepEquals, expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestNegatedTerms(c *gc.C) {
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		about  string
+		text   string
+		expect []string
+	}{{
+		about: "positive term only",
+		text:  "wordpress",
+		expect: []string{
+			"cs:~charmers/precise/wordpress-23",
+			"cs:~charmers/bundle/wordpress-simple-4",
+		},
+	}, {
+		about:  "positive and negated terms",
+		text:   "wordpress -simple",
+		expect: []string{"cs:~charmers/precise/wordpress-23"},
+	}, {
+		about:  "negated quoted phrase",
+		text:   `wordpress -"wordpress simple"`,
+		expect: []string{"cs:~charmers/precise/wordpress-23"},
+	}, {
+		about:  "negated term matching nothing",
+		text:   "wordpress -nothing",
+		expect: []string{"cs:~charmers/precise/wordpress-23", "cs:~charmers/bundle/wordpress-simple-4"},
+	}, {
+		about:  "hyphen within a name is not negation",
+		text:   "wordpress-simple",
+		expect: []string{"cs:~charmers/bundle/wordpress-simple-4"},
+	}, {
+		about:  "hyphen within quotes is not negation",
+		text:   `"-simple"`,
+		expect: []string{"cs:~charmers/bundle/wordpress-simple-4"},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		res, err := s.store.Search(SearchParams{
+			Text: test.text,
+			Sort: []SortParam{{Field: "name"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		var urls []string
+		for _, e := range res.Results {
+			urls = append(urls, e.URL.String())
+		}
+		c.Assert(urls, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestPhraseSearch(c *gc.C) {
+	for _, id := range []string{"~charmers/xenial/database-engine-1", "~charmers/xenial/engine-database-1"} {
+		addCharmForSearch(
+			c,
+			s.store,
+			router.MustNewResolvedURL(id, -1),
+			storetesting.NewCharm(nil),
+			[]string{params.Everyone},
+			0,
+		)
+	}
+	err := s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	tests := []struct {
+		about  string
+		text   string
+		expect []string
+	}{{
+		about: "words matched independently",
+		text:  "database engine",
+		expect: []string{
+			"cs:~charmers/xenial/database-engine-1",
+			"cs:~charmers/xenial/engine-database-1",
+		},
+	}, {
+		about: "phrase matched in order",
+		text:  `"database engine"`,
+		expect: []string{
+			"cs:~charmers/xenial/database-engine-1",
+			"cs:~openstack-charmers/xenial/mysql-7",
+			"cs:~foo/xenial/varnish-1",
+		},
+	}, {
+		about:  "reversed phrase",
+		text:   `"engine database"`,
+		expect: []string{"cs:~charmers/xenial/engine-database-1"},
+	}, {
+		about:  "phrase and word",
+		text:   `"database engine" varnish`,
+		expect: []string{"cs:~foo/xenial/varnish-1"},
+	}, {
+		about:  "negated phrase",
+		text:   `"database engine" -"database engine charm"`,
+		expect: []string{"cs:~charmers/xenial/database-engine-1", "cs:~openstack-charmers/xenial/mysql-7", "cs:~foo/xenial/varnish-1"},
+	}, {
+		about: "unbalanced quote is literal",
+		text:  `"database engine`,
+		expect: []string{
+			"cs:~charmers/xenial/database-engine-1",
+			"cs:~charmers/xenial/engine-database-1",
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		res, err := s.store.Search(SearchParams{
+			Text: test.text,
+			Sort: []SortParam{{Field: "name"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		var urls []string
+		for _, e := range res.Results {
+			urls = append(urls, e.URL.String())
+		}
+		c.Assert(urls, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestOnlyNegatedTerms(c *gc.C) {
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	_, err := s.store.Search(SearchParams{
+		Text: "-wordpress -mysql",
+	})
+	c.Assert(err, gc.ErrorMatches, "search text must contain a term that is not negated")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *StoreSearchSuite) TestMinimumShouldMatch(c *gc.C) {
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		about              string
+		minimumShouldMatch string
+		expect             []string
+	}{{
+		about:  "default requires all terms",
+		expect: []string{},
+	}, {
+		about:              "two terms",
+		minimumShouldMatch: "2",
+		expect:             []string{"cs:~charmers/bundle/wordpress-simple-4"},
+	}, {
+		about:              "one term",
+		minimumShouldMatch: "1",
+		expect: []string{
+			"cs:~charmers/precise/wordpress-23",
+			"cs:~charmers/bundle/wordpress-simple-4",
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		res, err := s.store.Search(SearchParams{
+			Text:               "wordpress simple unmatched",
+			MinimumShouldMatch: test.minimumShouldMatch,
+			Sort:               []SortParam{{Field: "name"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		expect := make(Entities, len(test.expect))
+		for i, url := range test.expect {
+			expect[i] = s.entity(c, url)
+		}
+		c.Assert(Entities(res.Results), jc.DeepEquals, expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestFuzzySearch(c *gc.C) {
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		about  string
+		sp     SearchParams
+		expect []string
+	}{{
+		about: "missing character without fuzzy",
+		sp: SearchParams{
+			Text: "wordpess",
+		},
+		expect: []string{},
+	}, {
+		about: "missing character",
+		sp: SearchParams{
+			Text:  "wordpess",
+			Fuzzy: true,
+		},
+		expect: []string{
+			"cs:~charmers/precise/wordpress-23",
+			"cs:~charmers/bundle/wordpress-simple-4",
+		},
+	}, {
+		about: "transposed characters",
+		sp: SearchParams{
+			Text:  "wrodpress",
+			Fuzzy: true,
+		},
+		expect: []string{
+			"cs:~charmers/precise/wordpress-23",
+			"cs:~charmers/bundle/wordpress-simple-4",
+		},
+	}, {
+		about: "transposed characters with autocomplete",
+		sp: SearchParams{
+			Text:         "wrodpress",
+			Fuzzy:        true,
+			AutoComplete: true,
+		},
+		expect: []string{
+			"cs:~charmers/precise/wordpress-23",
+			"cs:~charmers/bundle/wordpress-simple-4",
+		},
+	}, {
+		about: "edit distance too large",
+		sp: SearchParams{
+			Text:  "wrdpesz",
+			Fuzzy: true,
+		},
+		expect: []string{},
+	}, {
+		about: "private charm not found",
+		sp: SearchParams{
+			Text:  "riek",
+			Fuzzy: true,
+		},
+		expect: []string{},
+	}, {
+		about: "private charm found by group",
+		sp: SearchParams{
+			Text:   "riek",
+			Fuzzy:  true,
+			Groups: []string{"charmers"},
+		},
+		expect: []string{"cs:~charmers/xenial/riak-67"},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		test.sp.Sort = []SortParam{{Field: "name"}}
+		res, err := s.store.Search(test.sp)
+		c.Assert(err, gc.Equals, nil)
+		expect := make(Entities, len(test.expect))
+		for i, url := range test.expect {
+			expect[i] = s.entity(c, url)
+		}
+		c.Assert(Entities(res.Results), jc.DeepEquals, expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestFuzzyPromulgatedRank(c *gc.C) {
+	charmArchive := storetesting.NewCharm(nil)
+	ent := newEntity("cs:~charmers/xenial/varnish-1", 1)
+	addCharmForSearch(
+		c,
+		s.store,
+		EntityResolvedURL(ent),
+		charmArchive,
+		[]string{ent.URL.User, params.Everyone},
+		0,
+	)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	res, err := s.store.Search(SearchParams{
+		Text:  "varnsh",
+		Fuzzy: true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(Entities(res.Results), jc.DeepEquals, Entities{
+		s.entity(c, "cs:~charmers/xenial/varnish-1"),
+		s.entity(c, searchEntities["varnish"].entity.URL.String()),
+	})
+}
+
+func (s *StoreSearchSuite) TestPromulgatedCollapse(c *gc.C) {
+	charmArchive := storetesting.NewCharm(nil)
+	ent := newEntity("cs:~charmers/xenial/varnish-1", 1)
+	addCharmForSearch(
+		c,
+		s.store,
+		EntityResolvedURL(ent),
+		charmArchive,
+		[]string{ent.URL.User, params.Everyone},
+		0,
+	)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		about    string
+		collapse CollapseMode
+		expect   []string
+	}{{
+		about:    "no collapse",
+		collapse: CollapseNone,
+		expect: []string{
+			"cs:~charmers/xenial/varnish-1",
+			searchEntities["varnish"].entity.URL.String(),
+		},
+	}, {
+		about:    "collapse to promulgated",
+		collapse: CollapsePromulgated,
+		expect:   []string{"cs:~charmers/xenial/varnish-1"},
+	}, {
+		about:    "collapse to owner",
+		collapse: CollapseOwner,
+		expect:   []string{searchEntities["varnish"].entity.URL.String()},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"name": {"varnish"},
+			},
+			Collapse: test.collapse,
+		})
+		c.Assert(err, gc.Equals, nil)
+		expect := make(Entities, len(test.expect))
+		for i, url := range test.expect {
+			expect[i] = s.entity(c, url)
+		}
+		c.Assert(Entities(res.Results), jc.DeepEquals, expect)
+		c.Assert(res.Total, gc.Equals, len(test.expect))
+		c.Assert(res.Scores, gc.HasLen, len(test.expect))
+	}
+}
+
+func (s *StoreSearchSuite) TestSearchScores(c *gc.C) {
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	res, err := s.store.Search(SearchParams{
+		Text: "wordpress",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(len(res.Results), jc.GreaterThan, 1)
+	c.Assert(res.Scores, gc.HasLen, len(res.Results))
+	for i, score := range res.Scores {
+		c.Assert(score, jc.GreaterThan, 0.0)
+		if i > 0 {
+			c.Assert(score, jc.LessThan, res.Scores[i-1]+1e-9)
+		}
+	}
+
+	// Scores are still returned when sorting on another field.
+	res, err = s.store.Search(SearchParams{
+		Text: "wordpress",
+		Sort: []SortParam{{Field: "name"}},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Scores, gc.HasLen, len(res.Results))
+	for _, score := range res.Scores {
+		c.Assert(score, jc.GreaterThan, 0.0)
+	}
+}
+
+func (s *StoreSearchSuite) TestDownloadedBoost(c *gc.C) {
+	relatedMeta := func(name, iface string) *charm.Meta {
+		return &charm.Meta{
+			Name: name,
+			Provides: map[string]charm.Relation{
+				"rel": {
+					Name:      "rel",
+					Role:      charm.RoleProvider,
+					Interface: iface,
+				},
+			},
+		}
+	}
+	for id, meta := range map[string]*charm.Meta{
+		"cs:~alice/xenial/source-1": relatedMeta("source", "shared"),
+		"cs:~bob/xenial/alpha-1":    relatedMeta("alpha", "other"),
+		"cs:~bob/xenial/beta-1":     relatedMeta("beta", "shared"),
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(c, s.store, url, storetesting.NewCharm(meta), []string{url.URL.User, params.Everyone}, 0)
+	}
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	search := func(downloaded ...string) []string {
+		sp := SearchParams{
+			Filters: map[string][]string{
+				"owner": {"bob"},
+			},
+		}
+		for _, id := range downloaded {
+			sp.Downloaded = append(sp.Downloaded, charm.MustParseURL(id))
+		}
+		res, err := s.store.Search(sp)
+		c.Assert(err, gc.Equals, nil)
+		urls := make([]string, len(res.Results))
+		for i, e := range res.Results {
+			urls[i] = e.URL.String()
+		}
+		return urls
+	}
+	// Without any downloaded charms, the results are equally
+	// ranked so they are ordered by URL.
+	c.Assert(search(), jc.DeepEquals, []string{
+		"cs:~bob/xenial/alpha-1",
+		"cs:~bob/xenial/beta-1",
+	})
+	// The charm sharing an interface with a downloaded charm
+	// ranks higher.
+	c.Assert(search("~alice/source"), jc.DeepEquals, []string{
+		"cs:~bob/xenial/beta-1",
+		"cs:~bob/xenial/alpha-1",
+	})
+	// Unknown charms are ignored.
+	c.Assert(search("~alice/unknown"), jc.DeepEquals, []string{
+		"cs:~bob/xenial/alpha-1",
+		"cs:~bob/xenial/beta-1",
+	})
+}
+
+func (s *StoreSearchSuite) TestSortCreated(c *gc.C) {
+	t0 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{
+		"cs:~bob/xenial/beta-1",
+		"cs:~bob/xenial/alpha-1",
+		"cs:~bob/xenial/gamma-1",
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(c, s.store, url, storetesting.NewCharm(nil), []string{url.URL.User, params.Everyone}, 0)
+		err := s.store.UpdateEntity(url, bson.D{{
+			"$set", bson.D{{"stablepublishtime", t0.Add(time.Duration(i) * time.Hour)}},
+		}})
+		c.Assert(err, gc.Equals, nil)
+		err = s.store.UpdateSearch(url)
+		c.Assert(err, gc.Equals, nil)
+	}
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		sort   string
+		expect []string
+	}{{
+		sort: "created",
+		expect: []string{
+			"cs:~bob/xenial/beta-1",
+			"cs:~bob/xenial/alpha-1",
+			"cs:~bob/xenial/gamma-1",
+		},
+	}, {
+		sort: "-created",
+		expect: []string{
+			"cs:~bob/xenial/gamma-1",
+			"cs:~bob/xenial/alpha-1",
+			"cs:~bob/xenial/beta-1",
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.sort)
+		var sp SearchParams
+		err := sp.ParseSortFields(test.sort)
+		c.Assert(err, gc.Equals, nil)
+		sp.Filters = map[string][]string{
+			"owner": {"bob"},
+		}
+		res, err := s.store.Search(sp)
+		c.Assert(err, gc.Equals, nil)
+		urls := make([]string, len(res.Results))
+		for i, e := range res.Results {
+			urls[i] = e.URL.String()
+		}
+		c.Assert(urls, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestSorting(c *gc.C) {
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		about     string
+		sortQuery string
+		results   []searchEntity
+	}{{
+		about:     "name ascending",
+		sortQuery: "name",
 		results: []searchEntity{
+			searchEntities["cloud-controller-worker-v2"],
+			searchEntities["mysql"],
+			searchEntities["squid-forwardproxy"],
+			searchEntities["varnish"],
 			searchEntities["wordpress"],
 			searchEntities["wordpress-simple"],
+		},
+	}, {
+		about:     "name descending",
+		sortQuery: "-name",
+		results: []searchEntity{
+			searchEntities["wordpress-simple"],
+			searchEntities["wordpress"],
+			searchEntities["varnish"],
 			searchEntities["squid-forwardproxy"],
 			searchEntities["mysql"],
 			searchEntities["cloud-controller-worker-v2"],
+		},
+	}, {
+		about:     "series ascending",
+		sortQuery: "series,name",
+		results: []searchEntity{
+			searchEntities["squid-forwardproxy"],
+			searchEntities["wordpress-simple"],
+			searchEntities["wordpress"],
+			searchEntities["cloud-controller-worker-v2"],
+			searchEntities["mysql"],
 			searchEntities["varnish"],
 		},
 	}, {
-		about:     "downloads descending",
-		sortQuery: "-downloads",
+		about:     "series descending",
+		sortQuery: "-series,name",
 		results: []searchEntity{
+			searchEntities["mysql"],
 			searchEntities["varnish"],
 			searchEntities["cloud-controller-worker-v2"],
-			searchEntities["mysql"],
-			searchEntities["squid-forwardproxy"],
-			searchEntities["wordpress-simple"],
 			searchEntities["wordpress"],
+			searchEntities["wordpress-simple"],
+			searchEntities["squid-forwardproxy"],
+		},
+	}, {
+		about:     "owner ascending",
+		sortQuery: "owner,name",
+		results: []searchEntity{
+			searchEntities["cloud-controller-worker-v2"],
+			searchEntities["squid-forwardproxy"],
+			searchEntities["wordpress"],
+			searchEntities["wordpress-simple"],
+			searchEntities["varnish"],
+			searchEntities["mysql"],
+		},
+	}, {
+		about:     "owner descending",
+		sortQuery: "-owner,name",
+		results: []searchEntity{
+			searchEntities["mysql"],
+			searchEntities["varnish"],
+			searchEntities["squid-forwardproxy"],
+			searchEntities["wordpress"],
+			searchEntities["wordpress-simple"],
+			searchEntities["cloud-controller-worker-v2"],
+		},
+	}, {
+		about:     "downloads ascending",
+		sortQuery: "downloads",
+		results: []searchEntity{
+			searchEntities["wordpress"],
+			searchEntities["wordpress-simple"],
+			searchEntities["squid-forwardproxy"],
+			searchEntities["mysql"],
+			searchEntities["cloud-controller-worker-v2"],
+			searchEntities["varnish"],
+		},
+	}, {
+		about:     "downloads descending",
+		sortQuery: "-downloads",
+		results: []searchEntity{
+			searchEntities["varnish"],
+			searchEntities["cloud-controller-worker-v2"],
+			searchEntities["mysql"],
+			searchEntities["squid-forwardproxy"],
+			searchEntities["wordpress-simple"],
+			searchEntities["wordpress"],
+		},
+	}, {
+		about:     "owner ascending, name descending, series ascending",
+		sortQuery: "owner,-name,series",
+		results: []searchEntity{
+			searchEntities["cloud-controller-worker-v2"],
+			searchEntities["wordpress-simple"],
+			searchEntities["wordpress"],
+			searchEntities["squid-forwardproxy"],
+			searchEntities["varnish"],
+			searchEntities["mysql"],
+		},
+	}, {
+		about:     "series descending, owner ascending, name descending",
+		sortQuery: "-series,owner,-name",
+		results: []searchEntity{
+			searchEntities["varnish"],
+			searchEntities["mysql"],
+			searchEntities["cloud-controller-worker-v2"],
+			searchEntities["wordpress"],
+			searchEntities["wordpress-simple"],
+			searchEntities["squid-forwardproxy"],
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d. %s", i, test.about)
+		var sp SearchParams
+		err := sp.ParseSortFields(test.sortQuery)
+		c.Assert(err, gc.Equals, nil)
+		res, err := s.store.Search(sp)
+		c.Assert(err, gc.Equals, nil)
+		expected := make([]*mongodoc.Entity, len(test.results))
+		for i, r := range test.results {
+			expected[i] = r.storedEntity(c, s.store)
+		}
+		c.Assert(Entities(res.Results), jc.DeepEquals, Entities(expected))
+		c.Assert(res.Total, gc.Equals, len(test.results))
+	}
+}
+
+var parseSortFieldsTests = []struct {
+	about       string
+	fields      []string
+	expect      []SortParam
+	expectError string
+}{{
+	about:  "single field",
+	fields: []string{"name"},
+	expect: []SortParam{{Field: "name"}},
+}, {
+	about:  "mixed directions",
+	fields: []string{"-downloads,name,-series"},
+	expect: []SortParam{
+		{Field: "downloads", Descending: true},
+		{Field: "name"},
+		{Field: "series", Descending: true},
+	},
+}, {
+	about:  "multiple values",
+	fields: []string{"-updated", "owner,-created"},
+	expect: []SortParam{
+		{Field: "updated", Descending: true},
+		{Field: "owner"},
+		{Field: "created", Descending: true},
+	},
+}, {
+	about:       "unknown field",
+	fields:      []string{"name,foo"},
+	expectError: `unrecognized sort parameter "foo"`,
+}, {
+	about:       "empty field",
+	fields:      []string{"name,,series"},
+	expectError: `unrecognized sort parameter ""`,
+}, {
+	about:       "hyphen only",
+	fields:      []string{"-"},
+	expectError: `unrecognized sort parameter ""`,
+}, {
+	about:       "repeated field",
+	fields:      []string{"name,series", "-name"},
+	expectError: `sort parameter "name" specified more than once`,
+}}
+
+func (s *StoreSearchSuite) TestParseSortFields(c *gc.C) {
+	for i, test := range parseSortFieldsTests {
+		c.Logf("test %d. %s", i, test.about)
+		var sp SearchParams
+		err := sp.ParseSortFields(test.fields...)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(sp.Sort, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestBoosting(c *gc.C) {
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	var sp SearchParams
+	res, err := s.store.Search(sp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(Entities(res.Results), jc.DeepEquals, Entities{
+		searchEntities["squid-forwardproxy"].storedEntity(c, s.store),
+		searchEntities["wordpress-simple"].storedEntity(c, s.store),
+		searchEntities["mysql"].storedEntity(c, s.store),
+		searchEntities["wordpress"].storedEntity(c, s.store),
+		searchEntities["varnish"].storedEntity(c, s.store),
+		searchEntities["cloud-controller-worker-v2"].storedEntity(c, s.store),
+	})
+}
+
+func (s *StoreSearchSuite) TestBoostingWithConfiguredWeights(c *gc.C) {
+	pool, err := NewPool(s.Session.DB("foo"), &s.index, nil, ServerParams{
+		DownloadBoost:    1,
+		PromulgatedBoost: 1,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	var sp SearchParams
+	res, err := store.Search(sp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(Entities(res.Results), jc.DeepEquals, Entities{
+		searchEntities["varnish"].storedEntity(c, s.store),
+		searchEntities["cloud-controller-worker-v2"].storedEntity(c, s.store),
+		searchEntities["mysql"].storedEntity(c, s.store),
+		searchEntities["squid-forwardproxy"].storedEntity(c, s.store),
+		searchEntities["wordpress-simple"].storedEntity(c, s.store),
+		searchEntities["wordpress"].storedEntity(c, s.store),
+	})
+}
+
+func (s *StoreSearchSuite) TestBoostingOrderIsStable(c *gc.C) {
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	var sp SearchParams
+	res, err := s.store.Search(sp)
+	c.Assert(err, gc.Equals, nil)
+	expect := Entities(res.Results).String()
+	for i := 0; i < 10; i++ {
+		res, err := s.store.Search(sp)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(Entities(res.Results).String(), gc.Equals, expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestEnsureIndex(c *gc.C) {
+	s.store.ES.Index = s.TestIndex + "-ensure-index"
+	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
+	indexes, err := s.ES.ListIndexesForAlias(s.store.ES.Index)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 0)
+	err = s.store.ES.ensureIndexes(false)
+	c.Assert(err, gc.Equals, nil)
+	indexes, err = s.ES.ListIndexesForAlias(s.store.ES.Index)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 1)
+	index := indexes[0]
+	err = s.store.ES.ensureIndexes(false)
+	c.Assert(err, gc.Equals, nil)
+	indexes, err = s.ES.ListIndexesForAlias(s.store.ES.Index)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 1)
+	c.Assert(indexes[0], gc.Equals, index)
+}
+
+func (s *StoreSearchSuite) TestEnsureConcurrent(c *gc.C) {
+	s.store.ES.Index = s.TestIndex + "-ensure-index-conc"
+	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
+	indexes, err := s.ES.ListIndexesForAlias(s.store.ES.Index)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 0)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		err := s.store.ES.ensureIndexes(false)
+		c.Check(err, gc.Equals, nil)
+		wg.Done()
+	}()
+	err = s.store.ES.ensureIndexes(false)
+	c.Assert(err, gc.Equals, nil)
+	indexes, err = s.ES.ListIndexesForAlias(s.store.ES.Index)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 1)
+	wg.Wait()
+}
+
+func (s *StoreSearchSuite) TestEnsureIndexForce(c *gc.C) {
+	s.store.ES.Index = s.TestIndex + "-ensure-index-force"
+	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
+	indexes, err := s.ES.ListIndexesForAlias(s.store.ES.Index)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 0)
+	err = s.store.ES.ensureIndexes(false)
+	c.Assert(err, gc.Equals, nil)
+	indexes, err = s.ES.ListIndexesForAlias(s.store.ES.Index)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 1)
+	index := indexes[0]
+	err = s.store.ES.ensureIndexes(true)
+	c.Assert(err, gc.Equals, nil)
+	indexes, err = s.ES.ListIndexesForAlias(s.store.ES.Index)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 1)
+	c.Assert(indexes[0], gc.Not(gc.Equals), index)
+}
+
+func (s *StoreSearchSuite) TestSynchroniseElasticsearch(c *gc.C) {
+	indexes, err := s.ES.ListIndexesForAlias(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 1)
+	index := indexes[0]
+	err = s.store.SynchroniseElasticsearch()
+	c.Assert(err, gc.Equals, nil)
+	indexes, err = s.ES.ListIndexesForAlias(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 1)
+	c.Assert(indexes[0], gc.Not(gc.Equals), index)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	res, err := s.store.Search(SearchParams{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 6)
+}
+
+func (s *StoreSearchSuite) TestCancelReindex(c *gc.C) {
+	indexes, err := s.ES.ListIndexesForAlias(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 1)
+	index := indexes[0]
+	s.PatchValue(&syncSearchHook, func() {
+		c.Check(s.store.CancelReindex(), gc.Equals, true)
+	})
+	err = s.store.SynchroniseElasticsearch()
+	c.Assert(errgo.Cause(err), gc.Equals, ErrReindexCancelled)
+	indexes, err = s.ES.ListIndexesForAlias(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, jc.DeepEquals, []string{index})
+	c.Assert(s.store.CancelReindex(), gc.Equals, false)
+}
+
+func (s *StoreSearchSuite) TestReindexFailureLeavesCurrentIndex(c *gc.C) {
+	indexes, err := s.ES.ListIndexesForAlias(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, gc.HasLen, 1)
+	index := indexes[0]
+	allIndexes, err := s.ES.ListAllIndexes()
+	c.Assert(err, gc.Equals, nil)
+
+	// Add an entity without a base entity so that
+	// it cannot be indexed.
+	url := charm.MustParseURL("cs:~charmers/xenial/orphan-1")
+	err = s.store.DB.Entities().Insert(&mongodoc.Entity{
+		URL:                 url,
+		BaseURL:             mongodoc.BaseURL(url),
+		User:                url.User,
+		Name:                url.Name,
+		Revision:            url.Revision,
+		Series:              url.Series,
+		PromulgatedRevision: -1,
+	})
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Reindex()
+	c.Assert(err, gc.ErrorMatches, `cannot synchronise indexes: cannot index cs:~charmers/xenial/orphan-1: .*`)
+
+	// The partially populated index has been deleted
+	// and the current index is still used.
+	indexes, err = s.ES.ListIndexesForAlias(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(indexes, jc.DeepEquals, []string{index})
+	newAllIndexes, err := s.ES.ListAllIndexes()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(newAllIndexes, jc.SameContents, allIndexes)
+	res, err := s.store.Search(SearchParams{})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 6)
+}
+
+func (s *StoreSearchSuite) TestCheckDocumentCount(c *gc.C) {
+	err := s.store.ES.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	esr, err := s.store.ES.Search(s.TestIndex, typeName, elasticsearch.QueryDSL{
+		Query: elasticsearch.MatchAllQuery{},
+	})
+	c.Assert(err, gc.Equals, nil)
+	n := esr.Hits.Total
+	c.Assert(n > 0, gc.Equals, true)
+	err = s.store.ES.checkDocumentCount(n)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.ES.checkDocumentCount(n + 1)
+	c.Assert(err, gc.ErrorMatches, fmt.Sprintf(`index .* holds %d documents, expected %d`, n, n+1))
+}
+
+func (s *StoreSearchSuite) TestSearchDocumentCount(c *gc.C) {
+	n, err := s.store.searchDocumentCount(s.store.ES)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.ES.checkDocumentCount(n)
+	c.Assert(err, gc.Equals, nil)
+
+	// A missing document is detected.
+	wordpress := searchEntities["wordpress"].entity
+	err = s.ES.DeleteDocument(s.TestIndex, typeName, s.store.ES.getID(wordpress.URL))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.ES.checkDocumentCount(n)
+	c.Assert(err, gc.ErrorMatches, fmt.Sprintf(`index .* holds %d documents, expected %d`, n-1, n))
+}
+
+func (s *StoreSearchSuite) TestReindexProgress(c *gc.C) {
+	total, err := s.store.DB.Entities().Count()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(total > 3, gc.Equals, true)
+	var progress []ReindexProgress
+	s.PatchValue(&syncSearchHook, func() {
+		progress = append(progress, s.store.ReindexProgress())
+		if len(progress) == 3 {
+			c.Check(s.store.CancelReindex(), gc.Equals, true)
+		}
+	})
+	err = s.store.SynchroniseElasticsearch()
+	c.Assert(errgo.Cause(err), gc.Equals, ErrReindexCancelled)
+	c.Assert(progress, jc.DeepEquals, []ReindexProgress{{
+		InProgress: true,
+		Done:       0,
+		Total:      total,
+	}, {
+		InProgress: true,
+		Done:       1,
+		Total:      total,
+	}, {
+		InProgress: true,
+		Done:       2,
+		Total:      total,
+	}})
+	c.Assert(s.store.ReindexProgress(), jc.DeepEquals, ReindexProgress{
+		Done:  2,
+		Total: total,
+	})
+
+	// The progress is reset by the next reindex.
+	progress = nil
+	s.PatchValue(&syncSearchHook, func() {})
+	err = s.store.SynchroniseElasticsearch()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(s.store.ReindexProgress(), jc.DeepEquals, ReindexProgress{
+		Done:  total,
+		Total: total,
+	})
+}
+
+func (s *StoreSearchSuite) TestGetCurrentVersionNoVersion(c *gc.C) {
+	s.store.ES.Index = s.TestIndex + "-current-version"
+	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
+	v, dv, err := s.store.ES.getCurrentVersion()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v, gc.Equals, version{})
+	c.Assert(dv, gc.Equals, int64(0))
+}
+
+func (s *StoreSearchSuite) TestGetCurrentVersionWithVersion(c *gc.C) {
+	s.store.ES.Index = s.TestIndex + "-current-version"
+	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
+	index, err := s.store.ES.newIndex()
+	c.Assert(err, gc.Equals, nil)
+	updated, err := s.store.ES.updateVersion(version{1, index}, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(updated, gc.Equals, true)
+	v, dv, err := s.store.ES.getCurrentVersion()
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(v, gc.Equals, version{1, index})
+	c.Assert(dv, gc.Equals, int64(1))
+}
+
+func (s *StoreSearchSuite) TestUpdateVersionNew(c *gc.C) {
+	s.store.ES.Index = s.TestIndex + "-update-version"
+	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
+	index, err := s.store.ES.newIndex()
+	c.Assert(err, gc.Equals, nil)
+	updated, err := s.store.ES.updateVersion(version{1, index}, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(updated, gc.Equals, true)
+}
+
+func (s *StoreSearchSuite) TestUpdateVersionUpdate(c *gc.C) {
+	s.store.ES.Index = s.TestIndex + "-update-version"
+	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
+	index, err := s.store.ES.newIndex()
+	c.Assert(err, gc.Equals, nil)
+	updated, err := s.store.ES.updateVersion(version{1, index}, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(updated, gc.Equals, true)
+	index, err = s.store.ES.newIndex()
+	c.Assert(err, gc.Equals, nil)
+	updated, err = s.store.ES.updateVersion(version{2, index}, 1)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(updated, gc.Equals, true)
+}
+
+func (s *StoreSearchSuite) TestUpdateCreateConflict(c *gc.C) {
+	s.store.ES.Index = s.TestIndex + "-update-version"
+	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
+	index, err := s.store.ES.newIndex()
+	c.Assert(err, gc.Equals, nil)
+	updated, err := s.store.ES.updateVersion(version{1, index}, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(updated, gc.Equals, true)
+	index, err = s.store.ES.newIndex()
+	c.Assert(err, gc.Equals, nil)
+	updated, err = s.store.ES.updateVersion(version{1, index}, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(updated, gc.Equals, false)
+}
+
+func (s *StoreSearchSuite) TestUpdateConflict(c *gc.C) {
+	s.store.ES.Index = s.TestIndex + "-update-version"
+	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
+	index, err := s.store.ES.newIndex()
+	c.Assert(err, gc.Equals, nil)
+	updated, err := s.store.ES.updateVersion(version{1, index}, 0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(updated, gc.Equals, true)
+	index, err = s.store.ES.newIndex()
+	c.Assert(err, gc.Equals, nil)
+	updated, err = s.store.ES.updateVersion(version{1, index}, 3)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(updated, gc.Equals, false)
+}
+
+func (s *StoreSearchSuite) TestMultiSeriesCharmFiltersSeriesCorrectly(c *gc.C) {
+	charmArchive := storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, "trusty", "xenial", "utopic", "vivid", "wily", "yakkety"))
+	url := router.MustNewResolvedURL("cs:~charmers/juju-gui-25", -1)
+	addCharmForSearch(
+		c,
+		s.store,
+		url,
+		charmArchive,
+		[]string{url.URL.User, params.Everyone},
+		0,
+	)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	filterTests := []struct {
+		series   string
+		notFound bool
+	}{{
+		series: "xenial",
+	}, {
+		series: "vivid",
+	}, {
+		series:   "sauch",
+		notFound: true,
+	}}
+	for i, test := range filterTests {
+		c.Logf("%d. %s", i, test.series)
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"name":   {"juju-gui"},
+				"series": {test.series},
+			},
+		})
+		c.Assert(err, gc.Equals, nil)
+		if test.notFound {
+			c.Assert(res.Results, gc.HasLen, 0)
+			continue
+		}
+		c.Assert(res.Results, gc.HasLen, 1)
+		c.Assert(res.Results[0].URL.String(), gc.Equals, url.String())
+	}
+}
+
+func (s *StoreSearchSuite) TestMultiSeriesCharmSortsSeriesCorrectly(c *gc.C) {
+	charmArchive := storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, "trusty", "xenial", "bionic", "utopic", "vivid", "wily", "yakkety"))
+	url := router.MustNewResolvedURL("cs:~charmers/juju-gui-25", -1)
+	addCharmForSearch(
+		c,
+		s.store,
+		url,
+		charmArchive,
+		[]string{url.URL.User, params.Everyone},
+		0,
+	)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	var sp SearchParams
+	sp.ParseSortFields("-series", "owner")
+	res, err := s.store.Search(sp)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(Entities(res.Results), jc.DeepEquals, Entities{
+		s.entity(c, "cs:~charmers/juju-gui-25"),
+		searchEntities["varnish"].storedEntity(c, s.store),
+		searchEntities["mysql"].storedEntity(c, s.store),
+		searchEntities["cloud-controller-worker-v2"].storedEntity(c, s.store),
+		searchEntities["wordpress"].storedEntity(c, s.store),
+		searchEntities["wordpress-simple"].storedEntity(c, s.store),
+		searchEntities["squid-forwardproxy"].storedEntity(c, s.store),
+	})
+}
+
+func (s *StoreSearchSuite) TestOnlyIndexStableCharms(c *gc.C) {
+	ch := storetesting.NewCharm(&charm.Meta{
+		Name: "test",
+	})
+	id := router.MustNewResolvedURL("~test/xenial/test-0", -1)
+	err := s.store.AddCharmWithArchive(id, ch)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "read", "test", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "edge.read", "test", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "stable.read", "test", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+
+	var actual json.RawMessage
+
+	err = s.store.UpdateSearch(id)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(&id.URL), &actual)
+	c.Assert(err, gc.ErrorMatches, "elasticsearch document not found")
+
+	err = s.store.Publish(id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.UpdateSearch(id)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(&id.URL), &actual)
+	c.Assert(err, gc.ErrorMatches, "elasticsearch document not found")
+
+	err = s.store.Publish(id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.UpdateSearch(id)
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(&id.URL), &actual)
+	c.Assert(err, gc.Equals, nil)
+
+	entity, err := s.store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+	doc := SearchDoc{
+		Entity:        entity,
+		ReadACLs:      []string{"test", params.Everyone},
+		Series:        []string{"xenial"},
+		RevisionCount: 1,
+		Platforms:     []string{"xenial/all"},
+		Channel:       params.StableChannel,
+		AllSeries:     true,
+		SingleSeries:  true,
+	}
+	c.Assert(string(actual), jc.JSONEquals, doc)
+}
+
+func (s *StoreSearchSuite) TestSearchChannel(c *gc.C) {
+	stableURL := router.MustNewResolvedURL("cs:~channel-test/xenial/stable-1", -1)
+	addCharmForSearch(c, s.store, stableURL, storetesting.NewCharm(nil), []string{params.Everyone}, 0)
+	edgeURL := router.MustNewResolvedURL("cs:~channel-test/xenial/edge-only-1", -1)
+	err := s.store.AddCharmWithArchive(edgeURL, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&edgeURL.URL, "edge.read", "edge-testers")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(edgeURL, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+
+	tests := []struct {
+		about   string
+		channel params.Channel
+		groups  []string
+		expect  []string
+	}{{
+		about:  "default channel is stable",
+		groups: []string{"edge-testers"},
+		expect: []string{"cs:~channel-test/xenial/stable-1"},
+	}, {
+		about:   "stable channel",
+		channel: params.StableChannel,
+		groups:  []string{"edge-testers"},
+		expect:  []string{"cs:~channel-test/xenial/stable-1"},
+	}, {
+		about:   "edge channel without edge read access",
+		channel: params.EdgeChannel,
+	}, {
+		about:   "edge channel with edge read access",
+		channel: params.EdgeChannel,
+		groups:  []string{"edge-testers"},
+		expect:  []string{"cs:~channel-test/xenial/edge-only-1"},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{"owner": {"channel-test"}},
+			Channel: test.channel,
+			Groups:  test.groups,
+		})
+		c.Assert(err, gc.Equals, nil)
+		var got []string
+		for _, e := range res.Results {
+			got = append(got, e.URL.String())
+		}
+		c.Assert(got, jc.DeepEquals, test.expect)
+	}
+
+	_, err = s.store.Search(SearchParams{
+		Channel: params.UnpublishedChannel,
+	})
+	c.Assert(err, gc.ErrorMatches, `cannot search channel "unpublished"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *StoreSearchSuite) TestPublishEdgeUpdatesSearch(c *gc.C) {
+	id := router.MustNewResolvedURL("cs:~edge-publish/xenial/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "edge.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+
+	// Publishing only to edge must index the entity in the edge
+	// channel without any explicit reindex.
+	err = s.store.Publish(id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+
+	res, err := s.store.Search(SearchParams{
+		Filters: map[string][]string{"owner": {"edge-publish"}},
+		Channel: params.EdgeChannel,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 1)
+	c.Assert(res.Results[0].URL.String(), gc.Equals, "cs:~edge-publish/xenial/wordpress-0")
+
+	// The entity is not in the stable channel and has no stable
+	// publish time.
+	res, err = s.store.Search(SearchParams{
+		Filters: map[string][]string{"owner": {"edge-publish"}},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 0)
+	entity, err := s.store.FindEntity(id, FieldSelector("stablepublishtime"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.StablePublishTime.IsZero(), gc.Equals, true)
+}
+
+func (s *StoreSearchSuite) TestSearchChannelReadACLs(c *gc.C) {
+	id := router.MustNewResolvedURL("cs:~acl-test/xenial/both-1", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "stable.read", "acl-test", "stable-testers")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "edge.read", "acl-test", "edge-testers")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id, nil, params.StableChannel, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+
+	tests := []struct {
+		about   string
+		channel params.Channel
+		groups  []string
+		admin   bool
+		expect  []string
+	}{{
+		about:   "edge read access in edge channel",
+		channel: params.EdgeChannel,
+		groups:  []string{"edge-testers"},
+		expect:  []string{"cs:~acl-test/xenial/both-1"},
+	}, {
+		about:   "edge read access in stable channel",
+		channel: params.StableChannel,
+		groups:  []string{"edge-testers"},
+	}, {
+		about:   "stable read access in stable channel",
+		channel: params.StableChannel,
+		groups:  []string{"stable-testers"},
+		expect:  []string{"cs:~acl-test/xenial/both-1"},
+	}, {
+		about:   "stable read access in edge channel",
+		channel: params.EdgeChannel,
+		groups:  []string{"stable-testers"},
+	}, {
+		about:   "admin in edge channel",
+		channel: params.EdgeChannel,
+		admin:   true,
+		expect:  []string{"cs:~acl-test/xenial/both-1"},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{"owner": {"acl-test"}},
+			Channel: test.channel,
+			Groups:  test.groups,
+			Admin:   test.admin,
+		})
+		c.Assert(err, gc.Equals, nil)
+		var got []string
+		for _, e := range res.Results {
+			got = append(got, e.URL.String())
+		}
+		c.Assert(got, jc.DeepEquals, test.expect)
+	}
+}
+
+var explainSearchTests = []struct {
+	about  string
+	id     string
+	sp     SearchParams
+	expect SearchExplanation
+}{{
+	about: "found",
+	id:    "cs:~charmers/precise/wordpress-23",
+	expect: SearchExplanation{
+		Found:  true,
+		Reason: "matches search",
+	},
+}, {
+	about: "unpublished",
+	id:    "cs:~explain-test/xenial/unpublished-1",
+	expect: SearchExplanation{
+		Reason: "not indexed: not published on stable",
+	},
+}, {
+	about: "unpublished in edge channel",
+	id:    "cs:~explain-test/xenial/unpublished-1",
+	sp: SearchParams{
+		Channel: params.EdgeChannel,
+	},
+	expect: SearchExplanation{
+		Reason: "not indexed: not published on edge",
+	},
+}, {
+	about: "old revision",
+	id:    "cs:~explain-test/xenial/old-1",
+	expect: SearchExplanation{
+		Reason: "not indexed: not the current stable revision",
+	},
+}, {
+	about: "filtered by ACL",
+	id:    "cs:~charmers/xenial/riak-67",
+	expect: SearchExplanation{
+		Reason: "filtered by ACL",
+	},
+}, {
+	about: "visible to group",
+	id:    "cs:~charmers/xenial/riak-67",
+	sp: SearchParams{
+		Groups: []string{"charmers"},
+	},
+	expect: SearchExplanation{
+		Found:  true,
+		Reason: "matches search",
+	},
+}, {
+	about: "does not match text",
+	id:    "cs:~charmers/precise/wordpress-23",
+	sp: SearchParams{
+		Text: "varnish",
+	},
+	expect: SearchExplanation{
+		Reason: "does not match text",
+	},
+}, {
+	about: "filtered by filter",
+	id:    "cs:~charmers/precise/wordpress-23",
+	sp: SearchParams{
+		Filters: map[string][]string{
+			"owner":  {"charmers"},
+			"series": {"xenial"},
+		},
+	},
+	expect: SearchExplanation{
+		Reason: `filtered by "series" filter`,
+	},
+}, {
+	about: "excluded by filter",
+	id:    "cs:~charmers/precise/wordpress-23",
+	sp: SearchParams{
+		Exclude: map[string][]string{
+			"owner": {"charmers"},
+		},
+	},
+	expect: SearchExplanation{
+		Reason: `excluded by "owner" filter`,
+	},
+}}
+
+func (s *StoreSearchSuite) TestExplainSearch(c *gc.C) {
+	err := s.store.AddCharmWithArchive(router.MustNewResolvedURL("cs:~explain-test/xenial/unpublished-1", -1), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	for _, id := range []string{"cs:~explain-test/xenial/old-1", "cs:~explain-test/xenial/old-2"} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(c, s.store, url, storetesting.NewCharm(nil), []string{params.Everyone}, 0)
+	}
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	for i, test := range explainSearchTests {
+		c.Logf("test %d: %s", i, test.about)
+		explanation, err := s.store.ExplainSearch(test.sp, router.MustNewResolvedURL(test.id, -1))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(explanation, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestAssumesFilter(c *gc.C) {
+	ch := storetesting.NewCharm(nil).WithExtraMeta(map[string]interface{}{
+		"assumes": []interface{}{
+			"juju >= 2.9",
+			map[string]interface{}{
+				"any-of": []interface{}{"k8s-api", "lxd"},
+			},
+		},
+	})
+	url := router.MustNewResolvedURL("cs:~charmers/xenial/kubeflow-1", -1)
+	addCharmForSearch(
+		c,
+		s.store,
+		url,
+		ch,
+		[]string{url.URL.User, params.Everyone},
+		0,
+	)
+	entity, err := s.store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.CharmAssumes, jc.DeepEquals, []string{"juju", "k8s-api", "lxd"})
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	res, err := s.store.Search(SearchParams{
+		Filters: map[string][]string{
+			"assumes": {"k8s-api"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 1)
+	c.Assert(res.Results[0].URL.String(), gc.Equals, url.String())
+	res, err = s.store.Search(SearchParams{
+		Filters: map[string][]string{
+			"assumes": {"juju-db"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 0)
+}
+
+func (s *StoreSearchSuite) TestContainerFilter(c *gc.C) {
+	ch := storetesting.NewCharm(nil).WithExtraMeta(map[string]interface{}{
+		"containers": map[string]interface{}{
+			"database": map[string]interface{}{
+				"resource": "database-image",
+			},
+		},
+		"resources": map[string]interface{}{
+			"database-image": map[string]interface{}{
+				"type":            "oci-image",
+				"upstream-source": "mariadb:10.3",
+			},
+		},
+	})
+	url := router.MustNewResolvedURL("cs:~charmers/kubernetes/mariadb-k8s-1", -1)
+	addCharmForSearch(
+		c,
+		s.store,
+		url,
+		ch,
+		[]string{url.URL.User, params.Everyone},
+		0,
+	)
+	entity, err := s.store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.CharmContainers, jc.DeepEquals, []string{"database"})
+	c.Assert(entity.CharmContainerImages, jc.DeepEquals, []string{"mariadb:10.3"})
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	for _, container := range []string{"database", "mariadb:10.3"} {
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"container": {container},
+			},
+		})
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(res.Results, gc.HasLen, 1)
+		c.Assert(res.Results[0].URL.String(), gc.Equals, url.String())
+	}
+	res, err := s.store.Search(SearchParams{
+		Filters: map[string][]string{
+			"container": {"postgresql"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 0)
+}
+
+func (s *StoreSearchSuite) TestMinJujuVersionFilter(c *gc.C) {
+	for id, v := range map[string]string{
+		"cs:~version-test/xenial/any-1":   "",
+		"cs:~version-test/xenial/old-1":   "2.0.0",
+		"cs:~version-test/xenial/exact-1": "2.9.0",
+		"cs:~version-test/xenial/new-1":   "3.1.2",
+	} {
+		meta := &charm.Meta{}
+		if v != "" {
+			meta.MinJujuVersion = jujuversion.MustParse(v)
+		}
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(
+			c,
+			s.store,
+			url,
+			storetesting.NewCharm(meta),
+			[]string{url.URL.User, params.Everyone},
+			0,
+		)
+	}
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		version string
+		expect  []string
+	}{{
+		version: "2.9",
+		expect: []string{
+			"cs:~version-test/xenial/any-1",
+			"cs:~version-test/xenial/exact-1",
+			"cs:~version-test/xenial/old-1",
+		},
+	}, {
+		version: "2.8.5",
+		expect: []string{
+			"cs:~version-test/xenial/any-1",
+			"cs:~version-test/xenial/old-1",
+		},
+	}, {
+		version: "1.25",
+		expect: []string{
+			"cs:~version-test/xenial/any-1",
+		},
+	}, {
+		version: "3.1.2",
+		expect: []string{
+			"cs:~version-test/xenial/any-1",
+			"cs:~version-test/xenial/exact-1",
+			"cs:~version-test/xenial/new-1",
+			"cs:~version-test/xenial/old-1",
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.version)
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"owner":            {"version-test"},
+				"min-juju-version": {test.version},
+			},
+			Sort: []SortParam{{Field: "name"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		var urls []string
+		for _, e := range res.Results {
+			urls = append(urls, e.URL.String())
+		}
+		c.Assert(urls, jc.DeepEquals, test.expect)
+	}
+}
+
+var parseJujuVersionTests = []struct {
+	value       string
+	expect      int
+	expectError string
+}{{
+	value:  "2.9",
+	expect: 2009000,
+}, {
+	value:  "2.10.3",
+	expect: 2010003,
+}, {
+	value:       "2",
+	expectError: `invalid Juju version "2"`,
+}, {
+	value:       "2.9.1.4",
+	expectError: `invalid Juju version "2.9.1.4"`,
+}, {
+	value:       "2.x",
+	expectError: `invalid Juju version "2.x"`,
+}, {
+	value:       "2.1000",
+	expectError: `invalid Juju version "2.1000"`,
+}}
+
+func (s *StoreSearchSuite) TestParseJujuVersion(c *gc.C) {
+	for i, test := range parseJujuVersionTests {
+		c.Logf("test %d: %s", i, test.value)
+		n, err := ParseJujuVersion(test.value)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(n, gc.Equals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestLicenseFilter(c *gc.C) {
+	for id, license := range map[string]string{
+		"cs:~license-test/xenial/apache-1":     "Apache-2.0",
+		"cs:~license-test/xenial/mit-1":        "MIT",
+		"cs:~license-test/xenial/gpl-1":        "GPL-3.0",
+		"cs:~license-test/xenial/unlicensed-1": "",
+	} {
+		extra := map[string]interface{}{}
+		if license != "" {
+			extra["license"] = license
+		}
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(
+			c,
+			s.store,
+			url,
+			storetesting.NewCharm(nil).WithExtraMeta(extra),
+			[]string{url.URL.User, params.Everyone},
+			0,
+		)
+	}
+	entity, err := s.store.FindEntity(router.MustNewResolvedURL("cs:~license-test/xenial/apache-1", -1), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.CharmLicense, gc.Equals, "Apache-2.0")
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		licenses []string
+		expect   []string
+	}{{
+		licenses: []string{"Apache-2.0"},
+		expect:   []string{"cs:~license-test/xenial/apache-1"},
+	}, {
+		licenses: []string{"Apache-2.0", "MIT"},
+		expect: []string{
+			"cs:~license-test/xenial/apache-1",
+			"cs:~license-test/xenial/mit-1",
+		},
+	}, {
+		licenses: []string{"BSD-3-Clause"},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %v", i, test.licenses)
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"owner":   {"license-test"},
+				"license": test.licenses,
+			},
+			Sort: []SortParam{{Field: "name"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		var urls []string
+		for _, e := range res.Results {
+			urls = append(urls, e.URL.String())
+		}
+		c.Assert(urls, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestSearchFacets(c *gc.C) {
+	for id, public := range map[string]bool{
+		"cs:~facet-test/xenial/one-1":    true,
+		"cs:~facet-test/trusty/two-1":    true,
+		"cs:~facet-test/xenial/hidden-1": false,
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		acl := []string{url.URL.User}
+		if public {
+			acl = append(acl, params.Everyone)
+		}
+		addCharmForSearch(c, s.store, url, storetesting.NewCharm(nil), acl, 0)
+	}
+	url := router.MustNewResolvedURL("cs:~facet-test/bundle/blog-1", -1)
+	addBundleForSearch(
+		c,
+		s.store,
+		url,
+		storetesting.NewBundle(searchEntities["wordpress-simple"].bundleData),
+		[]string{url.URL.User, params.Everyone},
+		0,
+	)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		about  string
+		groups []string
+		expect map[string][]FacetCount
+	}{{
+		about: "hidden charms not counted",
+		expect: map[string][]FacetCount{
+			"owner": {{"facet-test", 3}},
+			"series": {
+				{"bundle", 1},
+				{"trusty", 1},
+				{"xenial", 1},
+			},
+			"type": {
+				{"charm", 2},
+				{"bundle", 1},
+			},
+		},
+	}, {
+		about:  "hidden charms visible to the owner",
+		groups: []string{"facet-test"},
+		expect: map[string][]FacetCount{
+			"owner": {{"facet-test", 4}},
+			"series": {
+				{"xenial", 2},
+				{"bundle", 1},
+				{"trusty", 1},
+			},
+			"type": {
+				{"charm", 3},
+				{"bundle", 1},
+			},
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"owner": {"facet-test"},
+			},
+			Groups: test.groups,
+			Limit:  1,
+			Facets: []string{"owner", "series", "type", "no-such-facet"},
+		})
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(res.Results, gc.HasLen, 1)
+		c.Assert(res.Facets, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestTypeFacetCounts(c *gc.C) {
+	c.Assert(typeFacetCounts(2, 1), jc.DeepEquals, []FacetCount{{"charm", 2}, {"bundle", 1}})
+	c.Assert(typeFacetCounts(1, 2), jc.DeepEquals, []FacetCount{{"bundle", 2}, {"charm", 1}})
+	c.Assert(typeFacetCounts(1, 1), jc.DeepEquals, []FacetCount{{"bundle", 1}, {"charm", 1}})
+	c.Assert(typeFacetCounts(3, 0), jc.DeepEquals, []FacetCount{{"charm", 3}})
+	c.Assert(typeFacetCounts(0, 0), jc.DeepEquals, []FacetCount{})
+}
+
+func (s *StoreSearchSuite) TestSearchTypeCounts(c *gc.C) {
+	for id, public := range map[string]bool{
+		"cs:~count-test/xenial/one-1":    true,
+		"cs:~count-test/trusty/two-1":    true,
+		"cs:~count-test/xenial/hidden-1": false,
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		acl := []string{url.URL.User}
+		if public {
+			acl = append(acl, params.Everyone)
+		}
+		addCharmForSearch(c, s.store, url, storetesting.NewCharm(nil), acl, 0)
+	}
+	url := router.MustNewResolvedURL("cs:~count-test/bundle/blog-1", -1)
+	addBundleForSearch(
+		c,
+		s.store,
+		url,
+		storetesting.NewBundle(searchEntities["wordpress-simple"].bundleData),
+		[]string{url.URL.User, params.Everyone},
+		0,
+	)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		about         string
+		filters       map[string][]string
+		exclude       map[string][]string
+		groups        []string
+		expectResults int
+		expect        map[string]int
+	}{{
+		about: "all types",
+		filters: map[string][]string{
+			"owner": {"count-test"},
+		},
+		expectResults: 3,
+		expect:        map[string]int{"charm": 2, "bundle": 1},
+	}, {
+		about: "type filter ignored",
+		filters: map[string][]string{
+			"owner": {"count-test"},
+			"type":  {"bundle"},
+		},
+		expectResults: 1,
+		expect:        map[string]int{"charm": 2, "bundle": 1},
+	}, {
+		about: "excluded type ignored",
+		filters: map[string][]string{
+			"owner": {"count-test"},
+		},
+		exclude: map[string][]string{
+			"type": {"charm"},
+		},
+		expectResults: 1,
+		expect:        map[string]int{"charm": 2, "bundle": 1},
+	}, {
+		about: "other filters honored",
+		filters: map[string][]string{
+			"owner":  {"count-test"},
+			"series": {"xenial"},
+			"type":   {"bundle"},
+		},
+		expect: map[string]int{"charm": 1, "bundle": 0},
+	}, {
+		about: "hidden charms visible to the owner",
+		filters: map[string][]string{
+			"owner": {"count-test"},
+			"type":  {"charm"},
+		},
+		groups:        []string{"count-test"},
+		expectResults: 3,
+		expect:        map[string]int{"charm": 3, "bundle": 1},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		res, err := s.store.Search(SearchParams{
+			Filters:    test.filters,
+			Exclude:    test.exclude,
+			Groups:     test.groups,
+			TypeCounts: true,
+		})
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(res.Results, gc.HasLen, test.expectResults)
+		c.Assert(res.TypeCounts, jc.DeepEquals, test.expect)
+	}
+
+	// Type counts are only returned when requested.
+	res, err := s.store.Search(SearchParams{
+		Filters: map[string][]string{
+			"owner": {"count-test"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.TypeCounts, gc.IsNil)
+}
+
+func (s *StoreSearchSuite) TestConfigOptionsIndexed(c *gc.C) {
+	config := charm.NewConfig()
+	for _, name := range []string{"proxy-url", "port"} {
+		config.Options[name] = charm.Option{
+			Type:        "string",
+			Description: name,
+		}
+	}
+	url := router.MustNewResolvedURL("cs:~config-test/xenial/proxy-1", -1)
+	addCharmForSearch(c, s.store, url, storetesting.NewCharm(nil).WithConfig(config), []string{url.URL.User, params.Everyone}, 0)
+	url = router.MustNewResolvedURL("cs:~config-test/xenial/noconfig-1", -1)
+	addCharmForSearch(c, s.store, url, storetesting.NewCharm(nil), []string{url.URL.User, params.Everyone}, 0)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	doc, err := s.store.ES.GetSearchDocument(charm.MustParseURL("cs:~config-test/xenial/proxy-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.ConfigOptions, jc.DeepEquals, []string{"port", "proxy-url"})
+	doc, err = s.store.ES.GetSearchDocument(charm.MustParseURL("cs:~config-test/xenial/noconfig-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.ConfigOptions, gc.HasLen, 0)
+}
+
+func (s *StoreSearchSuite) TestResourceFilter(c *gc.C) {
+	for id, resources := range map[string][]string{
+		"cs:~resource-test/xenial/snapped-1":     {"snap", "config-bundle"},
+		"cs:~resource-test/xenial/image-1":       {"image"},
+		"cs:~resource-test/xenial/noresources-1": nil,
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		ch := storetesting.NewCharm(storetesting.MetaWithResources(nil, resources...))
+		addCharmForSearch(c, s.store, url, ch, []string{url.URL.User, params.Everyone}, 0)
+	}
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	doc, err := s.store.ES.GetSearchDocument(charm.MustParseURL("cs:~resource-test/xenial/snapped-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.Resources, jc.DeepEquals, []string{"config-bundle", "snap"})
+	doc, err = s.store.ES.GetSearchDocument(charm.MustParseURL("cs:~resource-test/xenial/noresources-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.Resources, gc.HasLen, 0)
+
+	tests := []struct {
+		resources []string
+		expect    []string
+	}{{
+		resources: []string{"snap"},
+		expect:    []string{"cs:~resource-test/xenial/snapped-1"},
+	}, {
+		resources: []string{"config-bundle"},
+		expect:    []string{"cs:~resource-test/xenial/snapped-1"},
+	}, {
+		resources: []string{"snap", "image"},
+		expect: []string{
+			"cs:~resource-test/xenial/image-1",
+			"cs:~resource-test/xenial/snapped-1",
+		},
+	}, {
+		resources: []string{"database"},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %v", i, test.resources)
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"owner":    {"resource-test"},
+				"resource": test.resources,
+			},
+			Sort: []SortParam{{Field: "name"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		var urls []string
+		for _, e := range res.Results {
+			urls = append(urls, e.URL.String())
+		}
+		c.Assert(urls, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestStorageFilter(c *gc.C) {
+	newMeta := func(types ...charm.StorageType) *charm.Meta {
+		meta := &charm.Meta{
+			Storage: make(map[string]charm.Storage),
+		}
+		for i, t := range types {
+			name := fmt.Sprintf("store%d", i)
+			meta.Storage[name] = charm.Storage{
+				Name:     name,
+				Type:     t,
+				CountMin: 1,
+				CountMax: 1,
+			}
+		}
+		return meta
+	}
+	for id, meta := range map[string]*charm.Meta{
+		"cs:~storage-test/xenial/both-1":      newMeta(charm.StorageBlock, charm.StorageFilesystem, charm.StorageBlock),
+		"cs:~storage-test/xenial/block-1":     newMeta(charm.StorageBlock),
+		"cs:~storage-test/xenial/nostorage-1": nil,
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(c, s.store, url, storetesting.NewCharm(meta), []string{url.URL.User, params.Everyone}, 0)
+	}
+	url := router.MustNewResolvedURL("cs:~storage-test/bundle/blog-1", -1)
+	addBundleForSearch(
+		c,
+		s.store,
+		url,
+		storetesting.NewBundle(searchEntities["wordpress-simple"].bundleData),
+		[]string{url.URL.User, params.Everyone},
+		0,
+	)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	doc, err := s.store.ES.GetSearchDocument(charm.MustParseURL("cs:~storage-test/xenial/both-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.StorageTypes, jc.DeepEquals, []string{"block", "filesystem"})
+	doc, err = s.store.ES.GetSearchDocument(charm.MustParseURL("cs:~storage-test/xenial/nostorage-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.StorageTypes, gc.HasLen, 0)
+
+	tests := []struct {
+		types  []string
+		expect []string
+	}{{
+		types: []string{"block"},
+		expect: []string{
+			"cs:~storage-test/xenial/block-1",
+			"cs:~storage-test/xenial/both-1",
+		},
+	}, {
+		types:  []string{"filesystem"},
+		expect: []string{"cs:~storage-test/xenial/both-1"},
+	}, {
+		types: []string{"filesystem", "block"},
+		expect: []string{
+			"cs:~storage-test/xenial/block-1",
+			"cs:~storage-test/xenial/both-1",
+		},
+	}, {
+		types: []string{"object"},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %v", i, test.types)
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"owner":   {"storage-test"},
+				"storage": test.types,
+			},
+			Sort: []SortParam{{Field: "name"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		var urls []string
+		for _, e := range res.Results {
+			urls = append(urls, e.URL.String())
+		}
+		c.Assert(urls, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestFiltersAll(c *gc.C) {
+	for id, meta := range map[string]*charm.Meta{
+		"cs:~all-test/xenial/web-1": storetesting.MetaWithTags(
+			storetesting.RelationMeta("provides website http"),
+			"http", "cache",
+		),
+		"cs:~all-test/xenial/db-1": storetesting.MetaWithTags(
+			storetesting.RelationMeta("provides db mysql"),
+			"database",
+		),
+		"cs:~all-test/xenial/both-1": storetesting.MetaWithTags(
+			storetesting.RelationMeta("provides website http", "provides db mysql"),
+			"http", "database",
+		),
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(c, s.store, url, storetesting.NewCharm(meta), []string{url.URL.User, params.Everyone}, 0)
+	}
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	tests := []struct {
+		about      string
+		filters    map[string][]string
+		filtersAll map[string][]string
+		expect     []string
+	}{{
+		about: "tags or",
+		filters: map[string][]string{
+			"tags": {"http", "database"},
+		},
+		expect: []string{
+			"cs:~all-test/xenial/both-1",
+			"cs:~all-test/xenial/db-1",
+			"cs:~all-test/xenial/web-1",
+		},
+	}, {
+		about: "tags and",
+		filtersAll: map[string][]string{
+			"tags": {"http", "database"},
+		},
+		expect: []string{
+			"cs:~all-test/xenial/both-1",
+		},
+	}, {
+		about: "provides or",
+		filters: map[string][]string{
+			"provides": {"http", "mysql"},
+		},
+		expect: []string{
+			"cs:~all-test/xenial/both-1",
+			"cs:~all-test/xenial/db-1",
+			"cs:~all-test/xenial/web-1",
+		},
+	}, {
+		about: "provides and",
+		filtersAll: map[string][]string{
+			"provides": {"http", "mysql"},
+		},
+		expect: []string{
+			"cs:~all-test/xenial/both-1",
+		},
+	}, {
+		about: "and combined with or",
+		filters: map[string][]string{
+			"tags": {"cache", "database"},
+		},
+		filtersAll: map[string][]string{
+			"provides": {"http"},
+		},
+		expect: []string{
+			"cs:~all-test/xenial/both-1",
+			"cs:~all-test/xenial/web-1",
+		},
+	}, {
+		about: "and matching nothing",
+		filtersAll: map[string][]string{
+			"tags": {"cache", "database"},
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		filters := map[string][]string{
+			"owner": {"all-test"},
+		}
+		for k, v := range test.filters {
+			filters[k] = v
+		}
+		res, err := s.store.Search(SearchParams{
+			Filters:    filters,
+			FiltersAll: test.filtersAll,
+			Sort:       []SortParam{{Field: "name"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		var urls []string
+		for _, e := range res.Results {
+			urls = append(urls, e.URL.String())
+		}
+		c.Assert(urls, jc.DeepEquals, test.expect)
+	}
+}
+
+func (s *StoreSearchSuite) TestActionsIndexed(c *gc.C) {
+	actions := charm.NewActions()
+	actions.ActionSpecs = make(map[string]charm.ActionSpec)
+	for _, name := range []string{"backup", "restore"} {
+		actions.ActionSpecs[name] = charm.ActionSpec{
+			Description: "Run " + name + ".",
+		}
+	}
+	url := router.MustNewResolvedURL("cs:~action-test/xenial/database-1", -1)
+	addCharmForSearch(c, s.store, url, storetesting.NewCharm(nil).WithActions(actions), []string{url.URL.User, params.Everyone}, 0)
+	url = router.MustNewResolvedURL("cs:~action-test/xenial/noactions-1", -1)
+	addCharmForSearch(c, s.store, url, storetesting.NewCharm(nil), []string{url.URL.User, params.Everyone}, 0)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	doc, err := s.store.ES.GetSearchDocument(charm.MustParseURL("cs:~action-test/xenial/database-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.Actions, jc.DeepEquals, []string{"backup", "restore"})
+	doc, err = s.store.ES.GetSearchDocument(charm.MustParseURL("cs:~action-test/xenial/noactions-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.Actions, gc.HasLen, 0)
+}
+
+func (s *StoreSearchSuite) TestMetricFilter(c *gc.C) {
+	newMetrics := func(names ...string) *charm.Metrics {
+		metrics := &charm.Metrics{
+			Metrics: make(map[string]charm.Metric),
+		}
+		for _, name := range names {
+			metrics.Metrics[name] = charm.Metric{
+				Type:        charm.MetricTypeGauge,
+				Description: name,
+			}
+		}
+		return metrics
+	}
+	for id, metrics := range map[string]*charm.Metrics{
+		"cs:~metric-test/xenial/web-1":       newMetrics("requests", "latency"),
+		"cs:~metric-test/xenial/db-1":        newMetrics("requests"),
+		"cs:~metric-test/xenial/nometrics-1": nil,
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		ch := storetesting.NewCharm(nil)
+		if metrics != nil {
+			ch = ch.WithMetrics(metrics)
+		}
+		addCharmForSearch(c, s.store, url, ch, []string{url.URL.User, params.Everyone}, 0)
+	}
+	url := router.MustNewResolvedURL("cs:~metric-test/bundle/requests-1", -1)
+	addBundleForSearch(
+		c,
+		s.store,
+		url,
+		storetesting.NewBundle(searchEntities["wordpress-simple"].bundleData),
+		[]string{url.URL.User, params.Everyone},
+		0,
+	)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	doc, err := s.store.ES.GetSearchDocument(charm.MustParseURL("cs:~metric-test/xenial/web-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.Metrics, jc.DeepEquals, []string{"latency", "requests"})
+	doc, err = s.store.ES.GetSearchDocument(charm.MustParseURL("cs:~metric-test/xenial/nometrics-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(doc.Metrics, gc.HasLen, 0)
+
+	tests := []struct {
+		metrics []string
+		expect  []string
+	}{{
+		metrics: []string{"latency"},
+		expect:  []string{"cs:~metric-test/xenial/web-1"},
+	}, {
+		metrics: []string{"requests"},
+		expect: []string{
+			"cs:~metric-test/xenial/db-1",
+			"cs:~metric-test/xenial/web-1",
+		},
+	}, {
+		metrics: []string{"latency", "requests"},
+		expect: []string{
+			"cs:~metric-test/xenial/db-1",
+			"cs:~metric-test/xenial/web-1",
 		},
+	}, {
+		metrics: []string{"late"},
 	}}
 	for i, test := range tests {
-		c.Logf("test %d. %s", i, test.about)
-		var sp SearchParams
-		err := sp.ParseSortFields(test.sortQuery)
-		c.Assert(err, gc.Equals, nil)
-		res, err := s.store.Search(sp)
+		c.Logf("test %d: %v", i, test.metrics)
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"owner":  {"metric-test"},
+				"metric": test.metrics,
+			},
+			Sort: []SortParam{{Field: "name"}},
+		})
 		c.Assert(err, gc.Equals, nil)
-		expected := make([]*mongodoc.Entity, len(test.results))
-		for i, r := range test.results {
-			expected[i] = r.storedEntity(c, s.store)
+		var urls []string
+		for _, e := range res.Results {
+			urls = append(urls, e.URL.String())
 		}
-		c.Assert(Entities(res.Results), jc.DeepEquals, Entities(expected))
-		c.Assert(res.Total, gc.Equals, len(test.results))
+		c.Assert(urls, jc.DeepEquals, test.expect)
 	}
-}
 
-func (s *StoreSearchSuite) TestBoosting(c *gc.C) {
-	s.store.ES.Database.RefreshIndex(s.TestIndex)
-	var sp SearchParams
-	res, err := s.store.Search(sp)
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(Entities(res.Results), jc.DeepEquals, Entities{
-		searchEntities["squid-forwardproxy"].storedEntity(c, s.store),
-		searchEntities["wordpress-simple"].storedEntity(c, s.store),
-		searchEntities["mysql"].storedEntity(c, s.store),
-		searchEntities["wordpress"].storedEntity(c, s.store),
-		searchEntities["varnish"].storedEntity(c, s.store),
-		searchEntities["cloud-controller-worker-v2"].storedEntity(c, s.store),
+	// Metric names are matched by the search text.
+	res, err := s.store.Search(SearchParams{
+		Text: "latency",
+		Filters: map[string][]string{
+			"owner": {"metric-test"},
+		},
 	})
-}
-
-func (s *StoreSearchSuite) TestEnsureIndex(c *gc.C) {
-	s.store.ES.Index = s.TestIndex + "-ensure-index"
-	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
-	indexes, err := s.ES.ListIndexesForAlias(s.store.ES.Index)
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(indexes, gc.HasLen, 0)
-	err = s.store.ES.ensureIndexes(false)
-	c.Assert(err, gc.Equals, nil)
-	indexes, err = s.ES.ListIndexesForAlias(s.store.ES.Index)
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(indexes, gc.HasLen, 1)
-	index := indexes[0]
-	err = s.store.ES.ensureIndexes(false)
-	c.Assert(err, gc.Equals, nil)
-	indexes, err = s.ES.ListIndexesForAlias(s.store.ES.Index)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(indexes, gc.HasLen, 1)
-	c.Assert(indexes[0], gc.Equals, index)
+	c.Assert(res.Results, gc.HasLen, 1)
+	c.Assert(res.Results[0].URL.String(), gc.Equals, "cs:~metric-test/xenial/web-1")
 }
 
-func (s *StoreSearchSuite) TestEnsureConcurrent(c *gc.C) {
-	s.store.ES.Index = s.TestIndex + "-ensure-index-conc"
-	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
-	indexes, err := s.ES.ListIndexesForAlias(s.store.ES.Index)
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(indexes, gc.HasLen, 0)
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		err := s.store.ES.ensureIndexes(false)
-		c.Check(err, gc.Equals, nil)
-		wg.Done()
-	}()
-	err = s.store.ES.ensureIndexes(false)
-	c.Assert(err, gc.Equals, nil)
-	indexes, err = s.ES.ListIndexesForAlias(s.store.ES.Index)
+func (s *StoreSearchSuite) TestContainsCharmFilter(c *gc.C) {
+	for id, bd := range map[string]*charm.BundleData{
+		"cs:~contains-test/bundle/wordpress-simple-1": searchEntities["wordpress-simple"].bundleData,
+		"cs:~contains-test/bundle/blog-1": {
+			Applications: map[string]*charm.ApplicationSpec{
+				"blog": {
+					Charm: "cs:precise/wordpress-23",
+				},
+				"db": {
+					Charm: "cs:~openstack-charmers/xenial/mysql-7",
+				},
+			},
+		},
+		"cs:~contains-test/bundle/database-1": {
+			Applications: map[string]*charm.ApplicationSpec{
+				"db": {
+					Charm: "mysql",
+				},
+			},
+		},
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addBundleForSearch(c, s.store, url, storetesting.NewBundle(bd), []string{url.URL.User, params.Everyone}, 0)
+	}
+	// A charm named after the charm used by the bundles must not
+	// match.
+	url := router.MustNewResolvedURL("cs:~contains-test/xenial/wordpress-1", -1)
+	addCharmForSearch(c, s.store, url, storetesting.NewCharm(nil), []string{url.URL.User, params.Everyone}, 0)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+
+	doc, err := s.store.ES.GetSearchDocument(charm.MustParseURL("cs:~contains-test/bundle/blog-1"))
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(indexes, gc.HasLen, 1)
-	wg.Wait()
+	c.Assert(doc.BundleCharmNames, jc.DeepEquals, []string{"mysql", "wordpress"})
+
+	tests := []struct {
+		charms []string
+		expect []string
+	}{{
+		charms: []string{"wordpress"},
+		expect: []string{
+			"cs:~contains-test/bundle/blog-1",
+			"cs:~contains-test/bundle/wordpress-simple-1",
+		},
+	}, {
+		charms: []string{"mysql"},
+		expect: []string{
+			"cs:~contains-test/bundle/blog-1",
+			"cs:~contains-test/bundle/database-1",
+		},
+	}, {
+		charms: []string{"wordpress", "mysql"},
+		expect: []string{
+			"cs:~contains-test/bundle/blog-1",
+			"cs:~contains-test/bundle/database-1",
+			"cs:~contains-test/bundle/wordpress-simple-1",
+		},
+	}, {
+		charms: []string{"word"},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %v", i, test.charms)
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"owner":          {"contains-test"},
+				"contains-charm": test.charms,
+			},
+			Sort: []SortParam{{Field: "name"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		var urls []string
+		for _, e := range res.Results {
+			urls = append(urls, e.URL.String())
+		}
+		c.Assert(urls, jc.DeepEquals, test.expect)
+	}
 }
 
-func (s *StoreSearchSuite) TestEnsureIndexForce(c *gc.C) {
-	s.store.ES.Index = s.TestIndex + "-ensure-index-force"
-	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
-	indexes, err := s.ES.ListIndexesForAlias(s.store.ES.Index)
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(indexes, gc.HasLen, 0)
-	err = s.store.ES.ensureIndexes(false)
-	c.Assert(err, gc.Equals, nil)
-	indexes, err = s.ES.ListIndexesForAlias(s.store.ES.Index)
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(indexes, gc.HasLen, 1)
-	index := indexes[0]
-	err = s.store.ES.ensureIndexes(true)
+func (s *StoreSearchSuite) TestOriginFilter(c *gc.C) {
+	var urls []*router.ResolvedURL
+	for _, id := range []string{
+		"cs:~origin-test/xenial/local-1",
+		"cs:~origin-test/xenial/mirrored-1",
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(
+			c,
+			s.store,
+			url,
+			storetesting.NewCharm(nil),
+			[]string{url.URL.User, params.Everyone},
+			0,
+		)
+		urls = append(urls, url)
+	}
+	err := s.store.SetOrigin(urls[1], OriginMirror)
 	c.Assert(err, gc.Equals, nil)
-	indexes, err = s.ES.ListIndexesForAlias(s.store.ES.Index)
+	entity, err := s.store.FindEntity(urls[1], FieldSelector("origin"))
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(indexes, gc.HasLen, 1)
-	c.Assert(indexes[0], gc.Not(gc.Equals), index)
-}
+	c.Assert(entity.Origin, gc.Equals, OriginMirror)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	search := func(origin string) []string {
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"owner":  {"origin-test"},
+				"origin": {origin},
+			},
+		})
+		c.Assert(err, gc.Equals, nil)
+		var ids []string
+		for _, e := range res.Results {
+			ids = append(ids, e.URL.String())
+		}
+		return ids
+	}
+	c.Assert(search(OriginMirror), jc.DeepEquals, []string{"cs:~origin-test/xenial/mirrored-1"})
+	c.Assert(search(OriginNative), jc.DeepEquals, []string{"cs:~origin-test/xenial/local-1"})
 
-func (s *StoreSearchSuite) TestGetCurrentVersionNoVersion(c *gc.C) {
-	s.store.ES.Index = s.TestIndex + "-current-version"
-	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
-	v, dv, err := s.store.ES.getCurrentVersion()
+	// Setting the origin back to native removes it from the mirror results.
+	err = s.store.SetOrigin(urls[1], OriginNative)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(v, gc.Equals, version{})
-	c.Assert(dv, gc.Equals, int64(0))
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(search(OriginMirror), gc.HasLen, 0)
+
+	err = s.store.SetOrigin(urls[1], "elsewhere")
+	c.Assert(err, gc.ErrorMatches, `invalid origin "elsewhere"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
 }
 
-func (s *StoreSearchSuite) TestGetCurrentVersionWithVersion(c *gc.C) {
-	s.store.ES.Index = s.TestIndex + "-current-version"
-	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
-	index, err := s.store.ES.newIndex()
+func (s *StoreSearchSuite) TestDeprecatedEntities(c *gc.C) {
+	var urls []*router.ResolvedURL
+	for _, id := range []string{
+		"cs:~deprecated-test/xenial/current-1",
+		"cs:~deprecated-test/xenial/superseded-1",
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(
+			c,
+			s.store,
+			url,
+			storetesting.NewCharm(nil),
+			[]string{url.URL.User, params.Everyone},
+			0,
+		)
+		urls = append(urls, url)
+	}
+	err := s.store.SetDeprecated(urls[1], true)
 	c.Assert(err, gc.Equals, nil)
-	updated, err := s.store.ES.updateVersion(version{1, index}, 0)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	search := func(includeDeprecated bool) []string {
+		res, err := s.store.Search(SearchParams{
+			Filters: map[string][]string{
+				"owner": {"deprecated-test"},
+			},
+			IncludeDeprecated: includeDeprecated,
+		})
+		c.Assert(err, gc.Equals, nil)
+		var ids []string
+		for _, e := range res.Results {
+			ids = append(ids, e.URL.String())
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	// Deprecated entities are hidden by default.
+	c.Assert(search(false), jc.DeepEquals, []string{"cs:~deprecated-test/xenial/current-1"})
+
+	// They are included when explicitly requested.
+	c.Assert(search(true), jc.DeepEquals, []string{
+		"cs:~deprecated-test/xenial/current-1",
+		"cs:~deprecated-test/xenial/superseded-1",
+	})
+
+	// They can still be resolved by their id.
+	entity, err := s.store.FindEntity(urls[1], FieldSelector("deprecated"))
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(updated, gc.Equals, true)
-	v, dv, err := s.store.ES.getCurrentVersion()
+	c.Assert(entity.Deprecated, gc.Equals, true)
+
+	// Removing the deprecation makes the entity visible again.
+	err = s.store.SetDeprecated(urls[1], false)
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(v, gc.Equals, version{1, index})
-	c.Assert(dv, gc.Equals, int64(1))
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(search(false), gc.HasLen, 2)
 }
 
-func (s *StoreSearchSuite) TestUpdateVersionNew(c *gc.C) {
-	s.store.ES.Index = s.TestIndex + "-update-version"
-	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
-	index, err := s.store.ES.newIndex()
-	c.Assert(err, gc.Equals, nil)
-	updated, err := s.store.ES.updateVersion(version{1, index}, 0)
+func (s *StoreSearchSuite) TestBundleReadMeSearch(c *gc.C) {
+	b := storetesting.NewBundleWithReadMe(
+		searchEntities["wordpress-simple"].bundleData,
+		"A bundle for deploying a frobnicated blog.",
+	)
+	url := router.MustNewResolvedURL("cs:~charmers/bundle/blog-1", -1)
+	addBundleForSearch(
+		c,
+		s.store,
+		url,
+		b,
+		[]string{url.URL.User, params.Everyone},
+		0,
+	)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	res, err := s.store.Search(SearchParams{
+		Text: "frobnicated",
+	})
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(updated, gc.Equals, true)
+	c.Assert(res.Results, gc.HasLen, 1)
+	c.Assert(res.Results[0].URL.String(), gc.Equals, url.String())
 }
 
-func (s *StoreSearchSuite) TestUpdateVersionUpdate(c *gc.C) {
-	s.store.ES.Index = s.TestIndex + "-update-version"
-	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
-	index, err := s.store.ES.newIndex()
-	c.Assert(err, gc.Equals, nil)
-	updated, err := s.store.ES.updateVersion(version{1, index}, 0)
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(updated, gc.Equals, true)
-	index, err = s.store.ES.newIndex()
+func (s *StoreSearchSuite) TestSearchHighlight(c *gc.C) {
+	b := storetesting.NewBundleWithReadMe(
+		searchEntities["wordpress-simple"].bundleData,
+		"A bundle for deploying a frobnicated blog.",
+	)
+	url := router.MustNewResolvedURL("cs:~charmers/bundle/blog-1", -1)
+	addBundleForSearch(c, s.store, url, b, []string{url.URL.User, params.Everyone}, 0)
+	ch := storetesting.NewCharm(&charm.Meta{
+		Summary:     "A frobnicated web server.",
+		Description: "Serves frobnicated pages.",
+	})
+	curl := router.MustNewResolvedURL("cs:~charmers/xenial/frobnicated-1", -1)
+	addCharmForSearch(c, s.store, curl, ch, []string{curl.URL.User, params.Everyone}, 0)
+	privateURL := router.MustNewResolvedURL("cs:~secret/xenial/frobnicated-1", -1)
+	addCharmForSearch(c, s.store, privateURL, storetesting.NewCharm(&charm.Meta{
+		Description: "A secret frobnicated charm.",
+	}), []string{privateURL.URL.User}, 0)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+
+	// Highlighting is off by default.
+	res, err := s.store.Search(SearchParams{
+		Text: "frobnicated",
+		Sort: []SortParam{{Field: "name"}},
+	})
 	c.Assert(err, gc.Equals, nil)
-	updated, err = s.store.ES.updateVersion(version{2, index}, 1)
+	c.Assert(res.Results, gc.HasLen, 2)
+	c.Assert(res.Highlights, gc.IsNil)
+
+	res, err = s.store.Search(SearchParams{
+		Text:      "frobnicated",
+		Sort:      []SortParam{{Field: "name"}},
+		Highlight: true,
+	})
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(updated, gc.Equals, true)
+	c.Assert(res.Results, gc.HasLen, 2)
+	c.Assert(res.Highlights, gc.HasLen, 2)
+	c.Assert(res.Results[0].URL.String(), gc.Equals, url.String())
+	c.Assert(res.Highlights[0], jc.DeepEquals, map[string][]string{
+		"BundleReadMe": {"A bundle for deploying a <em>frobnicated</em> blog."},
+	})
+	c.Assert(res.Results[1].URL.String(), gc.Equals, curl.String())
+	c.Assert(res.Highlights[1], jc.DeepEquals, map[string][]string{
+		"CharmMeta.Summary":     {"A <em>frobnicated</em> web server."},
+		"CharmMeta.Description": {"Serves <em>frobnicated</em> pages."},
+	})
 }
 
-func (s *StoreSearchSuite) TestUpdateCreateConflict(c *gc.C) {
-	s.store.ES.Index = s.TestIndex + "-update-version"
-	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
-	index, err := s.store.ES.newIndex()
-	c.Assert(err, gc.Equals, nil)
-	updated, err := s.store.ES.updateVersion(version{1, index}, 0)
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(updated, gc.Equals, true)
-	index, err = s.store.ES.newIndex()
-	c.Assert(err, gc.Equals, nil)
-	updated, err = s.store.ES.updateVersion(version{1, index}, 0)
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(updated, gc.Equals, false)
+var searchSuggestionsTests = []struct {
+	about             string
+	sp                SearchParams
+	expectTotal       int
+	expectSuggestions []string
+}{{
+	about: "misspelled name",
+	sp: SearchParams{
+		Text:    "wordpres",
+		Suggest: true,
+	},
+	expectSuggestions: []string{"wordpress"},
+}, {
+	about: "misspelled name in upper case",
+	sp: SearchParams{
+		Text:    "WORDPRES",
+		Suggest: true,
+	},
+	expectSuggestions: []string{"wordpress"},
+}, {
+	about: "nonsense",
+	sp: SearchParams{
+		Text:    "xyzzyplugh",
+		Suggest: true,
+	},
+}, {
+	about: "suggestions not requested",
+	sp: SearchParams{
+		Text: "wordpres",
+	},
+}, {
+	about: "no suggestions when there are results",
+	sp: SearchParams{
+		Text:    "wordpress",
+		Suggest: true,
+	},
+	expectTotal: 2,
+}, {
+	about: "name not visible to user",
+	sp: SearchParams{
+		Text:    "riakk",
+		Suggest: true,
+	},
+}, {
+	about: "name visible to group",
+	sp: SearchParams{
+		Text:    "riakk",
+		Suggest: true,
+		Groups:  []string{"charmers"},
+	},
+	expectSuggestions: []string{"riak"},
+}, {
+	about: "name visible to admin",
+	sp: SearchParams{
+		Text:    "riakk",
+		Suggest: true,
+		Admin:   true,
+	},
+	expectSuggestions: []string{"riak"},
+}}
+
+func (s *StoreSearchSuite) TestSearchSuggestions(c *gc.C) {
+	for i, test := range searchSuggestionsTests {
+		c.Logf("test %d: %s", i, test.about)
+		res, err := s.store.Search(test.sp)
+		c.Assert(err, gc.Equals, nil)
+		c.Check(res.Total, gc.Equals, test.expectTotal)
+		c.Check(res.Suggestions, jc.DeepEquals, test.expectSuggestions)
+	}
 }
 
-func (s *StoreSearchSuite) TestUpdateConflict(c *gc.C) {
-	s.store.ES.Index = s.TestIndex + "-update-version"
-	defer s.ES.DeleteDocument(".versions", "version", s.store.ES.Index)
-	index, err := s.store.ES.newIndex()
-	c.Assert(err, gc.Equals, nil)
-	updated, err := s.store.ES.updateVersion(version{1, index}, 0)
-	c.Assert(err, gc.Equals, nil)
-	c.Assert(updated, gc.Equals, true)
-	index, err = s.store.ES.newIndex()
-	c.Assert(err, gc.Equals, nil)
-	updated, err = s.store.ES.updateVersion(version{1, index}, 3)
+func (s *StoreSearchSuite) TestPlatformFilter(c *gc.C) {
+	charms := []struct {
+		id     string
+		series []string
+		archs  []string
+	}{{
+		id:    "cs:~platform-test/bionic/arm-1",
+		archs: []string{"arm64"},
+	}, {
+		id:    "cs:~platform-test/bionic/amd-1",
+		archs: []string{"amd64"},
+	}, {
+		id:    "cs:~platform-test/xenial/xenial-arm-1",
+		archs: []string{"arm64", "amd64"},
+	}, {
+		id:     "cs:~platform-test/multi-1",
+		series: []string{"xenial", "bionic"},
+		archs:  []string{"amd64", "s390x"},
+	}, {
+		id:     "cs:~platform-test/multi-arm-1",
+		series: []string{"xenial", "bionic"},
+		archs:  []string{"ppc64el", "arm64"},
+	}, {
+		id: "cs:~platform-test/bionic/any-1",
+	}}
+	for _, ch := range charms {
+		url := router.MustNewResolvedURL(ch.id, -1)
+		var meta *charm.Meta
+		if len(ch.series) > 0 {
+			meta = &charm.Meta{
+				Series: ch.series,
+			}
+		}
+		addCharmForSearch(
+			c,
+			s.store,
+			url,
+			storetesting.NewCharm(meta).WithExtraMeta(map[string]interface{}{
+				"architectures": ch.archs,
+			}),
+			[]string{url.URL.User, params.Everyone},
+			0,
+		)
+	}
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	res, err := s.store.Search(SearchParams{
+		Filters: map[string][]string{
+			"owner":    {"platform-test"},
+			"platform": {"bionic/arm64"},
+		},
+		Sort: []SortParam{{Field: "name"}},
+	})
 	c.Assert(err, gc.Equals, nil)
-	c.Assert(updated, gc.Equals, false)
+	c.Assert(Entities(res.Results), jc.DeepEquals, Entities{
+		s.entity(c, "cs:~platform-test/bionic/any-1"),
+		s.entity(c, "cs:~platform-test/bionic/arm-1"),
+		s.entity(c, "cs:~platform-test/multi-arm-1"),
+	})
 }
 
-func (s *StoreSearchSuite) TestMultiSeriesCharmFiltersSeriesCorrectly(c *gc.C) {
-	charmArchive := storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, "trusty", "xenial", "utopic", "vivid", "wily", "yakkety"))
-	url := router.MustNewResolvedURL("cs:~charmers/juju-gui-25", -1)
-	addCharmForSearch(
-		c,
-		s.store,
-		url,
-		charmArchive,
-		[]string{url.URL.User, params.Everyone},
-		0,
-	)
+func (s *StoreSearchSuite) TestArchFilter(c *gc.C) {
+	charms := []struct {
+		id    string
+		archs []string
+	}{{
+		id:    "cs:~arch-test/bionic/arm-1",
+		archs: []string{"arm64"},
+	}, {
+		id:    "cs:~arch-test/bionic/amd-1",
+		archs: []string{"amd64"},
+	}, {
+		id:    "cs:~arch-test/bionic/s390x-1",
+		archs: []string{"s390x", "ppc64el"},
+	}, {
+		id: "cs:~arch-test/bionic/any-1",
+	}}
+	for _, ch := range charms {
+		url := router.MustNewResolvedURL(ch.id, -1)
+		addCharmForSearch(
+			c,
+			s.store,
+			url,
+			storetesting.NewCharm(nil).WithExtraMeta(map[string]interface{}{
+				"architectures": ch.archs,
+			}),
+			[]string{url.URL.User, params.Everyone},
+			0,
+		)
+	}
 	s.store.ES.Database.RefreshIndex(s.TestIndex)
-	filterTests := []struct {
-		series   string
-		notFound bool
+	tests := []struct {
+		about  string
+		archs  []string
+		expect []string
 	}{{
-		series: "xenial",
+		about: "single arch",
+		archs: []string{"arm64"},
+		expect: []string{
+			"cs:~arch-test/bionic/any-1",
+			"cs:~arch-test/bionic/arm-1",
+		},
 	}, {
-		series: "vivid",
+		about: "multiple archs",
+		archs: []string{"arm64", "ppc64el"},
+		expect: []string{
+			"cs:~arch-test/bionic/any-1",
+			"cs:~arch-test/bionic/arm-1",
+			"cs:~arch-test/bionic/s390x-1",
+		},
 	}, {
-		series:   "sauch",
-		notFound: true,
+		about: "undeclared arch",
+		archs: []string{"riscv64"},
+		expect: []string{
+			"cs:~arch-test/bionic/any-1",
+		},
 	}}
-	for i, test := range filterTests {
-		c.Logf("%d. %s", i, test.series)
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
 		res, err := s.store.Search(SearchParams{
 			Filters: map[string][]string{
-				"name":   {"juju-gui"},
-				"series": {test.series},
+				"owner": {"arch-test"},
+				"arch":  test.archs,
 			},
+			Sort: []SortParam{{Field: "name"}},
 		})
 		c.Assert(err, gc.Equals, nil)
-		if test.notFound {
-			c.Assert(res.Results, gc.HasLen, 0)
-			continue
+		expect := make(Entities, len(test.expect))
+		for i, id := range test.expect {
+			expect[i] = s.entity(c, id)
 		}
-		c.Assert(res.Results, gc.HasLen, 1)
-		c.Assert(res.Results[0].URL.String(), gc.Equals, url.String())
+		c.Assert(Entities(res.Results), jc.DeepEquals, expect)
 	}
 }
 
-func (s *StoreSearchSuite) TestMultiSeriesCharmSortsSeriesCorrectly(c *gc.C) {
-	charmArchive := storetesting.NewCharm(storetesting.MetaWithSupportedSeries(nil, "trusty", "xenial", "bionic", "utopic", "vivid", "wily", "yakkety"))
-	url := router.MustNewResolvedURL("cs:~charmers/juju-gui-25", -1)
+func (s *StoreSearchSuite) TestDocsSearch(c *gc.C) {
+	url := router.MustNewResolvedURL("cs:~charmers/xenial/documented-1", -1)
 	addCharmForSearch(
 		c,
 		s.store,
 		url,
-		charmArchive,
+		storetesting.NewCharm(nil),
 		[]string{url.URL.User, params.Everyone},
 		0,
 	)
+	err := s.store.SetDocs(url, "Configuring the flux capacitor for time travel.")
+	c.Assert(err, gc.Equals, nil)
+	entity, err := s.store.FindEntity(url, FieldSelector("docs"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Docs, gc.Equals, "Configuring the flux capacitor for time travel.")
 	s.store.ES.Database.RefreshIndex(s.TestIndex)
-	var sp SearchParams
-	sp.ParseSortFields("-series", "owner")
-	res, err := s.store.Search(sp)
+	res, err := s.store.Search(SearchParams{
+		Text: "capacitor",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 1)
+	c.Assert(res.Results[0].URL.String(), gc.Equals, url.String())
+
+	// Removing the docs removes the entity from the results.
+	err = s.store.SetDocs(url, "")
+	c.Assert(err, gc.Equals, nil)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	res, err = s.store.Search(SearchParams{
+		Text: "capacitor",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 0)
+}
+
+func (s *StoreSearchSuite) TestAdminOnlyFilters(c *gc.C) {
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	filters := map[string][]string{
+		"readable-by": {"charmers"},
+	}
+
+	// Admins can use admin-only filters.
+	res, err := s.store.Search(SearchParams{
+		Filters: filters,
+		Admin:   true,
+	})
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(Entities(res.Results), jc.DeepEquals, Entities{
-		s.entity(c, "cs:~charmers/juju-gui-25"),
-		searchEntities["varnish"].storedEntity(c, s.store),
-		searchEntities["mysql"].storedEntity(c, s.store),
-		searchEntities["cloud-controller-worker-v2"].storedEntity(c, s.store),
-		searchEntities["wordpress"].storedEntity(c, s.store),
-		searchEntities["wordpress-simple"].storedEntity(c, s.store),
-		searchEntities["squid-forwardproxy"].storedEntity(c, s.store),
+		searchEntities["riak"].storedEntity(c, s.store),
+	})
+
+	// Other users cannot, even when they are members of
+	// the groups in the filter.
+	_, err = s.store.Search(SearchParams{
+		Filters: filters,
+		Groups:  []string{"charmers"},
+	})
+	c.Assert(err, gc.ErrorMatches, `filter "readable-by" is restricted to administrators`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	_, err = s.store.Search(SearchParams{
+		Exclude: filters,
 	})
+	c.Assert(err, gc.ErrorMatches, `filter "readable-by" is restricted to administrators`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	_, err = s.store.SearchOwners(SearchParams{
+		Filters: filters,
+	})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
 }
 
-func (s *StoreSearchSuite) TestOnlyIndexStableCharms(c *gc.C) {
-	ch := storetesting.NewCharm(&charm.Meta{
-		Name: "test",
+func (s *StoreSearchSuite) TestSearchLimitIsClamped(c *gc.C) {
+	pool, err := NewPool(s.Session.DB("foo"), &s.index, nil, ServerParams{
+		MaxSearchLimit: 2,
 	})
-	id := router.MustNewResolvedURL("~test/xenial/test-0", -1)
-	err := s.store.AddCharmWithArchive(id, ch)
 	c.Assert(err, gc.Equals, nil)
-	err = s.store.SetPerms(&id.URL, "read", "test", params.Everyone)
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+	all, err := s.store.Search(SearchParams{
+		Limit: 100,
+	})
 	c.Assert(err, gc.Equals, nil)
-	err = s.store.SetPerms(&id.URL, "edge.read", "test", params.Everyone)
+	c.Assert(len(all.Results) > 2, gc.Equals, true)
+	res, err := store.Search(SearchParams{
+		Limit: 100,
+	})
 	c.Assert(err, gc.Equals, nil)
-	err = s.store.SetPerms(&id.URL, "stable.read", "test", params.Everyone)
+	c.Assert(res.Results, gc.HasLen, 2)
+	c.Assert(res.Total, gc.Equals, all.Total)
+}
+
+func (s *StoreSearchSuite) TestDefaultMaxSearchLimit(c *gc.C) {
+	c.Assert(s.store.pool.config.MaxSearchLimit, gc.Equals, DefaultMaxSearchLimit)
+}
+
+var searchRetryTests = []struct {
+	about         string
+	retries       int
+	responses     []flakyESResponse
+	expectError   string
+	expectResults bool
+	expectCalls   int
+}{{
+	about: "success after transient error",
+	responses: []flakyESResponse{
+		{http.StatusServiceUnavailable, `{"error":"unavailable","status":503}`},
+		{http.StatusOK, `{"took":1,"hits":{"total":0,"hits":[]}}`},
+	},
+	expectResults: true,
+	expectCalls:   2,
+}, {
+	about: "query errors are not retried",
+	responses: []flakyESResponse{
+		{http.StatusBadRequest, `{"error":"bad query","status":400}`},
+		{http.StatusOK, `{"took":1,"hits":{"total":0,"hits":[]}}`},
+	},
+	expectError: "search failed: bad query",
+	expectCalls: 1,
+}, {
+	about: "retries exhausted",
+	responses: []flakyESResponse{
+		{http.StatusServiceUnavailable, `{"error":"unavailable","status":503}`},
+		{http.StatusServiceUnavailable, `{"error":"still unavailable","status":503}`},
+		{http.StatusServiceUnavailable, `{"error":"unavailable again","status":503}`},
+		{http.StatusOK, `{"took":1,"hits":{"total":0,"hits":[]}}`},
+	},
+	expectError: "search failed: unavailable again",
+	expectCalls: 3,
+}, {
+	about:   "retries disabled",
+	retries: -1,
+	responses: []flakyESResponse{
+		{http.StatusServiceUnavailable, `{"error":"unavailable","status":503}`},
+		{http.StatusOK, `{"took":1,"hits":{"total":0,"hits":[]}}`},
+	},
+	expectError: "search failed: unavailable",
+	expectCalls: 1,
+}}
+
+// flakyESResponse holds a response returned by a flaky
+// elasticsearch server.
+type flakyESResponse struct {
+	status int
+	body   string
+}
+
+func (s *StoreSearchSuite) TestSearchRetry(c *gc.C) {
+	s.PatchValue(&searchRetryDelay, time.Duration(0))
+	for i, test := range searchRetryTests {
+		c.Logf("test %d: %s", i, test.about)
+		calls := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			resp := test.responses[calls]
+			calls++
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(resp.status)
+			w.Write([]byte(resp.body))
+		}))
+		si := &SearchIndex{
+			Database: &elasticsearch.Database{
+				Addr: strings.TrimPrefix(srv.URL, "http://"),
+			},
+			Index: s.TestIndex,
+		}
+		pool, err := NewPool(s.Session.DB("foo"), si, nil, ServerParams{
+			NoIndexes:     true,
+			SearchRetries: test.retries,
+		})
+		c.Assert(err, gc.Equals, nil)
+		// The caller's search index is not changed.
+		c.Assert(si.retries, gc.Equals, 0)
+		store := pool.Store()
+		res, err := store.Search(SearchParams{})
+		store.Close()
+		pool.Close()
+		srv.Close()
+		c.Assert(calls, gc.Equals, test.expectCalls)
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(res.Results, gc.HasLen, 0)
+	}
+}
+
+func (s *StoreSearchSuite) TestSearchRetryReadTimeout(c *gc.C) {
+	s.PatchValue(&searchRetryDelay, time.Duration(0))
+	done := make(chan struct{})
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if calls == 1 {
+			// Stall part way through the response so
+			// that the client times out reading it.
+			w.Write([]byte(`{"took":1,`))
+			w.(http.Flusher).Flush()
+			<-done
+			return
+		}
+		w.Write([]byte(`{"took":1,"hits":{"total":0,"hits":[]}}`))
+	}))
+	defer srv.Close()
+	defer close(done)
+	si := &SearchIndex{
+		Database: &elasticsearch.Database{
+			Addr:    strings.TrimPrefix(srv.URL, "http://"),
+			Timeout: 100 * time.Millisecond,
+		},
+		Index: s.TestIndex,
+	}
+	pool, err := NewPool(s.Session.DB("foo"), si, nil, ServerParams{
+		NoIndexes: true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+	res, err := store.Search(SearchParams{})
 	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 0)
+	c.Assert(calls, gc.Equals, 2)
+}
 
-	var actual json.RawMessage
+func (s *StoreSearchSuite) TestSearchFallback(c *gc.C) {
+	s.PatchValue(&searchRetryDelay, time.Duration(0))
+	// Use a search index on a server that cannot be reached.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	si := &SearchIndex{
+		Database: &elasticsearch.Database{
+			Addr: strings.TrimPrefix(srv.URL, "http://"),
+		},
+		Index: s.TestIndex,
+	}
+	pool, err := NewPool(s.Session.DB("foo"), si, nil, ServerParams{
+		NoIndexes:      true,
+		SearchFallback: true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
 
-	err = s.store.UpdateSearch(id)
+	// Filter-only searches are answered from the database.
+	res, err := store.Search(SearchParams{
+		Filters: map[string][]string{"name": {"wordpress"}},
+	})
 	c.Assert(err, gc.Equals, nil)
-	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(&id.URL), &actual)
-	c.Assert(err, gc.ErrorMatches, "elasticsearch document not found")
+	c.Assert(res.Total, gc.Equals, 1)
+	c.Assert(res.Results, gc.HasLen, 1)
+	c.Assert(res.Scores, gc.HasLen, 1)
+	c.Assert(res.Results[0].URL.String(), gc.Equals, "cs:~charmers/precise/wordpress-23")
+	c.Assert(res.Results[0].PromulgatedURL.String(), gc.Equals, "cs:precise/wordpress-23")
 
-	err = s.store.Publish(id, nil, params.EdgeChannel)
+	res, err = store.Search(SearchParams{
+		Filters: map[string][]string{
+			"owner":  {"openstack-charmers", "foo"},
+			"series": {"xenial"},
+		},
+	})
 	c.Assert(err, gc.Equals, nil)
-	err = s.store.UpdateSearch(id)
+	c.Assert(res.Results, gc.HasLen, 2)
+	c.Assert(res.Results[0].URL.String(), gc.Equals, "cs:~foo/xenial/varnish-1")
+	c.Assert(res.Results[1].URL.String(), gc.Equals, "cs:~openstack-charmers/xenial/mysql-7")
+
+	// An empty owner matches only promulgated charms and bundles.
+	res, err = store.Search(SearchParams{
+		Filters: map[string][]string{
+			"owner":  {""},
+			"series": {"xenial"},
+		},
+	})
 	c.Assert(err, gc.Equals, nil)
-	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(&id.URL), &actual)
-	c.Assert(err, gc.ErrorMatches, "elasticsearch document not found")
+	c.Assert(res.Results, gc.HasLen, 1)
+	c.Assert(res.Results[0].URL.String(), gc.Equals, "cs:~openstack-charmers/xenial/mysql-7")
+	c.Assert(res.Results[0].PromulgatedURL.String(), gc.Equals, "cs:xenial/mysql-7")
 
-	err = s.store.Publish(id, nil, params.StableChannel)
+	// The ACLs are still respected.
+	res, err = store.Search(SearchParams{
+		Filters: map[string][]string{"name": {"riak"}},
+	})
 	c.Assert(err, gc.Equals, nil)
-	err = s.store.UpdateSearch(id)
+	c.Assert(res.Results, gc.HasLen, 0)
+	res, err = store.Search(SearchParams{
+		Filters: map[string][]string{"name": {"riak"}},
+		Groups:  []string{"charmers"},
+	})
 	c.Assert(err, gc.Equals, nil)
-	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(&id.URL), &actual)
+	c.Assert(res.Results, gc.HasLen, 1)
+
+	// Text searches cannot be answered from the database.
+	_, err = store.Search(SearchParams{
+		Text: "wordpress",
+	})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrServiceUnavailable)
+	c.Assert(err, gc.ErrorMatches, "search index unavailable: .*")
+
+	// Without the fallback, all searches fail.
+	nofallbackPool, err := NewPool(s.Session.DB("foo"), si, nil, ServerParams{
+		NoIndexes: true,
+	})
 	c.Assert(err, gc.Equals, nil)
+	defer nofallbackPool.Close()
+	nofallbackStore := nofallbackPool.Store()
+	defer nofallbackStore.Close()
+	_, err = nofallbackStore.Search(SearchParams{
+		Filters: map[string][]string{"name": {"wordpress"}},
+	})
+	c.Assert(err, gc.ErrorMatches, "search failed: .*")
+	c.Assert(errgo.Cause(err), gc.Not(gc.Equals), params.ErrServiceUnavailable)
 
-	entity, err := s.store.FindEntity(id, nil)
+	// Errors returned by a reachable search index, such as a
+	// missing index, are not answered from the database.
+	reachablePool, err := NewPool(s.Session.DB("foo"), &s.index, nil, ServerParams{
+		NoIndexes:      true,
+		SearchFallback: true,
+	})
 	c.Assert(err, gc.Equals, nil)
-	doc := SearchDoc{
-		Entity:       entity,
-		ReadACLs:     []string{"test", params.Everyone},
-		Series:       []string{"xenial"},
-		AllSeries:    true,
-		SingleSeries: true,
+	defer reachablePool.Close()
+	reachableStore := reachablePool.Store()
+	defer reachableStore.Close()
+	err = s.ES.DeleteIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	_, err = reachableStore.Search(SearchParams{
+		Filters: map[string][]string{"name": {"wordpress"}},
+	})
+	c.Assert(err, gc.ErrorMatches, "search failed: .*")
+	c.Assert(errgo.Cause(err), gc.Not(gc.Equals), params.ErrServiceUnavailable)
+}
+
+func (s *StoreSearchSuite) TestIgnoreAdminOnlyFilters(c *gc.C) {
+	pool, err := NewPool(s.Session.DB("foo"), &s.index, nil, ServerParams{
+		IgnoreAdminOnlyFilters: true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+	for _, id := range []string{
+		"cs:~bob/xenial/public-1",
+		"cs:~bob/xenial/other-1",
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(c, store, url, storetesting.NewCharm(nil), []string{url.URL.User, params.Everyone}, 0)
 	}
-	c.Assert(string(actual), jc.JSONEquals, doc)
+	store.ES.Database.RefreshIndex(s.TestIndex)
+	filters := map[string][]string{
+		"owner":       {"bob"},
+		"readable-by": {"nobody"},
+	}
+
+	// The admin-only filter is ignored for other users.
+	res, err := store.Search(SearchParams{
+		Filters: filters,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 2)
+	c.Assert(filters, gc.HasLen, 2)
+
+	// The admin-only filter is still used for admins.
+	res, err = store.Search(SearchParams{
+		Filters: filters,
+		Admin:   true,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 0)
+}
+
+func (s *StoreSearchSuite) TestDeprecatedSeries(c *gc.C) {
+	pool, err := NewPool(s.Session.DB("foo"), &s.index, nil, ServerParams{
+		DeprecatedSeries: []string{"precise", "trusty"},
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer pool.Close()
+	store := pool.Store()
+	defer store.Close()
+	for _, id := range []string{
+		"cs:~bob/precise/oldie-1",
+		"cs:~bob/bionic/newbie-1",
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(c, store, url, storetesting.NewCharm(nil), []string{url.URL.User, params.Everyone}, 0)
+	}
+	url := router.MustNewResolvedURL("cs:~bob/mixie-1", -1)
+	ch := storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise", "bionic"},
+	})
+	addCharmForSearch(c, store, url, ch, []string{url.URL.User, params.Everyone}, 0)
+	store.ES.Database.RefreshIndex(s.TestIndex)
+	res, err := store.Search(SearchParams{
+		Filters: map[string][]string{
+			"owner": {"bob"},
+		},
+		Sort: []SortParam{{Field: "name"}},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 3)
+	deprecated := make(map[string]bool)
+	for _, e := range res.Results {
+		deprecated[e.URL.String()] = store.HasOnlyDeprecatedSeries(e)
+	}
+	c.Assert(deprecated, jc.DeepEquals, map[string]bool{
+		"cs:~bob/mixie-1":         false,
+		"cs:~bob/bionic/newbie-1": false,
+		"cs:~bob/precise/oldie-1": true,
+	})
+}
+
+func (s *StoreSearchSuite) TestSearchOwners(c *gc.C) {
+	for _, id := range []string{
+		"cs:~bob/trusty/wordpress-1",
+		"cs:~bob/xenial/wordpress-nginx-1",
+		"cs:~bob/xenial/wordpress-mysql-1",
+		"cs:~alice/trusty/wordpress-1",
+		"cs:~alice/trusty/mysql-1",
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(
+			c,
+			s.store,
+			url,
+			storetesting.NewCharm(nil),
+			[]string{url.URL.User, params.Everyone},
+			0,
+		)
+	}
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	owners, err := s.store.SearchOwners(SearchParams{
+		Text: "wordpress",
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(owners, jc.DeepEquals, []OwnerCount{{
+		Owner: "bob",
+		Count: 3,
+	}, {
+		Owner: "charmers",
+		Count: 2,
+	}, {
+		Owner: "alice",
+		Count: 1,
+	}})
+
+	owners, err = s.store.SearchOwners(SearchParams{
+		Text:  "wordpress",
+		Limit: 1,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(owners, jc.DeepEquals, []OwnerCount{{
+		Owner: "bob",
+		Count: 3,
+	}})
+}
+
+func (s *StoreSearchSuite) TestSearchOwnersPagination(c *gc.C) {
+	for _, id := range []string{
+		"cs:~bob/trusty/wordpress-1",
+		"cs:~alice/trusty/wordpress-1",
+		"cs:~carol/trusty/wordpress-1",
+		"cs:~dave/trusty/wordpress-1",
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(
+			c,
+			s.store,
+			url,
+			storetesting.NewCharm(nil),
+			[]string{url.URL.User, params.Everyone},
+			0,
+		)
+	}
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	all, err := s.store.SearchOwners(SearchParams{
+		Text:  "wordpress",
+		Limit: 100,
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(all, gc.HasLen, 5)
+	var paged []OwnerCount
+	for skip := 0; ; skip += 2 {
+		owners, err := s.store.SearchOwners(SearchParams{
+			Text:  "wordpress",
+			Limit: 2,
+			Skip:  skip,
+		})
+		c.Assert(err, gc.Equals, nil)
+		if len(owners) == 0 {
+			break
+		}
+		c.Assert(len(owners) <= 2, gc.Equals, true)
+		paged = append(paged, owners...)
+	}
+	c.Assert(paged, jc.DeepEquals, all)
+}
+
+func (s *StoreSearchSuite) TestSearchFacetPages(c *gc.C) {
+	for _, id := range []string{
+		"cs:~bob/trusty/wordpress-1",
+		"cs:~alice/trusty/wordpress-1",
+		"cs:~carol/trusty/wordpress-1",
+		"cs:~dave/trusty/wordpress-1",
+	} {
+		url := router.MustNewResolvedURL(id, -1)
+		addCharmForSearch(
+			c,
+			s.store,
+			url,
+			storetesting.NewCharm(nil),
+			[]string{url.URL.User, params.Everyone},
+			0,
+		)
+	}
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	all, err := s.store.Search(SearchParams{
+		Facets: []string{"owner"},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(len(all.Facets["owner"]), jc.GreaterThan, 4)
+
+	// Paging through the owner facet returns disjoint pages
+	// that together cover all the owners.
+	var paged []FacetCount
+	seen := make(map[string]bool)
+	for skip := 0; ; skip += 2 {
+		c.Assert(skip, jc.LessThan, 100)
+		res, err := s.store.Search(SearchParams{
+			Facets: []string{"owner"},
+			FacetPages: map[string]FacetPage{
+				"owner": {Skip: skip, Limit: 2},
+			},
+		})
+		c.Assert(err, gc.Equals, nil)
+		owners := res.Facets["owner"]
+		if len(owners) == 0 {
+			break
+		}
+		c.Assert(len(owners) <= 2, gc.Equals, true)
+		for _, o := range owners {
+			c.Assert(seen[o.Value], gc.Equals, false, gc.Commentf("owner %q in more than one page", o.Value))
+			seen[o.Value] = true
+		}
+		paged = append(paged, owners...)
+	}
+	c.Assert(paged, jc.DeepEquals, all.Facets["owner"])
+}
+
+func (s *StoreSearchSuite) TestRevisionCountFilter(c *gc.C) {
+	for i := 0; i < 3; i++ {
+		url := router.MustNewResolvedURL(fmt.Sprintf("cs:~charmers/xenial/churn-%d", i), -1)
+		addCharmForSearch(
+			c,
+			s.store,
+			url,
+			storetesting.NewCharm(nil),
+			[]string{url.URL.User, params.Everyone},
+			0,
+		)
+	}
+	baseEntity, err := s.store.FindBaseEntity(charm.MustParseURL("cs:~charmers/churn"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.RevisionCount, gc.Equals, 3)
+	s.store.ES.Database.RefreshIndex(s.TestIndex)
+	res, err := s.store.Search(SearchParams{
+		Filters: map[string][]string{
+			"revision-count": {">=3"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 1)
+	c.Assert(res.Results[0].URL.String(), gc.Equals, "cs:~charmers/xenial/churn-2")
+	res, err = s.store.Search(SearchParams{
+		Filters: map[string][]string{
+			"revision-count": {"1"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 6)
 }
 
 // addCharmForSearch adds a charm to the specified store such that it
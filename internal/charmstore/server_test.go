@@ -165,7 +165,7 @@ func (s *ServerSuite) TestNewServerWithElasticSearch(c *gc.C) {
 	}
 	h, err := NewServer(
 		s.Session.DB("foo"),
-		&SearchIndex{s.ES, s.TestIndex},
+		&SearchIndex{Database: s.ES, Index: s.TestIndex},
 		params,
 		map[string]NewAPIHandlerFunc{
 			"version1": serveConfig,
@@ -42,6 +42,7 @@ const StatsGranularity = time.Minute
 //
 //     juju.stat.counters - Counters for statistics
 //     juju.stat.tokens   - Tokens used in statistics counter keys
+//     juju.stat.totals   - Running totals too expensive to aggregate
 
 func (s StoreDatabase) StatCounters() *mgo.Collection {
 	return s.C("juju.stat.counters")
@@ -51,6 +52,21 @@ func (s StoreDatabase) StatTokens() *mgo.Collection {
 	return s.C("juju.stat.tokens")
 }
 
+func (s StoreDatabase) StatTotals() *mgo.Collection {
+	return s.C("juju.stat.totals")
+}
+
+// archiveDownloadTotalId holds the id of the document in the
+// StatTotals collection that holds the total number of archive
+// downloads of all charms and bundles.
+const archiveDownloadTotalId = "archive-download"
+
+// statTotal holds a document in the StatTotals collection.
+type statTotal struct {
+	Id    string `bson:"_id"`
+	Count int64  `bson:"c"`
+}
+
 // key returns the compound statistics identifier that represents key.
 // If write is true, the identifier will be created if necessary.
 // Identifiers have a form similar to "ab:c:def:", where each section is a
@@ -197,6 +213,47 @@ func (s *Store) IncCounterAtTime(key []string, t time.Time) error {
 	return err
 }
 
+// moveCounters moves the values of all the counters with keys that
+// start with oldPrefix to the counters with the same keys but starting
+// with newPrefix instead. If a counter with the new key already exists,
+// the old value is added to it.
+func (s *Store) moveCounters(oldPrefix, newPrefix []string) error {
+	oldKey, err := s.stats.key(s.DB, oldPrefix, false)
+	if errgo.Cause(err) == params.ErrNotFound {
+		// No counters have ever been recorded with the prefix.
+		return nil
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	newKey, err := s.stats.key(s.DB, newPrefix, true)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	counters := s.DB.StatCounters()
+	iter := counters.Find(bson.D{{"k", bson.D{{"$regex", "^" + oldKey}}}}).Iter()
+	var counter struct {
+		Key   string `bson:"k"`
+		Time  int32  `bson:"t"`
+		Count int64  `bson:"c"`
+	}
+	for iter.Next(&counter) {
+		key := newKey + strings.TrimPrefix(counter.Key, oldKey)
+		if _, err := counters.Upsert(bson.D{{"k", key}, {"t", counter.Time}}, bson.D{{"$inc", bson.D{{"c", counter.Count}}}}); err != nil {
+			iter.Close()
+			return errgo.Notef(err, "cannot update stats counter")
+		}
+		if err := counters.Remove(bson.D{{"k", counter.Key}, {"t", counter.Time}}); err != nil {
+			iter.Close()
+			return errgo.Notef(err, "cannot remove stats counter")
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot iterate over stats counters")
+	}
+	return nil
+}
+
 // CounterRequest represents a request to aggregate counter values.
 type CounterRequest struct {
 	// Key and Prefix determine the counter keys to match.
@@ -556,6 +613,54 @@ func (s *Store) aggregateStats(key []string, prefix bool) (AggregatedCounts, err
 	return counts, nil
 }
 
+// StatsArchiveDownloadSeries holds the stats kind used to record
+// archive downloads broken down by the series that the entity was
+// resolved to at download time.
+const StatsArchiveDownloadSeries = "archive-download-series"
+
+// seriesStatsKeyPrefix returns the prefix of the keys used to record
+// per-series downloads of the given entity. Keys are generated using
+// the following schema:
+//   archive-download-series:name:user:revision:series
+// so that all the series downloaded for a single revision can be
+// retrieved by listing the keys under the revision prefix.
+func seriesStatsKeyPrefix(url *charm.URL) []string {
+	return []string{StatsArchiveDownloadSeries, url.Name, url.User, strconv.Itoa(url.Revision)}
+}
+
+// downloadSeries returns the series that the given id was resolved to.
+// For multi-series entities this is the preferred series requested by
+// the client, if any.
+func downloadSeries(id *router.ResolvedURL) string {
+	if id.PreferredSeries != "" {
+		return id.PreferredSeries
+	}
+	return id.URL.Series
+}
+
+// ArchiveDownloadCountsBySeries returns the number of downloads of the
+// entity with the given id, keyed by the series that was resolved when
+// the archive was downloaded. Downloads of multi-series entities that
+// did not specify a series are recorded under the empty series.
+func (s *Store) ArchiveDownloadCountsBySeries(id *charm.URL) (map[string]int64, error) {
+	counters, err := s.Counters(&CounterRequest{
+		Key:    seriesStatsKeyPrefix(id),
+		Prefix: true,
+		List:   true,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get per-series download counts for %q", id)
+	}
+	counts := make(map[string]int64)
+	for _, c := range counters {
+		if len(c.Key) == 0 {
+			continue
+		}
+		counts[c.Key[len(c.Key)-1]] += c.Count
+	}
+	return counts, nil
+}
+
 // IncrementDownloadCountsAsync updates the download statistics for entity id in both
 // the statistics database and the search database. The action is done in the
 // background using a separate goroutine.
@@ -580,6 +685,13 @@ func (s *Store) IncrementDownloadCountsAtTime(id *router.ResolvedURL, t time.Tim
 	if err := s.IncCounterAtTime(key, t); err != nil {
 		return errgo.Notef(err, "cannot increase stats counter for %v", key)
 	}
+	if _, err := s.DB.StatTotals().UpsertId(archiveDownloadTotalId, bson.D{{"$inc", bson.D{{"c", 1}}}}); err != nil {
+		return errgo.Notef(err, "cannot increase total download count")
+	}
+	key = append(seriesStatsKeyPrefix(&id.URL), downloadSeries(id))
+	if err := s.IncCounterAtTime(key, t); err != nil {
+		return errgo.Notef(err, "cannot increase stats counter for %v", key)
+	}
 	if id.PromulgatedRevision == -1 {
 		// Check that the id really is for an unpromulgated entity.
 		// This unfortunately adds an extra round trip to the database,
@@ -604,3 +716,108 @@ func (s *Store) IncrementDownloadCountsAtTime(id *router.ResolvedURL, t time.Tim
 	}
 	return nil
 }
+
+// countsCacheMaxAge holds the length of time for which the results
+// of Store.Counts are cached.
+const countsCacheMaxAge = time.Minute
+
+// StoreCounts holds aggregate counts of the charms and bundles in the
+// store.
+type StoreCounts struct {
+	// Charms holds the number of charms. All the revisions of a
+	// charm are counted once.
+	Charms int
+
+	// Bundles holds the number of bundles. All the revisions of a
+	// bundle are counted once.
+	Bundles int
+
+	// Promulgated holds the number of promulgated charms and
+	// bundles.
+	Promulgated int
+
+	// Downloads holds the total number of archive downloads of all
+	// charms and bundles. It is not restricted by channel.
+	Downloads int64
+}
+
+// Counts returns aggregate counts of the charms and bundles in the
+// store. If all is false, only charms and bundles with a current
+// revision in the stable channel are counted, otherwise all charms and
+// bundles are counted. The results are cached for a short time, so
+// they may not reflect very recent changes.
+func (s *Store) Counts(all bool) (StoreCounts, error) {
+	v, err := s.pool.countsCache.Get(strconv.FormatBool(all), func() (interface{}, error) {
+		return s.counts(all)
+	})
+	if err != nil {
+		return StoreCounts{}, errgo.Mask(err)
+	}
+	return v.(StoreCounts), nil
+}
+
+// counts is the uncached version of Counts.
+func (s *Store) counts(all bool) (StoreCounts, error) {
+	// Count base entities rather than entities so that each charm
+	// or bundle is counted once however many revisions it has.
+	stable := "channelentities." + string(params.StableChannel)
+	query := func(elems ...bson.DocElem) bson.D {
+		var q bson.D
+		if !all {
+			q = append(q, bson.DocElem{stable, bson.D{{"$exists", true}, {"$ne", bson.D{}}}})
+		}
+		return append(q, elems...)
+	}
+	total, err := s.DB.BaseEntities().Find(query()).Count()
+	if err != nil {
+		return StoreCounts{}, errgo.Notef(err, "cannot count charms and bundles")
+	}
+	promulgated, err := s.DB.BaseEntities().Find(query(bson.DocElem{"promulgated", 1})).Count()
+	if err != nil {
+		return StoreCounts{}, errgo.Notef(err, "cannot count promulgated charms and bundles")
+	}
+	bundles, err := s.countBundles(all)
+	if err != nil {
+		return StoreCounts{}, errgo.Mask(err)
+	}
+	var downloads statTotal
+	err = s.DB.StatTotals().FindId(archiveDownloadTotalId).One(&downloads)
+	if err != nil && err != mgo.ErrNotFound {
+		return StoreCounts{}, errgo.Notef(err, "cannot count downloads")
+	}
+	return StoreCounts{
+		Charms:      total - bundles,
+		Bundles:     bundles,
+		Promulgated: promulgated,
+		Downloads:   downloads.Count,
+	}, nil
+}
+
+// countBundles returns the number of bundles in the store. If all is
+// false, only bundles with a current revision in the stable channel
+// are counted.
+func (s *Store) countBundles(all bool) (int, error) {
+	if !all {
+		n, err := s.DB.BaseEntities().Find(bson.D{{
+			"channelentities." + string(params.StableChannel) + ".bundle", bson.D{{"$exists", true}},
+		}}).Count()
+		if err != nil {
+			return 0, errgo.Notef(err, "cannot count bundles")
+		}
+		return n, nil
+	}
+	// Unpublished base entities do not record their series, so
+	// count the distinct base URLs of the bundle entities.
+	var result struct {
+		Count int `bson:"count"`
+	}
+	err := s.DB.Entities().Pipe([]bson.D{
+		{{"$match", bson.D{{"series", "bundle"}}}},
+		{{"$group", bson.D{{"_id", "$baseurl"}}}},
+		{{"$group", bson.D{{"_id", nil}, {"count", bson.D{{"$sum", 1}}}}}},
+	}).One(&result)
+	if err != nil && err != mgo.ErrNotFound {
+		return 0, errgo.Notef(err, "cannot count bundles")
+	}
+	return result.Count, nil
+}
@@ -673,6 +673,34 @@ func (s *StatsSuite) TestIncrementDownloadCountsOnIdWithPreferredSeries(c *gc.C)
 	c.Assert(allRevisions, jc.DeepEquals, expect)
 }
 
+func (s *StatsSuite) TestArchiveDownloadCountsBySeries(c *gc.C) {
+	ch := storetesting.Charms.CharmDir("multi-series")
+	id := charmstore.MustParseResolvedURL("~charmers/wordpress-1")
+	err := s.store.AddCharmWithArchive(id, ch)
+	c.Assert(err, gc.Equals, nil)
+	for i, series := range []string{"trusty", "utopic", "trusty"} {
+		id := charmstore.MustParseResolvedURL("~charmers/wordpress-1")
+		id.PreferredSeries = series
+		err = s.store.IncrementDownloadCounts(id)
+		c.Assert(err, gc.Equals, nil, gc.Commentf("download %d", i))
+	}
+	counts, err := s.store.ArchiveDownloadCountsBySeries(charm.MustParseURL("~charmers/wordpress-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(counts, jc.DeepEquals, map[string]int64{
+		"trusty": 2,
+		"utopic": 1,
+	})
+	thisRevision, _, err := s.store.ArchiveDownloadCounts(charm.MustParseURL("~charmers/wordpress-1"), true)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(thisRevision.Total, gc.Equals, counts["trusty"]+counts["utopic"])
+}
+
+func (s *StatsSuite) TestArchiveDownloadCountsBySeriesNoDownloads(c *gc.C) {
+	counts, err := s.store.ArchiveDownloadCountsBySeries(charm.MustParseURL("~charmers/trusty/wordpress-1"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(counts, jc.DeepEquals, map[string]int64{})
+}
+
 func (s *StatsSuite) TestIncrementDownloadCountsCaching(c *gc.C) {
 	ch := storetesting.Charms.CharmDir("wordpress")
 	id := charmstore.MustParseResolvedURL("0 ~charmers/trusty/wordpress-1")
@@ -706,3 +734,73 @@ func (s *StatsSuite) TestIncrementDownloadCountsCaching(c *gc.C) {
 	c.Assert(thisRevision, jc.DeepEquals, expectAfter)
 	c.Assert(allRevisions, jc.DeepEquals, expectAfter)
 }
+
+func (s *StatsSuite) TestCounts(c *gc.C) {
+	for _, add := range []struct {
+		id        string
+		channels  []params.Channel
+		downloads int
+	}{
+		{"0 ~charmers/trusty/wordpress-1", []params.Channel{params.StableChannel}, 2},
+		{"~charmers/trusty/mysql-1", []params.Channel{params.StableChannel}, 0},
+		{"~charmers/trusty/mysql-2", []params.Channel{params.StableChannel, params.EdgeChannel}, 1},
+		{"~charmers/trusty/mysql-3", []params.Channel{params.EdgeChannel}, 0},
+		{"~bob/trusty/wordpress-0", nil, 0},
+	} {
+		id := charmstore.MustParseResolvedURL(add.id)
+		err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		if len(add.channels) > 0 {
+			err = s.store.Publish(id, nil, add.channels...)
+			c.Assert(err, gc.Equals, nil)
+		}
+		for i := 0; i < add.downloads; i++ {
+			err = s.store.IncrementDownloadCounts(id)
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
+	id := charmstore.MustParseResolvedURL("~charmers/bundle/wordpress-simple-1")
+	err := s.store.AddBundleWithArchive(id, storetesting.NewBundle(&charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"wordpress": {
+				Charm: "cs:~charmers/trusty/wordpress-1",
+			},
+		},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	counts, err := s.store.Counts(false)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(counts, jc.DeepEquals, charmstore.StoreCounts{
+		Charms:      2,
+		Bundles:     1,
+		Promulgated: 1,
+		Downloads:   3,
+	})
+	counts, err = s.store.Counts(true)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(counts, jc.DeepEquals, charmstore.StoreCounts{
+		Charms:      3,
+		Bundles:     1,
+		Promulgated: 1,
+		Downloads:   3,
+	})
+
+	// Check that the results are cached.
+	id = charmstore.MustParseResolvedURL("~charmers/trusty/postgresql-1")
+	err = s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	counts, err = s.store.Counts(false)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(counts.Charms, gc.Equals, 2)
+}
+
+func (s *StatsSuite) TestCountsEmpty(c *gc.C) {
+	counts, err := s.store.Counts(false)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(counts, jc.DeepEquals, charmstore.StoreCounts{})
+}
@@ -4,6 +4,7 @@
 package charmstore // import "gopkg.in/juju/charmstore.v5/internal/charmstore"
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -24,6 +25,7 @@ import (
 	"gopkg.in/natefinch/lumberjack.v2"
 
 	"gopkg.in/juju/charmstore.v5/audit"
+	"gopkg.in/juju/charmstore.v5/elasticsearch"
 	"gopkg.in/juju/charmstore.v5/internal/blobstore"
 	"gopkg.in/juju/charmstore.v5/internal/cache"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
@@ -34,8 +36,9 @@ import (
 var logger = loggo.GetLogger("charmstore.internal.charmstore")
 
 var (
-	errClosed          = errgo.New("charm store has been closed")
-	ErrTooManySessions = errgo.New("too many mongo sessions in use")
+	errClosed           = errgo.New("charm store has been closed")
+	ErrTooManySessions  = errgo.New("too many mongo sessions in use")
+	ErrReindexCancelled = errgo.New("reindex cancelled")
 )
 
 // Pool holds a connection to the underlying charm and blob
@@ -55,6 +58,14 @@ type Pool struct {
 	// entity.
 	statsCache *cache.Cache
 
+	// countsCache holds a cache of StoreCounts values,
+	// keyed by whether they include unpublished entities.
+	countsCache *cache.Cache
+
+	// groupsCache holds a cache of the groups that users
+	// are members of, keyed by user name.
+	groupsCache *cache.Cache
+
 	config ServerParams
 
 	// auditEncoder encodes messages to auditLogger.
@@ -74,10 +85,25 @@ type Pool struct {
 	// closed holds whether the handler has been closed.
 	closed bool
 
+	// reindexCancel holds a channel that will be closed
+	// by CancelReindex to stop the reindex in progress.
+	// It is nil when no reindex is in progress.
+	reindexCancel chan struct{}
+
+	// reindexProgress holds the progress of the current or
+	// most recent population of the search index.
+	reindexProgress ReindexProgress
+
 	// rootKeys holds the cache of macaroon root keys.
 	rootKeys *mgostorage.RootKeys
 }
 
+// DefaultGroupsCacheMaxAge holds the length of time for which the
+// groups of a user are cached when ServerParams.GroupsCacheMaxAge
+// is not set. It is kept short so that removing a user from a group
+// takes effect quickly.
+const DefaultGroupsCacheMaxAge = time.Minute
+
 // reqStoreCacheSize holds the maximum number of store
 // instances to keep around cached when there is no
 // limit specified by config.MaxMgoSessions.
@@ -98,6 +124,30 @@ func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceP
 	if config.StatsCacheMaxAge == 0 {
 		config.StatsCacheMaxAge = time.Hour
 	}
+	if config.GroupsCacheMaxAge == 0 {
+		config.GroupsCacheMaxAge = DefaultGroupsCacheMaxAge
+	}
+	if config.MaxSearchLimit == 0 {
+		config.MaxSearchLimit = DefaultMaxSearchLimit
+	}
+	if config.SearchRetries == 0 {
+		config.SearchRetries = DefaultSearchRetries
+	}
+	if si != nil {
+		// Use a copy so that the caller's search index is left
+		// unchanged.
+		si1 := *si
+		si1.retries = config.SearchRetries
+		si = &si1
+	}
+	if len(config.ResolveChannels) == 0 {
+		config.ResolveChannels = DefaultResolveChannels
+	}
+	for _, ch := range config.ResolveChannels {
+		if !params.ValidChannels[ch] || ch == params.UnpublishedChannel {
+			return nil, errgo.Newf("invalid resolve channel %q", ch)
+		}
+	}
 	if config.NewBlobBackend == nil {
 		config.NewBlobBackend = func(db *mgo.Database) blobstore.Backend {
 			return blobstore.NewMongoBackend(db, "entitystore")
@@ -108,6 +158,8 @@ func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceP
 		db:          StoreDatabase{db}.copy(),
 		es:          si,
 		statsCache:  cache.New(config.StatsCacheMaxAge),
+		countsCache: cache.New(countsCacheMaxAge),
+		groupsCache: cache.New(config.GroupsCacheMaxAge),
 		config:      config,
 		run:         parallel.NewRun(maxAsyncGoroutines),
 		auditLogger: config.AuditLogger,
@@ -345,6 +397,26 @@ func (s *Store) Pool() *Pool {
 	return s.pool
 }
 
+// UserGroups returns the groups that the user with the given name is
+// a member of. The groups are obtained by calling fetch, which will
+// usually ask the identity service, unless they have already been
+// fetched within the configured GroupsCacheMaxAge.
+func (s *Store) UserGroups(username string, fetch func() ([]string, error)) ([]string, error) {
+	v, err := s.pool.groupsCache.Get(username, func() (interface{}, error) {
+		return fetch()
+	})
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return v.([]string), nil
+}
+
+// InvalidateUserGroups removes any cached groups for the user with the
+// given name, so that they will be fetched again on next use.
+func (s *Store) InvalidateUserGroups(username string) {
+	s.pool.groupsCache.Evict(username)
+}
+
 func (s *Store) ensureIndexes() error {
 	indexes := []struct {
 		c *mgo.Collection
@@ -382,6 +454,9 @@ func (s *Store) ensureIndexes() error {
 	}, {
 		s.DB.Entities(),
 		mgo.Index{Key: []string{"blobhash256"}},
+	}, {
+		s.DB.Entities(),
+		mgo.Index{Key: []string{"blobhash"}},
 	}, {
 		s.DB.Entities(),
 		mgo.Index{Key: []string{"_id", "name"}},
@@ -433,6 +508,37 @@ func (s *Store) ensureIndexes() error {
 // deleting all blobs that have not been referenced since
 // the given time.
 func (s *Store) BlobStoreGC(before time.Time) error {
+	_, err := s.blobStoreGC(before)
+	return errgo.Mask(err)
+}
+
+// GCBlobsResult holds the result of a GCBlobs call.
+type GCBlobsResult struct {
+	// Count holds the number of blobs removed.
+	Count int
+
+	// Size holds the total size in bytes of the blobs removed.
+	Size int64
+}
+
+// GCBlobs removes all the blobs in the blob store that are not
+// referenced by any entity or resource and have not been put
+// within the given grace period. The grace period makes it safe
+// to run concurrently with ingestion, which puts a blob before
+// adding the entity that refers to it.
+func (s *Store) GCBlobs(gracePeriod time.Duration) (GCBlobsResult, error) {
+	stats, err := s.blobStoreGC(time.Now().Add(-gracePeriod))
+	if err != nil {
+		return GCBlobsResult{}, errgo.Mask(err)
+	}
+	return GCBlobsResult{
+		Count: stats.RemovedCount,
+		Size:  stats.RemovedSize,
+	}, nil
+}
+
+// blobStoreGC implements BlobStoreGC and GCBlobs.
+func (s *Store) blobStoreGC(before time.Time) (monitoring.BlobStats, error) {
 	// BEWARE: if this code does not add all the relevant blob
 	// hashes, they will be removed by the garbage collector!
 
@@ -440,11 +546,11 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 	// measure of hash count.
 	entityCount, err := s.DB.Entities().Count()
 	if err != nil {
-		return errgo.Mask(err)
+		return monitoring.BlobStats{}, errgo.Mask(err)
 	}
 	resourceCount, err := s.DB.Resources().Count()
 	if err != nil {
-		return errgo.Mask(err)
+		return monitoring.BlobStats{}, errgo.Mask(err)
 	}
 	// Assume non-multipart resources, v5 entities that need conversion,
 	// and a 20% duplication rate,
@@ -464,7 +570,7 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 		refs.Add(entity.BlobHash)
 	}
 	if err := iter.Err(); err != nil {
-		return errgo.Mask(err)
+		return monitoring.BlobStats{}, errgo.Mask(err)
 	}
 	iter = s.DB.Resources().Find(nil).Select(FieldSelector(
 		"blobhash",
@@ -481,14 +587,14 @@ func (s *Store) BlobStoreGC(before time.Time) error {
 		}
 	}
 	if err := iter.Err(); err != nil {
-		return errgo.Mask(err)
+		return monitoring.BlobStats{}, errgo.Mask(err)
 	}
 	stats, err := s.BlobStore.GC(refs, before)
 	if err != nil {
-		return errgo.Notef(err, "blobstore GC failed")
+		return monitoring.BlobStats{}, errgo.Notef(err, "blobstore GC failed")
 	}
 	monitoring.SetBlobStoreStats(stats)
-	return nil
+	return stats, nil
 }
 
 // AddAudit adds the given entry to the audit log.
@@ -507,6 +613,20 @@ func (s *Store) addAuditAtTime(entry audit.Entry, t time.Time) {
 	}
 }
 
+// latestRevision returns the latest revision recorded for the
+// given id, or -1 if no revision has been recorded.
+func (s *Store) latestRevision(id *charm.URL) (int, error) {
+	var doc mongodoc.LatestRevision
+	err := s.DB.Revisions().FindId(id.WithRevision(-1)).One(&doc)
+	if err == mgo.ErrNotFound {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot get latest revision for %v", id)
+	}
+	return doc.Revision, nil
+}
+
 // NewRevision returns a new revision number for the
 // given entity URL.
 func (s *Store) NewRevision(id *charm.URL) (int, error) {
@@ -593,9 +713,25 @@ func (s *Store) addRevision(id *charm.URL) error {
 // FindEntity finds the entity in the store with the given URL, which
 // must be fully qualified. If the given URL has no user then it is
 // assumed to be a promulgated entity. If fields is not nil, only its
-// fields will be populated in the returned entities.
+// fields will be populated in the returned entities. Archived entities
+// are not found.
 func (s *Store) FindEntity(url *router.ResolvedURL, fields map[string]int) (*mongodoc.Entity, error) {
-	q := s.DB.Entities().Find(bson.D{{"_id", &url.URL}})
+	return s.findEntity(url, fields, false)
+}
+
+// FindEntityIncludingArchived is like FindEntity except that
+// archived entities are also found.
+func (s *Store) FindEntityIncludingArchived(url *router.ResolvedURL, fields map[string]int) (*mongodoc.Entity, error) {
+	return s.findEntity(url, fields, true)
+}
+
+// findEntity implements FindEntity and FindEntityIncludingArchived.
+func (s *Store) findEntity(url *router.ResolvedURL, fields map[string]int, includeArchived bool) (*mongodoc.Entity, error) {
+	query := bson.D{{"_id", &url.URL}}
+	if !includeArchived {
+		query = append(query, notArchived...)
+	}
+	q := s.DB.Entities().Find(query)
 	if fields != nil {
 		q = q.Select(fields)
 	}
@@ -629,6 +765,115 @@ func (s *Store) FindEntities(url *charm.URL, fields map[string]int) ([]*mongodoc
 	return docs, nil
 }
 
+// FindEntitiesWithBlobHash returns all the entities whose archive is
+// the blob with the given SHA384 hash. If fields is not nil, only its
+// fields will be populated in the returned entities.
+func (s *Store) FindEntitiesWithBlobHash(hash string, fields map[string]int) ([]*mongodoc.Entity, error) {
+	query := s.DB.Entities().Find(bson.D{{"blobhash", hash}})
+	if fields != nil {
+		query = query.Select(fields)
+	}
+	var docs []*mongodoc.Entity
+	if err := query.All(&docs); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities with blob hash %s", hash)
+	}
+	return docs, nil
+}
+
+// OwnerEntity holds a charm or bundle returned by ListOwnerEntities.
+type OwnerEntity struct {
+	// URL holds the id of the latest revision of the
+	// charm or bundle.
+	URL *charm.URL
+
+	// Downloads holds the total number of downloads of all
+	// revisions of the charm or bundle.
+	Downloads int64
+}
+
+// ListOwnerEntities returns one entry for each charm or bundle owned by
+// the given user that has been published to the given channel, holding
+// its latest revision in that channel. If channel is params.NoChannel,
+// the stable channel is used. The results are ordered by base URL.
+//
+// Only entities readable by everyone or by any of the given groups,
+// which should include the name of the requesting user, are returned.
+func (s *Store) ListOwnerEntities(owner string, channel params.Channel, groups []string) ([]OwnerEntity, error) {
+	if channel == params.NoChannel {
+		channel = params.StableChannel
+	}
+	if !params.ValidChannels[channel] {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid channel %q", channel)
+	}
+	acl := append([]string{params.Everyone}, groups...)
+	var baseEntities []*mongodoc.BaseEntity
+	if err := s.DB.BaseEntities().Find(bson.D{
+		{"user", owner},
+		{"channelacls." + string(channel) + ".read", bson.D{{"$in", acl}}},
+	}).Select(bson.D{{"_id", 1}}).All(&baseEntities); err != nil {
+		return nil, errgo.Notef(err, "cannot find base entities owned by %q", owner)
+	}
+	if len(baseEntities) == 0 {
+		return []OwnerEntity{}, nil
+	}
+	baseURLs := make([]*charm.URL, len(baseEntities))
+	for i, be := range baseEntities {
+		baseURLs[i] = be.URL
+	}
+	query := append(bson.D{{"baseurl", bson.D{{"$in", baseURLs}}}}, notArchived...)
+	if channel != params.UnpublishedChannel {
+		query = append(query, bson.DocElem{"published." + string(channel), true})
+	}
+	iter := s.DB.Entities().Find(query).Select(bson.D{{"_id", 1}, {"baseurl", 1}}).Iter()
+	latest := make(map[string]*charm.URL)
+	// seriesURLs holds, for each base URL, a URL with no revision
+	// for each series, used to aggregate the download counts.
+	seriesURLs := make(map[string]map[string]*charm.URL)
+	var entity mongodoc.Entity
+	for iter.Next(&entity) {
+		base := entity.BaseURL.String()
+		if u := latest[base]; u == nil || entity.URL.Revision > u.Revision {
+			latest[base] = entity.URL
+		}
+		if seriesURLs[base] == nil {
+			seriesURLs[base] = make(map[string]*charm.URL)
+		}
+		u := *entity.URL
+		u.Revision = -1
+		seriesURLs[base][u.Series] = &u
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities owned by %q", owner)
+	}
+	results := make([]OwnerEntity, 0, len(latest))
+	for base, url := range latest {
+		var downloads int64
+		for _, u := range seriesURLs[base] {
+			_, counts, err := s.ArchiveDownloadCounts(u, false)
+			if err != nil {
+				return nil, errgo.Notef(err, "cannot get download counts for %s", u)
+			}
+			downloads += counts.Total
+		}
+		results = append(results, OwnerEntity{
+			URL:       url,
+			Downloads: downloads,
+		})
+	}
+	sort.Sort(ownerEntitiesByBaseURL(results))
+	return results, nil
+}
+
+// ownerEntitiesByBaseURL implements sort.Interface for []OwnerEntity,
+// ordering by base URL.
+type ownerEntitiesByBaseURL []OwnerEntity
+
+func (s ownerEntitiesByBaseURL) Len() int      { return len(s) }
+func (s ownerEntitiesByBaseURL) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s ownerEntitiesByBaseURL) Less(i, j int) bool {
+	return mongodoc.BaseURL(s[i].URL).String() < mongodoc.BaseURL(s[j].URL).String()
+}
+
 // FindBestEntity finds the entity that provides the preferred match to
 // the given URL, on the given channel. If the given URL has no user
 // then only promulgated entities will be queried. If fields is not nil,
@@ -638,8 +883,9 @@ func (s *Store) FindEntities(url *charm.URL, fields map[string]int) ([]*mongodoc
 // and refer to a single entity; the channel is ignored.
 //
 // If the URL does not contain a revision then the channel is searched
-// for the best match, here NoChannel will be treated as
-// params.StableChannel.
+// for the best match. If the channel is NoChannel, each of the channels
+// in ServerParams.ResolveChannels is searched in turn and the best
+// match from the first channel that has one is returned.
 func (s *Store) FindBestEntity(url *charm.URL, channel params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
 	if fields != nil {
 		// Make sure we have all the fields we need to make a decision.
@@ -678,13 +924,21 @@ func (s *Store) FindBestEntity(url *charm.URL, channel params.Channel, fields ma
 	case params.UnpublishedChannel:
 		return s.findUnpublishedEntity(url, fields)
 	case params.NoChannel:
-		channel = params.StableChannel
-		fallthrough
+		return s.findEntityInChannels(url, s.pool.config.ResolveChannels, fields)
 	default:
-		return s.findEntityInChannel(url, channel, fields)
+		return s.findEntityInChannels(url, []params.Channel{channel}, fields)
 	}
 }
 
+// DefaultResolveChannels holds the channels searched, in order, when
+// resolving an id without a channel if ServerParams.ResolveChannels
+// is not set.
+var DefaultResolveChannels = []params.Channel{
+	params.StableChannel,
+	params.CandidateChannel,
+	params.EdgeChannel,
+}
+
 // findSingleEntity returns the entity referred to by URL. It is expected
 // that the URL refers to only one entity and is fully formed. The url may
 // refer to either a user-owned or promulgated charm name.
@@ -704,10 +958,11 @@ func (s *Store) findSingleEntity(url *charm.URL, fields map[string]int) (*mongod
 	return nil, errgo.Notef(err, "cannot find entities matching %s", url)
 }
 
-// findEntityInChannel attempts to find an entity on the given channel. The
-// base entity for URL is retrieved and the series with the best match to
-// URL.Series is used as the resolved entity.
-func (s *Store) findEntityInChannel(url *charm.URL, ch params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
+// findEntityInChannels attempts to find an entity on one of the given
+// channels, which are tried in order. The base entity for URL is
+// retrieved and the series with the best match to URL.Series in the
+// first channel that has a match is used as the resolved entity.
+func (s *Store) findEntityInChannels(url *charm.URL, channels []params.Channel, fields map[string]int) (*mongodoc.Entity, error) {
 	baseEntity, err := s.FindBaseEntity(url, map[string]int{
 		"_id":             1,
 		"channelentities": 1,
@@ -717,6 +972,18 @@ func (s *Store) findEntityInChannel(url *charm.URL, ch params.Channel, fields ma
 	} else if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	for _, ch := range channels {
+		if entityURL := channelEntityURL(baseEntity, url, ch); entityURL != nil {
+			return s.findSingleEntity(entityURL, fields)
+		}
+	}
+	return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", url)
+}
+
+// channelEntityURL returns the URL of the entity published on the
+// given channel of baseEntity that best matches URL.Series, or nil if
+// there is none.
+func channelEntityURL(baseEntity *mongodoc.BaseEntity, url *charm.URL, ch params.Channel) *charm.URL {
 	var entityURL *charm.URL
 	if url.Series == "" {
 		var entitySeries string
@@ -744,10 +1011,7 @@ func (s *Store) findEntityInChannel(url *charm.URL, ch params.Channel, fields ma
 	} else {
 		entityURL = baseEntity.ChannelEntities[ch][url.Series]
 	}
-	if entityURL == nil {
-		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %s", url)
-	}
-	return s.findSingleEntity(entityURL, fields)
+	return entityURL
 }
 
 // findUnpublishedEntity attempts to find an entity on the unpublished
@@ -811,13 +1075,37 @@ var seriesScore = map[string]int{
 
 var seriesBundleOrEmpty = bson.D{{"$or", []bson.D{{{"series", "bundle"}}, {{"series", ""}}}}}
 
+// notArchived holds the query clause that excludes archived entities.
+var notArchived = bson.D{{"archived", bson.D{{"$ne", true}}}}
+
 // EntitiesQuery creates a mgo.Query object that can be used to find entities
 // matching the given URL. If the given URL has no user then the produced query
-// will only match promulgated entities.
+// will only match promulgated entities. Archived entities are never matched.
 func (s *Store) EntitiesQuery(url *charm.URL) *mgo.Query {
-	entities := s.DB.Entities()
-	query := make(bson.D, 1, 5)
+	return s.DB.Entities().Find(entitiesQueryDoc(url))
+}
+
+// ExpandURLWithChannel is like EntitiesQuery except that the returned
+// query only matches entities published on the given channel. If
+// channel is params.NoChannel or params.UnpublishedChannel, which holds
+// all entities, the query matches the same entities as EntitiesQuery.
+func (s *Store) ExpandURLWithChannel(url *charm.URL, channel params.Channel) (*mgo.Query, error) {
+	if channel == params.NoChannel || channel == params.UnpublishedChannel {
+		return s.EntitiesQuery(url), nil
+	}
+	if !params.ValidChannels[channel] {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid channel %q", channel)
+	}
+	query := append(entitiesQueryDoc(url), bson.DocElem{"published." + string(channel), true})
+	return s.DB.Entities().Find(query), nil
+}
+
+// entitiesQueryDoc returns the query document used by EntitiesQuery
+// to find entities matching the given URL.
+func entitiesQueryDoc(url *charm.URL) bson.D {
+	query := make(bson.D, 2, 7)
 	query[0] = bson.DocElem{"name", url.Name}
+	query[1] = notArchived[0]
 	if url.User == "" {
 		if url.Revision > -1 {
 			query = append(query, bson.DocElem{"promulgated-revision", url.Revision})
@@ -842,7 +1130,7 @@ func (s *Store) EntitiesQuery(url *charm.URL) *mgo.Query {
 	} else {
 		query = append(query, bson.DocElem{"supportedseries", url.Series})
 	}
-	return entities.Find(query)
+	return query
 }
 
 // FindBaseEntity finds the base entity in the store using the given URL,
@@ -869,6 +1157,35 @@ func (s *Store) FindBaseEntity(url *charm.URL, fields map[string]int) (*mongodoc
 	return &baseEntity, nil
 }
 
+// LatestRevision returns the highest revision of any entity with the
+// same base URL as url, along with the highest promulgated revision of
+// those entities, or -1 if none of them has been promulgated. If url
+// has no user, the promulgated base entity with the same name is used.
+//
+// If there are no matching entities, an error with a params.ErrNotFound
+// cause is returned.
+func (s *Store) LatestRevision(url *charm.URL) (revision, promulgatedRevision int, err error) {
+	baseEntity, err := s.FindBaseEntity(url, FieldSelector("_id"))
+	if err != nil {
+		return 0, 0, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	query := bson.D{{"baseurl", baseEntity.URL}}
+	var entity mongodoc.Entity
+	err = s.DB.Entities().Find(query).Sort("-revision").Select(FieldSelector("revision")).One(&entity)
+	if err == mgo.ErrNotFound {
+		return 0, 0, errgo.WithCausef(nil, params.ErrNotFound, "no entities found with base URL %v", baseEntity.URL)
+	}
+	if err != nil {
+		return 0, 0, errgo.Notef(err, "cannot find latest revision")
+	}
+	revision = entity.Revision
+	err = s.DB.Entities().Find(query).Sort("-promulgated-revision").Select(FieldSelector("promulgated-revision")).One(&entity)
+	if err != nil {
+		return 0, 0, errgo.Notef(err, "cannot find latest promulgated revision")
+	}
+	return revision, entity.PromulgatedRevision, nil
+}
+
 // FieldSelector returns a field selector that will select
 // the given fields, or all fields if none are specified.
 func FieldSelector(fields ...string) map[string]int {
@@ -914,6 +1231,187 @@ func (s *Store) UpdateBaseEntity(url *router.ResolvedURL, update bson.D) error {
 	return nil
 }
 
+// SetDocs stores the given snapshot of the external documentation for
+// the entity with the given id, replacing any existing snapshot, and
+// updates the search index so that the entity can be found by its
+// documentation. An empty text removes the snapshot.
+func (s *Store) SetDocs(id *router.ResolvedURL, text string) error {
+	var update bson.D
+	if text == "" {
+		update = bson.D{{"$unset", bson.D{{"docs", ""}}}}
+	} else {
+		update = bson.D{{"$set", bson.D{{"docs", text}}}}
+	}
+	if err := s.UpdateEntity(id, update); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.UpdateSearch(id); err != nil {
+		return errgo.Notef(err, "cannot update search index")
+	}
+	return nil
+}
+
+// CheckExtraInfoKey checks that key may be used as a key in the given
+// metadata field, either extra-info or common-info. The key is used
+// as part of a MongoDB field name, so it must not contain ".", "/" or
+// "$".
+func CheckExtraInfoKey(key string, field string) error {
+	if strings.ContainsAny(key, "./$") {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "bad key for "+field)
+	}
+	return nil
+}
+
+// isNullValue reports whether value holds no value or a JSON null,
+// either of which removes a metadata key, as with a PUT of null.
+func isNullValue(value json.RawMessage) bool {
+	return value == nil || bytes.Equal(value, []byte("null"))
+}
+
+// SetExtraInfo sets the extra-info metadata with the given key for the
+// entity with the given id to the given JSON-encoded value, replacing
+// any existing value. A nil or null value removes the key.
+//
+// The key follows the same rules as keys set with a PUT to
+// meta/extra-info. Tools should namespace their keys to avoid
+// collisions, for example "ci:build-url", but this is not enforced.
+func (s *Store) SetExtraInfo(id *router.ResolvedURL, key string, value json.RawMessage) error {
+	if key == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "empty key for extra-info")
+	}
+	if err := CheckExtraInfoKey(key, "extra-info"); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	var update bson.D
+	if isNullValue(value) {
+		update = bson.D{{"$unset", bson.D{{"extrainfo." + key, ""}}}}
+	} else {
+		if !json.Valid(value) {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid JSON value for extra-info key %q", key)
+		}
+		update = bson.D{{"$set", bson.D{{"extrainfo." + key, []byte(value)}}}}
+	}
+	if err := s.UpdateEntity(id, update); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil
+}
+
+// ExtraInfo returns the JSON-encoded extra-info metadata with the given
+// key for the entity with the given id. If there is no such key, it
+// returns an error with a params.ErrMetadataNotFound cause.
+func (s *Store) ExtraInfo(id *router.ResolvedURL, key string) (json.RawMessage, error) {
+	entity, err := s.FindEntity(id, FieldSelector("extrainfo"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	value, ok := entity.ExtraInfo[key]
+	if !ok {
+		return nil, errgo.WithCausef(nil, params.ErrMetadataNotFound, "extra-info key %q not found for %s", key, id)
+	}
+	return json.RawMessage(value), nil
+}
+
+// SetCommonInfo sets the common-info metadata with the given key for
+// the base entity of the given URL to the given JSON-encoded value,
+// replacing any existing value. A nil or null value removes the key.
+// As the metadata is held in the base entity, it is shared by all
+// revisions and series of the entity.
+func (s *Store) SetCommonInfo(baseURL *charm.URL, key string, value json.RawMessage) error {
+	if key == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "empty key for common-info")
+	}
+	if err := CheckExtraInfoKey(key, "common-info"); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	var update bson.D
+	if isNullValue(value) {
+		update = bson.D{{"$unset", bson.D{{"commoninfo." + key, ""}}}}
+	} else {
+		if !json.Valid(value) {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "invalid JSON value for common-info key %q", key)
+		}
+		update = bson.D{{"$set", bson.D{{"commoninfo." + key, []byte(value)}}}}
+	}
+	baseEntity, err := s.FindBaseEntity(baseURL, FieldSelector("_id"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.DB.BaseEntities().UpdateId(baseEntity.URL, update); err != nil {
+		return errgo.Notef(err, "cannot update common-info for %q", baseURL)
+	}
+	return nil
+}
+
+// CommonInfo returns all the common-info metadata for the base entity
+// of the given URL, keyed by name. The returned map is empty if no
+// metadata has been set.
+func (s *Store) CommonInfo(baseURL *charm.URL) (map[string]json.RawMessage, error) {
+	baseEntity, err := s.FindBaseEntity(baseURL, FieldSelector("commoninfo"))
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	info := make(map[string]json.RawMessage, len(baseEntity.CommonInfo))
+	for key, val := range baseEntity.CommonInfo {
+		info[key] = json.RawMessage(val)
+	}
+	return info, nil
+}
+
+// SetDeprecated marks the entity with the given id as deprecated or
+// not, and updates the search index accordingly. Deprecated entities
+// are omitted from search results unless SearchParams.IncludeDeprecated
+// is set, but can still be resolved by their id.
+func (s *Store) SetDeprecated(id *router.ResolvedURL, deprecated bool) error {
+	var update bson.D
+	if deprecated {
+		update = bson.D{{"$set", bson.D{{"deprecated", true}}}}
+	} else {
+		update = bson.D{{"$unset", bson.D{{"deprecated", ""}}}}
+	}
+	if err := s.UpdateEntity(id, update); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.UpdateSearch(id); err != nil {
+		return errgo.Notef(err, "cannot update search index")
+	}
+	return nil
+}
+
+// Entity origins that may be set with Store.SetOrigin.
+const (
+	// OriginNative is the origin of entities published directly
+	// to the charm store.
+	OriginNative = "native"
+
+	// OriginMirror is the origin of entities imported from an
+	// upstream charm store.
+	OriginMirror = "mirror"
+)
+
+// SetOrigin records where the entity with the given id was obtained
+// from, which must be either OriginNative or OriginMirror, and updates
+// the search index so that the entity can be found with the origin
+// filter.
+func (s *Store) SetOrigin(id *router.ResolvedURL, origin string) error {
+	var update bson.D
+	switch origin {
+	case OriginNative:
+		update = bson.D{{"$unset", bson.D{{"origin", ""}}}}
+	case OriginMirror:
+		update = bson.D{{"$set", bson.D{{"origin", origin}}}}
+	default:
+		return errgo.WithCausef(nil, params.ErrBadRequest, "invalid origin %q", origin)
+	}
+	if err := s.UpdateEntity(id, update); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.UpdateSearch(id); err != nil {
+		return errgo.Notef(err, "cannot update search index")
+	}
+	return nil
+}
+
 var ErrPublishResourceMismatch = errgo.Newf("charm published with incorrect resources")
 
 // Publish assigns channels to the entity corresponding to the given URL.
@@ -924,7 +1422,7 @@ var ErrPublishResourceMismatch = errgo.Newf("charm published with incorrect reso
 // If the given resources do not match those expected or they're not
 // found, an error with a ErrPublichResourceMismatch cause will be returned.
 func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, channels ...params.Channel) error {
-	var updateSearch bool
+	var updateSearch, stable bool
 	// Throw away any channels that we don't like.
 	actualChannels := make([]params.Channel, 0, len(channels))
 	for _, c := range channels {
@@ -932,15 +1430,18 @@ func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, chann
 			continue
 		}
 		actualChannels = append(actualChannels, c)
-		if c == params.StableChannel {
+		if isSearchChannel(c) {
 			updateSearch = true
 		}
+		if c == params.StableChannel {
+			stable = true
+		}
 	}
 	channels = actualChannels
 	if len(channels) == 0 {
 		return errgo.Newf("cannot update %q: no valid channels provided", url)
 	}
-	entity, err := s.FindEntity(url, FieldSelector("series", "supportedseries", "charmmeta", "baseurl"))
+	entity, err := s.FindEntity(url, FieldSelector("series", "supportedseries", "charmmeta", "baseurl", "stablepublishtime"))
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
@@ -964,6 +1465,9 @@ func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, chann
 	for _, c := range channels {
 		update = append(update, bson.DocElem{"published." + string(c), true})
 	}
+	if stable && entity.StablePublishTime.IsZero() {
+		update = append(update, bson.DocElem{"stablepublishtime", time.Now()})
+	}
 	if err := s.UpdateEntity(url, bson.D{{"$set", update}}); err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
@@ -991,6 +1495,82 @@ func (s *Store) Publish(url *router.ResolvedURL, resources map[string]int, chann
 	return nil
 }
 
+// PublishMulti is like Publish except that all the given channels must
+// be valid. If any channel is not valid, including the unpublished
+// channel, an error with a params.ErrBadRequest cause is returned and
+// the entity is not published to any channel. The entity is published
+// to all the channels with a single update and the search index is
+// updated once.
+func (s *Store) PublishMulti(url *router.ResolvedURL, resources map[string]int, channels []params.Channel) error {
+	if len(channels) == 0 {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot update %q: no channels provided", url)
+	}
+	for _, c := range channels {
+		if !params.ValidChannels[c] || c == params.UnpublishedChannel {
+			return errgo.WithCausef(nil, params.ErrBadRequest, "cannot update %q: invalid channel %q", url, c)
+		}
+	}
+	if err := s.Publish(url, resources, channels...); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(ErrPublishResourceMismatch))
+	}
+	return nil
+}
+
+// Unpublish removes the entity with the given id from the given
+// channel. If the entity is the current revision in the channel, the
+// channel is left with no current revision for the entity's series and,
+// if the channel is indexed for search, the entity is removed from the
+// search index. If the entity is not published in the channel, an error
+// with a params.ErrNotFound cause is returned.
+//
+// The channel does not fall back to an earlier revision that was
+// published in it. The resources published with a revision are only
+// recorded for the channel as a whole, so those of the earlier
+// revision are no longer known. To make an earlier revision current
+// again, publish it with the resources that it needs.
+func (s *Store) Unpublish(id *router.ResolvedURL, channel params.Channel) error {
+	if !params.ValidChannels[channel] || channel == params.UnpublishedChannel {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot unpublish %q: invalid channel %q", id, channel)
+	}
+	entity, err := s.FindEntity(id, FieldSelector("published", "supportedseries"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if !entity.Published[channel] {
+		return errgo.WithCausef(nil, params.ErrNotFound, "%q is not published in the %s channel", id, channel)
+	}
+	if err := s.UpdateEntity(id, bson.D{{
+		"$unset", bson.D{{"published." + string(channel), ""}},
+	}}); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	baseEntity, err := s.FindBaseEntity(&id.URL, FieldSelector("channelentities"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	var update bson.D
+	for series, u := range baseEntity.ChannelEntities[channel] {
+		if *u == id.URL {
+			update = append(update, bson.DocElem{fmt.Sprintf("channelentities.%s.%s", channel, series), ""})
+		}
+	}
+	if len(update) == 0 {
+		// The entity was not the current revision in the
+		// channel, so nothing else needs to change.
+		return nil
+	}
+	if err := s.UpdateBaseEntity(id, bson.D{{"$unset", update}}); err != nil {
+		return errgo.Mask(err)
+	}
+	if !isSearchChannel(channel) {
+		return nil
+	}
+	if err := s.ES.deleteEntity(entity, channel); err != nil {
+		return errgo.Notef(err, "cannot remove %q from search index", id)
+	}
+	return nil
+}
+
 func (s *Store) checkPublishedResources(entity *mongodoc.Entity, resources map[string]int) error {
 	knownResources, _, err := s.charmResources(entity.BaseURL)
 	if err != nil {
@@ -1020,6 +1600,249 @@ func (s *Store) checkPublishedResources(entity *mongodoc.Entity, resources map[s
 	return errgo.Newf("resources are missing from publish request: %s", strings.Join(missing, ", "))
 }
 
+// Promulgate sets whether the charm or bundle with the given base URL
+// is promulgated. Promulgating works as for SetPromulgated, assigning
+// the next promulgated revision to the latest revision in each series.
+// Unpromulgating also removes the promulgated URL from all revisions
+// of the base entity, so that they can no longer be referred to by
+// their promulgated URLs. The search index is updated in both cases.
+func (s *Store) Promulgate(baseURL *charm.URL, promulgate bool) error {
+	base := mongodoc.BaseURL(baseURL)
+	id := &router.ResolvedURL{URL: *base, PromulgatedRevision: -1}
+	if !promulgate {
+		_, err := s.DB.Entities().UpdateAll(bson.D{{"baseurl", base}}, bson.D{{
+			"$set", bson.D{{"promulgated-revision", -1}},
+		}, {
+			"$unset", bson.D{{"promulgated-url", ""}},
+		}})
+		if err != nil {
+			return errgo.Notef(err, "cannot remove promulgated URLs for %q", base)
+		}
+	}
+	if err := s.SetPromulgated(id, promulgate); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil
+}
+
+// TransferOwnership moves all the revisions of the charm or bundle with
+// the given base URL to newUser. The user part of the URL of every
+// entity is rewritten, the owner is replaced by newUser in the ACLs,
+// the download statistics are moved to the new URLs and the search
+// index is updated to reflect the change. Promulgated URLs are
+// preserved.
+//
+// The documents for the new owner are all created before any of the
+// old ones are removed, and if creating them fails they are removed
+// again, so a failed transfer leaves the charm or bundle with its
+// original owner.
+//
+// If there is no base entity with the given URL, it returns an error
+// with an ErrNotFound cause. If newUser already owns a charm or bundle
+// with the same name, it returns an error with an ErrDuplicateUpload
+// cause.
+func (s *Store) TransferOwnership(baseURL *charm.URL, newUser string) error {
+	oldBase := mongodoc.BaseURL(baseURL)
+	if newUser == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot transfer %q to an empty user", oldBase)
+	}
+	if newUser == oldBase.User {
+		return nil
+	}
+	newBase := *oldBase
+	newBase.User = newUser
+	baseEntity, err := s.FindBaseEntity(oldBase, nil)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if _, err := s.FindBaseEntity(&newBase, FieldSelector("_id")); err == nil {
+		return errgo.WithCausef(nil, params.ErrDuplicateUpload, "cannot transfer %q: %q already exists", oldBase, &newBase)
+	} else if errgo.Cause(err) != params.ErrNotFound {
+		return errgo.Mask(err)
+	}
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().Find(bson.D{{"baseurl", oldBase}}).All(&entities); err != nil {
+		return errgo.Notef(err, "cannot get entities for %q", oldBase)
+	}
+
+	// Create the new documents before touching the old ones.
+	newBaseEntity := *baseEntity
+	newBaseEntity.URL = &newBase
+	newBaseEntity.User = newUser
+	newBaseEntity.ChannelACLs = make(map[params.Channel]mongodoc.ACL, len(baseEntity.ChannelACLs))
+	for ch, acl := range baseEntity.ChannelACLs {
+		newBaseEntity.ChannelACLs[ch] = mongodoc.ACL{
+			Read:  replaceACLUser(acl.Read, oldBase.User, newUser),
+			Write: replaceACLUser(acl.Write, oldBase.User, newUser),
+		}
+	}
+	newBaseEntity.ChannelEntities = make(map[params.Channel]map[string]*charm.URL, len(baseEntity.ChannelEntities))
+	for ch, m := range baseEntity.ChannelEntities {
+		newm := make(map[string]*charm.URL, len(m))
+		for series, u := range m {
+			u1 := *u
+			u1.User = newUser
+			newm[series] = &u1
+		}
+		newBaseEntity.ChannelEntities[ch] = newm
+	}
+	if err := s.DB.BaseEntities().Insert(&newBaseEntity); err != nil {
+		if mgo.IsDup(err) {
+			return errgo.WithCausef(nil, params.ErrDuplicateUpload, "cannot transfer %q: %q already exists", oldBase, &newBase)
+		}
+		return errgo.Notef(err, "cannot insert base entity %q", &newBase)
+	}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		// Undo the partial transfer so that the old owner is
+		// left intact. Revisions allocated for the new owner are
+		// left alone, as they only ever cause revision numbers
+		// to be skipped.
+		if err := s.moveDownloadCounters(&newBase, entities, oldBase.User); err != nil {
+			logger.Errorf("cannot restore download statistics for %q: %v", oldBase, err)
+		}
+		if _, err := s.DB.Resources().UpdateAll(bson.D{{"baseurl", &newBase}}, bson.D{{
+			"$set", bson.D{{"baseurl", oldBase}},
+		}}); err != nil {
+			logger.Errorf("cannot restore resources for %q: %v", oldBase, err)
+		}
+		if _, err := s.DB.Entities().RemoveAll(bson.D{{"baseurl", &newBase}}); err != nil {
+			logger.Errorf("cannot remove entities for %q: %v", &newBase, err)
+		}
+		if err := s.DB.BaseEntities().RemoveId(&newBase); err != nil {
+			logger.Errorf("cannot remove base entity %q: %v", &newBase, err)
+		}
+	}()
+	for _, e := range entities {
+		newEntity := *e
+		u := *e.URL
+		u.User = newUser
+		newEntity.URL = &u
+		newEntity.User = newUser
+		newEntity.BaseURL = &newBase
+		// The promulgated URL is unique across all entities, so it
+		// is only set once the old entity has been removed.
+		newEntity.PromulgatedURL = nil
+		if err := s.DB.Entities().Insert(&newEntity); err != nil {
+			return errgo.Notef(err, "cannot insert entity %q", &u)
+		}
+	}
+	var revisions []mongodoc.LatestRevision
+	if err := s.DB.Revisions().Find(bson.D{{"baseurl", oldBase}}).All(&revisions); err != nil {
+		return errgo.Notef(err, "cannot get revisions for %q", oldBase)
+	}
+	for _, rev := range revisions {
+		u := *rev.URL
+		u.User = newUser
+		if err := s.addRevision(u.WithRevision(rev.Revision)); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := s.moveDownloadCounters(oldBase, entities, newUser); err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := s.DB.Resources().UpdateAll(bson.D{{"baseurl", oldBase}}, bson.D{{
+		"$set", bson.D{{"baseurl", &newBase}},
+	}}); err != nil {
+		return errgo.Notef(err, "cannot update resources for %q", oldBase)
+	}
+
+	// Remove the old documents. From here on the new owner holds
+	// everything, so the transfer is not undone.
+	committed = true
+	if _, err := s.DB.Entities().RemoveAll(bson.D{{"baseurl", oldBase}}); err != nil {
+		return errgo.Notef(err, "cannot remove entities for %q", oldBase)
+	}
+	if _, err := s.DB.Revisions().RemoveAll(bson.D{{"baseurl", oldBase}}); err != nil {
+		return errgo.Notef(err, "cannot remove revisions for %q", oldBase)
+	}
+	if err := s.DB.BaseEntities().RemoveId(oldBase); err != nil {
+		return errgo.Notef(err, "cannot remove base entity %q", oldBase)
+	}
+	for _, e := range entities {
+		if e.PromulgatedURL == nil {
+			continue
+		}
+		u := *e.URL
+		u.User = newUser
+		err := s.DB.Entities().UpdateId(&u, bson.D{{"$set", bson.D{{"promulgated-url", e.PromulgatedURL}}}})
+		if err != nil {
+			return errgo.Notef(err, "cannot set promulgated URL for %q", &u)
+		}
+	}
+
+	// Replace the old documents in the search index.
+	for _, ch := range searchChannels {
+		for _, e := range entities {
+			for _, u := range baseEntity.ChannelEntities[ch] {
+				if *u != *e.URL {
+					continue
+				}
+				if err := s.ES.deleteEntity(e, ch); err != nil {
+					return errgo.Notef(err, "cannot remove %q from search index", e.URL)
+				}
+				break
+			}
+		}
+	}
+	if err := s.UpdateSearchBaseURL(&newBase); err != nil {
+		return errgo.Notef(err, "cannot update search index")
+	}
+	return nil
+}
+
+// moveDownloadCounters moves the archive download counters of the
+// given entities, all of which have the given base URL, so that they
+// are keyed by newUser instead of the owner in the base URL. The
+// counters of promulgated URLs do not include the owner and are left
+// unchanged.
+func (s *Store) moveDownloadCounters(base *charm.URL, entities []*mongodoc.Entity, newUser string) error {
+	seen := make(map[string]bool)
+	for _, e := range entities {
+		if seen[e.URL.Series] {
+			continue
+		}
+		seen[e.URL.Series] = true
+		if err := s.moveCounters(
+			[]string{params.StatsArchiveDownload, e.URL.Series, base.Name, base.User},
+			[]string{params.StatsArchiveDownload, e.URL.Series, base.Name, newUser},
+		); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := s.moveCounters(
+		[]string{params.StatsArchiveDownloadSeries, base.Name, base.User},
+		[]string{params.StatsArchiveDownloadSeries, base.Name, newUser},
+	); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// replaceACLUser returns a copy of acl with any occurrence of oldUser
+// replaced by newUser.
+func replaceACLUser(acl []string, oldUser, newUser string) []string {
+	if acl == nil {
+		return nil
+	}
+	result := make([]string, 0, len(acl))
+	seen := make(map[string]bool)
+	for _, u := range acl {
+		if u == oldUser {
+			u = newUser
+		}
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		result = append(result, u)
+	}
+	return result
+}
+
 // SetPromulgated sets whether the base entity of url is promulgated, If
 // promulgated is true it also unsets promulgated on any other base
 // entity for entities with the same name. It also calculates the next
@@ -1189,6 +2012,21 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 		}
 		pID := *r.URL
 		pID.User = ""
+		// Take into account any promulgated revisions that have been
+		// allocated but are no longer held by an entity (for example
+		// because the charm was unpromulgated) so that promulgated
+		// revisions are never reused.
+		for _, series := range append([]string{pID.Series}, entitySeries...) {
+			u := pID
+			u.Series = series
+			rev, err := s.latestRevision(&u)
+			if err != nil {
+				return errgo.Mask(err)
+			}
+			if rev > maxRev {
+				maxRev = rev
+			}
+		}
 		pID.Revision = maxRev + 1
 		logger.Infof("updating promulgation URL of %v to %v", r.URL, &pID)
 		err := s.DB.Entities().Update(
@@ -1203,11 +2041,17 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 				}},
 			},
 		)
-		if err != nil && err != mgo.ErrNotFound {
+		if err == mgo.ErrNotFound {
 			// If we get NotFound it is most likely because the latest owned revision is
 			// already promulgated, so carry on.
+			continue
+		}
+		if err != nil {
 			return errgo.Notef(err, "cannot update promulgated URLs")
 		}
+		if err := s.addRevision(&pID); err != nil {
+			return errgo.Mask(err)
+		}
 	}
 
 	// Update the search record for the newest entity.
@@ -1251,6 +2095,56 @@ func (s *Store) MatchingInterfacesQuery(required, provided []string) *mgo.Query
 	}})
 }
 
+// InterfaceRole specifies the role in which a charm uses a
+// relation interface.
+type InterfaceRole string
+
+const (
+	// RoleProvides matches charms that provide the interface.
+	RoleProvides InterfaceRole = "provides"
+
+	// RoleRequires matches charms that require the interface.
+	RoleRequires InterfaceRole = "requires"
+
+	// RoleAny matches charms that either provide or require
+	// the interface.
+	RoleAny InterfaceRole = "any"
+)
+
+// EntitiesByInterface returns all the charms that use the relation
+// interface iface in the given role, ordered by id. Unlike Search, it
+// queries the database directly, so it works even when the search index
+// is unavailable. It does not check whether the charms are published
+// or who may read them.
+//
+// If fields is not nil, only its fields will be populated in the
+// returned entities.
+func (s *Store) EntitiesByInterface(iface string, role InterfaceRole, fields map[string]int) ([]*mongodoc.Entity, error) {
+	var query bson.D
+	switch role {
+	case RoleProvides:
+		query = bson.D{{"charmprovidedinterfaces", iface}}
+	case RoleRequires:
+		query = bson.D{{"charmrequiredinterfaces", iface}}
+	case RoleAny:
+		query = bson.D{{"$or", []bson.D{
+			{{"charmprovidedinterfaces", iface}},
+			{{"charmrequiredinterfaces", iface}},
+		}}}
+	default:
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid interface role %q", role)
+	}
+	q := s.DB.Entities().Find(query).Sort("_id")
+	if fields != nil {
+		q = q.Select(fields)
+	}
+	var entities []*mongodoc.Entity
+	if err := q.All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities with interface %q", iface)
+	}
+	return entities, nil
+}
+
 // AddLog adds a log message to the database.
 func (s *Store) AddLog(data *json.RawMessage, logLevel mongodoc.LogLevel, logType mongodoc.LogType, urls []*charm.URL) error {
 	// Encode the JSON data.
@@ -1292,16 +2186,23 @@ func (s *Store) AddLog(data *json.RawMessage, logLevel mongodoc.LogLevel, logTyp
 }
 
 // DeleteEntity deletes the entity with the given id from the store. If
-// the entity is the current published revision for any channel or the
-// last revision with the same base entity, it returns an error with an
-// ErrForbidden cause.
-func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
+// the entity is the last revision with the same base entity, it returns
+// an error with an ErrForbidden cause. If the entity is the current
+// published revision for any channel, it also returns an error with an
+// ErrForbidden cause unless force is true, in which case the entity is
+// unpublished from those channels and removed from the search index.
+// If there is no entity with the given id, it returns an error with an
+// ErrNotFound cause.
+//
+// The entity's blobs are not removed immediately: they will be
+// removed by the next BlobStoreGC once nothing else refers to them.
+func (s *Store) DeleteEntity(id *router.ResolvedURL, force bool) error {
 	// Find all the entities that use the base URL of id so
 	// that we can refuse to delete the last reference to the
 	// base URL.
 	var entities []*mongodoc.Entity
 	err := s.DB.Entities().Find(bson.D{{"baseurl", mongodoc.BaseURL(&id.URL)}}).
-		Select(FieldSelector("blobhash", "prev5blobhash")).
+		Select(FieldSelector("blobhash", "prev5blobhash", "supportedseries")).
 		All(&entities)
 	if err != nil {
 		return errgo.Mask(err)
@@ -1314,7 +2215,7 @@ func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
 		}
 	}
 	if entity == nil {
-		return errgo.WithCausef(nil, params.ErrNotFound, "")
+		return errgo.WithCausef(nil, params.ErrNotFound, "entity %q not found", &id.URL)
 	}
 	if len(entities) == 1 {
 		return errgo.WithCausef(nil, params.ErrForbidden, "cannot delete last revision of charm or bundle")
@@ -1329,17 +2230,37 @@ func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
 		return errgo.Mask(err)
 	}
 	var published []string
+	publishedChannels := make(map[params.Channel]bool)
+	var unpublish bson.D
 	for ch, ids := range baseEntity.ChannelEntities {
-		for _, publishedId := range ids {
-			if *publishedId == id.URL {
+		for series, publishedId := range ids {
+			if *publishedId != id.URL {
+				continue
+			}
+			if !publishedChannels[ch] {
+				publishedChannels[ch] = true
 				published = append(published, string(ch))
 			}
+			unpublish = append(unpublish, bson.DocElem{fmt.Sprintf("channelentities.%s.%s", ch, series), ""})
 		}
 	}
-	if len(published) > 0 {
+	if len(published) > 0 && !force {
 		sort.Strings(published)
 		return errgo.WithCausef(nil, params.ErrForbidden, "cannot delete %q because it is the current revision in channels %s", &id.URL, published)
 	}
+	if len(unpublish) > 0 {
+		if err := s.UpdateBaseEntity(id, bson.D{{"$unset", unpublish}}); err != nil {
+			return errgo.Notef(err, "cannot unpublish %q", &id.URL)
+		}
+		for _, ch := range searchChannels {
+			if !publishedChannels[ch] {
+				continue
+			}
+			if err := s.ES.deleteEntity(entity, ch); err != nil {
+				return errgo.Notef(err, "cannot remove %q from search index", &id.URL)
+			}
+		}
+	}
 	// Remove the entity.
 	if err := s.DB.Entities().RemoveId(&id.URL); err != nil {
 		if err == mgo.ErrNotFound {
@@ -1348,7 +2269,60 @@ func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
 		}
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
+	err = s.DB.BaseEntities().UpdateId(mongodoc.BaseURL(&id.URL), bson.D{{
+		"$inc", bson.D{{"revisioncount", -1}},
+	}})
+	if err != nil {
+		return errgo.Notef(err, "cannot update revision count")
+	}
+	return nil
+}
+
+// ArchiveEntity archives the entity with the given id. An archived
+// entity is kept in the database but is excluded from searches and
+// cannot be found by id until it is restored with RestoreEntity.
+// If there is no entity with the given id, it returns an error with
+// an ErrNotFound cause.
+func (s *Store) ArchiveEntity(id *router.ResolvedURL) error {
+	entity, err := s.FindEntityIncludingArchived(id, FieldSelector("supportedseries"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.UpdateEntity(id, bson.D{{"$set", bson.D{{"archived", true}}}}); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	baseEntity, err := s.FindBaseEntity(&id.URL, FieldSelector("channelentities"))
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	// Remove the entity from the search index for each channel it is
+	// currently published in.
+	for _, ch := range searchChannels {
+		for _, u := range baseEntity.ChannelEntities[ch] {
+			if *u != id.URL {
+				continue
+			}
+			if err := s.ES.deleteEntity(entity, ch); err != nil {
+				return errgo.Notef(err, "cannot remove %q from search index", &id.URL)
+			}
+			break
+		}
+	}
+	return nil
+}
 
+// RestoreEntity restores the entity with the given id that
+// was previously archived with ArchiveEntity, adding it back
+// to the search index if it is published.
+// If there is no entity with the given id, it returns an error with
+// an ErrNotFound cause.
+func (s *Store) RestoreEntity(id *router.ResolvedURL) error {
+	if err := s.UpdateEntity(id, bson.D{{"$unset", bson.D{{"archived", ""}}}}); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.UpdateSearch(id); err != nil {
+		return errgo.Notef(err, "cannot update search index")
+	}
 	return nil
 }
 
@@ -1429,6 +2403,7 @@ var allCollections = []func(StoreDatabase) *mgo.Collection{
 	StoreDatabase.Revisions,
 	StoreDatabase.StatCounters,
 	StoreDatabase.StatTokens,
+	StoreDatabase.StatTotals,
 }
 
 // Collections returns a slice of all the collections used
@@ -1471,13 +2446,197 @@ func ReaderAtSeeker(r io.ReadSeeker) io.ReaderAt {
 // Search searches the store for the given SearchParams.
 // It returns a SearchResult containing the results of the search.
 func (store *Store) Search(sp SearchParams) (SearchResult, error) {
+	if err := store.prepareSearch(&sp); err != nil {
+		return SearchResult{}, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 	result, err := store.ES.search(sp)
+	if err == nil {
+		return result, nil
+	}
+	if !store.pool.config.SearchFallback || !elasticsearch.IsTransient(errgo.Cause(err)) {
+		// Only fall back to the database when the search index
+		// is unreachable or failing; other errors, such as a
+		// malformed query, would not be fixed by retrying later.
+		return SearchResult{}, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if !canSearchDatabase(sp) {
+		return SearchResult{}, errgo.WithCausef(err, params.ErrServiceUnavailable, "search index unavailable")
+	}
+	logger.Warningf("search index unavailable, searching database instead: %v", err)
+	result, err = store.searchDatabase(sp)
 	if err != nil {
-		return SearchResult{}, errgo.Mask(err)
+		return SearchResult{}, errgo.Notef(err, "cannot search database")
 	}
 	return result, nil
 }
 
+// prepareSearch checks that sp describes a valid search and fills in
+// the parts of it that depend on the store configuration. An error
+// with a params.ErrBadRequest cause is returned if the search is not
+// valid.
+func (store *Store) prepareSearch(sp *SearchParams) error {
+	if err := store.checkAdminOnlyFilters(sp); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if sp.Channel != "" && !isSearchChannel(sp.Channel) {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot search channel %q", sp.Channel)
+	}
+	text, negated := splitNegatedTerms(sp.Text)
+	if len(negated) > 0 && text == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "search text must contain a term that is not negated")
+	}
+	if prefix, ok := wildcardPrefix(text); ok && prefix == "" {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "wildcard search requires a prefix")
+	}
+	if max := store.pool.config.MaxSearchLimit; sp.Limit > max {
+		sp.Limit = max
+	}
+	sp.boosts = searchBoosts{
+		downloads:   store.pool.config.DownloadBoost,
+		promulgated: store.pool.config.PromulgatedBoost,
+	}
+	if len(sp.Downloaded) > 0 {
+		related, err := store.relatedTerms(sp.Downloaded)
+		if err != nil {
+			return errgo.Notef(err, "cannot find downloaded entities")
+		}
+		sp.related = related
+	}
+	return nil
+}
+
+// searchStreamPageSize holds the number of results fetched from the
+// search index at a time by SearchStream. It is a variable so that it
+// can be changed in tests.
+var searchStreamPageSize = 100
+
+// SearchStream is like Search except that, rather than returning the
+// results, it calls f with each matching entity in turn, in the order
+// specified by sp.Sort. The results are fetched from the search index
+// a page at a time using a scrolled search, so that memory use is
+// bounded however many entities match and the results are consistent
+// even if the index changes during the search. If sp.Limit is
+// non-zero, at most that many entities are returned; otherwise all
+// matching entities are returned. The Skip, Cursor, Collapse, Facets,
+// TypeCounts, Suggest and Highlight fields of sp are ignored.
+//
+// If f returns an error, the search stops and SearchStream returns
+// that error.
+func (store *Store) SearchStream(sp SearchParams, f func(*mongodoc.Entity) error) error {
+	limit := sp.Limit
+	sp.Limit = 0
+	sp.Skip = 0
+	sp.Cursor = ""
+	sp.Collapse = CollapseNone
+	sp.Facets = nil
+	sp.TypeCounts = false
+	sp.Suggest = false
+	sp.Highlight = false
+	if err := store.prepareSearch(&sp); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	pageSize := searchStreamPageSize
+	if max := store.pool.config.MaxSearchLimit; pageSize > max {
+		pageSize = max
+	}
+	if err := store.ES.searchStream(sp, pageSize, limit, f); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return nil
+}
+
+// checkAdminOnlyFilters checks that the filters in sp that are
+// restricted to administrators (see adminOnlyFilters) are only used in
+// admin searches. If the store is configured to ignore such filters,
+// they are removed from sp instead of causing an error with a
+// params.ErrBadRequest cause.
+func (s *Store) checkAdminOnlyFilters(sp *SearchParams) error {
+	if sp.Admin {
+		return nil
+	}
+	var err error
+	if sp.Filters, err = s.removeAdminOnlyFilters(sp.Filters); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if sp.Exclude, err = s.removeAdminOnlyFilters(sp.Exclude); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if sp.FiltersAll, err = s.removeAdminOnlyFilters(sp.FiltersAll); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	return nil
+}
+
+// removeAdminOnlyFilters returns filters without any admin-only filters,
+// or an error if the store is not configured to ignore them. The
+// original map is not modified.
+func (s *Store) removeAdminOnlyFilters(filters map[string][]string) (map[string][]string, error) {
+	var allowed map[string][]string
+	for k := range filters {
+		if !adminOnlyFilters[k] {
+			continue
+		}
+		if !s.pool.config.IgnoreAdminOnlyFilters {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "filter %q is restricted to administrators", k)
+		}
+		if allowed == nil {
+			allowed = make(map[string][]string, len(filters))
+			for k, v := range filters {
+				allowed[k] = v
+			}
+		}
+		delete(allowed, k)
+	}
+	if allowed == nil {
+		return filters, nil
+	}
+	return allowed, nil
+}
+
+// HasOnlyDeprecatedSeries reports whether e is a charm whose
+// supported series are all configured as deprecated (see
+// ServerParams.DeprecatedSeries). Bundles are never reported as
+// deprecated.
+func (s *Store) HasOnlyDeprecatedSeries(e *mongodoc.Entity) bool {
+	if e.URL.Series == "bundle" || len(e.SupportedSeries) == 0 {
+		return false
+	}
+	for _, series := range e.SupportedSeries {
+		if !s.isDeprecatedSeries(series) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDeprecatedSeries reports whether the given series is configured as
+// deprecated.
+func (s *Store) isDeprecatedSeries(series string) bool {
+	for _, d := range s.pool.config.DeprecatedSeries {
+		if d == series {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchOwners returns the distinct owners of the charms and bundles
+// that match the given SearchParams, along with the number of matching
+// charms and bundles for each owner, ordered by descending count and
+// then by owner name. The first sp.Skip owners are omitted, and at most
+// sp.Limit owners are returned if it is non-zero, so clients can page
+// through all the owners. The Sort and Include parameters are ignored.
+func (store *Store) SearchOwners(sp SearchParams) ([]OwnerCount, error) {
+	if err := store.checkAdminOnlyFilters(&sp); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	owners, err := store.ES.searchOwners(sp)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return owners, nil
+}
+
 var listFilters = map[string]string{
 	"name":        "name",
 	"owner":       "user",
@@ -1632,16 +2791,155 @@ func (lq *ListQuery) Iter(fields map[string]int) *mgo.Iter {
 
 // SynchroniseElasticsearch creates new indexes in elasticsearch
 // and populates them with the current data from the mongodb database.
+// It is equivalent to Reindex.
 func (s *Store) SynchroniseElasticsearch() error {
-	if err := s.ES.ensureIndexes(true); err != nil {
+	return s.Reindex()
+}
+
+// Reindex creates a new search index and populates it with the
+// current data from the mongodb database. Once the new index has been
+// fully populated and holds a document for every charm and bundle
+// that the database says should be indexed, it atomically replaces
+// the current index, so searches never use a partially populated
+// index. If anything fails, the new index is deleted and the current
+// index is left in place.
+//
+// If the reindex is stopped by a call to CancelReindex, the new
+// index is discarded and an error with an ErrReindexCancelled cause
+// is returned.
+func (s *Store) Reindex() error {
+	if s.ES == nil || s.ES.Database == nil {
+		return nil
+	}
+	cancel, err := s.pool.startReindex()
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer s.pool.endReindex()
+	old, dv, err := s.ES.getCurrentVersion()
+	if err != nil {
+		return errgo.Notef(err, "cannot get current version")
+	}
+	index, err := s.ES.newIndex()
+	if err != nil {
 		return errgo.Notef(err, "cannot create indexes")
 	}
-	if err := s.syncSearch(); err != nil {
-		return errgo.Notef(err, "cannot synchronise indexes")
+	si := &SearchIndex{
+		Database: s.ES.Database,
+		Index:    index,
+		retries:  s.ES.retries,
+	}
+	if err := s.syncSearchIndex(si, cancel); err != nil {
+		s.ES.deleteIndex(index)
+		return errgo.NoteMask(err, "cannot synchronise indexes", errgo.Is(ErrReindexCancelled))
+	}
+	n, err := s.searchDocumentCount(si)
+	if err != nil {
+		s.ES.deleteIndex(index)
+		return errgo.Notef(err, "cannot count indexable entities")
+	}
+	if err := si.checkDocumentCount(n); err != nil {
+		s.ES.deleteIndex(index)
+		return errgo.Notef(err, "cannot verify new index")
+	}
+	if err := s.ES.activateIndex(index, old, dv); err != nil {
+		return errgo.Notef(err, "cannot create indexes")
 	}
 	return nil
 }
 
+// CancelReindex stops any reindex started by SynchroniseElasticsearch
+// that is currently in progress. The current indexes are left in place.
+// It reports whether there was a reindex to cancel.
+func (s *Store) CancelReindex() bool {
+	return s.pool.cancelReindex()
+}
+
+// ReindexProgress holds the progress of a population of the search
+// index.
+type ReindexProgress struct {
+	// InProgress holds whether the search index is being
+	// populated.
+	InProgress bool
+
+	// Done holds the number of entities indexed so far.
+	Done int
+
+	// Total holds the number of entities to index.
+	Total int
+}
+
+// ReindexProgress returns the progress of the current population of
+// the search index, either by SynchroniseElasticsearch or when the
+// server starts. If no population is in progress, it returns the
+// progress of the most recent one.
+func (s *Store) ReindexProgress() ReindexProgress {
+	s.pool.mu.Lock()
+	defer s.pool.mu.Unlock()
+	return s.pool.reindexProgress
+}
+
+// startReindexProgress resets the reindex progress at the start of a
+// population of the search index with the given number of entities.
+func (p *Pool) startReindexProgress(total int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reindexProgress = ReindexProgress{
+		InProgress: true,
+		Total:      total,
+	}
+}
+
+// addReindexProgress records that another entity has been indexed.
+func (p *Pool) addReindexProgress() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reindexProgress.Done++
+}
+
+// endReindexProgress records that the population of the search index
+// has finished.
+func (p *Pool) endReindexProgress() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reindexProgress.InProgress = false
+}
+
+// startReindex records that a reindex is in progress and returns a
+// channel that will be closed if the reindex is cancelled.
+func (p *Pool) startReindex() (<-chan struct{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.reindexCancel != nil {
+		return nil, errgo.New("reindex already in progress")
+	}
+	p.reindexCancel = make(chan struct{})
+	return p.reindexCancel, nil
+}
+
+// endReindex records that the current reindex has finished.
+func (p *Pool) endReindex() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reindexCancel = nil
+}
+
+// cancelReindex cancels the current reindex, if any.
+func (p *Pool) cancelReindex() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.reindexCancel == nil {
+		return false
+	}
+	select {
+	case <-p.reindexCancel:
+		// Already cancelled.
+	default:
+		close(p.reindexCancel)
+	}
+	return true
+}
+
 // EntityResolvedURL returns the ResolvedURL for the entity. It requires
 // that the PromulgatedURL field has been filled out in the entity.
 func EntityResolvedURL(e *mongodoc.Entity) *router.ResolvedURL {
@@ -145,6 +145,276 @@ func (s *StoreSuite) testURLFinding(c *gc.C, check func(store *Store, expand *ch
 	}
 }
 
+func (s *StoreSuite) TestExpandURLWithChannelNoChannel(c *gc.C) {
+	s.testURLFinding(c, func(store *Store, expand *charm.URL, expect []*router.ResolvedURL) {
+		// With no channel or the unpublished channel, all
+		// matching entities are found, as for EntitiesQuery.
+		for _, ch := range []params.Channel{params.NoChannel, params.UnpublishedChannel} {
+			q, err := store.ExpandURLWithChannel(expand, ch)
+			c.Assert(err, gc.Equals, nil)
+			var gotEntities []*mongodoc.Entity
+			err = q.Select(FieldSelector("_id", "promulgated-url")).All(&gotEntities)
+			c.Assert(err, gc.Equals, nil)
+			if expand.User == "" {
+				sort.Sort(entitiesByPromulgatedURL(gotEntities))
+			} else {
+				sort.Sort(entitiesByURL(gotEntities))
+			}
+			c.Assert(gotEntities, gc.HasLen, len(expect))
+			for i, url := range expect {
+				c.Assert(gotEntities[i], jc.DeepEquals, &mongodoc.Entity{
+					URL:            &url.URL,
+					PromulgatedURL: url.PromulgatedURL(),
+				}, gc.Commentf("channel %q, index %d", ch, i))
+			}
+		}
+	})
+}
+
+var expandURLWithChannelTests = []struct {
+	expand  string
+	channel params.Channel
+	expect  []string
+}{{
+	expand:  "wordpress",
+	channel: params.StableChannel,
+	expect:  []string{"cs:~charmers/precise/wordpress-23", "cs:~charmers/precise/wordpress-25"},
+}, {
+	expand:  "wordpress",
+	channel: params.EdgeChannel,
+	expect:  []string{"cs:~charmers/precise/wordpress-24", "cs:~charmers/precise/wordpress-25"},
+}, {
+	expand:  "~charmers/precise/wordpress",
+	channel: params.StableChannel,
+	expect:  []string{"cs:~charmers/precise/wordpress-23", "cs:~charmers/precise/wordpress-25"},
+}, {
+	expand:  "~charmers/precise/wordpress-24",
+	channel: params.StableChannel,
+	expect:  []string{},
+}, {
+	expand:  "~charmers/precise/wordpress-24",
+	channel: params.EdgeChannel,
+	expect:  []string{"cs:~charmers/precise/wordpress-24"},
+}, {
+	expand:  "wordpress",
+	channel: params.CandidateChannel,
+	expect:  []string{},
+}, {
+	expand:  "wordpress",
+	channel: params.UnpublishedChannel,
+	expect: []string{
+		"cs:~charmers/precise/wordpress-23",
+		"cs:~charmers/precise/wordpress-24",
+		"cs:~charmers/precise/wordpress-25",
+		"cs:~charmers/precise/wordpress-26",
+	},
+}}
+
+func (s *StoreSuite) TestExpandURLWithChannel(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ch := storetesting.Charms.CharmDir("wordpress")
+	published := map[string][]params.Channel{
+		"23 cs:~charmers/precise/wordpress-23": {params.StableChannel},
+		"24 cs:~charmers/precise/wordpress-24": {params.EdgeChannel},
+		"25 cs:~charmers/precise/wordpress-25": {params.StableChannel, params.EdgeChannel},
+		"26 cs:~charmers/precise/wordpress-26": nil,
+	}
+	for id, channels := range published {
+		url := MustParseResolvedURL(id)
+		err := store.AddCharmWithArchive(url, ch)
+		c.Assert(err, gc.Equals, nil)
+		if len(channels) > 0 {
+			err = store.Publish(url, nil, channels...)
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
+	for i, test := range expandURLWithChannelTests {
+		c.Logf("test %d: %s in %s", i, test.expand, test.channel)
+		q, err := store.ExpandURLWithChannel(charm.MustParseURL(test.expand), test.channel)
+		c.Assert(err, gc.Equals, nil)
+		var entities []*mongodoc.Entity
+		err = q.Select(FieldSelector("_id")).All(&entities)
+		c.Assert(err, gc.Equals, nil)
+		sort.Sort(entitiesByURL(entities))
+		urls := make([]string, len(entities))
+		for i, e := range entities {
+			urls[i] = e.URL.String()
+		}
+		c.Assert(urls, jc.DeepEquals, test.expect)
+	}
+
+	_, err := store.ExpandURLWithChannel(charm.MustParseURL("wordpress"), "bad")
+	c.Assert(err, gc.ErrorMatches, `invalid channel "bad"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+var listOwnerEntitiesTests = []struct {
+	about   string
+	owner   string
+	channel params.Channel
+	groups  []string
+	expect  []OwnerEntity
+}{{
+	about: "only entities readable by everyone",
+	owner: "charmers",
+	expect: []OwnerEntity{{
+		URL:       charm.MustParseURL("cs:~charmers/precise/wordpress-1"),
+		Downloads: 3,
+	}},
+}, {
+	about:  "entities readable by the owner",
+	owner:  "charmers",
+	groups: []string{"charmers"},
+	expect: []OwnerEntity{{
+		URL:       charm.MustParseURL("cs:~charmers/trusty/mysql-1"),
+		Downloads: 1,
+	}, {
+		URL:       charm.MustParseURL("cs:~charmers/precise/wordpress-1"),
+		Downloads: 3,
+	}},
+}, {
+	about:   "edge channel",
+	owner:   "charmers",
+	channel: params.EdgeChannel,
+	groups:  []string{"charmers"},
+	expect: []OwnerEntity{{
+		URL:       charm.MustParseURL("cs:~charmers/precise/wordpress-2"),
+		Downloads: 3,
+	}},
+}, {
+	about:   "unpublished channel",
+	owner:   "charmers",
+	channel: params.UnpublishedChannel,
+	groups:  []string{"charmers"},
+	expect: []OwnerEntity{{
+		URL:       charm.MustParseURL("cs:~charmers/trusty/mysql-1"),
+		Downloads: 1,
+	}, {
+		URL:       charm.MustParseURL("cs:~charmers/precise/wordpress-2"),
+		Downloads: 3,
+	}},
+}, {
+	about:  "unknown owner",
+	owner:  "bob",
+	groups: []string{"bob"},
+	expect: []OwnerEntity{},
+}}
+
+func (s *StoreSuite) TestListOwnerEntities(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	entities := []struct {
+		id        string
+		channels  []params.Channel
+		downloads int
+	}{
+		{"~charmers/precise/wordpress-0", []params.Channel{params.StableChannel}, 1},
+		{"~charmers/precise/wordpress-1", []params.Channel{params.StableChannel}, 2},
+		{"~charmers/precise/wordpress-2", []params.Channel{params.EdgeChannel}, 0},
+		{"~charmers/trusty/mysql-0", []params.Channel{params.StableChannel}, 0},
+		{"~charmers/trusty/mysql-1", []params.Channel{params.StableChannel}, 1},
+	}
+	for _, e := range entities {
+		url := router.MustNewResolvedURL(e.id, -1)
+		err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir(url.URL.Name))
+		c.Assert(err, gc.Equals, nil)
+		err = store.Publish(url, nil, e.channels...)
+		c.Assert(err, gc.Equals, nil)
+		for i := 0; i < e.downloads; i++ {
+			err := store.IncrementDownloadCounts(url)
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
+	err := store.SetPerms(charm.MustParseURL("~charmers/wordpress"), "stable.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+
+	for i, test := range listOwnerEntitiesTests {
+		c.Logf("test %d: %s", i, test.about)
+		results, err := store.ListOwnerEntities(test.owner, test.channel, test.groups)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(results, jc.DeepEquals, test.expect)
+	}
+
+	_, err = store.ListOwnerEntities("charmers", "bad", nil)
+	c.Assert(err, gc.ErrorMatches, `invalid channel "bad"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *StoreSuite) TestUserGroupsCache(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		GroupsCacheMaxAge: time.Hour,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	fetchCount := 0
+	fetch := func() ([]string, error) {
+		fetchCount++
+		return []string{"group1", "group2"}, nil
+	}
+
+	store := p.Store()
+	defer store.Close()
+	groups, err := store.UserGroups("bob", fetch)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []string{"group1", "group2"})
+	c.Assert(fetchCount, gc.Equals, 1)
+
+	// A second lookup within the cache lifetime, even from
+	// another store, does not call fetch.
+	store1 := p.Store()
+	defer store1.Close()
+	groups, err = store1.UserGroups("bob", fetch)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(groups, jc.DeepEquals, []string{"group1", "group2"})
+	c.Assert(fetchCount, gc.Equals, 1)
+
+	// Other users are fetched separately.
+	_, err = store.UserGroups("alice", fetch)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(fetchCount, gc.Equals, 2)
+
+	// Invalidating the cached groups causes them to be fetched again.
+	store.InvalidateUserGroups("bob")
+	_, err = store.UserGroups("bob", fetch)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(fetchCount, gc.Equals, 3)
+
+	// Errors are not cached.
+	_, err = store.UserGroups("charlie", func() ([]string, error) {
+		return nil, errgo.New("identity service unavailable")
+	})
+	c.Assert(err, gc.ErrorMatches, "identity service unavailable")
+	_, err = store.UserGroups("charlie", fetch)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(fetchCount, gc.Equals, 4)
+}
+
+func (s *StoreSuite) TestUserGroupsCacheExpiry(c *gc.C) {
+	p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		GroupsCacheMaxAge: time.Millisecond,
+	})
+	c.Assert(err, gc.Equals, nil)
+	defer p.Close()
+	store := p.Store()
+	defer store.Close()
+	fetchCount := 0
+	fetch := func() ([]string, error) {
+		fetchCount++
+		return []string{"group1"}, nil
+	}
+	_, err = store.UserGroups("bob", fetch)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(fetchCount, gc.Equals, 1)
+
+	// Group membership is fetched again once the cache
+	// lifetime has passed.
+	time.Sleep(5 * time.Millisecond)
+	_, err = store.UserGroups("bob", fetch)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(fetchCount, gc.Equals, 2)
+}
+
 func (s *StoreSuite) TestRequestStore(c *gc.C) {
 	config := ServerParams{
 		HTTPRequestWaitDuration: time.Millisecond,
@@ -321,12 +591,15 @@ func (s *StoreSuite) TestFindEntity(c *gc.C) {
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(entity0, gc.NotNil)
 	c.Assert(entity0.Size, gc.Not(gc.Equals), 0)
+	c.Assert(entity0.CharmConfig, gc.NotNil)
 
 	// Check that the field selector works.
 	entity2, err := store.FindEntity(rurl, FieldSelector("blobhash"))
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(entity2.BlobHash, gc.Equals, entity0.BlobHash)
 	c.Assert(entity2.Size, gc.Equals, int64(0))
+	c.Assert(entity2.CharmConfig, gc.IsNil)
+	c.Assert(entity2.CharmMeta, gc.IsNil)
 
 	rurl.URL.Name = "another"
 	entity3, err := store.FindEntity(rurl, nil)
@@ -915,6 +1188,38 @@ func (s *StoreSuite) TestOpenBlob(c *gc.C) {
 	info, err := f.Stat()
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(blob.Size, gc.Equals, info.Size())
+
+	data, err := ioutil.ReadFile(charmArchive.Path)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(blob.Hash256, gc.Equals, fmt.Sprintf("%x", sha256.Sum256(data)))
+}
+
+func (s *StoreSuite) TestBlobHash256CalculatedLazily(c *gc.C) {
+	charmArchive := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := router.MustNewResolvedURL("cs:~charmers/precise/wordpress-23", 23)
+	err := store.AddCharmWithArchive(url, charmArchive)
+	c.Assert(err, gc.Equals, nil)
+	data, err := ioutil.ReadFile(charmArchive.Path)
+	c.Assert(err, gc.Equals, nil)
+	expectHash256 := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	// Simulate an entity created before the SHA256 hash was recorded.
+	err = store.DB.Entities().UpdateId(&url.URL, bson.D{{
+		"$unset", bson.D{{"blobhash256", ""}},
+	}})
+	c.Assert(err, gc.Equals, nil)
+
+	blob, err := store.OpenBlob(url)
+	c.Assert(err, gc.Equals, nil)
+	blob.Close()
+	c.Assert(blob.Hash256, gc.Equals, expectHash256)
+
+	// The hash has been stored in the entity.
+	entity, err := store.FindEntity(url, FieldSelector("blobhash256"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.BlobHash256, gc.Equals, expectHash256)
 }
 
 func (s *StoreSuite) TestOpenBlobPreV5(c *gc.C) {
@@ -1098,7 +1403,8 @@ func (s *StoreSuite) TestCollections(c *gc.C) {
 	c.Assert(err, gc.Equals, nil)
 	// Some collections don't have indexes so they are created only when used.
 	createdOnUse := map[string]bool{
-		"migrations": true,
+		"migrations":       true,
+		"juju.stat.totals": true,
 	}
 	// Check that all collections mentioned by Collections are actually created.
 	for _, coll := range colls {
@@ -1871,9 +2177,8 @@ var findBestEntityTests = []struct {
 	expectError:      "no matching charm or bundle for cs:mongodb",
 	expectErrorCause: params.ErrNotFound,
 }, {
-	url:              "~charmers/trusty/apache",
-	expectError:      "no matching charm or bundle for cs:~charmers/trusty/apache",
-	expectErrorCause: params.ErrNotFound,
+	url:      "~charmers/trusty/apache",
+	expectID: router.MustNewResolvedURL("~charmers/trusty/apache-0", 0),
 }, {
 	url:              "~charmers/trusty/apache",
 	channel:          params.StableChannel,
@@ -1903,9 +2208,8 @@ var findBestEntityTests = []struct {
 	channel:  params.UnpublishedChannel,
 	expectID: router.MustNewResolvedURL("~charmers/trusty/apache-0", 0),
 }, {
-	url:              "trusty/apache",
-	expectError:      "no matching charm or bundle for cs:trusty/apache",
-	expectErrorCause: params.ErrNotFound,
+	url:      "trusty/apache",
+	expectID: router.MustNewResolvedURL("~charmers/trusty/apache-0", 0),
 }, {
 	url:              "trusty/apache",
 	channel:          params.StableChannel,
@@ -2355,9 +2659,8 @@ var findBestEntityTests = []struct {
 	channel:  params.UnpublishedChannel,
 	expectID: router.MustNewResolvedURL("~openstack-charmers/trusty/ceph-0", 1),
 }, {
-	url:              "~openstack-charmers/trusty/ceph",
-	expectError:      "no matching charm or bundle for cs:~openstack-charmers/trusty/ceph",
-	expectErrorCause: params.ErrNotFound,
+	url:      "~openstack-charmers/trusty/ceph",
+	expectID: router.MustNewResolvedURL("~openstack-charmers/trusty/ceph-0", 1),
 }, {
 	url:              "~openstack-charmers/trusty/ceph",
 	channel:          params.StableChannel,
@@ -2402,9 +2705,8 @@ var findBestEntityTests = []struct {
 	channel:  params.UnpublishedChannel,
 	expectID: router.MustNewResolvedURL("~openstack-charmers/trusty/ceph-0", 1),
 }, {
-	url:              "trusty/ceph",
-	expectError:      "no matching charm or bundle for cs:trusty/ceph",
-	expectErrorCause: params.ErrNotFound,
+	url:      "trusty/ceph",
+	expectID: router.MustNewResolvedURL("~openstack-charmers/trusty/ceph-0", 1),
 }, {
 	url:              "trusty/ceph",
 	channel:          params.StableChannel,
@@ -2419,9 +2721,8 @@ var findBestEntityTests = []struct {
 	channel:  params.UnpublishedChannel,
 	expectID: router.MustNewResolvedURL("~openstack-charmers/trusty/ceph-0", 1),
 }, {
-	url:              "ceph",
-	expectError:      "no matching charm or bundle for cs:ceph",
-	expectErrorCause: params.ErrNotFound,
+	url:      "ceph",
+	expectID: router.MustNewResolvedURL("~openstack-charmers/trusty/ceph-0", 1),
 }, {
 	url:              "ceph",
 	channel:          params.StableChannel,
@@ -2492,6 +2793,94 @@ func (s *StoreSuite) TestFindBestEntity(c *gc.C) {
 	}
 }
 
+var resolveChannelsTests = []struct {
+	about           string
+	resolveChannels []params.Channel
+	url             string
+	expectID        *router.ResolvedURL
+	expectError     string
+}{{
+	about:    "stable preferred over higher revisions",
+	url:      "~charmers/trusty/django",
+	expectID: router.MustNewResolvedURL("~charmers/trusty/django-0", -1),
+}, {
+	about:    "candidate preferred over edge",
+	url:      "~charmers/trusty/redis",
+	expectID: router.MustNewResolvedURL("~charmers/trusty/redis-0", -1),
+}, {
+	about:    "fall back to edge",
+	url:      "~charmers/trusty/haproxy",
+	expectID: router.MustNewResolvedURL("~charmers/trusty/haproxy-0", -1),
+}, {
+	about:       "unpublished not resolved",
+	url:         "~charmers/trusty/varnish",
+	expectError: "no matching charm or bundle for cs:~charmers/trusty/varnish",
+}, {
+	about:    "unpublished resolved with revision",
+	url:      "~charmers/trusty/varnish-0",
+	expectID: router.MustNewResolvedURL("~charmers/trusty/varnish-0", -1),
+}, {
+	about:           "custom order",
+	resolveChannels: []params.Channel{params.EdgeChannel, params.StableChannel},
+	url:             "~charmers/trusty/django",
+	expectID:        router.MustNewResolvedURL("~charmers/trusty/django-2", -1),
+}, {
+	about:           "custom order without fallback",
+	resolveChannels: []params.Channel{params.StableChannel},
+	url:             "~charmers/trusty/haproxy",
+	expectError:     "no matching charm or bundle for cs:~charmers/trusty/haproxy",
+}}
+
+func (s *StoreSuite) TestFindBestEntityResolveChannels(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, add := range []struct {
+		id       string
+		channels []params.Channel
+	}{
+		{"~charmers/trusty/django-0", []params.Channel{params.StableChannel}},
+		{"~charmers/trusty/django-1", []params.Channel{params.CandidateChannel}},
+		{"~charmers/trusty/django-2", []params.Channel{params.EdgeChannel}},
+		{"~charmers/trusty/redis-0", []params.Channel{params.CandidateChannel}},
+		{"~charmers/trusty/redis-1", []params.Channel{params.EdgeChannel}},
+		{"~charmers/trusty/haproxy-0", []params.Channel{params.EdgeChannel}},
+		{"~charmers/trusty/varnish-0", nil},
+	} {
+		id := router.MustNewResolvedURL(add.id, -1)
+		err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+		if len(add.channels) > 0 {
+			err = store.Publish(id, nil, add.channels...)
+			c.Assert(err, gc.Equals, nil)
+		}
+	}
+	for i, test := range resolveChannelsTests {
+		c.Logf("test %d: %s", i, test.about)
+		p, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+			ResolveChannels: test.resolveChannels,
+		})
+		c.Assert(err, gc.Equals, nil)
+		store1 := p.Store()
+		entity, err := store1.FindBestEntity(charm.MustParseURL(test.url), params.NoChannel, nil)
+		store1.Close()
+		p.Close()
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+			continue
+		}
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(EntityResolvedURL(entity), jc.DeepEquals, test.expectID)
+	}
+}
+
+func (s *StoreSuite) TestNewPoolInvalidResolveChannel(c *gc.C) {
+	_, err := NewPool(s.Session.DB("juju_test"), nil, nil, ServerParams{
+		ResolveChannels: []params.Channel{params.StableChannel, params.UnpublishedChannel},
+	})
+	c.Assert(err, gc.ErrorMatches, `invalid resolve channel "unpublished"`)
+}
+
 var matchingInterfacesQueryTests = []struct {
 	required []string
 	provided []string
@@ -2557,6 +2946,53 @@ func (s *StoreSuite) TestMatchingInterfacesQuery(c *gc.C) {
 	}
 }
 
+var entitiesByInterfaceTests = []struct {
+	iface  string
+	role   InterfaceRole
+	expect []string
+}{{
+	iface:  "mysql",
+	role:   RoleProvides,
+	expect: []string{"cs:~charmers/trusty/mysql-1"},
+}, {
+	iface:  "mysql",
+	role:   RoleRequires,
+	expect: []string{"cs:~charmers/trusty/wordpress-1"},
+}, {
+	iface: "mysql",
+	role:  RoleAny,
+	expect: []string{
+		"cs:~charmers/trusty/mysql-1",
+		"cs:~charmers/trusty/wordpress-1",
+	},
+}, {
+	iface: "no-such-interface",
+	role:  RoleAny,
+}}
+
+func (s *StoreSuite) TestEntitiesByInterface(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, name := range []string{"mysql", "wordpress"} {
+		url := router.MustNewResolvedURL("~charmers/trusty/"+name+"-1", -1)
+		err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir(name))
+		c.Assert(err, gc.Equals, nil)
+	}
+	for i, test := range entitiesByInterfaceTests {
+		c.Logf("test %d: %s %s", i, test.role, test.iface)
+		entities, err := store.EntitiesByInterface(test.iface, test.role, map[string]int{"_id": 1})
+		c.Assert(err, gc.Equals, nil)
+		var got []string
+		for _, e := range entities {
+			got = append(got, e.URL.String())
+		}
+		c.Assert(got, jc.DeepEquals, test.expect)
+	}
+	_, err := store.EntitiesByInterface("mysql", "consumes", nil)
+	c.Assert(err, gc.ErrorMatches, `invalid interface role "consumes"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
 var updateEntityTests = []struct {
 	url       string
 	expectErr string
@@ -2592,6 +3028,73 @@ func (s *StoreSuite) TestUpdateEntity(c *gc.C) {
 	}
 }
 
+func (s *StoreSuite) TestExtraInfo(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := router.MustNewResolvedURL("~charmers/trusty/wordpress-10", -1)
+	err := store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.SetExtraInfo(id, "ci:build-url", json.RawMessage(`"https://ci.example.com/build/1"`))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetExtraInfo(id, "provenance:commit", json.RawMessage(`{"repo":"example","rev":"abc123"}`))
+	c.Assert(err, gc.Equals, nil)
+
+	// Each key can be retrieved individually.
+	val, err := store.ExtraInfo(id, "ci:build-url")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(val), gc.Equals, `"https://ci.example.com/build/1"`)
+	val, err = store.ExtraInfo(id, "provenance:commit")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(val), jc.JSONEquals, map[string]string{
+		"repo": "example",
+		"rev":  "abc123",
+	})
+
+	// The whole map is held in the entity.
+	entity, err := store.FindEntity(id, FieldSelector("extrainfo"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.ExtraInfo, gc.HasLen, 2)
+	c.Assert(string(entity.ExtraInfo["ci:build-url"]), gc.Equals, `"https://ci.example.com/build/1"`)
+
+	// Setting a nil value removes the key.
+	err = store.SetExtraInfo(id, "ci:build-url", nil)
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.ExtraInfo(id, "ci:build-url")
+	c.Assert(err, gc.ErrorMatches, `extra-info key "ci:build-url" not found for cs:~charmers/trusty/wordpress-10`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrMetadataNotFound)
+
+	// Setting a null value also removes the key, as it does
+	// with a PUT to meta/extra-info.
+	err = store.SetExtraInfo(id, "provenance:commit", json.RawMessage(`null`))
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.ExtraInfo(id, "provenance:commit")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrMetadataNotFound)
+
+	// Keys that are not namespaced are allowed, as they are
+	// when set with a PUT to meta/extra-info.
+	err = store.SetExtraInfo(id, "featured", json.RawMessage(`true`))
+	c.Assert(err, gc.Equals, nil)
+	val, err = store.ExtraInfo(id, "featured")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(val), gc.Equals, `true`)
+
+	// Keys must be usable as mongo field names.
+	for _, key := range []string{"", "ci:build.url", "ci:$build", "ci/build"} {
+		err = store.SetExtraInfo(id, key, json.RawMessage(`"x"`))
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest, gc.Commentf("key %q", key))
+	}
+
+	// Values must be valid JSON.
+	err = store.SetExtraInfo(id, "ci:build-url", json.RawMessage(`not json`))
+	c.Assert(err, gc.ErrorMatches, `invalid JSON value for extra-info key "ci:build-url"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	// The entity must exist.
+	err = store.SetExtraInfo(router.MustNewResolvedURL("~charmers/trusty/missing-1", -1), "ci:build-url", json.RawMessage(`"x"`))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
 var updateBaseEntityTests = []struct {
 	url       string
 	expectErr string
@@ -2995,6 +3498,8 @@ func (s *StoreSuite) TestSetPromulgated(c *gc.C) {
 		c.Assert(err, gc.Equals, nil)
 		_, err = store.DB.BaseEntities().RemoveAll(nil)
 		c.Assert(err, gc.Equals, nil)
+		_, err = store.DB.Revisions().RemoveAll(nil)
+		c.Assert(err, gc.Equals, nil)
 		for _, entity := range test.entities {
 			err := store.DB.Entities().Insert(entity)
 			c.Assert(err, gc.Equals, nil)
@@ -3028,6 +3533,59 @@ func (s *StoreSuite) TestSetPromulgated(c *gc.C) {
 	}
 }
 
+func (s *StoreSuite) TestPromulgate(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/trusty/wordpress-0", -1)
+	addCharmForSearch(c, store, url, storetesting.NewCharm(&charm.Meta{
+		Name: "wordpress",
+	}), []string{params.Everyone}, 0)
+
+	searchPromulgated := func() []*mongodoc.Entity {
+		err := store.ES.RefreshIndex(s.TestIndex)
+		c.Assert(err, gc.Equals, nil)
+		res, err := store.Search(SearchParams{
+			Filters: map[string][]string{"promulgated": {"1"}},
+		})
+		c.Assert(err, gc.Equals, nil)
+		return res.Results
+	}
+	c.Assert(searchPromulgated(), gc.HasLen, 0)
+
+	err := store.Promulgate(charm.MustParseURL("~charmers/wordpress"), true)
+	c.Assert(err, gc.Equals, nil)
+	results := searchPromulgated()
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(results[0].PromulgatedURL.String(), gc.Equals, "cs:trusty/wordpress-0")
+
+	err = store.Promulgate(charm.MustParseURL("~charmers/wordpress"), false)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(searchPromulgated(), gc.HasLen, 0)
+	entity, err := store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.PromulgatedURL, gc.IsNil)
+	c.Assert(entity.PromulgatedRevision, gc.Equals, -1)
+	_, err = store.FindBestEntity(charm.MustParseURL("trusty/wordpress-0"), params.NoChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// Promulgating again does not reuse the previous
+	// promulgated revision.
+	err = store.Promulgate(charm.MustParseURL("~charmers/wordpress"), true)
+	c.Assert(err, gc.Equals, nil)
+	results = searchPromulgated()
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(results[0].PromulgatedURL.String(), gc.Equals, "cs:trusty/wordpress-1")
+}
+
+func (s *StoreSuite) TestPromulgateNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.Promulgate(charm.MustParseURL("~charmers/wordpress"), true)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.Promulgate(charm.MustParseURL("~charmers/wordpress"), false)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
 func (s *StoreSuite) TestSetPromulgatedUpdateSearch(c *gc.C) {
 	store := s.newStore(c, true)
 	defer store.Close()
@@ -3397,6 +3955,29 @@ func (s *StoreSuite) TestBundleCharms(c *gc.C) {
 	}
 }
 
+func (s *StoreSuite) TestLatestRevision(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	ch := storetesting.NewCharm(nil)
+	for _, id := range MustParseResolvedURLs([]string{
+		"2 ~charmers/trusty/wordpress-4",
+		"~charmers/trusty/wordpress-2",
+		"5 ~charmers/precise/wordpress-7",
+		"~charmers/utopic/wordpress-3",
+	}) {
+		err := store.AddCharmWithArchive(id, ch)
+		c.Assert(err, gc.Equals, nil)
+	}
+	for _, url := range []string{"wordpress", "~charmers/wordpress", "~charmers/trusty/wordpress-2"} {
+		rev, promulgatedRev, err := store.LatestRevision(charm.MustParseURL(url))
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(rev, gc.Equals, 7)
+		c.Assert(promulgatedRev, gc.Equals, 5)
+	}
+	_, _, err := store.LatestRevision(charm.MustParseURL("~bob/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
 func (s *StoreSuite) TestNewRevisionFirstTime(c *gc.C) {
 	store := s.newStore(c, true)
 	defer store.Close()
@@ -4125,6 +4706,13 @@ func (s *StoreSuite) TestPublish(c *gc.C) {
 		c.Assert(err, gc.Equals, nil)
 		entity, err := store.FindEntity(test.url, nil)
 		c.Assert(err, gc.Equals, nil)
+		for _, ch := range test.channels {
+			if ch == params.StableChannel {
+				// The publish time is checked in TestPublishStablePublishTime.
+				c.Assert(entity.StablePublishTime.IsZero(), gc.Equals, false)
+				entity.StablePublishTime = time.Time{}
+			}
+		}
 		c.Assert(entity, jc.DeepEquals, denormalizedEntity(test.expectedEntity))
 		baseEntity, err := store.FindBaseEntity(&test.url.URL, nil)
 		c.Assert(err, gc.Equals, nil)
@@ -4132,7 +4720,164 @@ func (s *StoreSuite) TestPublish(c *gc.C) {
 	}
 }
 
-func (s *StoreSuite) TestPublishWithFailedESInsert(c *gc.C) {
+func (s *StoreSuite) TestPublishMulti(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.PublishMulti(url, nil, []params.Channel{params.StableChannel, params.CandidateChannel})
+	c.Assert(err, gc.Equals, nil)
+
+	entity, err := store.FindEntity(url, FieldSelector("published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published, jc.DeepEquals, map[params.Channel]bool{
+		params.StableChannel:    true,
+		params.CandidateChannel: true,
+	})
+	baseEntity, err := store.FindBaseEntity(&url.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelEntities[params.StableChannel]["precise"], jc.DeepEquals, &url.URL)
+	c.Assert(baseEntity.ChannelEntities[params.CandidateChannel]["precise"], jc.DeepEquals, &url.URL)
+	_, err = store.ES.GetSearchDocument(&url.URL)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *StoreSuite) TestPublishMultiWithInvalidChannel(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.PublishMulti(url, nil, []params.Channel{params.StableChannel, "bad-wolf"})
+	c.Assert(err, gc.ErrorMatches, `cannot update "cs:~charmers/precise/wordpress-12": invalid channel "bad-wolf"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	err = store.PublishMulti(url, nil, []params.Channel{params.EdgeChannel, params.UnpublishedChannel})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	// Nothing has been published.
+	entity, err := store.FindEntity(url, FieldSelector("published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published, gc.HasLen, 0)
+	baseEntity, err := store.FindBaseEntity(&url.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelEntities, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestUnpublish(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&url.URL, "stable.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(url, nil, params.StableChannel, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	search := func() []*mongodoc.Entity {
+		err := store.ES.RefreshIndex(s.TestIndex)
+		c.Assert(err, gc.Equals, nil)
+		res, err := store.Search(SearchParams{Text: "wordpress"})
+		c.Assert(err, gc.Equals, nil)
+		return res.Results
+	}
+	c.Assert(search(), gc.HasLen, 1)
+
+	err = store.Unpublish(url, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// The only stable revision has been removed from search.
+	c.Assert(search(), gc.HasLen, 0)
+	_, err = store.FindBestEntity(charm.MustParseURL("~charmers/wordpress"), params.StableChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// The entity is still published in the edge channel.
+	entity, err := store.FindEntity(url, FieldSelector("published"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Published, jc.DeepEquals, map[params.Channel]bool{
+		params.EdgeChannel: true,
+	})
+	e, err := store.FindBestEntity(charm.MustParseURL("~charmers/wordpress"), params.EdgeChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL, jc.DeepEquals, &url.URL)
+
+	// Unpublishing again fails.
+	err = store.Unpublish(url, params.StableChannel)
+	c.Assert(err, gc.ErrorMatches, `"cs:~charmers/precise/wordpress-12" is not published in the stable channel`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestUnpublishOlderRevision(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(url, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	url1 := router.MustNewResolvedURL("~charmers/precise/wordpress-13", -1)
+	err = store.AddCharmWithArchive(url1, storetesting.NewCharm(&charm.Meta{
+		Summary: "another piece of content",
+		Series:  []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(url1, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.Unpublish(url, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// The current stable revision is unaffected.
+	e, err := store.FindBestEntity(charm.MustParseURL("~charmers/wordpress"), params.StableChannel, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(e.URL, jc.DeepEquals, &url1.URL)
+}
+
+func (s *StoreSuite) TestPublishStablePublishTime(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url := MustParseResolvedURL("~charmers/trusty/wordpress-0")
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	// Publishing to other channels does not set the time.
+	err = store.Publish(url, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	entity, err := store.FindEntity(url, FieldSelector("stablepublishtime"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.StablePublishTime.IsZero(), gc.Equals, true)
+
+	t0 := time.Now().Add(-time.Second)
+	err = store.Publish(url, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	t1 := time.Now().Add(time.Second)
+	entity, err = store.FindEntity(url, FieldSelector("stablepublishtime"))
+	c.Assert(err, gc.Equals, nil)
+	publishTime := entity.StablePublishTime
+	c.Assert(publishTime.After(t0), gc.Equals, true)
+	c.Assert(publishTime.Before(t1), gc.Equals, true)
+
+	// Publishing to stable again retains the original time.
+	err = store.Publish(url, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	entity, err = store.FindEntity(url, FieldSelector("stablepublishtime"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.StablePublishTime.Equal(publishTime), gc.Equals, true)
+}
+
+func (s *StoreSuite) TestPublishWithFailedESInsert(c *gc.C) {
 	// Make an elastic search with a non-existent address,
 	// so that will try to add the charm there, but fail.
 	esdb := &elasticsearch.Database{
@@ -4141,7 +4886,7 @@ func (s *StoreSuite) TestPublishWithFailedESInsert(c *gc.C) {
 
 	store := s.newStore(c, false)
 	defer store.Close()
-	store.ES = &SearchIndex{esdb, "no-index"}
+	store.ES = &SearchIndex{Database: esdb, Index: "no-index"}
 
 	url := router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1)
 	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
@@ -4169,7 +4914,7 @@ func (s *StoreSuite) TestDeleteEntity(c *gc.C) {
 	entity, err := store.FindEntity(url, nil)
 	c.Assert(err, gc.Equals, nil)
 
-	err = store.DeleteEntity(url)
+	err = store.DeleteEntity(url, false)
 	c.Assert(err, gc.Equals, nil)
 
 	_, err = store.FindEntity(url, nil)
@@ -4188,6 +4933,55 @@ func (s *StoreSuite) TestDeleteEntity(c *gc.C) {
 	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
 }
 
+func (s *StoreSuite) TestGCBlobs(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	url1 := *url
+	url1.URL.Revision = 13
+	err = store.AddCharmWithArchive(&url1, storetesting.NewCharm(&charm.Meta{
+		Summary: "another piece of content",
+		Series:  []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+
+	entity, err := store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.DeleteEntity(url, false)
+	c.Assert(err, gc.Equals, nil)
+
+	// The blobs are too recent to be collected.
+	result, err := store.GCBlobs(time.Hour)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(result, jc.DeepEquals, GCBlobsResult{})
+	r, _, err := store.BlobStore.Open(entity.BlobHash, nil)
+	c.Assert(err, gc.Equals, nil)
+	r.Close()
+
+	// With no grace period the blob and the pre-v5
+	// compatibility blob of the deleted entity are removed.
+	result, err = store.GCBlobs(0)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(result.Count, gc.Equals, 2)
+	c.Assert(result.Size > entity.Size, gc.Equals, true)
+	_, _, err = store.BlobStore.Open(entity.BlobHash, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+	_, _, err = store.BlobStore.Open(entity.PreV5BlobExtraHash, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, blobstore.ErrNotFound)
+
+	// The remaining entity's blobs are still there.
+	entity1, err := store.FindEntity(&url1, nil)
+	c.Assert(err, gc.Equals, nil)
+	r, _, err = store.BlobStore.Open(entity1.BlobHash, nil)
+	c.Assert(err, gc.Equals, nil)
+	r.Close()
+}
+
 func (s *StoreSuite) TestDeleteEntityWithOnlyOneRevision(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
@@ -4197,7 +4991,7 @@ func (s *StoreSuite) TestDeleteEntityWithOnlyOneRevision(c *gc.C) {
 	}))
 	c.Assert(err, gc.Equals, nil)
 
-	err = store.DeleteEntity(url)
+	err = store.DeleteEntity(url, false)
 	c.Assert(err, gc.ErrorMatches, `cannot delete last revision of charm or bundle`)
 }
 
@@ -4218,7 +5012,7 @@ func (s *StoreSuite) TestDeleteEntityWithPublishedRevision(c *gc.C) {
 	}))
 	c.Assert(err, gc.Equals, nil)
 
-	err = store.DeleteEntity(url)
+	err = store.DeleteEntity(url, false)
 	c.Assert(err, gc.ErrorMatches, `cannot delete "cs:~charmers/precise/wordpress-12" because it is the current revision in channels \[beta edge\]`)
 
 	// Check that it really hasn't been deleted.
@@ -4226,6 +5020,297 @@ func (s *StoreSuite) TestDeleteEntityWithPublishedRevision(c *gc.C) {
 	c.Assert(err, gc.Equals, nil)
 }
 
+func (s *StoreSuite) TestDeleteEntityForcePublishedRevision(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(url, nil, params.StableChannel, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	url1 := *url
+	url1.URL.Revision = 13
+	err = store.AddCharmWithArchive(&url1, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	_, err = store.ES.GetSearchDocument(&url.URL)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.DeleteEntity(url, true)
+	c.Assert(err, gc.Equals, nil)
+
+	_, err = store.FindEntity(url, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// The entity is no longer published in any channel.
+	baseEntity, err := store.FindBaseEntity(&url.URL, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.ChannelEntities[params.StableChannel]["precise"], gc.IsNil)
+	c.Assert(baseEntity.ChannelEntities[params.EdgeChannel]["precise"], gc.IsNil)
+	c.Assert(baseEntity.RevisionCount, gc.Equals, 1)
+
+	// The search document has been removed.
+	_, err = store.ES.GetSearchDocument(&url.URL)
+	c.Assert(err, gc.ErrorMatches, `cannot retrieve search document for cs:~charmers/precise/wordpress-12: elasticsearch document not found`)
+}
+
+func (s *StoreSuite) TestDeleteEntityNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.DeleteEntity(router.MustNewResolvedURL("~charmers/precise/wordpress-13", -1), false)
+	c.Assert(err, gc.ErrorMatches, `entity "cs:~charmers/precise/wordpress-13" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestArchiveAndRestoreEntity(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url := router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1)
+	err := store.AddCharmWithArchive(url, storetesting.NewCharm(&charm.Meta{
+		Series: []string{"precise"},
+	}))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&url.URL, "stable.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(url, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	search := func() []*mongodoc.Entity {
+		err := store.ES.RefreshIndex(s.TestIndex)
+		c.Assert(err, gc.Equals, nil)
+		res, err := store.Search(SearchParams{Text: "wordpress"})
+		c.Assert(err, gc.Equals, nil)
+		return res.Results
+	}
+	c.Assert(search(), gc.HasLen, 1)
+
+	err = store.ArchiveEntity(url)
+	c.Assert(err, gc.Equals, nil)
+
+	// The archived entity can no longer be found or searched for.
+	c.Assert(search(), gc.HasLen, 0)
+	_, err = store.FindEntity(url, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = store.FindBestEntity(&url.URL, params.StableChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = store.FindBestEntity(charm.MustParseURL("~charmers/wordpress"), params.StableChannel, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	entity, err := store.FindEntityIncludingArchived(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Archived, gc.Equals, true)
+
+	err = store.RestoreEntity(url)
+	c.Assert(err, gc.Equals, nil)
+
+	// The restored entity is available again.
+	results := search()
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(results[0].URL, jc.DeepEquals, &url.URL)
+	entity, err = store.FindEntity(url, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.Archived, gc.Equals, false)
+}
+
+func (s *StoreSuite) TestArchiveEntityNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.ArchiveEntity(router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.RestoreEntity(router.MustNewResolvedURL("~charmers/precise/wordpress-12", -1))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestTransferOwnership(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url0 := router.MustNewResolvedURL("~alice/precise/wordpress-0", 3)
+	url1 := router.MustNewResolvedURL("~alice/precise/wordpress-1", 4)
+	for _, url := range []*router.ResolvedURL{url0, url1} {
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(&charm.Meta{
+			Series: []string{"precise"},
+		}))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.SetPerms(&url1.URL, "stable.read", params.Everyone, "alice")
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&url1.URL, "stable.write", "alice")
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(url1, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	search := func(owner string) []*mongodoc.Entity {
+		err := store.ES.RefreshIndex(s.TestIndex)
+		c.Assert(err, gc.Equals, nil)
+		res, err := store.Search(SearchParams{
+			Filters: map[string][]string{
+				"owner": {owner},
+			},
+		})
+		c.Assert(err, gc.Equals, nil)
+		return res.Results
+	}
+	c.Assert(search("alice"), gc.HasLen, 1)
+	c.Assert(search("bob"), gc.HasLen, 0)
+
+	err = store.TransferOwnership(charm.MustParseURL("~alice/wordpress"), "bob")
+	c.Assert(err, gc.Equals, nil)
+
+	// The search index reflects the new owner.
+	c.Assert(search("alice"), gc.HasLen, 0)
+	results := search("bob")
+	c.Assert(results, gc.HasLen, 1)
+	c.Assert(results[0].URL, jc.DeepEquals, charm.MustParseURL("~bob/precise/wordpress-1"))
+
+	// All revisions have been moved and the promulgated
+	// URLs are preserved.
+	_, err = store.FindEntity(url0, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	for _, url := range []*router.ResolvedURL{url0, url1} {
+		newURL := *url
+		newURL.URL.User = "bob"
+		entity, err := store.FindEntity(&newURL, nil)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(entity.User, gc.Equals, "bob")
+		c.Assert(entity.BaseURL, jc.DeepEquals, charm.MustParseURL("~bob/wordpress"))
+		c.Assert(entity.PromulgatedURL, jc.DeepEquals, url.PromulgatedURL())
+	}
+
+	// The base entity has been moved and the ACLs updated.
+	_, err = store.FindBaseEntity(charm.MustParseURL("~alice/wordpress"), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	baseEntity, err := store.FindBaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(baseEntity.User, gc.Equals, "bob")
+	c.Assert(baseEntity.ChannelACLs[params.StableChannel], jc.DeepEquals, mongodoc.ACL{
+		Read:  []string{params.Everyone, "bob"},
+		Write: []string{"bob"},
+	})
+	c.Assert(baseEntity.ChannelEntities[params.StableChannel], jc.DeepEquals, map[string]*charm.URL{
+		"precise": charm.MustParseURL("~bob/precise/wordpress-1"),
+	})
+
+	// New revisions for the new owner never reuse old ones.
+	rev, err := store.NewRevision(charm.MustParseURL("~bob/precise/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(rev, gc.Equals, 2)
+}
+
+func (s *StoreSuite) TestTransferOwnershipCollision(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, url := range []string{"~alice/precise/wordpress-0", "~bob/trusty/wordpress-0"} {
+		err := store.AddCharmWithArchive(router.MustNewResolvedURL(url, -1), storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.TransferOwnership(charm.MustParseURL("~alice/wordpress"), "bob")
+	c.Assert(err, gc.ErrorMatches, `cannot transfer "cs:~alice/wordpress": "cs:~bob/wordpress" already exists`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrDuplicateUpload)
+
+	// Nothing has changed.
+	_, err = store.FindEntity(router.MustNewResolvedURL("~alice/precise/wordpress-0", -1), nil)
+	c.Assert(err, gc.Equals, nil)
+}
+
+func (s *StoreSuite) TestTransferOwnershipMovesDownloadCounts(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+	store := s.newStore(c, false)
+	defer store.Close()
+	url0 := router.MustNewResolvedURL("~alice/precise/wordpress-0", 3)
+	url1 := router.MustNewResolvedURL("~alice/trusty/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{url0, url1} {
+		err := store.AddCharmWithArchive(url, storetesting.NewCharm(nil))
+		c.Assert(err, gc.Equals, nil)
+	}
+	for i := 0; i < 2; i++ {
+		err := store.IncrementDownloadCounts(url0)
+		c.Assert(err, gc.Equals, nil)
+	}
+	err := store.IncrementDownloadCounts(url1)
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.TransferOwnership(charm.MustParseURL("~alice/wordpress"), "bob")
+	c.Assert(err, gc.Equals, nil)
+
+	for i, test := range []struct {
+		url   string
+		total int64
+	}{
+		{"~bob/precise/wordpress-0", 2},
+		{"~bob/trusty/wordpress-1", 1},
+		{"precise/wordpress-3", 2},
+		{"~alice/precise/wordpress-0", 0},
+		{"~alice/trusty/wordpress-1", 0},
+	} {
+		c.Logf("test %d: %s", i, test.url)
+		thisRevision, _, err := store.ArchiveDownloadCounts(charm.MustParseURL(test.url), true)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(thisRevision.Total, gc.Equals, test.total)
+	}
+}
+
+func (s *StoreSuite) TestTransferOwnershipFailureLeavesOldOwner(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url0 := router.MustNewResolvedURL("~alice/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url0, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = store.SetPerms(&url0.URL, "stable.read", params.Everyone)
+	c.Assert(err, gc.Equals, nil)
+	err = store.Publish(url0, nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	// Insert a stray entity for the new owner with no base entity,
+	// so that the transfer fails after the new base entity has
+	// been created.
+	err = store.DB.Entities().Insert(&mongodoc.Entity{
+		URL: charm.MustParseURL("~bob/precise/wordpress-0"),
+	})
+	c.Assert(err, gc.Equals, nil)
+
+	err = store.TransferOwnership(charm.MustParseURL("~alice/wordpress"), "bob")
+	c.Assert(err, gc.ErrorMatches, `cannot insert entity "cs:~bob/precise/wordpress-0": .*`)
+
+	// The old owner still has everything.
+	entity, err := store.FindEntity(url0, nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(entity.User, gc.Equals, "alice")
+	_, err = store.FindBaseEntity(charm.MustParseURL("~alice/wordpress"), nil)
+	c.Assert(err, gc.Equals, nil)
+
+	// The partially created base entity has been removed.
+	_, err = store.FindBaseEntity(charm.MustParseURL("~bob/wordpress"), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// The search index still holds the old owner's charm.
+	err = store.ES.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	res, err := store.Search(SearchParams{
+		Filters: map[string][]string{
+			"owner": {"alice"},
+		},
+	})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(res.Results, gc.HasLen, 1)
+}
+
+func (s *StoreSuite) TestTransferOwnershipNotFound(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.TransferOwnership(charm.MustParseURL("~alice/wordpress"), "bob")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
 func (s *StoreSuite) TestGC(c *gc.C) {
 	store := s.newStore(c, false)
 	defer store.Close()
@@ -4319,7 +5404,7 @@ func (s *StoreSuite) TestGC(c *gc.C) {
 	}
 
 	// Then remove an entity and a resource.
-	err = store.DeleteEntity(id1)
+	err = store.DeleteEntity(id1, false)
 	c.Assert(err, gc.Equals, nil)
 	err = store.DB.Resources().Remove(bson.D{{
 		"baseurl", resource2.BaseURL,
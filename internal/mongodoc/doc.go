@@ -72,9 +72,9 @@ type Entity struct {
 	BlobHash string
 
 	// BlobHash256 holds the SHA256 hash checksum of the blob,
-	// in hexadecimal format. This is only used by the legacy
-	// API, and is calculated lazily the first time it is required.
-	// Note that this is calculated from the pre-V5 blob.
+	// in hexadecimal format. It is recorded when the entity is
+	// uploaded; for older entities it is calculated lazily the
+	// first time it is required (see Store.BlobHash256).
 	BlobHash256 string
 
 	// Size holds the size of the archive blob.
@@ -102,6 +102,29 @@ type Entity struct {
 	// for required interfaces.
 	CharmRequiredInterfaces []string
 
+	// CharmAssumes holds the names of the features listed in the
+	// "assumes" section of the charm metadata (for instance "juju"
+	// or "k8s-api").
+	CharmAssumes []string `bson:",omitempty" json:",omitempty"`
+
+	// CharmArchitectures holds the machine architectures that the
+	// charm supports, as listed in the charm metadata. If this is
+	// empty, the charm supports all architectures.
+	CharmArchitectures []string `bson:",omitempty" json:",omitempty"`
+
+	// CharmLicense holds the license declared in the charm
+	// metadata (for instance "Apache-2.0"), if any.
+	CharmLicense string `bson:",omitempty" json:",omitempty"`
+
+	// CharmContainers holds the names of the containers
+	// declared by a Kubernetes charm.
+	CharmContainers []string `bson:",omitempty" json:",omitempty"`
+
+	// CharmContainerImages holds the upstream image references
+	// (for instance "mariadb:10.3") of the containers declared
+	// by a Kubernetes charm.
+	CharmContainerImages []string `bson:",omitempty" json:",omitempty"`
+
 	BundleData   *charm.BundleData
 	BundleReadMe string
 
@@ -137,6 +160,31 @@ type Entity struct {
 
 	// Published holds whether the entity has been published on a channel.
 	Published map[params.Channel]bool `json:",omitempty" bson:",omitempty"`
+
+	// StablePublishTime holds the time that the entity was first
+	// published to the stable channel, which is when it became
+	// searchable.
+	StablePublishTime time.Time `bson:",omitempty"`
+
+	// Docs holds a snapshot of the text of any external
+	// documentation for the entity. It is indexed for search.
+	Docs string `json:",omitempty" bson:",omitempty"`
+
+	// Origin holds where the entity was obtained from, such as
+	// "mirror" for entities imported from an upstream store. It
+	// is empty for entities published directly to this store.
+	Origin string `json:",omitempty" bson:",omitempty"`
+
+	// Archived holds whether the entity has been archived. Archived
+	// entities are retained in the database so that they can be
+	// restored, but are otherwise treated as if they did not exist.
+	Archived bool `json:",omitempty" bson:",omitempty"`
+
+	// Deprecated holds whether the entity has been marked as
+	// deprecated by a maintainer. Deprecated entities are hidden
+	// from search results by default, but may still be resolved
+	// by their id.
+	Deprecated bool `json:",omitempty" bson:",omitempty"`
 }
 
 // PreferredURL returns the preferred way to refer to this entity. If
@@ -198,6 +246,10 @@ type BaseEntity struct {
 	// at present, this signifies that someone has taken over control from
 	// the ingester.
 	NoIngest bool `bson:",omitempty"`
+
+	// RevisionCount holds the number of entities that
+	// currently exist for the base entity.
+	RevisionCount int `bson:",omitempty"`
 }
 
 // LatestRevision holds an entry in the revisions collection.
@@ -59,6 +59,12 @@ type BlobStats struct {
 	MaxSize int64
 	// MeanSize holds the average blob size.
 	MeanSize int64
+	// RemovedCount holds the number of blobs removed
+	// by the garbage collector.
+	RemovedCount int
+	// RemovedSize holds the total size of the blobs removed
+	// by the garbage collector.
+	RemovedSize int64
 	// TODO add counts/sizes for different
 	// kinds of blob?
 }
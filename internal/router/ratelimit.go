@@ -0,0 +1,155 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package router // import "gopkg.in/juju/charmstore.v5/internal/router"
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charmrepo.v3/csclient/params"
+)
+
+// ErrTooManyRequests is the error code used when a client has
+// exceeded its rate limit.
+const ErrTooManyRequests params.ErrorCode = "too many requests"
+
+// maxRateLimitClients holds the number of clients tracked by a
+// RateLimiter above which clients that have not made any recent
+// requests are forgotten.
+const maxRateLimitClients = 10000
+
+// RateLimiter limits the rate of requests made by each client, using
+// a token bucket for each client. It is safe to use concurrently.
+type RateLimiter struct {
+	// perMinute holds the number of requests allowed per minute.
+	// It is also the number of requests allowed in a burst.
+	perMinute int
+
+	// now returns the current time. It is a field
+	// so that it can be replaced in tests.
+	now func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// tokenBucket holds the state of the rate limiter for a single client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter that allows each client to
+// make perMinute requests a minute. If perMinute is not positive, the
+// rate of requests is not limited.
+func NewRateLimiter(perMinute int) *RateLimiter {
+	return &RateLimiter{
+		perMinute: perMinute,
+		now:       time.Now,
+		buckets:   make(map[string]*tokenBucket),
+	}
+}
+
+// Allow reports whether a request from the given client is allowed
+// now. If it is not, it also returns how long the client should wait
+// before trying again.
+func (l *RateLimiter) Allow(client string) (bool, time.Duration) {
+	if l.perMinute <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	rate := float64(l.perMinute) / float64(time.Minute)
+	b := l.buckets[client]
+	if b == nil {
+		if len(l.buckets) >= maxRateLimitClients {
+			l.prune(now, rate)
+		}
+		b = &tokenBucket{
+			tokens: float64(l.perMinute),
+			last:   now,
+		}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(l.perMinute), b.tokens+float64(now.Sub(b.last))*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration(math.Ceil((1 - b.tokens) / rate))
+}
+
+// prune removes the buckets of all clients that would have a full
+// bucket at the given time, as they are indistinguishable from new
+// clients. It must be called with l.mu held.
+func (l *RateLimiter) prune(now time.Time, rate float64) {
+	for client, b := range l.buckets {
+		if b.tokens+float64(now.Sub(b.last))*rate >= float64(l.perMinute) {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// checkRateLimit checks whether the given request, which is for the
+// given route family, is within the rate limit configured for that
+// family. If it is not, it sets the Retry-After header in w and
+// returns an error with an ErrTooManyRequests cause.
+func (r *Router) checkRateLimit(family string, w http.ResponseWriter, req *http.Request) error {
+	limiter := r.RateLimits[family]
+	if limiter == nil {
+		return nil
+	}
+	client, exempt := r.rateLimitClient(req)
+	if exempt {
+		return nil
+	}
+	ok, wait := limiter.Allow(client)
+	if ok {
+		return nil
+	}
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	return errgo.WithCausef(nil, ErrTooManyRequests, "too many %s requests; retry after %ds", family, secs)
+}
+
+// rateLimitClient returns the client identity used to key rate limits
+// for the given request, and whether the request is exempt from rate
+// limiting.
+func (r *Router) rateLimitClient(req *http.Request) (client string, exempt bool) {
+	if r.RateLimitClient != nil {
+		return r.RateLimitClient(req)
+	}
+	return ClientIP(req), false
+}
+
+// ClientIP returns the IP address of the client that made the given
+// request.
+func ClientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// routeFamily returns the name of the family of routes that the
+// given handler key belongs to. This is the first element of the key.
+func routeFamily(key string) string {
+	key = strings.TrimPrefix(key, "/")
+	if i := strings.Index(key, "/"); i >= 0 {
+		key = key[:i]
+	}
+	return key
+}
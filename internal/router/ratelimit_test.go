@@ -0,0 +1,128 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charmrepo.v3/csclient/params"
+)
+
+type RateLimitSuite struct {
+	jujutesting.IsolationSuite
+}
+
+var _ = gc.Suite(&RateLimitSuite{})
+
+func (s *RateLimitSuite) TestRateLimiter(c *gc.C) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := NewRateLimiter(60)
+	l.now = func() time.Time {
+		return now
+	}
+
+	// A full burst is allowed straight away.
+	for i := 0; i < 60; i++ {
+		ok, _ := l.Allow("alice")
+		c.Assert(ok, gc.Equals, true, gc.Commentf("request %d", i))
+	}
+	ok, wait := l.Allow("alice")
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(wait, gc.Equals, time.Second)
+
+	// Other clients are not affected.
+	ok, _ = l.Allow("bob")
+	c.Assert(ok, gc.Equals, true)
+
+	// The bucket refills over time.
+	now = now.Add(time.Second)
+	ok, _ = l.Allow("alice")
+	c.Assert(ok, gc.Equals, true)
+	ok, _ = l.Allow("alice")
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *RateLimitSuite) TestRateLimiterNoLimit(c *gc.C) {
+	for _, perMinute := range []int{0, -1} {
+		c.Logf("limit %d", perMinute)
+		l := NewRateLimiter(perMinute)
+		for i := 0; i < 100; i++ {
+			ok, wait := l.Allow("alice")
+			c.Assert(ok, gc.Equals, true, gc.Commentf("request %d", i))
+			c.Assert(wait, gc.Equals, time.Duration(0))
+		}
+	}
+}
+
+func (s *RateLimitSuite) TestRouterRateLimit(c *gc.C) {
+	handlers := &Handlers{
+		Global: map[string]http.Handler{
+			"foo": http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+			"bar": http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		},
+		Id: map[string]IdHandler{
+			"foo": testIdHandler,
+		},
+	}
+	limiters := map[string]*RateLimiter{
+		"foo":  NewRateLimiter(3),
+		"meta": NewRateLimiter(3),
+	}
+	newRouter := func() *Router {
+		r := New(handlers, alwaysContext)
+		r.RateLimits = limiters
+		r.RateLimitClient = func(req *http.Request) (string, bool) {
+			user := req.Header.Get("User")
+			return user, user == "admin"
+		}
+		return r
+	}
+	get := func(url, user string) int {
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: newRouter(),
+			URL:     url,
+			Header:  http.Header{"User": {user}},
+		})
+		return rec.Code
+	}
+	for i := 0; i < 3; i++ {
+		c.Assert(get("/foo", "alice"), gc.Equals, http.StatusOK)
+	}
+	// The burst has been used up, so the next request is rejected.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: newRouter(),
+		URL:     "/foo",
+		Header:  http.Header{"User": {"alice"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(rec.Header().Get("Retry-After"), gc.Equals, "20")
+	var perr params.Error
+	err := json.Unmarshal(rec.Body.Bytes(), &perr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(perr, jc.DeepEquals, params.Error{
+		Code:    ErrTooManyRequests,
+		Message: "too many foo requests; retry after 20s",
+	})
+
+	// Other routes and clients are not affected, and admin
+	// requests are exempt.
+	c.Assert(get("/bar", "alice"), gc.Equals, http.StatusOK)
+	c.Assert(get("/foo", "bob"), gc.Equals, http.StatusOK)
+	for i := 0; i < 5; i++ {
+		c.Assert(get("/foo", "admin"), gc.Equals, http.StatusOK)
+	}
+
+	// Id and meta routes are limited by family.
+	c.Assert(get("/precise/wordpress-42/foo", "carol"), gc.Equals, http.StatusOK)
+	for i := 0; i < 3; i++ {
+		c.Assert(get("/meta/any?id=precise/wordpress-42", "dave"), gc.Equals, http.StatusOK)
+	}
+	c.Assert(get("/precise/wordpress-42/meta/any", "dave"), gc.Equals, http.StatusTooManyRequests)
+}
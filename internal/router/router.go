@@ -6,6 +6,8 @@
 package router // import "gopkg.in/juju/charmstore.v5/internal/router"
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -14,6 +16,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/utils/parallel"
 	"golang.org/x/net/context"
@@ -126,8 +129,82 @@ type Router struct {
 
 	// monitor holds a metric monitor to time a request.
 	Monitor monitoring.Request
+
+	// MaxMetaAnySize holds the maximum size in bytes of the
+	// JSON-encoded response to an id/meta/any request. If a
+	// response would be larger, an error with an
+	// ErrResponseTooLarge cause is returned instead. If this is
+	// zero, responses are not limited.
+	MaxMetaAnySize int
+
+	// MaxBulkMetaConcurrency holds the maximum number of ids
+	// for which metadata is fetched concurrently when serving
+	// a bulk meta request. If this is zero,
+	// defaultBulkMetaConcurrency is used.
+	MaxBulkMetaConcurrency int
+
+	// KnownSeries holds the set of series names that are
+	// recognized when splitting a charm or bundle id from a
+	// request path. Any other path element is treated as part
+	// of the charm or bundle name. If this is nil, the series
+	// known to the series package are used.
+	KnownSeries map[string]bool
+
+	// CORS holds the cross-origin resource sharing configuration
+	// for the router.
+	CORS CORSParams
+
+	// RateLimits holds the rate limiter to use for each family of
+	// routes, keyed by the first element of the route path (for
+	// example "search", "archive" or "meta"). Routes without a
+	// rate limiter are not limited.
+	RateLimits map[string]*RateLimiter
+
+	// RateLimitClient returns the client identity used to key the
+	// rate limits for the given request, and whether the request
+	// is exempt from rate limiting. If this is nil, the client IP
+	// address is used and no requests are exempt.
+	RateLimitClient func(req *http.Request) (client string, exempt bool)
+
+	// HandlerTimeout holds the maximum length of time that a
+	// request may take. When it is exceeded, the request context
+	// is cancelled and handlers that honor it fail with an error
+	// with an ErrTimeout cause. If this is zero, requests are not
+	// limited.
+	HandlerTimeout time.Duration
+}
+
+// KnownSeries returns a set holding the names of all the series
+// known to the series package, along with the given extra series.
+// It is suitable for use as Router.KnownSeries.
+func KnownSeries(extra ...string) map[string]bool {
+	known := make(map[string]bool, len(series.Series)+len(extra))
+	for s := range series.Series {
+		known[s] = true
+	}
+	for _, s := range extra {
+		known[s] = true
+	}
+	return known
 }
 
+// defaultBulkMetaConcurrency holds the default maximum number
+// of ids served concurrently by a bulk meta request.
+const defaultBulkMetaConcurrency = 10
+
+// ErrResponseTooLarge is the error code used when a response
+// would exceed Router.MaxMetaAnySize.
+const ErrResponseTooLarge params.ErrorCode = "response too large"
+
+// ErrTimeout is the error code used when a request takes
+// longer than Router.HandlerTimeout.
+const ErrTimeout params.ErrorCode = "timeout"
+
+// ErrPreconditionFailed is the error code used when a request
+// relies on server state that does not hold, such as an upload
+// that refers to an archive blob that is not present.
+const ErrPreconditionFailed params.ErrorCode = "precondition failed"
+
 // ResolvedURL represents a URL that has been resolved by resolveURL.
 type ResolvedURL struct {
 	// URL holds the canonical URL for the entity, as used as a key into
@@ -228,7 +305,9 @@ type Context interface {
 	// ResolveURLs is like ResolveURL but resolves multiple URLs
 	// at the same time. The length of the returned slice should
 	// be len(ids); any entities that are not found should be represented
-	// by nil elements.
+	// by nil elements. Bulk meta requests resolve all their ids with
+	// a single call, so implementations should fetch the entities
+	// together where possible.
 	ResolveURLs(ids []*charm.URL) ([]*ResolvedURL, error)
 
 	// AuthorizeEntity will be called to authorize requests
@@ -267,6 +346,10 @@ func New(
 		handler := handler
 		mux.Handle(path, http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			r.Monitor.SetKind(path[1:])
+			if err := r.checkRateLimit(routeFamily(path), w, req); err != nil {
+				WriteError(context.TODO(), w, err)
+				return
+			}
 			handler.ServeHTTP(w, req)
 		})))
 	}
@@ -286,12 +369,7 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// can work.
 	// See https://developer.mozilla.org/en-US/docs/Web/HTTP/Access_control_CORS
 	header := w.Header()
-	header.Set("Access-Control-Allow-Origin", "*")
-	header.Set("Access-Control-Allow-Headers", "Bakery-Protocol-Version, Macaroons, X-Requested-With")
-	header.Set("Access-Control-Allow-Credentials", "true")
-	header.Set("Access-Control-Cache-Max-Age", "600")
-	header.Set("Access-Control-Allow-Methods", "DELETE,GET,HEAD,PUT,POST,OPTIONS")
-	header.Set("Access-Control-Expose-Headers", "WWW-Authenticate")
+	allowed := r.setCORSHeaders(header, req)
 
 	if req.Method == "OPTIONS" {
 		// We cheat here and say that all methods are allowed,
@@ -300,16 +378,105 @@ func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		// putting OPTIONS handling in every endpoint,
 		// and it shouldn't actually matter in practice.
 		header.Set("Allow", "DELETE,GET,HEAD,PUT,POST")
-		header.Set("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		if allowed {
+			header.Set("Access-Control-Allow-Origin", req.Header.Get("Origin"))
+		}
 		return
 	}
 	if err := req.ParseForm(); err != nil {
 		WriteError(context.TODO(), w, errgo.Notef(err, "cannot parse form"))
 		return
 	}
+	if r.HandlerTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), r.HandlerTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
 	r.handler.ServeHTTP(w, req)
 }
 
+// contextError returns an error describing why the given context is
+// done, or nil if it is not. When the deadline has passed, the
+// returned error has an ErrTimeout cause.
+func contextError(ctx context.Context) error {
+	switch err := ctx.Err(); err {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return errgo.WithCausef(nil, ErrTimeout, "request timed out")
+	default:
+		return errgo.Notef(err, "request cancelled")
+	}
+}
+
+// Default values used for CORS response headers when the
+// corresponding CORSParams fields are empty.
+const (
+	defaultCORSAllowedMethods = "DELETE,GET,HEAD,PUT,POST,OPTIONS"
+	defaultCORSAllowedHeaders = "Bakery-Protocol-Version, Macaroons, X-Requested-With"
+)
+
+// CORSParams holds the cross-origin resource sharing configuration
+// of a Router.
+type CORSParams struct {
+	// AllowedOrigins holds the origins that are allowed to make
+	// cross-origin requests. If this is empty, requests from any
+	// origin are allowed.
+	AllowedOrigins []string
+
+	// AllowedMethods holds the methods that may be used in
+	// cross-origin requests. If this is empty, all the methods
+	// supported by the router are allowed.
+	AllowedMethods []string
+
+	// AllowedHeaders holds the non-standard headers that may be
+	// sent in cross-origin requests. If this is empty, the headers
+	// used by the charm store clients are allowed.
+	AllowedHeaders []string
+}
+
+// setCORSHeaders sets the Access-Control-* headers in the given
+// response header as appropriate for the given request, and reports
+// whether the request origin is allowed. When there are no configured
+// allowed origins, any origin is allowed; otherwise no CORS headers
+// are set for requests from other origins.
+func (r *Router) setCORSHeaders(header http.Header, req *http.Request) bool {
+	allowOrigin := "*"
+	if len(r.CORS.AllowedOrigins) > 0 {
+		origin := req.Header.Get("Origin")
+		if origin == "" || !containsString(r.CORS.AllowedOrigins, origin) {
+			return false
+		}
+		allowOrigin = origin
+		header.Add("Vary", "Origin")
+	}
+	methods := defaultCORSAllowedMethods
+	if len(r.CORS.AllowedMethods) > 0 {
+		methods = strings.Join(r.CORS.AllowedMethods, ",")
+	}
+	headers := defaultCORSAllowedHeaders
+	if len(r.CORS.AllowedHeaders) > 0 {
+		headers = strings.Join(r.CORS.AllowedHeaders, ", ")
+	}
+	header.Set("Access-Control-Allow-Origin", allowOrigin)
+	header.Set("Access-Control-Allow-Headers", headers)
+	header.Set("Access-Control-Allow-Credentials", "true")
+	header.Set("Access-Control-Cache-Max-Age", "600")
+	header.Set("Access-Control-Allow-Methods", methods)
+	header.Set("Access-Control-Expose-Headers", "WWW-Authenticate")
+	return true
+}
+
+// containsString reports whether ss contains s.
+func containsString(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
 // Handlers returns the set of handlers that the router was created with.
 // This should not be changed.
 func (r *Router) Handlers() *Handlers {
@@ -324,7 +491,7 @@ func (r *Router) serveIds(w http.ResponseWriter, req *http.Request) error {
 	// to slash-terminated URLs.
 	// http://cdivilly.wordpress.com/2014/03/11/why-trailing-slashes-on-uris-are-important/
 	path := strings.TrimSuffix(req.URL.Path, "/")
-	url, path, err := splitId(path)
+	url, path, err := splitId(path, r.KnownSeries)
 	if err != nil {
 		return errgo.WithCausef(err, params.ErrNotFound, "")
 	}
@@ -332,21 +499,65 @@ func (r *Router) serveIds(w http.ResponseWriter, req *http.Request) error {
 	if key == "" {
 		return errgo.WithCausef(nil, params.ErrNotFound, "")
 	}
+	var headw *headResponseWriter
+	if req.Method == "HEAD" {
+		// Make sure that no body is sent in response to a HEAD
+		// request, even when the handler treats it as a GET.
+		headw = &headResponseWriter{ResponseWriter: w}
+		w = headw
+	}
 	handler := r.handlers.Id[key]
 	if handler != nil {
 		r.Monitor.SetKind(key)
+		if err := r.checkRateLimit(routeFamily(key), w, req); err != nil {
+			return errgo.Mask(err, errgo.Is(ErrTooManyRequests))
+		}
 		req.URL.Path = path
 		err := handler(url, w, req)
+		if headw != nil && !headw.wroteHeader && errgo.Cause(err) == params.ErrMethodNotAllowed {
+			// The handler does not support HEAD requests, so
+			// serve the request as a GET, discarding the body.
+			greq := *req
+			greq.Method = "GET"
+			err = handler(url, w, &greq)
+		}
 		// Note: preserve error cause from handlers.
 		return errgo.Mask(err, errgo.Any)
 	}
 	if key != "meta/" && key != "meta" {
 		return errgo.WithCausef(nil, params.ErrNotFound, params.ErrNotFound.Error())
 	}
+	if err := r.checkRateLimit("meta", w, req); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrTooManyRequests))
+	}
 	req.URL.Path = path
 	return r.serveMeta(url, w, req)
 }
 
+// headResponseWriter wraps an http.ResponseWriter used to respond to
+// a HEAD request, discarding anything written to the response body.
+type headResponseWriter struct {
+	http.ResponseWriter
+
+	// wroteHeader holds whether the response header has been
+	// written.
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.WriteHeader.
+func (w *headResponseWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements http.ResponseWriter.Write by discarding the data.
+func (w *headResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return len(data), nil
+}
+
 func idHandlerNeedsResolveURL(req *http.Request) bool {
 	return req.Method != "POST" && req.Method != "PUT"
 }
@@ -378,13 +589,12 @@ func (r *Router) serveMeta(id *charm.URL, w http.ResponseWriter, req *http.Reque
 			// Note: preserve error cause from ResolveURL.
 			return errgo.Mask(err, errgo.Any)
 		}
-		resp, err := r.serveMetaGet(rurl, req)
+		resp, err := r.serveMetaGet(req.Context(), rurl, req)
 		if err != nil {
 			// Note: preserve error causes from meta handlers.
 			return errgo.Mask(err, errgo.Any)
 		}
-		httprequest.WriteJSON(w, http.StatusOK, resp)
-		return nil
+		return writeJSONWithETag(w, req, resp)
 	case "PUT":
 		rurl, err := r.Context.ResolveURL(id)
 		if err != nil {
@@ -398,6 +608,45 @@ func (r *Router) serveMeta(id *charm.URL, w http.ResponseWriter, req *http.Reque
 	return params.ErrMethodNotAllowed
 }
 
+// writeJSONWithETag writes val to w as JSON, setting an ETag header
+// derived from the encoded response. If the request has an
+// If-None-Match header matching the ETag, a 304 (Not Modified)
+// response is written instead. As the ETag is calculated from the
+// response itself, it changes whenever any of the included metadata
+// changes.
+func writeJSONWithETag(w http.ResponseWriter, req *http.Request, val interface{}) error {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal response")
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	if etagMatches(req.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return nil
+}
+
+// etagMatches reports whether the given If-None-Match header value
+// matches etag. See https://tools.ietf.org/html/rfc7232#section-3.2.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
 // willIncludeMetadata notifies the context about any metadata
 // that will probably be required by the request, so that initial
 // fetches (for example by ResolveURL) can fetch additional
@@ -415,13 +664,23 @@ func (r *Router) willIncludeMetadata(req *http.Request) {
 	r.Context.WillIncludeMetadata(includes)
 }
 
-func (r *Router) serveMetaGet(rurl *ResolvedURL, req *http.Request) (interface{}, error) {
+func (r *Router) serveMetaGet(ctx context.Context, rurl *ResolvedURL, req *http.Request) (interface{}, error) {
+	r.Monitor.SetKind("meta")
+	return r.getMeta(ctx, rurl, req)
+}
+
+// getMeta is the internal version of serveMetaGet. It does
+// not touch any request-wide state, so it can be called
+// concurrently for several ids.
+func (r *Router) getMeta(ctx context.Context, rurl *ResolvedURL, req *http.Request) (interface{}, error) {
+	if err := contextError(ctx); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrTimeout))
+	}
 	// TODO: consider whether we might want the capability to
 	// have different permissions for different meta endpoints.
 	if err := r.Context.AuthorizeEntity(rurl, req); err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
-	r.Monitor.SetKind("meta")
 	key, path := handlerKey(req.URL.Path)
 	if key == "" {
 		// GET id/meta
@@ -429,10 +688,10 @@ func (r *Router) serveMetaGet(rurl *ResolvedURL, req *http.Request) (interface{}
 		return r.metaNames(), nil
 	}
 	if key == "any" {
-		return r.serveMetaGetAny(rurl, req)
+		return r.serveMetaGetAny(ctx, rurl, req)
 	}
 	if handler := r.handlers.Meta[key]; handler != nil {
-		results, err := handler.HandleGet([]BulkIncludeHandler{handler}, rurl, []string{path}, req.Form, req)
+		results, err := handler.HandleGet([]BulkIncludeHandler{handler}, rurl, []string{path}, req.Form, req.WithContext(ctx))
 		if err != nil {
 			// Note: preserve error cause from handlers.
 			return nil, errgo.Mask(err, errgo.Any)
@@ -448,20 +707,33 @@ func (r *Router) serveMetaGet(rurl *ResolvedURL, req *http.Request) (interface{}
 
 // GET id/meta/any?[include=meta[&include=meta...]]
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetaany
-func (r *Router) serveMetaGetAny(id *ResolvedURL, req *http.Request) (interface{}, error) {
+func (r *Router) serveMetaGetAny(ctx context.Context, id *ResolvedURL, req *http.Request) (interface{}, error) {
 	includes := req.Form["include"]
 	if len(includes) == 0 {
 		return params.MetaAnyResponse{Id: id.PreferredURL()}, nil
 	}
-	meta, err := r.GetMetadata(id, includes, req)
+	meta, err := r.GetMetadata(ctx, id, includes, req)
 	if err != nil {
 		// Note: preserve error cause from handlers.
 		return nil, errgo.Mask(err, errgo.Any)
 	}
-	return params.MetaAnyResponse{
+	resp := params.MetaAnyResponse{
 		Id:   id.PreferredURL(),
 		Meta: meta,
-	}, nil
+	}
+	if r.MaxMetaAnySize <= 0 {
+		return resp, nil
+	}
+	// Encode the response here so that we can check its size
+	// before anything is written.
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal response")
+	}
+	if len(data) > r.MaxMetaAnySize {
+		return nil, errgo.WithCausef(nil, ErrResponseTooLarge, "response too large (%d bytes, maximum %d bytes); request fewer includes", len(data), r.MaxMetaAnySize)
+	}
+	return json.RawMessage(data), nil
 }
 
 const jsonContentType = "application/json"
@@ -563,6 +835,9 @@ func (r *Router) metaNames() []string {
 // serveBulkMeta serves bulk metadata requests (requests to /meta/...).
 func (r *Router) serveBulkMeta(w http.ResponseWriter, req *http.Request) error {
 	r.Monitor.SetKind("meta")
+	if err := r.checkRateLimit("meta", w, req); err != nil {
+		return errgo.Mask(err, errgo.Is(ErrTooManyRequests))
+	}
 	switch req.Method {
 	case "GET", "HEAD":
 		// A bare meta returns all endpoints.
@@ -571,7 +846,21 @@ func (r *Router) serveBulkMeta(w http.ResponseWriter, req *http.Request) error {
 			httprequest.WriteJSON(w, http.StatusOK, r.metaNames())
 			return nil
 		}
-		resp, err := r.serveBulkMetaGet(req)
+		resp, err := r.serveBulkMetaGet(req.Context(), req)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		httprequest.WriteJSON(w, http.StatusOK, resp)
+		return nil
+	case "POST":
+		if err := readBulkMetaIds(req); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+		}
+		// The request only reads metadata, so treat it as a GET,
+		// in particular for authorization purposes.
+		greq := *req
+		greq.Method = "GET"
+		resp, err := r.serveBulkMetaGet(req.Context(), &greq)
 		if err != nil {
 			return errgo.Mask(err, errgo.Any)
 		}
@@ -584,13 +873,29 @@ func (r *Router) serveBulkMeta(w http.ResponseWriter, req *http.Request) error {
 	}
 }
 
+// readBulkMetaIds adds any ids in the body of the given bulk meta POST
+// request to the "id" form values of the request. The body may hold
+// either a JSON array of ids or form values, which will already have
+// been parsed into req.Form.
+func readBulkMetaIds(req *http.Request) error {
+	if req.Header.Get("Content-Type") != jsonContentType {
+		return nil
+	}
+	var ids []string
+	if err := unmarshalJSONBody(req, &ids); err != nil {
+		return errgo.WithCausef(err, params.ErrBadRequest, "cannot read ids")
+	}
+	req.Form["id"] = append(req.Form["id"], ids...)
+	return nil
+}
+
 // serveBulkMetaGet serves the "bulk" metadata retrieval endpoint
 // that can return information on several ids at once.
 //
 // GET meta/$endpoint?id=$id0[&id=$id1...][$otherflags]
 // See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-metaendpoint
-func (r *Router) serveBulkMetaGet(req *http.Request) (interface{}, error) {
-	ids := req.Form["id"]
+func (r *Router) serveBulkMetaGet(ctx context.Context, req *http.Request) (interface{}, error) {
+	ids := uniqueStrings(req.Form["id"])
 	if len(ids) == 0 {
 		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "no ids specified in meta request")
 	}
@@ -615,28 +920,90 @@ func (r *Router) serveBulkMetaGet(req *http.Request) (interface{}, error) {
 		// Note: preserve error cause from resolveURL.
 		return nil, errgo.Mask(err, errgo.Any)
 	}
+	maxConcurrency := r.MaxBulkMetaConcurrency
+	if maxConcurrency <= 0 {
+		maxConcurrency = defaultBulkMetaConcurrency
+	}
+	var (
+		mu       sync.Mutex
+		firstErr error
+		// errIndex holds the index in ids of the id that
+		// firstErr was returned for.
+		errIndex = len(ids)
+	)
 	result := make(map[string]interface{})
+	// cancelled reports whether an error has already been
+	// encountered for an id before the one at index i or the
+	// request has been cancelled, in which case there is no
+	// point in fetching the metadata for the id. The ids before
+	// a failing one are always fetched, so the error returned is
+	// the one for the first failing id, as if the ids had been
+	// fetched in order.
+	cancelled := func(i int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return i > errIndex || ctx.Err() != nil
+	}
+	run := parallel.NewRun(maxConcurrency)
 	for i, rurl := range rurls {
 		if rurl == nil {
 			// URLs not found will be omitted from the result.
 			// https://github.com/juju/charmstore/blob/v4/docs/API.md#bulk-requests-and-missing-metadata
 			continue
 		}
-		meta, err := r.serveMetaGet(rurl, req)
-		if cause := errgo.Cause(err); cause == params.ErrNotFound || cause == params.ErrMetadataNotFound || (ignoreAuth && isAuthorizationError(cause)) {
-			// The relevant data does not exist, or it is not public and client
-			// asked not to authorize.
-			// https://github.com/juju/charmstore/blob/v4/docs/API.md#bulk-requests-and-missing-metadata
-			continue
-		}
-		if err != nil {
-			return nil, errgo.Mask(err)
+		if cancelled(i) {
+			break
 		}
-		result[ids[i]] = meta
+		i, id, rurl := i, ids[i], rurl
+		run.Do(func() error {
+			if cancelled(i) {
+				return nil
+			}
+			meta, err := r.getMeta(ctx, rurl, req)
+			if cause := errgo.Cause(err); cause == params.ErrNotFound || cause == params.ErrMetadataNotFound || (ignoreAuth && isAuthorizationError(cause)) {
+				// The relevant data does not exist, or it is not public and client
+				// asked not to authorize.
+				// https://github.com/juju/charmstore/blob/v4/docs/API.md#bulk-requests-and-missing-metadata
+				return nil
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if i < errIndex {
+					firstErr, errIndex = err, i
+				}
+				return nil
+			}
+			result[id] = meta
+			return nil
+		})
+	}
+	run.Wait()
+	// Report a timeout in preference to any errors caused by it.
+	if err := contextError(ctx); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrTimeout))
+	}
+	if firstErr != nil {
+		return nil, errgo.Mask(firstErr)
 	}
 	return result, nil
 }
 
+// uniqueStrings returns ss with any duplicate elements removed,
+// preserving the order of first occurrence.
+func uniqueStrings(ss []string) []string {
+	seen := make(map[string]bool, len(ss))
+	unique := ss[:0:0]
+	for _, s := range ss {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		unique = append(unique, s)
+	}
+	return unique
+}
+
 // ParseBool returns the boolean value represented by the string.
 // It accepts "1" or "0". Any other value returns an error.
 func ParseBool(value string) (bool, error) {
@@ -721,7 +1088,13 @@ const maxMetadataConcurrency = 5
 
 // GetMetadata retrieves metadata for the given charm or bundle id,
 // including information as specified by the includes slice.
-func (r *Router) GetMetadata(id *ResolvedURL, includes []string, req *http.Request) (map[string]interface{}, error) {
+// If ctx is cancelled, no more metadata handlers are started and
+// an error is returned. The handlers are passed a request holding
+// ctx, so that they can honor its deadline too.
+func (r *Router) GetMetadata(ctx context.Context, id *ResolvedURL, includes []string, req *http.Request) (map[string]interface{}, error) {
+	if req != nil {
+		req = req.WithContext(ctx)
+	}
 	groups := make(map[interface{}][]BulkIncludeHandler)
 	includesByGroup := make(map[interface{}][]string)
 	for _, include := range includes {
@@ -746,6 +1119,9 @@ func (r *Router) GetMetadata(id *ResolvedURL, includes []string, req *http.Reque
 	for _, g := range groups {
 		g := g
 		run.Do(func() error {
+			if err := contextError(ctx); err != nil {
+				return errgo.Mask(err, errgo.Is(ErrTimeout))
+			}
 			// We know that we must have at least one element in the
 			// slice here. We could use any member of the slice to
 			// actually handle the request, so arbitrarily choose
@@ -781,7 +1157,12 @@ func (r *Router) GetMetadata(id *ResolvedURL, includes []string, req *http.Reque
 			return nil
 		})
 	}
-	if err := run.Wait(); err != nil {
+	err := run.Wait()
+	// Report a timeout in preference to any errors caused by it.
+	if err := contextError(ctx); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(ErrTimeout))
+	}
+	if err != nil {
 		// We could have got multiple errors, but we'll only return one of them.
 		return nil, errgo.Mask(err.(parallel.Errors)[0], errgo.Any)
 	}
@@ -867,8 +1248,10 @@ func splitPath(path string, i int) (elem string, nextIndex int) {
 }
 
 // splitId splits the given URL path into a charm or bundle
-// URL and the rest of the path.
-func splitId(path string) (url *charm.URL, rest string, err error) {
+// URL and the rest of the path. The knownSeries set holds the
+// series names that may be present in the id; if it is nil,
+// the series known to the series package are used.
+func splitId(path string, knownSeries map[string]bool) (url *charm.URL, rest string, err error) {
 	path = strings.TrimPrefix(path, "/")
 	part, i := splitPath(path, 0)
 
@@ -878,7 +1261,7 @@ func splitId(path string) (url *charm.URL, rest string, err error) {
 	}
 
 	// Skip series.
-	if _, ok := series.Series[part]; ok {
+	if isKnownSeries(part, knownSeries) {
 		part, i = splitPath(path, i)
 	}
 
@@ -893,6 +1276,17 @@ func splitId(path string) (url *charm.URL, rest string, err error) {
 	return url, path[i:], nil
 }
 
+// isKnownSeries reports whether s is a member of knownSeries,
+// or of the series known to the series package when knownSeries
+// is nil.
+func isKnownSeries(s string, knownSeries map[string]bool) bool {
+	if knownSeries == nil {
+		_, ok := series.Series[s]
+		return ok
+	}
+	return knownSeries[s]
+}
+
 func mustParseURL(s string) *charm.URL {
 	u, err := parseURL(s)
 	if err != nil {
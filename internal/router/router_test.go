@@ -14,6 +14,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	jujutesting "github.com/juju/testing"
 	jc "github.com/juju/testing/checkers"
@@ -1181,10 +1182,375 @@ func (s *RouterSuite) TestRouterGet(c *gc.C) {
 	}
 }
 
+func (s *RouterSuite) TestBulkMetaResolvesURLsTogether(c *gc.C) {
+	var resolved [][]*charm.URL
+	ctxt := alwaysContext
+	ctxt.resolveURL = func(id *charm.URL) (*ResolvedURL, error) {
+		c.Errorf("ResolveURL called for %v", id)
+		return alwaysResolveURL(id)
+	}
+	ctxt.resolveURLs = func(ids []*charm.URL) ([]*ResolvedURL, error) {
+		resolved = append(resolved, ids)
+		rurls := make([]*ResolvedURL, len(ids))
+		for i, id := range ids {
+			rurl, err := alwaysResolveURL(id)
+			if err != nil {
+				return nil, err
+			}
+			rurls[i] = rurl
+		}
+		return rurls, nil
+	}
+	handlers := Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": constMetaHandler("fooval"),
+		},
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      New(&handlers, ctxt),
+		URL:          "/meta/foo?id=precise/wordpress-42&id=~bob/trusty/mysql-1&id=django",
+		ExpectStatus: http.StatusOK,
+		ExpectBody: map[string]interface{}{
+			"precise/wordpress-42": "fooval",
+			"~bob/trusty/mysql-1":  "fooval",
+			"django":               "fooval",
+		},
+	})
+	c.Assert(resolved, jc.DeepEquals, [][]*charm.URL{{
+		charm.MustParseURL("cs:precise/wordpress-42"),
+		charm.MustParseURL("cs:~bob/trusty/mysql-1"),
+		charm.MustParseURL("cs:django"),
+	}})
+}
+
+func (s *RouterSuite) TestBulkMetaConcurrent(c *gc.C) {
+	var (
+		mu             sync.Mutex
+		running        int
+		maxRunning     int
+		ids            []string
+		expectResponse = make(map[string]interface{})
+	)
+	for i := 0; i < 50; i++ {
+		id := fmt.Sprintf("precise/wordpress-%d", i)
+		ids = append(ids, "id="+id)
+		if i%7 == 3 {
+			// The handler returns no metadata for these ids,
+			// so they are omitted from the response.
+			continue
+		}
+		expectResponse[id] = "cs:" + id
+	}
+	handlers := Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": SingleIncludeHandler(func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+				mu.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mu.Unlock()
+				defer func() {
+					mu.Lock()
+					running--
+					mu.Unlock()
+				}()
+				if id.URL.Revision%7 == 3 {
+					return nil, params.ErrMetadataNotFound
+				}
+				return id.URL.String(), nil
+			}),
+		},
+	}
+	reqURL := "/meta/foo?" + strings.Join(ids, "&")
+	for _, concurrency := range []int{1, 5} {
+		c.Logf("concurrency %d", concurrency)
+		maxRunning = 0
+		router := New(&handlers, alwaysContext)
+		router.MaxBulkMetaConcurrency = concurrency
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      router,
+			URL:          reqURL,
+			ExpectStatus: http.StatusOK,
+			ExpectBody:   expectResponse,
+		})
+		c.Assert(maxRunning <= concurrency, gc.Equals, true, gc.Commentf("max running %d", maxRunning))
+	}
+}
+
+func (s *RouterSuite) TestBulkMetaConcurrentError(c *gc.C) {
+	var called int32
+	handlers := Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": SingleIncludeHandler(func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+				atomic.AddInt32(&called, 1)
+				if id.URL.Revision == 0 {
+					return nil, errgo.New("bad wolf")
+				}
+				return id.URL.String(), nil
+			}),
+		},
+	}
+	var ids []string
+	for i := 0; i < 50; i++ {
+		ids = append(ids, fmt.Sprintf("id=precise/wordpress-%d", i))
+	}
+	router := New(&handlers, alwaysContext)
+	router.MaxBulkMetaConcurrency = 1
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      router,
+		URL:          "/meta/foo?" + strings.Join(ids, "&"),
+		ExpectStatus: http.StatusInternalServerError,
+		ExpectBody: params.Error{
+			Message: "bad wolf",
+		},
+	})
+	// The remaining ids are not fetched once an error
+	// has been encountered.
+	c.Assert(atomic.LoadInt32(&called) < 50, gc.Equals, true)
+}
+
+func (s *RouterSuite) TestBulkMetaConcurrentErrorIsForFirstId(c *gc.C) {
+	handlers := Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": SingleIncludeHandler(func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+				if id.URL.Revision == 0 {
+					// Make sure that the errors for the
+					// other ids are seen first.
+					time.Sleep(20 * time.Millisecond)
+				}
+				return nil, errgo.Newf("error for %d", id.URL.Revision)
+			}),
+		},
+	}
+	var ids []string
+	for i := 0; i < 5; i++ {
+		ids = append(ids, fmt.Sprintf("id=precise/wordpress-%d", i))
+	}
+	router := New(&handlers, alwaysContext)
+	router.MaxBulkMetaConcurrency = 5
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      router,
+		URL:          "/meta/foo?" + strings.Join(ids, "&"),
+		ExpectStatus: http.StatusInternalServerError,
+		ExpectBody: params.Error{
+			Message: "error for 0",
+		},
+	})
+}
+
+// blockUntilDone blocks until the context of the given request is
+// done and then returns the context error.
+func blockUntilDone(req *http.Request) error {
+	<-req.Context().Done()
+	return req.Context().Err()
+}
+
+var handlerTimeoutTests = []struct {
+	about string
+	url   string
+}{{
+	about: "id handler",
+	url:   "/precise/wordpress-42/block",
+}, {
+	about: "meta handler",
+	url:   "/precise/wordpress-42/meta/block",
+}, {
+	about: "meta any",
+	url:   "/precise/wordpress-42/meta/any?include=block",
+}, {
+	about: "bulk meta",
+	url:   "/meta/block?id=precise/wordpress-42&id=utopic/foo-32",
+}, {
+	about: "global handler",
+	url:   "/global-block",
+}}
+
+func (s *RouterSuite) TestHandlerTimeout(c *gc.C) {
+	handlers := Handlers{
+		Global: map[string]http.Handler{
+			"global-block": HandleErrors(func(w http.ResponseWriter, req *http.Request) error {
+				return blockUntilDone(req)
+			}),
+		},
+		Id: map[string]IdHandler{
+			"block": func(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+				return blockUntilDone(req)
+			},
+		},
+		Meta: map[string]BulkIncludeHandler{
+			"block": SingleIncludeHandler(func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+				return nil, blockUntilDone(req)
+			}),
+		},
+	}
+	for i, test := range handlerTimeoutTests {
+		c.Logf("test %d: %s", i, test.about)
+		router := New(&handlers, alwaysContext)
+		router.HandlerTimeout = 10 * time.Millisecond
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      router,
+			URL:          test.url,
+			ExpectStatus: http.StatusGatewayTimeout,
+			ExpectBody: params.Error{
+				Code:    ErrTimeout,
+				Message: "request timed out",
+			},
+		})
+	}
+}
+
+func (s *RouterSuite) TestHandlerTimeoutNotExceeded(c *gc.C) {
+	handlers := Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": testMetaHandler(0),
+		},
+	}
+	router := New(&handlers, alwaysContext)
+	router.HandlerTimeout = time.Minute
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      router,
+		URL:          "/precise/wordpress-42/meta/foo",
+		ExpectStatus: http.StatusOK,
+		ExpectBody: &metaHandlerTestResp{
+			CharmURL: "cs:precise/wordpress-42",
+		},
+	})
+}
+
+func (s *RouterSuite) TestBulkMetaPost(c *gc.C) {
+	handlers := Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": testMetaHandler(0),
+		},
+	}
+	router := New(&handlers, alwaysContext)
+	var ids []string
+	for i := 0; i < 200; i++ {
+		ids = append(ids, fmt.Sprintf("precise/wordpress-%d", i))
+	}
+	body, err := json.Marshal(ids)
+	c.Assert(err, gc.Equals, nil)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: router,
+		Method:  "POST",
+		URL:     "/meta/foo?id=precise/wordpress-3&id=utopic/foo-32",
+		Header:  http.Header{"Content-Type": {"application/json"}},
+		Body:    bytes.NewReader(body),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	var postResult map[string]json.RawMessage
+	err = json.Unmarshal(rec.Body.Bytes(), &postResult)
+	c.Assert(err, gc.Equals, nil)
+	// Ids from the query and the body are combined, and the
+	// duplicated precise/wordpress-3 appears only once.
+	c.Assert(postResult, gc.HasLen, 201)
+
+	// The results are the same as for a GET request.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: router,
+		URL:     "/meta/foo?id=precise/wordpress-3&id=precise/wordpress-199&id=utopic/foo-32",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var getResult map[string]json.RawMessage
+	err = json.Unmarshal(rec.Body.Bytes(), &getResult)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(getResult, gc.HasLen, 3)
+	for id, val := range getResult {
+		c.Assert(string(postResult[id]), gc.Equals, string(val), gc.Commentf("id %s", id))
+	}
+
+	// Ids can also be posted as form values.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: router,
+		Method:  "POST",
+		URL:     "/meta/foo",
+		Header:  http.Header{"Content-Type": {"application/x-www-form-urlencoded"}},
+		Body:    strings.NewReader("id=precise/wordpress-3&id=precise/wordpress-199&id=utopic/foo-32"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var formResult map[string]json.RawMessage
+	err = json.Unmarshal(rec.Body.Bytes(), &formResult)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(formResult, jc.DeepEquals, getResult)
+}
+
+func (s *RouterSuite) TestBulkMetaPostInvalidBody(c *gc.C) {
+	handlers := Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": testMetaHandler(0),
+		},
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      New(&handlers, alwaysContext),
+		Method:       "POST",
+		URL:          "/meta/foo",
+		JSONBody:     map[string]string{"id": "precise/wordpress-3"},
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "cannot read ids: cannot unmarshal body: json: cannot unmarshal object into Go value of type []string",
+		},
+	})
+}
+
+func (s *RouterSuite) TestMetaAnySizeLimit(c *gc.C) {
+	big := strings.Repeat("x", 500)
+	handlers := Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"big1": constMetaHandler(big),
+			"big2": constMetaHandler(big),
+			"big3": constMetaHandler(big),
+		},
+	}
+	router := New(&handlers, alwaysContext)
+	router.MaxMetaAnySize = 1200
+
+	// A response within the limit is returned as usual.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      router,
+		URL:          "/precise/wordpress-42/meta/any?include=big1&include=big2",
+		ExpectStatus: http.StatusOK,
+		ExpectBody: params.MetaAnyResponse{
+			Id: charm.MustParseURL("cs:precise/wordpress-42"),
+			Meta: map[string]interface{}{
+				"big1": big,
+				"big2": big,
+			},
+		},
+	})
+
+	// A response that is too large is rejected.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      router,
+		URL:          "/precise/wordpress-42/meta/any?include=big1&include=big2&include=big3",
+		ExpectStatus: http.StatusRequestEntityTooLarge,
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, body json.RawMessage) {
+			var e params.Error
+			err := json.Unmarshal(body, &e)
+			c.Assert(err, gc.Equals, nil)
+			c.Assert(e.Code, gc.Equals, ErrResponseTooLarge)
+			c.Assert(e.Message, gc.Matches, `response too large \([0-9]+ bytes, maximum 1200 bytes\); request fewer includes`)
+		}),
+	})
+
+	// Other meta endpoints are not limited.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      router,
+		URL:          "/precise/wordpress-42/meta/big1",
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   big,
+	})
+}
+
 type funcContext struct {
 	resolveURL          func(id *charm.URL) (*ResolvedURL, error)
 	authorizeURL        func(id *ResolvedURL, req *http.Request) error
 	willIncludeMetadata func([]string)
+
+	// resolveURLs is used by ResolveURLs if it is set.
+	// Otherwise each id is resolved with resolveURL.
+	resolveURLs func(ids []*charm.URL) ([]*ResolvedURL, error)
 }
 
 func (ctxt funcContext) ResolveURL(id *charm.URL) (*ResolvedURL, error) {
@@ -1192,6 +1558,9 @@ func (ctxt funcContext) ResolveURL(id *charm.URL) (*ResolvedURL, error) {
 }
 
 func (ctxt funcContext) ResolveURLs(ids []*charm.URL) ([]*ResolvedURL, error) {
+	if ctxt.resolveURLs != nil {
+		return ctxt.resolveURLs(ids)
+	}
 	rurls := make([]*ResolvedURL, len(ids))
 	for i, id := range ids {
 		rurl, err := ctxt.resolveURL(id)
@@ -1264,6 +1633,57 @@ func (s *RouterSuite) TestCORSHeaders(c *gc.C) {
 	c.Assert(rec.Header().Get("Access-Control-Expose-Headers"), gc.Equals, "WWW-Authenticate")
 }
 
+func (s *RouterSuite) TestCORSAllowedOrigins(c *gc.C) {
+	h := New(&Handlers{
+		Global: map[string]http.Handler{
+			"foo": http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		},
+	}, alwaysContext)
+	h.CORS = CORSParams{
+		AllowedOrigins: []string{"https://1.2.42.47"},
+		AllowedMethods: []string{"GET", "HEAD", "OPTIONS"},
+		AllowedHeaders: []string{"Macaroons"},
+	}
+
+	// A preflight request from an allowed origin.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: h,
+		Method:  "OPTIONS",
+		URL:     "/foo",
+		Header:  http.Header{"Origin": {"https://1.2.42.47"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	header := rec.Header()
+	c.Assert(header.Get("Access-Control-Allow-Origin"), gc.Equals, "https://1.2.42.47")
+	c.Assert(header.Get("Access-Control-Allow-Methods"), gc.Equals, "GET,HEAD,OPTIONS")
+	c.Assert(header.Get("Access-Control-Allow-Headers"), gc.Equals, "Macaroons")
+	c.Assert(header.Get("Vary"), gc.Equals, "Origin")
+
+	// A simple request from an allowed origin.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: h,
+		URL:     "/foo",
+		Header:  http.Header{"Origin": {"https://1.2.42.47"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Access-Control-Allow-Origin"), gc.Equals, "https://1.2.42.47")
+	c.Assert(rec.Header().Get("Access-Control-Allow-Credentials"), gc.Equals, "true")
+
+	// Requests from other origins get no CORS headers.
+	for _, method := range []string{"OPTIONS", "GET"} {
+		rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: h,
+			Method:  method,
+			URL:     "/foo",
+			Header:  http.Header{"Origin": {"https://evil.example.com"}},
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		for name := range rec.Header() {
+			c.Assert(strings.HasPrefix(name, "Access-Control-"), gc.Equals, false, gc.Commentf("method %s, header %s", method, name))
+		}
+	}
+}
+
 func (s *RouterSuite) TestHTTPRequestPassedThroughToMeta(c *gc.C) {
 	testReq, err := http.NewRequest("GET", "/wordpress/meta/foo", nil)
 	c.Assert(err, gc.Equals, nil)
@@ -2032,7 +2452,7 @@ func (s *RouterSuite) TestGetMetadata(c *gc.C) {
 				"test":  testMetaHandler(0),
 			},
 		}, alwaysContext)
-		result, err := router.GetMetadata(test.id, test.includes, nil)
+		result, err := router.GetMetadata(context.Background(), test.id, test.includes, nil)
 		if test.expectError != "" {
 			c.Assert(err, gc.ErrorMatches, test.expectError)
 			c.Assert(result, gc.IsNil)
@@ -2070,7 +2490,7 @@ var splitIdTests = []struct {
 func (s *RouterSuite) TestSplitId(c *gc.C) {
 	for i, test := range splitIdTests {
 		c.Logf("test %d: %s", i, test.path)
-		url, rest, err := splitId(test.path)
+		url, rest, err := splitId(test.path, nil)
 		if test.expectError != "" {
 			c.Assert(err, gc.ErrorMatches, test.expectError, gc.Commentf("details: %v", errgo.Details(err)))
 			c.Assert(url, gc.IsNil)
@@ -2081,13 +2501,159 @@ func (s *RouterSuite) TestSplitId(c *gc.C) {
 		c.Assert(url.String(), gc.Equals, test.expectURL)
 		c.Assert(rest, gc.Equals, "")
 
-		url, rest, err = splitId(test.path + "/some/more")
+		url, rest, err = splitId(test.path+"/some/more", nil)
 		c.Assert(err, gc.Equals, nil)
 		c.Assert(url.String(), gc.Equals, test.expectURL)
 		c.Assert(rest, gc.Equals, "/some/more")
 	}
 }
 
+func (s *RouterSuite) TestSplitIdWithKnownSeries(c *gc.C) {
+	// An unknown series is treated as the charm name.
+	url, rest, err := splitId("~user/focal/wordpress-23", nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(url.String(), gc.Equals, "cs:~user/focal")
+	c.Assert(rest, gc.Equals, "/wordpress-23")
+
+	known := KnownSeries("focal", "jammy")
+	for _, s := range []string{"focal", "jammy", "trusty"} {
+		url, rest, err := splitId("~user/"+s+"/wordpress-23/meta/any", known)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(url.String(), gc.Equals, "cs:~user/"+s+"/wordpress-23")
+		c.Assert(rest, gc.Equals, "/meta/any")
+	}
+
+	// A custom set need not include the default series.
+	url, rest, err = splitId("trusty/wordpress-23", map[string]bool{"focal": true})
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(url.String(), gc.Equals, "cs:trusty")
+	c.Assert(rest, gc.Equals, "/wordpress-23")
+}
+
+func (s *RouterSuite) TestRouterHead(c *gc.C) {
+	var methods []string
+	handlers := Handlers{
+		Id: map[string]IdHandler{
+			"getonly": func(charmId *charm.URL, w http.ResponseWriter, req *http.Request) error {
+				methods = append(methods, req.Method)
+				if req.Method != "GET" {
+					return params.ErrMethodNotAllowed
+				}
+				return testIdHandler(charmId, w, req)
+			},
+		},
+		Meta: map[string]BulkIncludeHandler{
+			"foo": testMetaHandler(0),
+		},
+	}
+	router := New(&handlers, alwaysContext)
+
+	// A handler that does not support HEAD is called
+	// again with a GET request and the body is discarded.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: router,
+		Method:  "HEAD",
+		URL:     "/precise/wordpress-42/getonly",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+	c.Assert(rec.Body.Len(), gc.Equals, 0)
+	c.Assert(methods, jc.DeepEquals, []string{"HEAD", "GET"})
+
+	// Meta endpoints support HEAD directly.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: router,
+		Method:  "HEAD",
+		URL:     "/precise/wordpress-42/meta/foo",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Body.Len(), gc.Equals, 0)
+
+	// Errors are still reported.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: router,
+		Method:  "HEAD",
+		URL:     "/precise/wordpress-42/meta/bar",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotFound)
+}
+
+func (s *RouterSuite) TestMetaETag(c *gc.C) {
+	fooVal := "foo1"
+	handlers := Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": SingleIncludeHandler(func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+				return fooVal, nil
+			}),
+			"bar": constMetaHandler("bar"),
+		},
+	}
+	router := New(&handlers, alwaysContext)
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		var header http.Header
+		if etag != "" {
+			header = http.Header{"If-None-Match": {etag}}
+		}
+		return httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: router,
+			URL:     path,
+			Header:  header,
+		})
+	}
+	for i, path := range []string{
+		"/precise/wordpress-42/meta/foo",
+		"/precise/wordpress-42/meta/any?include=foo&include=bar",
+	} {
+		c.Logf("test %d: %s", i, path)
+		fooVal = "foo1"
+		rec := get(path, "")
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		etag := rec.Header().Get("ETag")
+		c.Assert(etag, gc.Not(gc.Equals), "")
+
+		// A matching If-None-Match header results
+		// in a Not Modified response with no body.
+		rec = get(path, etag)
+		c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+		c.Assert(rec.Header().Get("ETag"), gc.Equals, etag)
+		c.Assert(rec.Body.Len(), gc.Equals, 0)
+
+		// A weak comparison matches too.
+		rec = get(path, `"other", W/`+etag)
+		c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+
+		// When the metadata changes, so does the ETag.
+		fooVal = "foo2"
+		rec = get(path, etag)
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		c.Assert(rec.Header().Get("ETag"), gc.Not(gc.Equals), etag)
+	}
+
+	// The include set affects the ETag.
+	rec1 := get("/precise/wordpress-42/meta/any?include=foo", "")
+	rec2 := get("/precise/wordpress-42/meta/any?include=foo&include=bar", "")
+	c.Assert(rec1.Header().Get("ETag"), gc.Not(gc.Equals), rec2.Header().Get("ETag"))
+}
+
+func (s *RouterSuite) TestRouterKnownSeries(c *gc.C) {
+	handlers := Handlers{
+		Id: map[string]IdHandler{
+			"foo": testIdHandler,
+		},
+	}
+	router := New(&handlers, alwaysContext)
+	router.KnownSeries = KnownSeries("focal")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      router,
+		URL:          "/~joe/focal/wordpress-42/foo",
+		ExpectStatus: http.StatusOK,
+		ExpectBody: idHandlerTestResp{
+			Method:   "GET",
+			CharmURL: "cs:~joe/focal/wordpress-42",
+		},
+	})
+}
+
 var handlerKeyTests = []struct {
 	path       string
 	expectKey  string
@@ -2197,6 +2763,36 @@ func (s *RouterSuite) TestWriteError(c *gc.C) {
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(errResp1, gc.DeepEquals, errResp0)
 	c.Assert(rec.Code, gc.Equals, http.StatusInternalServerError)
+
+	// Information from an underlying error is included even
+	// when the cause is a standard error code.
+	rec = httptest.NewRecorder()
+	info := infoError{
+		"a": {Message: "a problem"},
+	}
+	WriteError(context.TODO(), rec, errgo.Mask(errgo.WithCausef(info, params.ErrBadRequest, ""), errgo.Any))
+	var errResp2 params.Error
+	err = json.Unmarshal(rec.Body.Bytes(), &errResp2)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(errResp2, jc.DeepEquals, params.Error{
+		Message: "info error",
+		Code:    params.ErrBadRequest,
+		Info: map[string]*params.Error{
+			"a": {Message: "a problem"},
+		},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusBadRequest)
+}
+
+// infoError is an error that provides error information.
+type infoError map[string]*params.Error
+
+func (infoError) Error() string {
+	return "info error"
+}
+
+func (e infoError) ErrorInfo() map[string]*params.Error {
+	return e
 }
 
 func (s *RouterSuite) TestServeMux(c *gc.C) {
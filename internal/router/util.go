@@ -75,6 +75,12 @@ func errorToResp1(err error) (int, interface{}) {
 	if err, ok := errgo.Cause(err).(*httpbakery.Error); ok {
 		return httpbakery.ErrorToResponse(err)
 	}
+	if errgo.Cause(err) == context.DeadlineExceeded {
+		// The handler has returned the error from a context
+		// that timed out, most likely because of
+		// Router.HandlerTimeout.
+		err = errgo.WithCausef(nil, ErrTimeout, "request timed out")
+	}
 	errorBody := errorResponseBody(err)
 	status := http.StatusInternalServerError
 	switch errorBody.Code {
@@ -94,6 +100,14 @@ func errorToResp1(err error) (int, interface{}) {
 		status = http.StatusMethodNotAllowed
 	case params.ErrServiceUnavailable:
 		status = http.StatusServiceUnavailable
+	case ErrResponseTooLarge:
+		status = http.StatusRequestEntityTooLarge
+	case ErrTooManyRequests:
+		status = http.StatusTooManyRequests
+	case ErrTimeout:
+		status = http.StatusGatewayTimeout
+	case ErrPreconditionFailed:
+		status = http.StatusPreconditionFailed
 	}
 	return status, errorBody
 }
@@ -111,10 +125,32 @@ func errorResponseBody(err error) *params.Error {
 	}
 	if infoer, ok := cause.(errorInfoer); ok {
 		errResp.Info = infoer.ErrorInfo()
+	} else if infoer := underlyingErrorInfoer(err); infoer != nil {
+		errResp.Info = infoer.ErrorInfo()
 	}
 	return errResp
 }
 
+// underlyingErrorInfoer returns the first error in the chain of
+// underlying errors of err that provides error information, or nil if
+// there is none. This allows an error to provide detailed information
+// while retaining one of the standard error codes as its cause.
+func underlyingErrorInfoer(err error) errorInfoer {
+	for err != nil {
+		if infoer, ok := err.(errorInfoer); ok {
+			return infoer
+		}
+		wrapper, ok := err.(interface {
+			Underlying() error
+		})
+		if !ok {
+			return nil
+		}
+		err = wrapper.Underlying()
+	}
+	return nil
+}
+
 type errorInfoer interface {
 	ErrorInfo() map[string]*params.Error
 }
@@ -48,11 +48,16 @@ func (b *Bundle) ReadMe() string {
 // NewBundle returns a bundle implementation
 // that contains the given bundle data.
 func NewBundle(data *charm.BundleData) *Bundle {
+	return NewBundleWithReadMe(data, "boring")
+}
+
+// NewBundleWithReadMe returns a bundle implementation
+// that contains the given bundle data and README text.
+func NewBundleWithReadMe(data *charm.BundleData, readMe string) *Bundle {
 	dataYAML, err := yaml.Marshal(data)
 	if err != nil {
 		panic(err)
 	}
-	readMe := "boring"
 	return &Bundle{
 		data:   data,
 		readMe: readMe,
@@ -72,9 +77,12 @@ func NewBundle(data *charm.BundleData) *Bundle {
 // Note that because it implements charmstore.ArchiverTo,
 // it can be used as an argument to charmstore.Store.AddCharmWithArchive.
 type Charm struct {
-	blob    *Blob
-	meta    *charm.Meta
-	metrics *charm.Metrics
+	blob      *Blob
+	meta      *charm.Meta
+	metrics   *charm.Metrics
+	config    *charm.Config
+	actions   *charm.Actions
+	extraMeta map[string]interface{}
 }
 
 var _ charm.Charm = (*Charm)(nil)
@@ -99,6 +107,22 @@ func (c *Charm) initBlob() {
 	if err != nil {
 		panic(err)
 	}
+	if len(c.extraMeta) > 0 {
+		var meta map[string]interface{}
+		if err := yaml.Unmarshal(metaYAML, &meta); err != nil {
+			panic(err)
+		}
+		if meta == nil {
+			meta = make(map[string]interface{})
+		}
+		for k, v := range c.extraMeta {
+			meta[k] = v
+		}
+		metaYAML, err = yaml.Marshal(meta)
+		if err != nil {
+			panic(err)
+		}
+	}
 	files := []File{{
 		Name: "metadata.yaml",
 		Data: metaYAML,
@@ -106,6 +130,34 @@ func (c *Charm) initBlob() {
 		Name: "README.md",
 		Data: []byte("boring"),
 	}}
+	if c.config != nil {
+		configYAML, err := yaml.Marshal(c.config)
+		if err != nil {
+			panic(err)
+		}
+		files = append(files, File{
+			Name: "config.yaml",
+			Data: configYAML,
+		})
+	}
+	if c.actions != nil {
+		// The actions.yaml file holds the action specs at
+		// the top level.
+		actions := make(map[string]interface{})
+		for name, spec := range c.actions.ActionSpecs {
+			actions[name] = map[string]interface{}{
+				"description": spec.Description,
+			}
+		}
+		actionsYAML, err := yaml.Marshal(actions)
+		if err != nil {
+			panic(err)
+		}
+		files = append(files, File{
+			Name: "actions.yaml",
+			Data: actionsYAML,
+		})
+	}
 	if c.metrics != nil {
 		metricsYAML, err := yaml.Marshal(c.metrics)
 		if err != nil {
@@ -124,6 +176,28 @@ func (c *Charm) WithMetrics(metrics *charm.Metrics) *Charm {
 	return c
 }
 
+// WithConfig sets the charm's config.yaml file to hold
+// the given configuration.
+func (c *Charm) WithConfig(config *charm.Config) *Charm {
+	c.config = config
+	return c
+}
+
+// WithActions sets the charm's actions.yaml file to hold the
+// given actions. Only the action descriptions are recorded.
+func (c *Charm) WithActions(actions *charm.Actions) *Charm {
+	c.actions = actions
+	return c
+}
+
+// WithExtraMeta adds the given fields to the charm's metadata.yaml
+// file. This can be used to add metadata that is not represented
+// in charm.Meta.
+func (c *Charm) WithExtraMeta(extra map[string]interface{}) *Charm {
+	c.extraMeta = extra
+	return c
+}
+
 // Meta implements charm.Charm.Meta.
 func (c *Charm) Meta() *charm.Meta {
 	return c.meta
@@ -131,6 +205,9 @@ func (c *Charm) Meta() *charm.Meta {
 
 // Config implements charm.Charm.Config.
 func (c *Charm) Config() *charm.Config {
+	if c.config != nil {
+		return c.config
+	}
 	return charm.NewConfig()
 }
 
@@ -141,6 +218,9 @@ func (c *Charm) Metrics() *charm.Metrics {
 
 // Actions implements charm.Charm.Actions.
 func (c *Charm) Actions() *charm.Actions {
+	if c.actions != nil {
+		return c.actions
+	}
 	return charm.NewActions()
 }
 
@@ -36,7 +36,7 @@ func (s *ElasticSearchSuite) SetUpSuite(c *gc.C) {
 	case "":
 		serverAddr = ":9200"
 	}
-	s.ES = &elasticsearch.Database{serverAddr}
+	s.ES = &elasticsearch.Database{Addr: serverAddr}
 }
 
 func (s *ElasticSearchSuite) TearDownSuite(c *gc.C) {
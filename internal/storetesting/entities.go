@@ -163,5 +163,8 @@ func NormalizeBaseEntity(be *mongodoc.BaseEntity) *mongodoc.BaseEntity {
 	if len(be1.ChannelResources) == 0 {
 		be1.ChannelResources = nil
 	}
+	// The revision count is maintained by the store as entities
+	// are added and removed, so it is not compared.
+	be1.RevisionCount = 0
 	return &be1
 }
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/juju/loggo"
 	"github.com/juju/mempool"
@@ -38,6 +39,29 @@ var reqHandlerPool = mempool.Pool{
 
 type Handler struct {
 	*v5.Handler
+
+	// maxMetaAnySize holds the limit on the size of
+	// meta/any responses. See charmstore.ServerParams.MaxMetaAnySize.
+	maxMetaAnySize int
+
+	// maxBulkMetaConcurrency holds the limit on the number of
+	// ids served concurrently by a bulk meta request.
+	// See charmstore.ServerParams.MaxBulkMetaConcurrency.
+	maxBulkMetaConcurrency int
+
+	// knownSeries holds the series recognized in ids.
+	// See charmstore.ServerParams.ExtraSeries.
+	knownSeries map[string]bool
+
+	// corsAllowedOrigins holds the origins allowed to make
+	// cross-origin requests.
+	// See charmstore.ServerParams.CORSAllowedOrigins.
+	corsAllowedOrigins []string
+
+	// handlerTimeout holds the maximum length of time
+	// that a request may take.
+	// See charmstore.ServerParams.HandlerTimeout.
+	handlerTimeout time.Duration
 }
 
 type ReqHandler struct {
@@ -50,7 +74,12 @@ func New(p charmstore.APIHandlerParams) (Handler, error) {
 		return Handler{}, errgo.Mask(err)
 	}
 	return Handler{
-		Handler: h,
+		Handler:                h,
+		maxMetaAnySize:         p.MaxMetaAnySize,
+		maxBulkMetaConcurrency: p.MaxBulkMetaConcurrency,
+		knownSeries:            router.KnownSeries(p.ExtraSeries...),
+		corsAllowedOrigins:     p.CORSAllowedOrigins,
+		handlerTimeout:         p.HandlerTimeout,
 	}, nil
 }
 
@@ -118,6 +147,14 @@ func (h *Handler) NewReqHandler(req *http.Request) (ReqHandler, error) {
 	rh.Cache = entitycache.New(rh.Store)
 	rh.Cache.AddEntityFields(requiredEntityFields)
 	rh.Cache.AddBaseEntityFields(v5.RequiredBaseEntityFields)
+	rh.Router.MaxMetaAnySize = h.maxMetaAnySize
+	rh.Router.MaxBulkMetaConcurrency = h.maxBulkMetaConcurrency
+	rh.Router.KnownSeries = h.knownSeries
+	rh.Router.CORS = router.CORSParams{
+		AllowedOrigins: h.corsAllowedOrigins,
+	}
+	rh.Router.RateLimits = h.RateLimits()
+	rh.Router.HandlerTimeout = h.handlerTimeout
 	return rh, nil
 }
 
@@ -152,11 +189,15 @@ func newReqHandler() ReqHandler {
 	delete(handlers.Meta, "can-write")
 	delete(handlers.Meta, "promulgated-id")
 	delete(handlers.Meta, "unpromulgated-id")
+	delete(handlers.Meta, "relation-summary")
+	delete(handlers.Meta, "interfaces")
+	delete(handlers.Meta, "bundle-verify")
 
 	delete(handlers.Global, "upload")
 	delete(handlers.Global, "upload/")
 
 	h.Router = router.New(handlers, h)
+	h.Router.RateLimitClient = h.ReqHandler.RateLimitClient
 	return h
 }
 
@@ -52,7 +52,7 @@ const (
 	testPassword = "test-password"
 )
 
-var es *elasticsearch.Database = &elasticsearch.Database{"localhost:9200"}
+var es *elasticsearch.Database = &elasticsearch.Database{Addr: "localhost:9200"}
 var si *charmstore.SearchIndex = &charmstore.SearchIndex{
 	Database: es,
 	Index:    "cs",
@@ -17,7 +17,7 @@ import (
 // serveArchive returns a handler for /archive that falls back to v5ServeArchive
 // for all operations not handled by v4.
 func (h ReqHandler) serveArchive(v5ServeArchive router.IdHandler) router.IdHandler {
-	get := h.ResolvedIdHandler(h.serveGetArchive)
+	get := h.SeriesResolvedIdHandler(h.serveGetArchive)
 	return func(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
 		switch req.Method {
 		case "GET":
@@ -136,12 +136,13 @@ func (s *commonSuite) startServer(c *gc.C) {
 	// Disable group caching.
 	s.PatchValue(&v5.PermCacheExpiry, time.Duration(0))
 	config := charmstore.ServerParams{
-		AuthUsername:     testUsername,
-		AuthPassword:     testPassword,
-		StatsCacheMaxAge: time.Nanosecond,
-		MaxMgoSessions:   s.maxMgoSessions,
-		AgentUsername:    "notused",
-		AgentKey:         new(bakery.KeyPair),
+		AuthUsername:      testUsername,
+		AuthPassword:      testPassword,
+		StatsCacheMaxAge:  time.Nanosecond,
+		GroupsCacheMaxAge: time.Nanosecond,
+		MaxMgoSessions:    s.maxMgoSessions,
+		AgentUsername:     "notused",
+		AgentKey:          new(bakery.KeyPair),
 	}
 	keyring := httpbakery.NewPublicKeyRing(nil, nil)
 	keyring.AllowInsecure()
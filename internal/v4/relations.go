@@ -125,7 +125,7 @@ func (h ReqHandler) getRelatedIfaceResponses(
 
 	resp, err := h.getMetadataForEntities(entities, includes, req, usesInterface)
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Any)
 	}
 	return resp, nil
 }
@@ -141,6 +141,9 @@ func (h ReqHandler) getMetadataForEntities(entities []*mongodoc.Entity, includes
 		if includeEntity != nil && !includeEntity(e) {
 			return nil
 		}
+		if err := req.Context().Err(); err != nil {
+			return errgo.NoteMask(err, "cannot get metadata", errgo.Any)
+		}
 		meta, err := h.getMetadataForEntity(e, includes, req)
 		if err == errMetadataUnauthorized {
 			return nil
@@ -161,7 +164,7 @@ func (h ReqHandler) getMetadataForEntities(entities []*mongodoc.Entity, includes
 		return nil
 	})
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Any)
 	}
 	return response, nil
 }
@@ -174,5 +177,5 @@ func (h ReqHandler) getMetadataForEntity(e *mongodoc.Entity, includes []string,
 	if err := h.AuthorizeEntity(rurl, req); err != nil {
 		return nil, errMetadataUnauthorized
 	}
-	return h.Router.GetMetadata(rurl, includes, req)
+	return h.Router.GetMetadata(req.Context(), rurl, includes, req)
 }
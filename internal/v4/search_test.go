@@ -619,6 +619,122 @@ func (s *SearchSuite) TestDownloadsBoost(c *gc.C) {
 	c.Assert(sr.Results[2].Id.Name, gc.Equals, "mysql")
 }
 
+func (s *SearchSuite) TestSearchHighlight(c *gc.C) {
+	url := newResolvedURL("cs:~highlight-test/trusty/frobnicator-1", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(&charm.Meta{
+		Summary: "The frobnicator server.",
+	}), url)
+	err := s.esSuite.ES.RefreshIndex(s.esSuite.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	var sr struct {
+		Results []struct {
+			Id         *charm.URL
+			Highlights map[string][]string
+		}
+	}
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("search?text=frobnicator&highlight=1"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	err = json.Unmarshal(rec.Body.Bytes(), &sr)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sr.Results, gc.HasLen, 1)
+	c.Assert(sr.Results[0].Id.String(), gc.Equals, url.String())
+	c.Assert(sr.Results[0].Highlights, jc.DeepEquals, map[string][]string{
+		"CharmMeta.Summary": {"The <em>frobnicator</em> server."},
+	})
+
+	// Without the highlight parameter, no highlights are returned.
+	sr.Results = nil
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("search?text=frobnicator"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+	err = json.Unmarshal(rec.Body.Bytes(), &sr)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sr.Results, gc.HasLen, 1)
+	c.Assert(sr.Results[0].Highlights, gc.IsNil)
+}
+
+func (s *SearchSuite) TestSearchPreferredURL(c *gc.C) {
+	tests := []struct {
+		about              string
+		query              string
+		expectPreferredURL string
+		expectChannel      params.Channel
+	}{{
+		about:              "promulgated charm",
+		query:              "text=wordpress&type=charm",
+		expectPreferredURL: "cs:precise/wordpress-23",
+		expectChannel:      params.StableChannel,
+	}, {
+		about:              "non-promulgated charm",
+		query:              "text=varnish",
+		expectPreferredURL: "cs:~foo/trusty/varnish-1",
+		expectChannel:      params.StableChannel,
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL("search?" + test.query),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+		var sr struct {
+			Results []struct {
+				Id           *charm.URL
+				PreferredURL *charm.URL
+				Channel      params.Channel
+			}
+		}
+		err := json.Unmarshal(rec.Body.Bytes(), &sr)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(sr.Results, gc.HasLen, 1)
+		c.Assert(sr.Results[0].PreferredURL.String(), gc.Equals, test.expectPreferredURL)
+		c.Assert(sr.Results[0].Id, jc.DeepEquals, sr.Results[0].PreferredURL)
+		c.Assert(sr.Results[0].Channel, gc.Equals, test.expectChannel)
+	}
+}
+
+func (s *SearchSuite) TestSearchSuggestions(c *gc.C) {
+	tests := []struct {
+		about             string
+		query             string
+		expectSuggestions []string
+	}{{
+		about:             "misspelled name",
+		query:             "text=wordpresz&suggest=1",
+		expectSuggestions: []string{"wordpress"},
+	}, {
+		about: "nonsense",
+		query: "text=xyzzyplugh&suggest=1",
+	}, {
+		about: "name not visible to user",
+		query: "text=riakz&suggest=1",
+	}, {
+		about: "suggestions not requested",
+		query: "text=wordpresz",
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL("search?" + test.query),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+		var sr struct {
+			Total       int
+			Suggestions []string
+		}
+		err := json.Unmarshal(rec.Body.Bytes(), &sr)
+		c.Assert(err, gc.Equals, nil)
+		c.Assert(sr.Total, gc.Equals, 0)
+		c.Assert(sr.Suggestions, jc.DeepEquals, test.expectSuggestions)
+	}
+}
+
 func (s *SearchSuite) TestSearchWithAdminCredentials(c *gc.C) {
 	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
 		Handler:  s.srv,
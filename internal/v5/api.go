@@ -11,8 +11,10 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/juju/idmclient"
@@ -48,6 +50,210 @@ type SetAuthCookie struct {
 	Macaroons macaroon.Slice
 }
 
+// LatestRevisionResponse holds the response from a
+// GET id/latest-revision request.
+type LatestRevisionResponse struct {
+	// Revision holds the highest revision of the entity.
+	Revision int
+
+	// PromulgatedRevision holds the highest promulgated revision
+	// of the entity, or -1 if it has never been promulgated.
+	PromulgatedRevision int
+}
+
+// RelationSummaryResponse holds the response from a
+// GET id/meta/relation-summary request.
+type RelationSummaryResponse struct {
+	Provides RelationSummary
+	Requires RelationSummary
+	Peers    RelationSummary
+}
+
+// RelationSummary summarizes a set of charm relations.
+type RelationSummary struct {
+	// Count holds the number of relations.
+	Count int
+
+	// Interfaces holds the distinct interfaces used
+	// by the relations, in sorted order.
+	Interfaces []string `json:",omitempty"`
+}
+
+// InterfacesResponse holds the response from a
+// GET id/meta/interfaces request.
+type InterfacesResponse struct {
+	// Provides holds the interfaces provided by the charm,
+	// in sorted order.
+	Provides []string
+
+	// Requires holds the interfaces required by the charm,
+	// in sorted order.
+	Requires []string
+}
+
+// SearchOwnersResponse holds the response from a
+// GET search/owners request.
+type SearchOwnersResponse struct {
+	Results []OwnerResult
+}
+
+// BundleVerifyResponse holds the response from a
+// GET id/meta/bundle-verify request.
+type BundleVerifyResponse struct {
+	// Problems holds an entry for each application in the
+	// bundle whose charm cannot be used, ordered by
+	// application name. It is empty when all the charms
+	// resolve and are readable.
+	Problems []BundleVerifyProblem
+}
+
+// BundleVerifyProblem describes a problem with the charm used by
+// an application in a bundle.
+type BundleVerifyProblem struct {
+	// Application holds the name of the application.
+	Application string
+
+	// Charm holds the charm id as specified in the bundle.
+	Charm string
+
+	// Code holds the kind of problem. It is params.ErrBadRequest
+	// if the charm id is invalid, params.ErrNotFound if the charm
+	// does not exist and params.ErrUnauthorized if the charm
+	// cannot be read.
+	Code params.ErrorCode
+
+	// Message holds a description of the problem.
+	Message string
+}
+
+// ReindexProgressResponse holds the response from a
+// GET search/reindex-progress request.
+type ReindexProgressResponse struct {
+	// InProgress holds whether the search index is
+	// being populated.
+	InProgress bool
+
+	// Done holds the number of charms and bundles
+	// indexed so far.
+	Done int
+
+	// Total holds the number of charms and bundles
+	// to index.
+	Total int
+}
+
+// StatsCountsResponse holds the response from a
+// GET stats/counts request.
+type StatsCountsResponse struct {
+	// Charms holds the number of charms.
+	Charms int
+
+	// Bundles holds the number of bundles.
+	Bundles int
+
+	// Promulgated holds the number of promulgated
+	// charms and bundles.
+	Promulgated int
+
+	// Downloads holds the total number of downloads
+	// of all charms and bundles.
+	Downloads int64
+}
+
+// SeriesStatsResponse holds the response from a
+// GET id/meta/series-stats request.
+type SeriesStatsResponse struct {
+	// ArchiveDownloadCount holds the total number of
+	// downloads of the entity archive, as reported by
+	// meta/stats.
+	ArchiveDownloadCount int64
+
+	// ArchiveDownloadBySeries holds the number of downloads
+	// of the entity archive keyed by the series that was
+	// resolved when the archive was downloaded. Downloads
+	// made before per-series counts were recorded are not
+	// included, so the counts may sum to less than
+	// ArchiveDownloadCount.
+	ArchiveDownloadBySeries map[string]int64
+}
+
+// SearchExplainResponse holds the response from a
+// GET search/explain request.
+type SearchExplainResponse struct {
+	// Id holds the id of the explained charm or bundle.
+	Id *charm.URL
+
+	// Found holds whether the search finds the charm
+	// or bundle.
+	Found bool
+
+	// Reason holds why the charm or bundle is or is
+	// not found.
+	Reason string
+}
+
+// OwnerResult holds the number of matching charms and
+// bundles published by an owner.
+type OwnerResult struct {
+	Owner string
+	Count int
+}
+
+// SearchResponse holds the response from a search request.
+// It is compatible with params.SearchResponse, but holds
+// additional information about each result.
+type SearchResponse struct {
+	SearchTime time.Duration
+	Total      int
+	Results    []SearchEntityResult
+
+	// Facets holds the counts for each requested facet,
+	// keyed by facet name.
+	Facets map[string][]charmstore.FacetCount `json:",omitempty"`
+
+	// TypeCounts holds the number of matching charms and
+	// bundles, ignoring any type filter, when requested.
+	TypeCounts map[string]int `json:",omitempty"`
+
+	// NextCursor holds a cursor that can be used to
+	// fetch the next page of results.
+	NextCursor string `json:",omitempty"`
+
+	// Suggestions holds similar names of charms and bundles
+	// when suggestions were requested and nothing matched.
+	Suggestions []string `json:",omitempty"`
+}
+
+// SearchEntityResult holds a single search result. It is compatible
+// with params.EntityResult.
+type SearchEntityResult struct {
+	Id   *charm.URL
+	Meta map[string]interface{} `json:",omitempty"`
+
+	// Score holds the relevance score of the result. Scores
+	// are only meaningful when compared with other scores
+	// from the same search; their range is not stable
+	// across index rebuilds.
+	Score float64 `json:",omitempty"`
+
+	// PreferredURL holds the preferred URL of the entity, which
+	// is its promulgated URL if it is promulgated and its
+	// owned URL otherwise.
+	PreferredURL *charm.URL `json:",omitempty"`
+
+	// Channel holds the channel in which the entity was found.
+	Channel params.Channel `json:",omitempty"`
+
+	// DeprecatedSeries holds whether the entity is a charm
+	// that is only available on deprecated series.
+	DeprecatedSeries bool `json:",omitempty"`
+
+	// Highlights holds fragments of the text fields of the
+	// entity that match the search text, keyed by field name.
+	// It is only set when highlighting was requested.
+	Highlights map[string][]string `json:",omitempty"`
+}
+
 var logger = loggo.GetLogger("charmstore.internal.v5")
 
 // reqHandlerPool holds a cache of ReqHandlers to save
@@ -72,6 +278,13 @@ type Handler struct {
 	// parameters of the search. It should only be used for searches
 	// from unauthenticated users.
 	searchCache *cache.Cache
+
+	// knownSeries holds the series recognized in ids.
+	// See charmstore.ServerParams.ExtraSeries.
+	knownSeries map[string]bool
+
+	// rateLimits holds the rate limiter for each route family.
+	rateLimits map[string]*router.RateLimiter
 }
 
 // ReqHandler holds the context for a single HTTP request.
@@ -96,6 +309,10 @@ type ReqHandler struct {
 	// has been done on this request.
 	auth Authorization
 
+	// authMu guards auth, which may be set concurrently
+	// when the router serves a bulk meta request.
+	authMu sync.Mutex
+
 	// cache holds the per-request entity cache.
 	Cache *entitycache.Cache
 }
@@ -116,9 +333,35 @@ func New(params charmstore.APIHandlerParams) (*Handler, error) {
 		rootPath:    params.Path,
 		searchCache: cache.New(params.SearchCacheMaxAge),
 		idmClient:   params.IDMClient,
+		knownSeries: router.KnownSeries(params.ExtraSeries...),
+		rateLimits:  newRateLimiters(params.RateLimits),
 	}, nil
 }
 
+// newRateLimiters returns a rate limiter for each of the
+// route families in the given limits. Families with a limit
+// that is not positive are not limited.
+func newRateLimiters(limits map[string]int) map[string]*router.RateLimiter {
+	if len(limits) == 0 {
+		return nil
+	}
+	limiters := make(map[string]*router.RateLimiter, len(limits))
+	for family, perMinute := range limits {
+		if perMinute <= 0 {
+			continue
+		}
+		limiters[family] = router.NewRateLimiter(perMinute)
+	}
+	return limiters
+}
+
+// RateLimits returns the rate limiters shared by all the
+// requests served by the handler, keyed by route family.
+// See charmstore.ServerParams.RateLimits.
+func (h *Handler) RateLimits() map[string]*router.RateLimiter {
+	return h.rateLimits
+}
+
 // Close closes the Handler.
 func (h *Handler) Close() {
 }
@@ -190,6 +433,14 @@ func (h *Handler) NewReqHandler(req *http.Request) (*ReqHandler, error) {
 	rh.Cache = entitycache.New(rh.Store)
 	rh.Cache.AddEntityFields(RequiredEntityFields)
 	rh.Cache.AddBaseEntityFields(RequiredBaseEntityFields)
+	rh.Router.MaxMetaAnySize = h.config.MaxMetaAnySize
+	rh.Router.MaxBulkMetaConcurrency = h.config.MaxBulkMetaConcurrency
+	rh.Router.KnownSeries = h.knownSeries
+	rh.Router.CORS = router.CORSParams{
+		AllowedOrigins: h.config.CORSAllowedOrigins,
+	}
+	rh.Router.RateLimits = h.rateLimits
+	rh.Router.HandlerTimeout = h.config.HandlerTimeout
 	return rh, nil
 }
 
@@ -202,24 +453,30 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 	authId := h.AuthIdHandler
 	return &router.Handlers{
 		Global: map[string]http.Handler{
-			"changes/published":    router.HandleJSON(h.serveChangesPublished),
-			"debug":                http.HandlerFunc(h.serveDebug),
-			"debug/pprof/":         newPprofHandler(h),
-			"debug/status":         router.HandleJSON(h.serveDebugStatus),
-			"list":                 router.HandleJSON(h.serveList),
-			"log":                  router.HandleErrors(h.serveLog),
-			"logout":               http.HandlerFunc(logout),
-			"search":               router.HandleJSON(h.serveSearch),
-			"search/interesting":   http.HandlerFunc(h.serveSearchInteresting),
-			"set-auth-cookie":      router.HandleErrors(h.serveSetAuthCookie),
-			"stats/":               router.NotFoundHandler(),
-			"stats/counter/":       router.HandleJSON(h.serveStatsCounter),
-			"stats/update":         router.HandleErrors(h.serveStatsUpdate),
-			"macaroon":             router.HandleJSON(h.serveMacaroon),
-			"delegatable-macaroon": router.HandleJSON(h.serveDelegatableMacaroon),
-			"whoami":               router.HandleJSON(h.serveWhoAmI),
-			"upload":               router.HandleErrors(h.serveUploadId),
-			"upload/":              router.HandleErrors(h.serveUploadPart),
+			"changes/published":       router.HandleJSON(h.serveChangesPublished),
+			"debug":                   http.HandlerFunc(h.serveDebug),
+			"debug/pprof/":            newPprofHandler(h),
+			"debug/status":            router.HandleJSON(h.serveDebugStatus),
+			"exists":                  router.HandleJSON(h.serveExists),
+			"list":                    router.HandleJSON(h.serveList),
+			"log":                     router.HandleErrors(h.serveLog),
+			"logout":                  http.HandlerFunc(logout),
+			"search":                  router.HandleJSON(h.serveSearch),
+			"search/interesting":      http.HandlerFunc(h.serveSearchInteresting),
+			"search/explain":          router.HandleJSON(h.serveSearchExplain),
+			"search/owners":           router.HandleJSON(h.serveSearchOwners),
+			"search/reindex-progress": router.HandleJSON(h.serveSearchReindexProgress),
+			"search/updated":          router.HandleJSON(h.serveSearchUpdated),
+			"set-auth-cookie":         router.HandleErrors(h.serveSetAuthCookie),
+			"stats/":                  router.NotFoundHandler(),
+			"stats/counter/":          router.HandleJSON(h.serveStatsCounter),
+			"stats/counts":            router.HandleJSON(h.serveStatsCounts),
+			"stats/update":            router.HandleErrors(h.serveStatsUpdate),
+			"macaroon":                router.HandleJSON(h.serveMacaroon),
+			"delegatable-macaroon":    router.HandleJSON(h.serveDelegatableMacaroon),
+			"whoami":                  router.HandleJSON(h.serveWhoAmI),
+			"upload":                  router.HandleErrors(h.serveUploadId),
+			"upload/":                 router.HandleErrors(h.serveUploadPart),
 		},
 		Id: map[string]router.IdHandler{
 			"archive":                     h.serveArchive,
@@ -227,6 +484,7 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 			"diagram.svg":                 resolveId(authId(h.serveDiagram), "bundledata"),
 			"expand-id":                   resolveId(authId(h.serveExpandId)),
 			"icon.svg":                    resolveId(authId(h.serveIcon), "contents", "blobhash"),
+			"latest-revision":             resolveId(authId(h.serveLatestRevision)),
 			"publish":                     resolveId(h.servePublish),
 			"promulgate":                  resolveId(h.servePromulgate),
 			"readme":                      resolveId(authId(h.serveReadMe), "contents", "blobhash"),
@@ -241,12 +499,14 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 			"bundle-metadata":      h.EntityHandler(h.metaBundleMetadata, "bundledata"),
 			"bundles-containing":   h.EntityHandler(h.metaBundlesContaining),
 			"bundle-unit-count":    h.EntityHandler(h.metaBundleUnitCount, "bundleunitcount"),
+			"bundle-verify":        h.EntityHandler(h.metaBundleVerify, "bundledata"),
 			"published":            h.EntityHandler(h.metaPublished, "published"),
+			"relation-summary":     h.EntityHandler(h.metaRelationSummary, "charmmeta"),
 			"charm-actions":        h.EntityHandler(h.metaCharmActions, "charmactions"),
 			"charm-config":         h.EntityHandler(h.metaCharmConfig, "charmconfig"),
 			"charm-metadata":       h.EntityHandler(h.metaCharmMetadata, "charmmeta"),
 			"charm-metrics":        h.EntityHandler(h.metaCharmMetrics, "charmmetrics"),
-			"charm-related":        h.EntityHandler(h.metaCharmRelated, "charmprovidedinterfaces", "charmrequiredinterfaces"),
+			"charm-related":        h.EntityHandler(h.metaCharmRelated, "charmprovidedinterfaces", "charmrequiredinterfaces", "baseurl"),
 			"common-info": h.puttableBaseEntityHandler(
 				h.metaCommonInfo,
 				h.putMetaCommonInfo,
@@ -268,12 +528,13 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 				"extrainfo",
 			),
 			"hash":             h.EntityHandler(h.metaHash, "blobhash"),
-			"hash256":          h.EntityHandler(h.metaHash256, "blobhash256"),
+			"hash256":          h.EntityHandler(h.metaHash256, "blobhash", "blobhash256"),
 			"id":               h.EntityHandler(h.metaId, "_id"),
 			"id-name":          h.EntityHandler(h.metaIdName, "_id"),
 			"id-user":          h.EntityHandler(h.metaIdUser, "_id"),
 			"id-revision":      h.EntityHandler(h.metaIdRevision, "_id"),
 			"id-series":        h.EntityHandler(h.metaIdSeries, "_id"),
+			"interfaces":       h.EntityHandler(h.metaInterfaces, "charmprovidedinterfaces", "charmrequiredinterfaces"),
 			"unpromulgated-id": h.EntityHandler(h.metaUnpromulgatedId, "_id"),
 			"promulgated-id":   h.EntityHandler(h.metaPromulgatedId, "_id", "promulgated-url"),
 			"manifest":         h.EntityHandler(h.metaManifest, "blobhash"),
@@ -286,6 +547,7 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 			"resources":        h.EntityHandler(h.metaResources, "charmmeta"),
 			"resources/":       h.EntityHandler(h.metaResourcesSingle, "charmmeta"),
 			"revision-info":    router.SingleIncludeHandler(h.metaRevisionInfo),
+			"series-stats":     h.EntityHandler(h.metaSeriesStats),
 			"stats":            h.EntityHandler(h.metaStats, "supportedseries"),
 			"supported-series": h.EntityHandler(h.metaSupportedSeries, "supportedseries"),
 			"tags":             h.EntityHandler(h.metaTags, "charmmeta", "bundledata"),
@@ -302,6 +564,7 @@ func RouterHandlers(h *ReqHandler) *router.Handlers {
 func newReqHandler() *ReqHandler {
 	var h ReqHandler
 	h.Router = router.New(RouterHandlers(&h), &h)
+	h.Router.RateLimitClient = h.RateLimitClient
 	return &h
 }
 
@@ -351,7 +614,9 @@ func (h *ReqHandler) Reset() {
 	h.Store = nil
 	h.Handler = nil
 	h.Cache = nil
+	h.authMu.Lock()
 	h.auth = Authorization{}
+	h.authMu.Unlock()
 }
 
 // ResolveURL implements router.Context.ResolveURL.
@@ -581,15 +846,20 @@ func (h *ReqHandler) serveExpandId(id *router.ResolvedURL, w http.ResponseWriter
 	// specified without a user, which will cause EntitiesQuery
 	// to return entities that match appropriately.
 
-	// Retrieve all the entities with the same base URL.
-	q := h.Store.EntitiesQuery(baseURL).Select(bson.D{{"_id", 1}, {"promulgated-url", 1}})
+	// Retrieve all the entities with the same base URL that are
+	// published on the requested channel, if any.
+	q, err := h.Store.ExpandURLWithChannel(baseURL, h.Store.Channel)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	q = q.Select(bson.D{{"_id", 1}, {"promulgated-url", 1}})
 	if id.PromulgatedRevision != -1 {
 		q = q.Sort("-series", "-promulgated-revision")
 	} else {
 		q = q.Sort("-series", "-revision")
 	}
 	var docs []*mongodoc.Entity
-	err := q.All(&docs)
+	err = q.All(&docs)
 	if err != nil && errgo.Cause(err) != mgo.ErrNotFound {
 		return errgo.Mask(err)
 	}
@@ -608,6 +878,48 @@ func (h *ReqHandler) serveExpandId(id *router.ResolvedURL, w http.ResponseWriter
 	return httprequest.WriteJSON(w, http.StatusOK, response)
 }
 
+// GET exists?id=id[&id=id...]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-exists
+func (h *ReqHandler) serveExists(_ http.Header, req *http.Request) (interface{}, error) {
+	ids := req.Form["id"]
+	if len(ids) == 0 {
+		return nil, badRequestf(nil, "no ids specified in exists request")
+	}
+	urls := make([]*charm.URL, len(ids))
+	for i, id := range ids {
+		url, err := charm.ParseURL(id)
+		if err != nil {
+			return nil, badRequestf(err, "")
+		}
+		urls[i] = url
+	}
+	rurls, err := h.ResolveURLs(urls)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	result := make(map[string]bool, len(ids))
+	for i, rurl := range rurls {
+		// Entities that cannot be read by the client are
+		// reported as missing so that their existence is
+		// not revealed.
+		result[ids[i]] = rurl != nil && h.AuthorizeEntity(rurl, req) == nil
+	}
+	return result, nil
+}
+
+// GET id/latest-revision
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idlatest-revision
+func (h *ReqHandler) serveLatestRevision(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+	rev, promulgatedRev, err := h.Store.LatestRevision(&id.URL)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return httprequest.WriteJSON(w, http.StatusOK, LatestRevisionResponse{
+		Revision:            rev,
+		PromulgatedRevision: promulgatedRev,
+	})
+}
+
 func badRequestf(underlying error, f string, a ...interface{}) error {
 	err := errgo.WithCausef(underlying, params.ErrBadRequest, f, a...)
 	err.(*errgo.Err).SetLocation(1)
@@ -626,6 +938,54 @@ func (h *ReqHandler) metaCharmMetrics(entity *mongodoc.Entity, id *router.Resolv
 	return entity.CharmMetrics, nil
 }
 
+// GET id/meta/relation-summary
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetarelation-summary
+func (h *ReqHandler) metaRelationSummary(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.CharmMeta == nil {
+		return nil, nil
+	}
+	return &RelationSummaryResponse{
+		Provides: relationSummary(entity.CharmMeta.Provides),
+		Requires: relationSummary(entity.CharmMeta.Requires),
+		Peers:    relationSummary(entity.CharmMeta.Peers),
+	}, nil
+}
+
+// GET id/meta/interfaces
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetainterfaces
+func (h *ReqHandler) metaInterfaces(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.URL.Series == "bundle" {
+		return nil, nil
+	}
+	return &InterfacesResponse{
+		Provides: sortedStrings(entity.CharmProvidedInterfaces),
+		Requires: sortedStrings(entity.CharmRequiredInterfaces),
+	}, nil
+}
+
+// sortedStrings returns a sorted copy of ss. It never returns nil.
+func sortedStrings(ss []string) []string {
+	ss1 := append([]string{}, ss...)
+	sort.Strings(ss1)
+	return ss1
+}
+
+// relationSummary returns a summary of the given relations.
+func relationSummary(rels map[string]charm.Relation) RelationSummary {
+	s := RelationSummary{
+		Count: len(rels),
+	}
+	found := make(map[string]bool)
+	for _, rel := range rels {
+		if !found[rel.Interface] {
+			found[rel.Interface] = true
+			s.Interfaces = append(s.Interfaces, rel.Interface)
+		}
+	}
+	sort.Strings(s.Interfaces)
+	return s
+}
+
 // GET id/meta/bundle-metadata
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetabundle-metadata
 func (h *ReqHandler) metaBundleMetadata(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
@@ -644,6 +1004,56 @@ func (h *ReqHandler) metaBundleMachineCount(entity *mongodoc.Entity, id *router.
 	return bundleCount(entity.BundleMachineCount), nil
 }
 
+// GET id/meta/bundle-verify
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetabundle-verify
+func (h *ReqHandler) metaBundleVerify(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.BundleData == nil {
+		return nil, nil
+	}
+	names := make([]string, 0, len(entity.BundleData.Applications))
+	for name := range entity.BundleData.Applications {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	problems := []BundleVerifyProblem{}
+	for _, name := range names {
+		charmId := entity.BundleData.Applications[name].Charm
+		problem := BundleVerifyProblem{
+			Application: name,
+			Charm:       charmId,
+		}
+		curl, err := charm.ParseURL(charmId)
+		if err != nil {
+			problem.Code = params.ErrBadRequest
+			problem.Message = err.Error()
+			problems = append(problems, problem)
+			continue
+		}
+		rurl, err := h.ResolveURL(curl)
+		if errgo.Cause(err) == params.ErrNotFound {
+			problem.Code = params.ErrNotFound
+			problem.Message = "charm not found"
+			problems = append(problems, problem)
+			continue
+		}
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot resolve %q", charmId)
+		}
+		ok, err := h.canRead(rurl, req)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot check read access to %q", charmId)
+		}
+		if !ok {
+			problem.Code = params.ErrUnauthorized
+			problem.Message = "charm is not readable"
+			problems = append(problems, problem)
+		}
+	}
+	return BundleVerifyResponse{
+		Problems: problems,
+	}, nil
+}
+
 func bundleCount(x *int) interface{} {
 	if x == nil {
 		return nil
@@ -728,8 +1138,12 @@ func (h *ReqHandler) metaHash(entity *mongodoc.Entity, id *router.ResolvedURL, p
 // GET id/meta/hash256
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetahash256
 func (h *ReqHandler) metaHash256(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	sum, err := h.Store.BlobHash256(entity)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
 	return &params.HashResponse{
-		Sum: entity.BlobHash256,
+		Sum: sum,
 	}, nil
 }
 
@@ -760,18 +1174,45 @@ func (h *ReqHandler) metaStats(entity *mongodoc.Entity, id *router.ResolvedURL,
 		return charmstore.SearchParams{}, badRequestf(err, "invalid refresh parameter")
 	}
 
-	preferredURL := id.PreferredURL()
-	counts, countsAllRevisions, err := h.Store.ArchiveDownloadCounts(preferredURL, refresh)
+	counts, countsAllRevisions, err := h.archiveDownloadCounts(entity, id, refresh)
 	if err != nil {
 		return nil, errgo.Mask(err)
 	}
+	// Return the response.
+	return &params.StatsResponse{
+		ArchiveDownloadCount: counts.Total,
+		ArchiveDownload: params.StatsCount{
+			Total: counts.Total,
+			Day:   counts.LastDay,
+			Week:  counts.LastWeek,
+			Month: counts.LastMonth,
+		},
+		ArchiveDownloadAllRevisions: params.StatsCount{
+			Total: countsAllRevisions.Total,
+			Day:   countsAllRevisions.LastDay,
+			Week:  countsAllRevisions.LastWeek,
+			Month: countsAllRevisions.LastMonth,
+		},
+	}, nil
+}
+
+// archiveDownloadCounts returns the aggregated archive download counts
+// for the given entity revision and for all its revisions. The counts
+// for a multi-series entity include the downloads recorded under each
+// of its supported series.
+func (h *ReqHandler) archiveDownloadCounts(entity *mongodoc.Entity, id *router.ResolvedURL, refresh bool) (counts, countsAllRevisions charmstore.AggregatedCounts, err error) {
+	preferredURL := id.PreferredURL()
+	counts, countsAllRevisions, err = h.Store.ArchiveDownloadCounts(preferredURL, refresh)
+	if err != nil {
+		return charmstore.AggregatedCounts{}, charmstore.AggregatedCounts{}, errgo.Mask(err)
+	}
 	if entity.Series == "" {
 		// Concatenate all the supported series for a multi-series entity.
 		for _, series := range entity.SupportedSeries {
 			preferredURL.Series = series
 			countsSeries, countsAllRevisionsSeries, err := h.Store.ArchiveDownloadCounts(preferredURL, refresh)
 			if err != nil {
-				return nil, errgo.Mask(err)
+				return charmstore.AggregatedCounts{}, charmstore.AggregatedCounts{}, errgo.Mask(err)
 			}
 			counts.Total += countsSeries.Total
 			counts.LastDay += countsSeries.LastDay
@@ -783,21 +1224,27 @@ func (h *ReqHandler) metaStats(entity *mongodoc.Entity, id *router.ResolvedURL,
 			countsAllRevisions.LastMonth += countsAllRevisionsSeries.LastMonth
 		}
 	}
-	// Return the response.
-	return &params.StatsResponse{
-		ArchiveDownloadCount: counts.Total,
-		ArchiveDownload: params.StatsCount{
-			Total: counts.Total,
-			Day:   counts.LastDay,
-			Week:  counts.LastWeek,
-			Month: counts.LastMonth,
-		},
-		ArchiveDownloadAllRevisions: params.StatsCount{
-			Total: countsAllRevisions.Total,
-			Day:   countsAllRevisions.LastDay,
-			Week:  countsAllRevisions.LastWeek,
-			Month: countsAllRevisions.LastMonth,
-		},
+	return counts, countsAllRevisions, nil
+}
+
+// GET id/meta/series-stats
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaseries-stats
+func (h *ReqHandler) metaSeriesStats(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	refresh, err := router.ParseBool(flags.Get("refresh"))
+	if err != nil {
+		return nil, badRequestf(err, "invalid refresh parameter")
+	}
+	counts, _, err := h.archiveDownloadCounts(entity, id, refresh)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	bySeries, err := h.Store.ArchiveDownloadCountsBySeries(&id.URL)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return &SeriesStatsResponse{
+		ArchiveDownloadCount:    counts.Total,
+		ArchiveDownloadBySeries: bySeries,
 	}, nil
 }
 
@@ -955,7 +1402,7 @@ func (h *ReqHandler) putMetaExtraInfo(id *router.ResolvedURL, path string, val *
 	}
 	// Check all the fields are OK before adding any fields to be updated.
 	for key := range fields {
-		if err := checkExtraInfoKey(key, "extra-info"); err != nil {
+		if err := charmstore.CheckExtraInfoKey(key, "extra-info"); err != nil {
 			return err
 		}
 	}
@@ -975,7 +1422,7 @@ var nullBytes = []byte("null")
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#put-idmetaextra-infokey
 func (h *ReqHandler) putMetaExtraInfoWithKey(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
 	key := strings.TrimPrefix(path, "/")
-	if err := checkExtraInfoKey(key, "extra-info"); err != nil {
+	if err := charmstore.CheckExtraInfoKey(key, "extra-info"); err != nil {
 		return err
 	}
 	// If the user puts null, we treat that as if they want to
@@ -1022,7 +1469,7 @@ func (h *ReqHandler) putMetaCommonInfo(id *router.ResolvedURL, path string, val
 	}
 	// Check all the fields are OK before adding any fields to be updated.
 	for key := range fields {
-		if err := checkExtraInfoKey(key, "common-info"); err != nil {
+		if err := charmstore.CheckExtraInfoKey(key, "common-info"); err != nil {
 			return err
 		}
 	}
@@ -1040,7 +1487,7 @@ func (h *ReqHandler) putMetaCommonInfo(id *router.ResolvedURL, path string, val
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#put-idmetacommon-infokey
 func (h *ReqHandler) putMetaCommonInfoWithKey(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
 	key := strings.TrimPrefix(path, "/")
-	if err := checkExtraInfoKey(key, "common-info"); err != nil {
+	if err := charmstore.CheckExtraInfoKey(key, "common-info"); err != nil {
 		return err
 	}
 	// If the user puts null, we treat that as if they want to
@@ -1053,13 +1500,6 @@ func (h *ReqHandler) putMetaCommonInfoWithKey(id *router.ResolvedURL, path strin
 	return nil
 }
 
-func checkExtraInfoKey(key string, field string) error {
-	if strings.ContainsAny(key, "./$") {
-		return errgo.WithCausef(nil, params.ErrBadRequest, "bad key for "+field)
-	}
-	return nil
-}
-
 // GET id/meta/perm
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaperm
 func (h *ReqHandler) metaPerm(entity *mongodoc.BaseEntity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
@@ -1640,6 +2080,23 @@ func (h *ReqHandler) ResolvedIdHandler(f ResolvedIdHandler, cacheFields ...strin
 	}
 }
 
+// SeriesResolvedIdHandler is like ResolvedIdHandler except that when
+// the id specifies a series and resolves to a multi-series charm, the
+// series is retained as the preferred series of the resolved id, so
+// that the response refers to the series-specific URL of the charm.
+func (h *ReqHandler) SeriesResolvedIdHandler(f ResolvedIdHandler, cacheFields ...string) router.IdHandler {
+	return func(id *charm.URL, w http.ResponseWriter, req *http.Request) error {
+		return h.ResolvedIdHandler(func(rid *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
+			if id.Series != "" && rid.URL.Series == "" {
+				rid1 := *rid
+				rid1.PreferredSeries = id.Series
+				rid = &rid1
+			}
+			return f(rid, w, req)
+		}, cacheFields...)(id, w, req)
+	}
+}
+
 // reqBodyReadHandler returns an id handler that reads the request body
 // before returning a response.
 func reqBodyReadHandler(f router.IdHandler) router.IdHandler {
@@ -1659,11 +2116,12 @@ var testAddAuditCallback func(e audit.Entry)
 // addAudit delegates an audit entry to the store to record an audit log after
 // it has set correctly the user doing the action.
 func (h *ReqHandler) addAudit(e audit.Entry) {
-	if h.auth.User == nil && !h.auth.Admin {
+	auth := h.authorization()
+	if auth.User == nil && !auth.Admin {
 		panic("No auth set in ReqHandler")
 	}
-	e.User = h.auth.Username
-	if h.auth.Admin && e.User == "" {
+	e.User = auth.Username
+	if auth.Admin && e.User == "" {
 		e.User = "admin"
 	}
 	h.Store.AddAudit(e)
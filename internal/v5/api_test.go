@@ -12,6 +12,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -52,7 +53,7 @@ const (
 	testPassword = "test-password"
 )
 
-var es *elasticsearch.Database = &elasticsearch.Database{"localhost:9200"}
+var es *elasticsearch.Database = &elasticsearch.Database{Addr: "localhost:9200"}
 var si *charmstore.SearchIndex = &charmstore.SearchIndex{
 	Database: es,
 	Index:    "cs",
@@ -178,6 +179,21 @@ var metaEndpoints = []metaEndpoint{{
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data.(params.BundleCount).Count, gc.Equals, 2)
 	},
+}, {
+	name:      "bundle-verify",
+	exclusive: bundleOnly,
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		if entity.BundleData == nil {
+			return nil
+		}
+		return v5.BundleVerifyResponse{
+			Problems: []v5.BundleVerifyProblem{},
+		}
+	}),
+	checkURL: newResolvedURL("~charmers/bundle/wordpress-simple-42", 42),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data.(v5.BundleVerifyResponse).Problems, gc.HasLen, 0)
+	},
 }, {
 	name:      "charm-actions",
 	exclusive: charmOnly,
@@ -329,6 +345,18 @@ var metaEndpoints = []metaEndpoint{{
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data, gc.FitsTypeOf, (*params.StatsResponse)(nil))
 	},
+}, {
+	name: "series-stats",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		// The entities used for those tests were never downloaded.
+		return &v5.SeriesStatsResponse{
+			ArchiveDownloadBySeries: map[string]int64{},
+		}, nil
+	},
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, gc.FitsTypeOf, (*v5.SeriesStatsResponse)(nil))
+	},
 }, {
 	name: "extra-info",
 	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
@@ -616,7 +644,7 @@ var metaEndpoints = []metaEndpoint{{
 	name: "resources",
 	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
 		if url.URL.Series == "bundle" {
-			return nil, nil
+			return []params.Resource{}, nil
 		}
 		entity, err := store.FindEntity(url, nil)
 		if err != nil {
@@ -713,6 +741,68 @@ var metaEndpoints = []metaEndpoint{{
 			}},
 		})
 	},
+}, {
+	name:      "relation-summary",
+	exclusive: charmOnly,
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		if entity.CharmMeta == nil {
+			return nil
+		}
+		summary := func(rels map[string]charm.Relation) v5.RelationSummary {
+			var s v5.RelationSummary
+			ifaces := make(map[string]bool)
+			for _, rel := range rels {
+				s.Count++
+				ifaces[rel.Interface] = true
+			}
+			for iface := range ifaces {
+				s.Interfaces = append(s.Interfaces, iface)
+			}
+			sort.Strings(s.Interfaces)
+			return s
+		}
+		return &v5.RelationSummaryResponse{
+			Provides: summary(entity.CharmMeta.Provides),
+			Requires: summary(entity.CharmMeta.Requires),
+			Peers:    summary(entity.CharmMeta.Peers),
+		}
+	}),
+	checkURL: newResolvedURL("cs:~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.RelationSummaryResponse{
+			Provides: v5.RelationSummary{
+				Count:      3,
+				Interfaces: []string{"http", "logging", "monitoring"},
+			},
+			Requires: v5.RelationSummary{
+				Count:      2,
+				Interfaces: []string{"mysql", "varnish"},
+			},
+		})
+	},
+}, {
+	name:      "interfaces",
+	exclusive: charmOnly,
+	get: entityGetter(func(entity *mongodoc.Entity) interface{} {
+		if entity.URL.Series == "bundle" {
+			return nil
+		}
+		provides := append([]string{}, entity.CharmProvidedInterfaces...)
+		requires := append([]string{}, entity.CharmRequiredInterfaces...)
+		sort.Strings(provides)
+		sort.Strings(requires)
+		return &v5.InterfacesResponse{
+			Provides: provides,
+			Requires: requires,
+		}
+	}),
+	checkURL: newResolvedURL("cs:~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data, jc.DeepEquals, &v5.InterfacesResponse{
+			Provides: []string{"http", "logging", "monitoring"},
+			Requires: []string{"mysql", "varnish"},
+		})
+	},
 }}
 
 // TestEndpointGet tries to ensure that the endpoint
@@ -1700,6 +1790,24 @@ func (s *APISuite) TestExtraInfo(c *gc.C) {
 	s.checkInfo(c, "common-info", id)
 }
 
+func (s *APISuite) TestNamespacedExtraInfo(c *gc.C) {
+	id := "precise/wordpress-23"
+	rurl := newResolvedURL("~charmers/"+id, 23)
+	s.addPublicCharmFromRepo(c, "wordpress", rurl)
+	err := s.store.SetExtraInfo(rurl, "ci:build-url", json.RawMessage(`"https://ci.example.com/build/1"`))
+	c.Assert(err, gc.Equals, nil)
+	s.assertPutAsAdmin(c, id+"/meta/extra-info/provenance:commit", "abc123")
+
+	s.assertGet(c, id+"/meta/extra-info/ci:build-url", "https://ci.example.com/build/1")
+	s.assertGet(c, id+"/meta/extra-info", map[string]string{
+		"ci:build-url":      "https://ci.example.com/build/1",
+		"provenance:commit": "abc123",
+	})
+	val, err := s.store.ExtraInfo(rurl, "provenance:commit")
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(string(val), gc.Equals, `"abc123"`)
+}
+
 func (s *APISuite) checkInfo(c *gc.C, path string, id string) {
 	// Add one value and check that it's there.
 	s.assertPutAsAdmin(c, id+"/meta/"+path+"/foo", "fooval")
@@ -1973,6 +2081,48 @@ func (s *APISuite) TestCommonInfo(c *gc.C) {
 	}
 }
 
+func (s *APISuite) TestSetCommonInfo(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-23", 23))
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("~charmers/trusty/wordpress-24", 24))
+
+	// Common info is empty when unset.
+	s.assertGet(c, "~charmers/precise/wordpress-23/meta/common-info", map[string]string{})
+
+	err := s.store.SetCommonInfo(charm.MustParseURL("~charmers/wordpress"), "homepage", json.RawMessage(`"https://wordpress.org"`))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetCommonInfo(charm.MustParseURL("~charmers/wordpress"), "bugs-url", json.RawMessage(`"https://bugs.example.com"`))
+	c.Assert(err, gc.Equals, nil)
+
+	// The values are visible from all revisions without republishing.
+	for _, id := range []string{"~charmers/precise/wordpress-23", "~charmers/trusty/wordpress-24"} {
+		s.assertGet(c, id+"/meta/common-info", map[string]string{
+			"homepage": "https://wordpress.org",
+			"bugs-url": "https://bugs.example.com",
+		})
+		s.assertGet(c, id+"/meta/common-info/homepage", "https://wordpress.org")
+	}
+
+	// Updating a value updates it for all revisions.
+	err = s.store.SetCommonInfo(charm.MustParseURL("~charmers/trusty/wordpress-24"), "homepage", json.RawMessage(`"https://wordpress.com"`))
+	c.Assert(err, gc.Equals, nil)
+	s.assertGet(c, "~charmers/precise/wordpress-23/meta/common-info/homepage", "https://wordpress.com")
+
+	// Setting a null value removes the key.
+	err = s.store.SetCommonInfo(charm.MustParseURL("~charmers/wordpress"), "bugs-url", json.RawMessage(`null`))
+	c.Assert(err, gc.Equals, nil)
+	info, err := s.store.CommonInfo(charm.MustParseURL("~charmers/wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(info, gc.HasLen, 1)
+	c.Assert(string(info["homepage"]), gc.Equals, `"https://wordpress.com"`)
+
+	err = s.store.SetCommonInfo(charm.MustParseURL("~charmers/wordpress"), "bad.key", json.RawMessage(`"x"`))
+	c.Assert(err, gc.ErrorMatches, `bad key for common-info`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	err = s.store.SetCommonInfo(charm.MustParseURL("~charmers/missing"), "homepage", json.RawMessage(`"x"`))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
 func isNull(v interface{}) bool {
 	data, err := json.Marshal(v)
 	if err != nil {
@@ -2211,6 +2361,94 @@ func (s *APISuite) TestPromulgatedBundleTags(c *gc.C) {
 	})
 }
 
+func (s *APISuite) TestMetaBundleVerify(c *gc.C) {
+	for _, id := range []string{
+		"~charmers/trusty/wordpress-0",
+		"~charmers/trusty/mysql-0",
+		"~charmers/trusty/private-0",
+	} {
+		s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL(id, -1))
+	}
+	url := newResolvedURL("~charmers/bundle/verify-0", -1)
+	s.addPublicBundle(c, storetesting.NewBundle(&charm.BundleData{
+		Applications: map[string]*charm.ApplicationSpec{
+			"wordpress": {
+				Charm: "cs:~charmers/trusty/wordpress-0",
+			},
+			"mysql": {
+				Charm: "cs:~charmers/trusty/mysql-0",
+			},
+			"private": {
+				Charm: "cs:~charmers/trusty/private-0",
+			},
+		},
+	}), url, false)
+
+	// All the charms resolve.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(url.URL.Path() + "/meta/bundle-verify"),
+		ExpectStatus: http.StatusOK,
+		ExpectBody: v5.BundleVerifyResponse{
+			Problems: []v5.BundleVerifyProblem{},
+		},
+	})
+
+	// Remove one of the charms and make another one private.
+	err := s.store.DB.Entities().RemoveId("cs:~charmers/trusty/mysql-0")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(charm.MustParseURL("~charmers/private"), "stable.read", "charmers")
+	c.Assert(err, gc.Equals, nil)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Do:           bakeryDo(nil),
+		URL:          storeURL(url.URL.Path() + "/meta/bundle-verify"),
+		ExpectStatus: http.StatusOK,
+		ExpectBody: v5.BundleVerifyResponse{
+			Problems: []v5.BundleVerifyProblem{{
+				Application: "mysql",
+				Charm:       "cs:~charmers/trusty/mysql-0",
+				Code:        params.ErrNotFound,
+				Message:     "charm not found",
+			}, {
+				Application: "private",
+				Charm:       "cs:~charmers/trusty/private-0",
+				Code:        params.ErrUnauthorized,
+				Message:     "charm is not readable",
+			}},
+		},
+	})
+
+	// A user that can read the private charm only sees
+	// the missing one.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		Do:           bakeryDo(s.login("charmers")),
+		URL:          storeURL(url.URL.Path() + "/meta/bundle-verify"),
+		ExpectStatus: http.StatusOK,
+		ExpectBody: v5.BundleVerifyResponse{
+			Problems: []v5.BundleVerifyProblem{{
+				Application: "mysql",
+				Charm:       "cs:~charmers/trusty/mysql-0",
+				Code:        params.ErrNotFound,
+				Message:     "charm not found",
+			}},
+		},
+	})
+
+	// Charms have no bundle-verify metadata.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/trusty/wordpress-0/meta/bundle-verify"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Message: params.ErrMetadataNotFound.Error(),
+			Code:    params.ErrMetadataNotFound,
+		},
+	})
+}
+
 type testMetaCharm struct {
 	meta *charm.Meta
 	charm.Charm
@@ -2454,6 +2692,140 @@ func (s *APISuite) TestServeExpandId(c *gc.C) {
 	}
 }
 
+var serveExpandIdWithChannelTests = []struct {
+	about  string
+	url    string
+	expect []params.ExpandedId
+}{{
+	about: "no channel",
+	url:   "wordpress/expand-id",
+	expect: []params.ExpandedId{
+		{Id: "cs:trusty/wordpress-49"},
+		{Id: "cs:trusty/wordpress-48"},
+		{Id: "cs:trusty/wordpress-47"},
+	},
+}, {
+	about: "stable channel",
+	url:   "wordpress/expand-id?channel=stable",
+	expect: []params.ExpandedId{
+		{Id: "cs:trusty/wordpress-47"},
+	},
+}, {
+	about: "edge channel",
+	url:   "~charmers/trusty/wordpress-47/expand-id?channel=edge",
+	expect: []params.ExpandedId{
+		{Id: "cs:~charmers/trusty/wordpress-48"},
+		{Id: "cs:~charmers/trusty/wordpress-47"},
+	},
+}, {
+	about: "unpublished channel",
+	url:   "~charmers/wordpress/expand-id?channel=unpublished",
+	expect: []params.ExpandedId{
+		{Id: "cs:~charmers/trusty/wordpress-49"},
+		{Id: "cs:~charmers/trusty/wordpress-48"},
+		{Id: "cs:~charmers/trusty/wordpress-47"},
+	},
+}}
+
+func (s *APISuite) TestServeExpandIdWithChannel(c *gc.C) {
+	// Revision 47 is published on the stable and edge channels,
+	// revision 48 only on the edge channel and revision 49 not
+	// at all.
+	id47 := newResolvedURL("cs:~charmers/trusty/wordpress-47", 47)
+	s.addPublicCharmFromRepo(c, "wordpress", id47)
+	err := s.store.Publish(id47, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	id48 := newResolvedURL("cs:~charmers/trusty/wordpress-48", 48)
+	err = s.store.AddCharmWithArchive(id48, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id48, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	id49 := newResolvedURL("cs:~charmers/trusty/wordpress-49", 49)
+	err = s.store.AddCharmWithArchive(id49, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	for i, test := range serveExpandIdWithChannelTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:    s.srv,
+			URL:        storeURL(test.url),
+			Username:   testUsername,
+			Password:   testPassword,
+			ExpectBody: test.expect,
+		})
+	}
+}
+
+func (s *APISuite) TestServeExists(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/trusty/wordpress-3", 3))
+	s.addPublicCharmFromRepo(c, "mysql", newResolvedURL("cs:~bob/precise/mysql-1", -1))
+	// Add a charm that is not readable by everyone.
+	err := s.store.AddCharmWithArchive(newResolvedURL("cs:~bob/trusty/private-1", -1), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(newResolvedURL("cs:~bob/trusty/private-1", -1), nil, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("exists?id=wordpress&id=trusty/wordpress-3&id=~bob/mysql&id=~bob/trusty/mysql&id=trusty/mediawiki&id=~bob/trusty/private-1"),
+		ExpectBody: map[string]bool{
+			"wordpress":             true,
+			"trusty/wordpress-3":    true,
+			"~bob/mysql":            true,
+			"~bob/trusty/mysql":     false,
+			"trusty/mediawiki":      false,
+			"~bob/trusty/private-1": false,
+		},
+	})
+}
+
+func (s *APISuite) TestServeExistsNoIds(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("exists"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "no ids specified in exists request",
+		},
+	})
+}
+
+func (s *APISuite) TestServeLatestRevision(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/trusty/wordpress-3", 1))
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-8", 2))
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~charmers/trusty/wordpress-5", 3))
+	s.addPublicCharmFromRepo(c, "wordpress", newResolvedURL("cs:~bob/trusty/wordpress-2", -1))
+
+	for _, url := range []string{"wordpress", "trusty/wordpress-1", "~charmers/wordpress"} {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			URL:     storeURL(url + "/latest-revision"),
+			ExpectBody: v5.LatestRevisionResponse{
+				Revision:            8,
+				PromulgatedRevision: 3,
+			},
+		})
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~bob/wordpress/latest-revision"),
+		ExpectBody: v5.LatestRevisionResponse{
+			Revision:            2,
+			PromulgatedRevision: -1,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~alice/wordpress/latest-revision"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `no matching charm or bundle for cs:~alice/wordpress`,
+		},
+	})
+}
+
 var serveMetaRevisionInfoTests = []struct {
 	about  string
 	url    string
@@ -2983,6 +3355,31 @@ func (s *APISuite) TestMetaStatsWhenChangedtoMultiSeries(c *gc.C) {
 
 }
 
+func (s *APISuite) TestMetaSeriesStats(c *gc.C) {
+	if !storetesting.MongoJSEnabled() {
+		c.Skip("MongoDB JavaScript not available")
+	}
+	id := newResolvedURL("~charmers/trusty/wordpress-1", -1)
+	s.addPublicCharmFromRepo(c, "wordpress", id)
+
+	// Simulate a download recorded before per-series counts were kept.
+	key := []string{params.StatsArchiveDownload, "trusty", "wordpress", "charmers", "1"}
+	err := s.store.IncCounter(key)
+	c.Assert(err, gc.Equals, nil)
+	for i := 0; i < 2; i++ {
+		err := s.store.IncrementDownloadCounts(id)
+		c.Assert(err, gc.Equals, nil)
+	}
+
+	// The total includes the earlier download, as it does in meta/stats.
+	s.assertGet(c, "~charmers/trusty/wordpress-1/meta/series-stats?refresh=1", &v5.SeriesStatsResponse{
+		ArchiveDownloadCount: 3,
+		ArchiveDownloadBySeries: map[string]int64{
+			"trusty": 2,
+		},
+	})
+}
+
 type publishSpec struct {
 	id   *router.ResolvedURL
 	time string
@@ -3668,6 +4065,17 @@ func (s *APISuite) TestHash256Laziness(c *gc.C) {
 	entity, err := s.store.FindEntity(id, charmstore.FieldSelector("blobhash256"))
 	c.Assert(err, gc.Equals, nil)
 	c.Assert(entity.BlobHash256, gc.Not(gc.Equals), "")
+
+	// When the hash is missing, it is calculated when requested.
+	err = s.store.DB.Entities().UpdateId(&id.URL, bson.D{{
+		"$unset", bson.D{{"blobhash256", ""}},
+	}})
+	c.Assert(err, gc.Equals, nil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("~who/precise/wordpress-0/meta/hash256"),
+		ExpectBody: params.HashResponse{Sum: entity.BlobHash256},
+	})
 }
 
 var urlChannelResolvingEntities = []struct {
@@ -4438,3 +4846,13 @@ func entityACLs(store *charmstore.Store, url *router.ResolvedURL) (mongodoc.ACL,
 	}
 	return be.ChannelACLs[ch], nil
 }
+
+func (s *APISuite) TestNewRateLimitersIgnoresNonPositiveLimits(c *gc.C) {
+	limiters := v5.NewRateLimiters(map[string]int{
+		"search":  10,
+		"meta":    0,
+		"archive": -1,
+	})
+	c.Assert(limiters, gc.HasLen, 1)
+	c.Assert(limiters["search"], gc.NotNil)
+}
@@ -5,6 +5,8 @@ package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
 
 import (
 	stdzip "archive/zip"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -28,7 +30,7 @@ import (
 // GET id/archive
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idarchive
 //
-// POST id/archive?hash=sha384hash
+// POST id/archive?hash=sha384hash[&existing-blob=1]
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#post-idarchive
 //
 // DELETE id/archive
@@ -44,8 +46,8 @@ func (h *ReqHandler) serveArchive(id *charm.URL, w http.ResponseWriter, req *htt
 	switch req.Method {
 	case "DELETE":
 		return resolveId(h.serveDeleteArchive)(id, w, req)
-	case "GET":
-		return resolveId(h.serveGetArchive)(id, w, req)
+	case "GET", "HEAD":
+		return h.SeriesResolvedIdHandler(h.serveGetArchive)(id, w, req)
 	case "POST", "PUT":
 		// Make sure we consume the full request body, before responding.
 		//
@@ -124,10 +126,14 @@ func (h *ReqHandler) SendEntityArchive(id *router.ResolvedURL, w http.ResponseWr
 	header := w.Header()
 	setArchiveCacheControl(w.Header(), h.isPublic(id))
 	header.Set(params.ContentHashHeader, blob.Hash)
+	if digest := digestHeader(blob.Hash256); digest != "" {
+		header.Set("Digest", digest)
+	}
 	header.Set(params.EntityIdHeader, id.PreferredURL().String())
 	header.Set("Content-Disposition", "attachment; filename="+id.PreferredURL().Name+".zip")
 
-	if StatsEnabled(req) {
+	if StatsEnabled(req) && req.Method != "HEAD" {
+		// Only count actual downloads.
 		h.Store.IncrementDownloadCountsAsync(id)
 	}
 	// TODO(rog) should we set connection=close here?
@@ -135,11 +141,22 @@ func (h *ReqHandler) SendEntityArchive(id *router.ResolvedURL, w http.ResponseWr
 	serveContent(w, req, blob.Size, blob)
 }
 
+// digestHeader returns the value of the Digest header (see RFC 3230)
+// for content with the given hex-encoded SHA256 hash, or the empty
+// string if the hash is not valid.
+func digestHeader(hash256 string) string {
+	sum, err := hex.DecodeString(hash256)
+	if err != nil || len(sum) != 32 {
+		return ""
+	}
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum)
+}
+
 func (h *ReqHandler) serveDeleteArchive(id *router.ResolvedURL, w http.ResponseWriter, req *http.Request) error {
 	if err := h.AuthorizeEntityForOp(id, req, OpWrite); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
-	if err := h.Store.DeleteEntity(id); err != nil {
+	if err := h.Store.DeleteEntity(id, false); err != nil {
 		return errgo.NoteMask(err, fmt.Sprintf("cannot delete %q", id.PreferredURL()), errgo.Is(params.ErrNotFound), errgo.Is(params.ErrForbidden))
 	}
 	h.Store.IncCounterAsync(charmstore.EntityStatsKey(&id.URL, params.StatsArchiveDelete))
@@ -170,7 +187,11 @@ func (h *ReqHandler) servePostArchive(id *charm.URL, w http.ResponseWriter, req
 	if hash == "" {
 		return badRequestf(nil, "hash parameter not specified")
 	}
-	if req.ContentLength == -1 {
+	existingBlob, err := router.ParseBool(req.Form.Get("existing-blob"))
+	if err != nil {
+		return badRequestf(err, "invalid existing-blob parameter")
+	}
+	if req.ContentLength == -1 && !existingBlob {
 		return badRequestf(nil, "Content-Length not specified")
 	}
 	oldURL, oldHash, err := h.latestRevisionInfo(id)
@@ -195,7 +216,20 @@ func (h *ReqHandler) servePostArchive(id *charm.URL, w http.ResponseWriter, req
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	if err := h.Store.UploadEntity(rid, req.Body, hash, req.ContentLength, nil); err != nil {
+	if existingBlob {
+		// The client claims that the archive content is already
+		// held by the store, so no body is needed.
+		if err := h.authorizeExistingBlob(hash, req); err != nil {
+			return errgo.Mask(err, errgo.Is(router.ErrPreconditionFailed))
+		}
+		err = h.Store.UploadEntityFromBlob(rid, hash, nil)
+		if errgo.Cause(err) == params.ErrNotFound {
+			return errgo.WithCausef(nil, router.ErrPreconditionFailed, "blob with hash %s not found; archive content must be uploaded", hash)
+		}
+	} else {
+		err = h.Store.UploadEntity(rid, req.Body, hash, req.ContentLength, nil)
+	}
+	if err != nil {
 		return errgo.Mask(err,
 			errgo.Is(params.ErrDuplicateUpload),
 			errgo.Is(params.ErrEntityIdNotAllowed),
@@ -296,6 +330,24 @@ func (h *ReqHandler) servePutArchive(id *charm.URL, w http.ResponseWriter, req *
 	return nil
 }
 
+// authorizeExistingBlob checks that the client may read the archive
+// blob with the given hash through at least one existing entity, so
+// that knowing the hash of another user's private archive is not
+// enough to obtain its content. The returned error does not reveal
+// whether the blob exists.
+func (h *ReqHandler) authorizeExistingBlob(hash string, req *http.Request) error {
+	entities, err := h.Store.FindEntitiesWithBlobHash(hash, charmstore.FieldSelector("_id", "promulgated-url"))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	for _, e := range entities {
+		if err := h.AuthorizeEntityForOp(charmstore.EntityResolvedURL(e), req, OpReadWithTerms); err == nil {
+			return nil
+		}
+	}
+	return errgo.WithCausef(nil, router.ErrPreconditionFailed, "blob with hash %s not found; archive content must be uploaded", hash)
+}
+
 func (h *ReqHandler) latestRevisionInfo(id *charm.URL) (*router.ResolvedURL, string, error) {
 	entities, err := h.Store.FindEntities(id, charmstore.FieldSelector("_id", "blobhash", "promulgated-url"))
 	if err != nil {
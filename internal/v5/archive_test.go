@@ -89,6 +89,8 @@ func (s *ArchiveSuite) TestGet(c *gc.C) {
 	)
 	c.Assert(rec.Header().Get(params.EntityIdHeader), gc.Equals, "cs:~charmers/precise/wordpress-0")
 	c.Assert(rec.Header().Get("Content-Disposition"), gc.Equals, "attachment; filename=wordpress.zip")
+	hash256 := sha256.Sum256(ch.Bytes())
+	c.Assert(rec.Header().Get("Digest"), gc.Equals, "SHA-256="+base64.StdEncoding.EncodeToString(hash256[:]))
 	assertCacheControl(c, rec.Header(), true)
 
 	// Check that the HTTP range logic is plugged in OK. If this
@@ -107,6 +109,91 @@ func (s *ArchiveSuite) TestGet(c *gc.C) {
 	assertCacheControl(c, rec.Header(), true)
 }
 
+func (s *ArchiveSuite) TestHead(c *gc.C) {
+	id := newResolvedURL("cs:~charmers/utopic/mysql-42", 42)
+	ch := storetesting.NewCharm(nil)
+	s.addPublicCharm(c, ch, id)
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Method:  "HEAD",
+		URL:     storeURL("~charmers/utopic/mysql-42/archive"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %q", rec.Body.Bytes()))
+	c.Assert(rec.Body.Len(), gc.Equals, 0)
+	c.Assert(rec.Header().Get("Content-Length"), gc.Equals, fmt.Sprint(len(ch.Bytes())))
+	c.Assert(rec.Header().Get(params.ContentHashHeader), gc.Equals, hashOfBytes(ch.Bytes()))
+	c.Assert(rec.Header().Get(params.EntityIdHeader), gc.Equals, "cs:~charmers/utopic/mysql-42")
+	assertCacheControl(c, rec.Header(), true)
+
+	// A HEAD request does not count as a download.
+	key := []string{params.StatsArchiveDownload, "utopic", "mysql", "charmers", "42"}
+	stats.CheckCounterSum(c, s.store, key, false, 0)
+}
+
+var getArchiveRangeTests = []struct {
+	about              string
+	rangeHeader        string
+	expectStatus       int
+	expectContentRange func(size int) string
+	expectBody         func(data []byte) []byte
+}{{
+	about:        "single range",
+	rangeHeader:  "bytes=10-100",
+	expectStatus: http.StatusPartialContent,
+	expectContentRange: func(size int) string {
+		return fmt.Sprintf("bytes 10-100/%d", size)
+	},
+	expectBody: func(data []byte) []byte {
+		return data[10:101]
+	},
+}, {
+	about:        "open-ended range",
+	rangeHeader:  "bytes=20-",
+	expectStatus: http.StatusPartialContent,
+	expectContentRange: func(size int) string {
+		return fmt.Sprintf("bytes 20-%d/%d", size-1, size)
+	},
+	expectBody: func(data []byte) []byte {
+		return data[20:]
+	},
+}, {
+	about:        "unsatisfiable range",
+	rangeHeader:  "bytes=100000000-",
+	expectStatus: http.StatusRequestedRangeNotSatisfiable,
+	expectContentRange: func(size int) string {
+		return fmt.Sprintf("bytes */%d", size)
+	},
+}, {
+	about:        "multiple ranges",
+	rangeHeader:  "bytes=0-10,20-30",
+	expectStatus: http.StatusRequestedRangeNotSatisfiable,
+	expectContentRange: func(size int) string {
+		return fmt.Sprintf("bytes */%d", size)
+	},
+}}
+
+func (s *ArchiveSuite) TestGetArchiveRange(c *gc.C) {
+	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	ch := storetesting.NewCharm(nil)
+	s.addPublicCharm(c, ch, id)
+	data := ch.Bytes()
+
+	for i, test := range getArchiveRangeTests {
+		c.Logf("test %d: %s", i, test.about)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL("~charmers/precise/wordpress-0/archive"),
+			Header:  http.Header{"Range": {test.rangeHeader}},
+		})
+		c.Assert(rec.Code, gc.Equals, test.expectStatus, gc.Commentf("body: %q", rec.Body.Bytes()))
+		c.Assert(rec.Header().Get("Content-Range"), gc.Equals, test.expectContentRange(len(data)))
+		if test.expectBody != nil {
+			c.Assert(rec.Body.Bytes(), gc.DeepEquals, test.expectBody(data))
+		}
+	}
+}
+
 func (s *ArchiveSuite) TestGetWithPartialId(c *gc.C) {
 	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
 	ch := storetesting.NewCharm(nil)
@@ -136,6 +223,24 @@ func (s *ArchiveSuite) TestGetPromulgatedWithPartialId(c *gc.C) {
 	c.Assert(rec.Header().Get(params.EntityIdHeader), gc.Equals, id.PromulgatedURL().String())
 }
 
+func (s *ArchiveSuite) TestGetMultiSeriesWithSeries(c *gc.C) {
+	s.addPublicCharmFromRepo(c, "multi-series", newResolvedURL("cs:~charmers/multi-series-0", -1))
+
+	var bodies [][]byte
+	for _, series := range []string{"trusty", "utopic"} {
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL("~charmers/" + series + "/multi-series-0/archive"),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %q", rec.Body.Bytes()))
+		c.Assert(rec.Header().Get(params.EntityIdHeader), gc.Equals, "cs:~charmers/"+series+"/multi-series-0")
+		c.Assert(rec.Header().Get(params.ContentHashHeader), gc.Equals, hashOfBytes(rec.Body.Bytes()))
+		bodies = append(bodies, rec.Body.Bytes())
+	}
+	// Both series refer to the same underlying archive.
+	c.Assert(bodies[0], gc.DeepEquals, bodies[1])
+}
+
 func (s *ArchiveSuite) TestGetCounters(c *gc.C) {
 	if !storetesting.MongoJSEnabled() {
 		c.Skip("MongoDB JavaScript not available")
@@ -659,6 +764,89 @@ func (s *ArchiveSuite) TestPostHashMismatch(c *gc.C) {
 	})
 }
 
+func (s *ArchiveSuite) TestPostExistingBlob(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.assertUploadCharm(c, "POST", id, "wordpress", nil)
+	entity, err := s.store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	// Uploading with only the hash of content that is already in the
+	// blob store creates a new entity without any body.
+	path := fmt.Sprintf("~bob/precise/wordpress/archive?hash=%s&existing-blob=1", entity.BlobHash)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL(path),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.ArchiveUploadResponse{
+			Id: charm.MustParseURL("~bob/precise/wordpress-0"),
+		},
+	})
+	newEntity, err := s.store.FindEntity(newResolvedURL("~bob/precise/wordpress-0", -1), nil)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(newEntity.BlobHash, gc.Equals, entity.BlobHash)
+	c.Assert(newEntity.BlobHash256, gc.Equals, entity.BlobHash256)
+	c.Assert(newEntity.Size, gc.Equals, entity.Size)
+}
+
+func (s *ArchiveSuite) TestPostExistingBlobNotFound(c *gc.C) {
+	hash := hashOfString("unknown content")
+	path := fmt.Sprintf("~charmers/precise/wordpress/archive?hash=%s&existing-blob=1", hash)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(path),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusPreconditionFailed,
+		ExpectBody: params.Error{
+			Code:    router.ErrPreconditionFailed,
+			Message: fmt.Sprintf("blob with hash %s not found; archive content must be uploaded", hash),
+		},
+	})
+	_, err := s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+func (s *ArchiveSuite) TestPostExistingBlobOfPrivateEntity(c *gc.C) {
+	// Add an entity that only its owner can read.
+	id := newResolvedURL("~alice/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.Equals, nil)
+	entity, err := s.store.FindEntity(id, nil)
+	c.Assert(err, gc.Equals, nil)
+
+	// Another user cannot create an entity from its blob even
+	// though they know its hash.
+	path := fmt.Sprintf("~bob/precise/wordpress/archive?hash=%s&existing-blob=1", entity.BlobHash)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(path),
+		Method:       "POST",
+		Do:           s.bakeryDoAsUser("bob"),
+		ExpectStatus: http.StatusPreconditionFailed,
+		ExpectBody: params.Error{
+			Code:    router.ErrPreconditionFailed,
+			Message: fmt.Sprintf("blob with hash %s not found; archive content must be uploaded", entity.BlobHash),
+		},
+	})
+	_, err = s.store.FindEntity(newResolvedURL("~bob/precise/wordpress-0", -1), nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// Once the entity is readable by everyone, the blob can be used.
+	s.setPublic(c, id)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL(path),
+		Method:  "POST",
+		Do:      s.bakeryDoAsUser("bob"),
+		ExpectBody: params.ArchiveUploadResponse{
+			Id: charm.MustParseURL("~bob/precise/wordpress-0"),
+		},
+	})
+}
+
+
 func (s *ArchiveSuite) TestPostEntityClearsCanIngest(c *gc.C) {
 	id := newResolvedURL("~charmers/precise/juju-gui-0", -1)
 	s.assertUploadCharm(c, "PUT", id, "wordpress", nil)
@@ -88,6 +88,28 @@ func (h *ReqHandler) AuthorizeEntity(id *router.ResolvedURL, req *http.Request)
 	return h.AuthorizeEntityForOp(id, req, op)
 }
 
+// RateLimitClient returns the client identity used to rate limit the
+// given request. Requests holding valid macaroons are identified by
+// the authenticated user; other requests are identified by the client
+// IP address. Requests with admin credentials are exempt.
+//
+// This method implements router.Router.RateLimitClient.
+func (h *ReqHandler) RateLimitClient(req *http.Request) (client string, exempt bool) {
+	auth, err := h.checkRequest(authorizeParams{
+		req: req,
+		ops: []string{OpReadWithNoTerms},
+	})
+	if err == nil {
+		if auth.Admin {
+			return "", true
+		}
+		if auth.Username != "" {
+			return "user:" + auth.Username, false
+		}
+	}
+	return "ip:" + router.ClientIP(req), false
+}
+
 // Authenticate is a convenience method that calls authorize to check
 // that that the given request is authenticated for some user.
 func (h *ReqHandler) Authenticate(req *http.Request) (Authorization, error) {
@@ -116,6 +138,14 @@ func (h *ReqHandler) AuthorizeEntityForOp(id *router.ResolvedURL, req *http.Requ
 	return nil
 }
 
+// authorization returns the results of the last successful
+// authorization done on the request.
+func (h *ReqHandler) authorization() Authorization {
+	h.authMu.Lock()
+	defer h.authMu.Unlock()
+	return h.auth
+}
+
 // authenticateAdmin checks that the given request has admin credentials.
 func (h *ReqHandler) authenticateAdmin(req *http.Request) error {
 	if _, err := h.authorize(authorizeParams{
@@ -229,7 +259,9 @@ func (h *ReqHandler) authorize(p authorizeParams) (Authorization, error) {
 		if err := set.check(auth, p.ops); err != nil {
 			return Authorization{}, errgo.WithCausef(err, params.ErrUnauthorized, "")
 		}
+		h.authMu.Lock()
 		h.auth = auth
+		h.authMu.Unlock()
 		return auth, nil
 	}
 	if _, ok := errgo.Cause(verr).(*bakery.VerificationError); !ok {
@@ -446,6 +478,30 @@ func (h *ReqHandler) entityACLs(id *router.ResolvedURL) (mongodoc.ACL, error) {
 	return baseEntity.ChannelACLs[ch], nil
 }
 
+// canRead reports whether the client making the given request can read
+// the entity with the given id. Unlike AuthorizeEntity, it never asks
+// the client to authenticate: a request without valid credentials can
+// only read public entities.
+func (h *ReqHandler) canRead(id *router.ResolvedURL, req *http.Request) (bool, error) {
+	acl, err := h.entityACLs(id)
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	if isPublicACL(acl.Read) {
+		return true, nil
+	}
+	auth, err := h.checkRequest(authorizeParams{
+		req: req,
+		ops: []string{OpReadWithNoTerms},
+	})
+	if err != nil {
+		return false, nil
+	}
+	set := newACLSet(1)
+	set.add(acl)
+	return set.check(auth, []string{OpReadWithNoTerms}) == nil, nil
+}
+
 // entitiesRequiredTerms returns the set of terms that the user must have
 // agreed to in order to access the entities with the given ids.
 func (h *ReqHandler) entitiesRequiredTerms(ids []*router.ResolvedURL) ([]string, error) {
@@ -178,6 +178,7 @@ func (s *commonSuite) startServer(c *gc.C) {
 		AuthUsername:          testUsername,
 		AuthPassword:          testPassword,
 		StatsCacheMaxAge:      time.Nanosecond,
+		GroupsCacheMaxAge:     time.Nanosecond,
 		MaxMgoSessions:        s.maxMgoSessions,
 		MinUploadPartSize:     10,
 		NewBlobBackend:        s.newBlobBackend(c),
@@ -12,4 +12,5 @@ var (
 	ResolveURL                = resolveURL
 	RenewMacaroon             = renewMacaroon
 	TimeNow                   = &timeNow
+	NewRateLimiters           = newRateLimiters
 )
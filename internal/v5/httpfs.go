@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -16,7 +17,15 @@ import (
 // provides us with all the HTTP Content-Range goodness
 // that we'd like.
 // TODO use http.ServeContent instead of this.
+//
+// Requests for multiple byte ranges are not supported and are
+// rejected with a 416 (Requested Range Not Satisfiable) status.
 func serveContent(w http.ResponseWriter, req *http.Request, length int64, content io.ReadSeeker) {
+	if r := req.Header.Get("Range"); strings.HasPrefix(r, "bytes=") && strings.Contains(r, ",") {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", length))
+		http.Error(w, "multiple ranges not supported", http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
 	fs := &archiveFS{
 		length:     length,
 		ReadSeeker: content,
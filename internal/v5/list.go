@@ -44,7 +44,7 @@ func (h *ReqHandler) serveList(_ http.Header, req *http.Request) (interface{}, e
 	}
 	r, err := h.getMetadataForEntities(results, sp.Include, req, nil)
 	if err != nil {
-		return nil, errgo.Notef(err, "cannot get metadata")
+		return nil, errgo.NoteMask(err, "cannot get metadata", errgo.Any)
 	}
 	sort.Sort(&entityResultsByOrder{
 		less:    less,
@@ -18,12 +18,16 @@ import (
 	"gopkg.in/juju/charmstore.v5/internal/router"
 )
 
-// GET id/meta/charm-related[?include=meta[&include=meta…]]
+// GET id/meta/charm-related[?include=meta[&include=meta…]][&include-self=1]
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetacharm-related
 func (h *ReqHandler) metaCharmRelated(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
 	if id.URL.Series == "bundle" {
 		return nil, nil
 	}
+	includeSelf, err := router.ParseBool(flags.Get("include-self"))
+	if err != nil {
+		return nil, badRequestf(err, "invalid value for include-self")
+	}
 	// If the charm does not define any relation we can just return without
 	// hitting the db.
 	if len(entity.CharmProvidedInterfaces)+len(entity.CharmRequiredInterfaces) == 0 {
@@ -35,6 +39,7 @@ func (h *ReqHandler) metaCharmRelated(entity *mongodoc.Entity, id *router.Resolv
 		"charmprovidedinterfaces",
 		"promulgated-url",
 		"promulgated-revision",
+		"baseurl",
 	)
 	query := h.Store.MatchingInterfacesQuery(entity.CharmProvidedInterfaces, entity.CharmRequiredInterfaces)
 	iter := h.Cache.Iter(query.Sort("_id"), fields)
@@ -46,6 +51,14 @@ func (h *ReqHandler) metaCharmRelated(entity *mongodoc.Entity, id *router.Resolv
 		return nil, errgo.Notef(err, "cannot retrieve the related charms")
 	}
 
+	// Other revisions of the charm itself are not usually
+	// interesting, so exclude them unless asked for.
+	if !includeSelf {
+		filterEntities(&entities, func(e *mongodoc.Entity) bool {
+			return *e.BaseURL != *entity.BaseURL
+		})
+	}
+
 	// If no entities are found there is no need for further processing the
 	// results.
 	if len(entities) == 0 {
@@ -138,7 +151,7 @@ func (h *ReqHandler) getRelatedIfaceResponses(
 	}
 	resp, err := h.getMetadataForEntities(entities, includes, req, usesInterface)
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Any)
 	}
 	return resp, nil
 }
@@ -252,7 +265,7 @@ func (h *ReqHandler) metaBundlesContaining(entity *mongodoc.Entity, id *router.R
 	}
 	resp, err := h.getMetadataForEntities(entities, flags["include"], req, nil)
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Any)
 	}
 	return resp, nil
 }
@@ -268,6 +281,9 @@ func (h *ReqHandler) getMetadataForEntities(entities []*mongodoc.Entity, include
 		if includeEntity != nil && !includeEntity(e) {
 			continue
 		}
+		if err := req.Context().Err(); err != nil {
+			return nil, errgo.NoteMask(err, "cannot get metadata", errgo.Any)
+		}
 		meta, err := h.getMetadataForEntity(e, includes, req)
 		if err == errMetadataUnauthorized {
 			continue
@@ -295,7 +311,7 @@ func (h *ReqHandler) getMetadataForEntity(e *mongodoc.Entity, includes []string,
 	if err := h.AuthorizeEntity(rurl, req); err != nil {
 		return nil, errMetadataUnauthorized
 	}
-	return h.Router.GetMetadata(rurl, includes, req)
+	return h.Router.GetMetadata(req.Context(), rurl, includes, req)
 }
 
 // filterEntities deletes all entities from *entities for which
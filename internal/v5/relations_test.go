@@ -256,6 +256,64 @@ var metaCharmRelatedTests = []struct {
 			}},
 		},
 	},
+}, {
+	about: "other revisions of the same charm are excluded",
+	charms: map[string]charm.Charm{
+		"0 ~charmers/trusty/peer-0": storetesting.NewCharm(storetesting.RelationMeta(
+			"provides server db",
+			"requires client db",
+		)),
+		"1 ~charmers/trusty/peer-1": storetesting.NewCharm(storetesting.RelationMeta(
+			"provides server db",
+			"requires client db",
+		)),
+		"2 ~charmers/utopic/other-2": storetesting.NewCharm(storetesting.RelationMeta(
+			"provides server db",
+		)),
+	},
+	id: "trusty/peer-0",
+	expectBody: params.RelatedResponse{
+		Provides: map[string][]params.EntityResult{
+			"db": {{
+				Id: charm.MustParseURL("utopic/other-2"),
+			}},
+		},
+	},
+}, {
+	about: "other revisions of the same charm included with include-self",
+	charms: map[string]charm.Charm{
+		"0 ~charmers/trusty/peer-0": storetesting.NewCharm(storetesting.RelationMeta(
+			"provides server db",
+			"requires client db",
+		)),
+		"1 ~charmers/trusty/peer-1": storetesting.NewCharm(storetesting.RelationMeta(
+			"provides server db",
+			"requires client db",
+		)),
+		"2 ~charmers/utopic/other-2": storetesting.NewCharm(storetesting.RelationMeta(
+			"provides server db",
+		)),
+	},
+	id:          "trusty/peer-0",
+	querystring: "?include-self=1",
+	expectBody: params.RelatedResponse{
+		Provides: map[string][]params.EntityResult{
+			"db": {{
+				Id: charm.MustParseURL("trusty/peer-0"),
+			}, {
+				Id: charm.MustParseURL("trusty/peer-1"),
+			}, {
+				Id: charm.MustParseURL("utopic/other-2"),
+			}},
+		},
+		Requires: map[string][]params.EntityResult{
+			"db": {{
+				Id: charm.MustParseURL("trusty/peer-0"),
+			}, {
+				Id: charm.MustParseURL("trusty/peer-1"),
+			}},
+		},
+	},
 }, {
 	about:  "don't show charms if you don't have perms for 'em",
 	charms: metaCharmRelatedCharms,
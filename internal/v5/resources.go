@@ -264,7 +264,8 @@ func (h *ReqHandler) serveUploadDockerResource(id *router.ResolvedURL, rid mongo
 // https://github.com/juju/charmstore/blob/v5/docs/API.md#get-idmetaresources
 func (h *ReqHandler) metaResources(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
 	if entity.URL.Series == "bundle" {
-		return nil, nil
+		// Bundles have no resources.
+		return []params.Resource{}, nil
 	}
 	ch, err := h.entityChannel(id)
 	if err != nil {
@@ -10,6 +10,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 
 	jc "github.com/juju/testing/checkers"
@@ -235,6 +236,7 @@ func (s *ResourceSuite) TestGet(c *gc.C) {
 	})
 	c.Assert(resp.Body.String(), gc.Equals, content+"1")
 	c.Assert(resp.Header().Get(params.ContentHashHeader), gc.Equals, hashOfString(content+"1"))
+	c.Assert(resp.Header().Get("Content-Length"), gc.Equals, strconv.Itoa(len(content+"1")))
 	c.Assert(resp.Code, gc.Equals, http.StatusOK)
 	assertCacheControl(c, resp.Header(), false)
 
@@ -254,6 +256,7 @@ func (s *ResourceSuite) TestGet(c *gc.C) {
 	})
 	c.Assert(resp.Body.String(), gc.Equals, content+"2")
 	c.Assert(resp.Header().Get(params.ContentHashHeader), gc.Equals, hashOfString(content+"2"))
+	c.Assert(resp.Header().Get("Content-Length"), gc.Equals, strconv.Itoa(len(content+"2")))
 	c.Assert(resp.Code, gc.Equals, http.StatusOK)
 	assertCacheControl(c, resp.Header(), true)
 }
@@ -878,10 +881,59 @@ func (s *ResourceSuite) TestMetaResourcesWithBundle(c *gc.C) {
 	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
 		Handler:      s.srv,
 		URL:          storeURL(id.URL.Path() + "/meta/resources"),
-		ExpectStatus: http.StatusNotFound,
-		ExpectBody: params.Error{
-			Code:    params.ErrMetadataNotFound,
-			Message: string(params.ErrMetadataNotFound),
+		ExpectStatus: http.StatusOK,
+		ExpectBody:   []params.Resource{},
+	})
+}
+
+func (s *ResourceSuite) TestMetaResourcesBulk(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.addPublicCharm(c, storetesting.NewCharm(storetesting.MetaWithResources(nil, "resource1", "resource2")), id)
+	s.uploadResource(c, id, "resource1", "resource1 content")
+	s.uploadResource(c, id, "resource2", "resource2 content")
+	err := s.store.Publish(id, map[string]int{
+		"resource1": 0,
+		"resource2": 0,
+	}, params.StableChannel)
+	c.Assert(err, gc.Equals, nil)
+	bundleId := newResolvedURL("cs:~charmers/bundle/bundlelovin-10", 10)
+	s.addPublicBundleFromRepo(c, "wordpress-simple", bundleId, true)
+
+	expectResources := []params.Resource{{
+		Name:        "resource1",
+		Type:        "file",
+		Path:        "resource1-file",
+		Description: "resource1 description",
+		Revision:    0,
+		Fingerprint: rawHash(hashOfString("resource1 content")),
+		Size:        int64(len("resource1 content")),
+	}, {
+		Name:        "resource2",
+		Type:        "file",
+		Path:        "resource2-file",
+		Description: "resource2 description",
+		Revision:    0,
+		Fingerprint: rawHash(hashOfString("resource2 content")),
+		Size:        int64(len("resource2 content")),
+	}}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("meta/resources?id=" + id.URL.Path() + "&id=" + bundleId.URL.Path()),
+		ExpectStatus: http.StatusOK,
+		ExpectBody: map[string][]params.Resource{
+			id.URL.Path():       expectResources,
+			bundleId.URL.Path(): {},
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(id.URL.Path() + "/meta/any?include=resources"),
+		ExpectStatus: http.StatusOK,
+		ExpectBody: params.MetaAnyResponse{
+			Id: id.PreferredURL(),
+			Meta: map[string]interface{}{
+				"resources": expectResources,
+			},
 		},
 	})
 }
@@ -6,11 +6,13 @@ package v5 // import "gopkg.in/juju/charmstore.v5/internal/v5"
 import (
 	"net/http"
 	"strconv"
+	"strings"
 	"sync/atomic"
 
 	"github.com/juju/utils/parallel"
 	"golang.org/x/net/context"
 	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v6"
 	"gopkg.in/juju/charmrepo.v3/csclient/params"
 
 	"gopkg.in/juju/charmstore.v5/internal/charmstore"
@@ -27,6 +29,113 @@ func (h *ReqHandler) serveSearch(_ http.Header, req *http.Request) (interface{},
 	if err != nil {
 		return "", err
 	}
+	h.addSearchGroups(&sp, req)
+	return h.Search(sp, req)
+}
+
+// GET search/updated[?filter=value…][&limit=limit][&include=meta][&skip=count]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-searchupdated
+func (h *ReqHandler) serveSearchUpdated(_ http.Header, req *http.Request) (interface{}, error) {
+	sp, err := ParseSearchParams(req)
+	if err != nil {
+		return "", err
+	}
+	if sp.Text != "" {
+		return "", badRequestf(nil, "text parameter not allowed")
+	}
+	if len(sp.Sort) > 0 {
+		return "", badRequestf(nil, "sort parameter not allowed")
+	}
+	sp.Sort = []charmstore.SortParam{{
+		Field:      "updated",
+		Descending: true,
+	}}
+	h.addSearchGroups(&sp, req)
+	return h.Search(sp, req)
+}
+
+// GET search/owners[?text=text][&autocomplete=1][&filter=value…][&limit=limit][&skip=count]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-searchowners
+func (h *ReqHandler) serveSearchOwners(_ http.Header, req *http.Request) (interface{}, error) {
+	sp, err := ParseSearchParams(req)
+	if err != nil {
+		return "", err
+	}
+	h.addSearchGroups(&sp, req)
+	owners, err := h.Store.SearchOwners(sp)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "error performing search", errgo.Is(params.ErrBadRequest))
+	}
+	resp := SearchOwnersResponse{
+		Results: make([]OwnerResult, len(owners)),
+	}
+	for i, o := range owners {
+		resp.Results[i] = OwnerResult{
+			Owner: o.Owner,
+			Count: o.Count,
+		}
+	}
+	return resp, nil
+}
+
+// GET search/explain?id=id[&group=group…][&text=text][&filter=value…]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-searchexplain
+func (h *ReqHandler) serveSearchExplain(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	idStr := req.Form.Get("id")
+	if idStr == "" {
+		return nil, badRequestf(nil, "id parameter not specified")
+	}
+	id, err := charm.ParseURL(idStr)
+	if err != nil {
+		return nil, badRequestf(err, "invalid id parameter")
+	}
+	groups := req.Form["group"]
+	// The remaining parameters specify the search.
+	delete(req.Form, "id")
+	delete(req.Form, "group")
+	sp, err := ParseSearchParams(req)
+	if err != nil {
+		return nil, err
+	}
+	// The search is explained as seen by a user that is a
+	// member of the given groups.
+	sp.Groups = groups
+	entity, err := h.Store.Store.FindBestEntity(id, params.UnpublishedChannel, charmstore.FieldSelector())
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	rid := charmstore.EntityResolvedURL(entity)
+	explanation, err := h.Store.ExplainSearch(sp, rid)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	return SearchExplainResponse{
+		Id:     &rid.URL,
+		Found:  explanation.Found,
+		Reason: explanation.Reason,
+	}, nil
+}
+
+// GET search/reindex-progress
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-searchreindex-progress
+func (h *ReqHandler) serveSearchReindexProgress(_ http.Header, req *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(req); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	p := h.Store.ReindexProgress()
+	return ReindexProgressResponse{
+		InProgress: p.InProgress,
+		Done:       p.Done,
+		Total:      p.Total,
+	}, nil
+}
+
+// addSearchGroups sets up sp so that the search will only return
+// entities that can be read by the authenticated user, if any.
+func (h *ReqHandler) addSearchGroups(sp *charmstore.SearchParams, req *http.Request) {
 	auth, err := h.Authenticate(req)
 	if err != nil {
 		logger.Infof("authorization failed on search request, granting no privileges: %v", err)
@@ -34,13 +143,12 @@ func (h *ReqHandler) serveSearch(_ http.Header, req *http.Request) (interface{},
 	sp.Admin = auth.Admin
 	if auth.User != nil {
 		sp.Groups = append(sp.Groups, auth.Username)
-		groups, err := auth.User.Groups()
+		groups, err := h.Store.UserGroups(auth.Username, auth.User.Groups)
 		if err != nil {
 			logger.Infof("cannot get groups for user %q, assuming no groups: %v", auth.Username, err)
 		}
 		sp.Groups = append(sp.Groups, groups...)
 	}
-	return h.Search(sp, req)
 }
 
 // Search performs the search specified by SearchParams. If sp
@@ -50,24 +158,66 @@ func (h *ReqHandler) Search(sp charmstore.SearchParams, req *http.Request) (inte
 	// perform query
 	results, err := h.Store.Search(sp)
 	if err != nil {
-		return nil, errgo.Notef(err, "error performing search")
+		return nil, errgo.NoteMask(err, "error performing search", errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrServiceUnavailable))
 	}
-	return params.SearchResponse{
-		SearchTime: results.SearchTime,
-		Total:      results.Total,
-		Results:    h.addMetaData(results.Results, sp.Include, req),
-	}, nil
+	// Some results may be dropped when adding the metadata, so
+	// remember the extra information about each result by id.
+	channel := sp.Channel
+	if channel == params.NoChannel {
+		channel = params.StableChannel
+	}
+	extra := make(map[string]SearchEntityResult)
+	for i, e := range results.Results {
+		r := SearchEntityResult{
+			Score:            results.Scores[i],
+			PreferredURL:     e.PreferredURL(true),
+			Channel:          channel,
+			DeprecatedSeries: h.Store.HasOnlyDeprecatedSeries(e),
+		}
+		if results.Highlights != nil {
+			r.Highlights = results.Highlights[i]
+		}
+		extra[e.PreferredURL(true).String()] = r
+	}
+	entities := h.addMetaData(results.Results, sp.Include, req)
+	if err := req.Context().Err(); err != nil {
+		// Some of the metadata is probably missing because
+		// the request has timed out, so don't return
+		// incomplete results.
+		return nil, errgo.NoteMask(err, "cannot add metadata to search results", errgo.Any)
+	}
+	resp := SearchResponse{
+		SearchTime:  results.SearchTime,
+		Total:       results.Total,
+		Results:     make([]SearchEntityResult, len(entities)),
+		Facets:      results.Facets,
+		TypeCounts:  results.TypeCounts,
+		NextCursor:  results.NextCursor,
+		Suggestions: results.Suggestions,
+	}
+	for i, e := range entities {
+		r := extra[e.Id.String()]
+		r.Id = e.Id
+		r.Meta = e.Meta
+		resp.Results[i] = r
+	}
+	return resp, nil
 }
 
 // addMetaData adds the requested meta data with the include list.
 func (h *ReqHandler) addMetaData(results []*mongodoc.Entity, include []string, req *http.Request) []params.EntityResult {
 	entities := make([]params.EntityResult, len(results))
+	ctx := req.Context()
 	run := parallel.NewRun(maxConcurrency)
 	var missing int32
 	for i, ent := range results {
 		i, ent := i, ent
 		run.Do(func() error {
-			meta, err := h.Router.GetMetadata(charmstore.EntityResolvedURL(ent), include, req)
+			if ctx.Err() != nil {
+				atomic.AddInt32(&missing, 1)
+				return nil
+			}
+			meta, err := h.Router.GetMetadata(ctx, charmstore.EntityResolvedURL(ent), include, req)
 			if err != nil {
 				// Unfortunately it is possible to get errors here due to
 				// internal inconsistency, so rather than throwing away
@@ -108,12 +258,83 @@ func (h *ReqHandler) serveSearchInteresting(w http.ResponseWriter, req *http.Req
 	router.WriteError(context.TODO(), w, errNotImplemented)
 }
 
+// excludeFilters holds the filters that may be negated by
+// prefixing the parameter name with "-", or that may require all
+// of their values to match by adding the suffix "-all" to the
+// parameter name.
+var excludeFilters = map[string]bool{
+	"action":         true,
+	"arch":           true,
+	"assumes":        true,
+	"config-option":  true,
+	"container":      true,
+	"contains-charm": true,
+	"description":    true,
+	"license":        true,
+	"metric":         true,
+	"name":           true,
+	"origin":         true,
+	"owner":          true,
+	"provides":       true,
+	"requires":       true,
+	"resource":       true,
+	"series":         true,
+	"storage":        true,
+	"summary":        true,
+	"tags":           true,
+	"type":           true,
+}
+
 // ParseSearchParms extracts the search paramaters from the request
 func ParseSearchParams(req *http.Request) (charmstore.SearchParams, error) {
 	sp := charmstore.SearchParams{}
 	sp.AutoComplete = true
 	var err error
 	for k, v := range req.Form {
+		if name := strings.TrimPrefix(k, "-"); name != k {
+			if !excludeFilters[name] {
+				return charmstore.SearchParams{}, badRequestf(nil, "invalid parameter: %s", k)
+			}
+			if sp.Exclude == nil {
+				sp.Exclude = make(map[string][]string)
+			}
+			sp.Exclude[name] = v
+			continue
+		}
+		if name := strings.TrimSuffix(k, "-all"); name != k && excludeFilters[name] {
+			var vals []string
+			for _, s := range v {
+				vals = append(vals, strings.Fields(s)...)
+			}
+			if len(vals) == 0 {
+				continue
+			}
+			if sp.FiltersAll == nil {
+				sp.FiltersAll = make(map[string][]string)
+			}
+			sp.FiltersAll[name] = vals
+			continue
+		}
+		if name := strings.TrimPrefix(k, "facet-skip."); name != k {
+			skip, err := strconv.Atoi(v[0])
+			if err != nil || skip < 0 {
+				return charmstore.SearchParams{}, badRequestf(nil, "invalid %s parameter: expected non-negative integer", k)
+			}
+			page := sp.FacetPages[name]
+			page.Skip = skip
+			setFacetPage(&sp, name, page)
+			continue
+		}
+		if name := strings.TrimPrefix(k, "facet-limit."); name != k {
+			limit, err := strconv.Atoi(v[0])
+			if err != nil || limit < 1 {
+				return charmstore.SearchParams{}, badRequestf(nil, "invalid %s parameter: expected integer greater than zero", k)
+			}
+			page := sp.FacetPages[name]
+			page.Limit = limit
+			setFacetPage(&sp, name, page)
+			continue
+		}
 		switch k {
 		case "text":
 			sp.Text = v[0]
@@ -130,13 +351,58 @@ func ParseSearchParams(req *http.Request) (charmstore.SearchParams, error) {
 			if sp.Limit < 1 {
 				return charmstore.SearchParams{}, badRequestf(nil, "invalid limit parameter: expected integer greater than zero")
 			}
+		case "match-all-terms":
+			sp.MatchAllTerms, err = router.ParseBool(v[0])
+			if err != nil {
+				return charmstore.SearchParams{}, badRequestf(err, "invalid match-all-terms parameter")
+			}
+		case "fuzzy":
+			sp.Fuzzy, err = router.ParseBool(v[0])
+			if err != nil {
+				return charmstore.SearchParams{}, badRequestf(err, "invalid fuzzy parameter")
+			}
+		case "highlight":
+			sp.Highlight, err = router.ParseBool(v[0])
+			if err != nil {
+				return charmstore.SearchParams{}, badRequestf(err, "invalid highlight parameter")
+			}
+		case "channel":
+			sp.Channel = params.Channel(v[0])
+		case "suggest":
+			sp.Suggest, err = router.ParseBool(v[0])
+			if err != nil {
+				return charmstore.SearchParams{}, badRequestf(err, "invalid suggest parameter")
+			}
+		case "type-counts":
+			sp.TypeCounts, err = router.ParseBool(v[0])
+			if err != nil {
+				return charmstore.SearchParams{}, badRequestf(err, "invalid type-counts parameter")
+			}
+		case "include-deprecated":
+			sp.IncludeDeprecated, err = router.ParseBool(v[0])
+			if err != nil {
+				return charmstore.SearchParams{}, badRequestf(err, "invalid include-deprecated parameter")
+			}
+		case "minimum-should-match":
+			sp.MinimumShouldMatch, err = charmstore.ParseMinimumShouldMatch(v[0])
+			if err != nil {
+				return charmstore.SearchParams{}, badRequestf(err, "invalid minimum-should-match parameter")
+			}
 		case "include":
 			for _, s := range v {
 				if s != "" {
 					sp.Include = append(sp.Include, s)
 				}
 			}
-		case "description", "name", "owner", "provides", "requires", "series", "summary", "tags", "type":
+		case "cursor":
+			sp.Cursor = v[0]
+		case "facet":
+			for _, s := range v {
+				if s != "" {
+					sp.Facets = append(sp.Facets, s)
+				}
+			}
+		case "action", "arch", "assumes", "config-option", "container", "contains-charm", "description", "license", "metric", "name", "origin", "owner", "provides", "readable-by", "requires", "resource", "series", "storage", "summary", "tags", "type":
 			if sp.Filters == nil {
 				sp.Filters = make(map[string][]string)
 			}
@@ -162,6 +428,51 @@ func ParseSearchParams(req *http.Request) (charmstore.SearchParams, error) {
 			if sp.Skip < 0 {
 				return charmstore.SearchParams{}, badRequestf(nil, "invalid skip parameter: expected non-negative integer")
 			}
+		case "revision-count":
+			for _, s := range v {
+				if _, _, err := charmstore.ParseIntFilter(s); err != nil {
+					return charmstore.SearchParams{}, badRequestf(err, "invalid revision-count filter parameter")
+				}
+			}
+			if sp.Filters == nil {
+				sp.Filters = make(map[string][]string)
+			}
+			sp.Filters[k] = v
+		case "downloads-min", "downloads-max":
+			for _, s := range v {
+				if _, err := charmstore.ParseDownloadCount(s); err != nil {
+					return charmstore.SearchParams{}, badRequestf(err, "invalid %s filter parameter", k)
+				}
+			}
+			if sp.Filters == nil {
+				sp.Filters = make(map[string][]string)
+			}
+			sp.Filters[k] = v
+		case "min-juju-version":
+			for _, s := range v {
+				if _, err := charmstore.ParseJujuVersion(s); err != nil {
+					return charmstore.SearchParams{}, badRequestf(err, "invalid min-juju-version filter parameter")
+				}
+			}
+			if sp.Filters == nil {
+				sp.Filters = make(map[string][]string)
+			}
+			sp.Filters[k] = v
+		case "collapse":
+			sp.Collapse, err = charmstore.ParseCollapseMode(v[0])
+			if err != nil {
+				return charmstore.SearchParams{}, badRequestf(err, "invalid collapse parameter")
+			}
+		case "platform":
+			for _, s := range v {
+				if _, _, err := charmstore.ParsePlatform(s); err != nil {
+					return charmstore.SearchParams{}, badRequestf(err, "invalid platform filter parameter")
+				}
+			}
+			if sp.Filters == nil {
+				sp.Filters = make(map[string][]string)
+			}
+			sp.Filters[k] = v
 		case "sort":
 			err = sp.ParseSortFields(v...)
 			if err != nil {
@@ -171,5 +482,18 @@ func ParseSearchParams(req *http.Request) (charmstore.SearchParams, error) {
 			return charmstore.SearchParams{}, badRequestf(nil, "invalid parameter: %s", k)
 		}
 	}
+	for _, name := range sp.Facets {
+		if page, ok := sp.FacetPages[name]; ok && page.End() > charmstore.MaxFacetPageEnd {
+			return charmstore.SearchParams{}, badRequestf(nil, "invalid page for %s facet: skip plus limit must not exceed %d", name, charmstore.MaxFacetPageEnd)
+		}
+	}
 	return sp, nil
 }
+
+// setFacetPage sets the page of values returned for the named facet.
+func setFacetPage(sp *charmstore.SearchParams, name string, page charmstore.FacetPage) {
+	if sp.FacetPages == nil {
+		sp.FacetPages = make(map[string]charmstore.FacetPage)
+	}
+	sp.FacetPages[name] = page
+}
@@ -148,6 +148,225 @@ func (s *SearchSuite) TestParseSearchParams(c *gc.C) {
 		expectParams: charmstore.SearchParams{
 			Include: []string{"archive-size", "bundle-data"},
 		},
+	}, {
+		about: "cursor",
+		query: "cursor=abc&limit=5&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Cursor: "abc",
+			Limit:  5,
+		},
+	}, {
+		about: "facets",
+		query: "facet=series&facet=&facet=type&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Facets: []string{"series", "type"},
+		},
+	}, {
+		about: "facet pages",
+		query: "facet=owner&facet=series&facet-skip.owner=20&facet-limit.owner=10&facet-limit.series=5&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Facets: []string{"owner", "series"},
+			FacetPages: map[string]charmstore.FacetPage{
+				"owner":  {Skip: 20, Limit: 10},
+				"series": {Limit: 5},
+			},
+		},
+	}, {
+		about:       "invalid facet skip",
+		query:       "facet=owner&facet-skip.owner=-1",
+		expectError: "invalid facet-skip.owner parameter: expected non-negative integer",
+	}, {
+		about:       "invalid facet limit",
+		query:       "facet=owner&facet-limit.owner=0",
+		expectError: "invalid facet-limit.owner parameter: expected integer greater than zero",
+	}, {
+		about: "last facet page",
+		query: "facet=owner&facet-skip.owner=9990&facet-limit.owner=10&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Facets: []string{"owner"},
+			FacetPages: map[string]charmstore.FacetPage{
+				"owner": {Skip: 9990, Limit: 10},
+			},
+		},
+	}, {
+		about:       "facet page too deep",
+		query:       "facet=owner&facet-skip.owner=9990&facet-limit.owner=11",
+		expectError: "invalid page for owner facet: skip plus limit must not exceed 10000",
+	}, {
+		about:       "facet page too deep with default limit",
+		query:       "facet=series&facet-skip.series=9901",
+		expectError: "invalid page for series facet: skip plus limit must not exceed 10000",
+	}, {
+		about: "excluded owner",
+		query: "-owner=charmers&type=charm&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"type": {"charm"},
+			},
+			Exclude: map[string][]string{
+				"owner": {"charmers"},
+			},
+		},
+	}, {
+		about: "excluded and included series",
+		query: "-series=trusty&series=xenial&-series=precise&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"series": {"xenial"},
+			},
+			Exclude: map[string][]string{
+				"series": {"trusty", "precise"},
+			},
+		},
+	}, {
+		about:       "invalid excluded filter",
+		query:       "-limit=3",
+		expectError: "invalid parameter: -limit",
+	}, {
+		about: "readable-by filter",
+		query: "readable-by=charmers&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"readable-by": {"charmers"},
+			},
+		},
+	}, {
+		about: "action filter",
+		query: "action=backup&type=charm&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"action": {"backup"},
+				"type":   {"charm"},
+			},
+		},
+	}, {
+		about: "contains-charm filter",
+		query: "contains-charm=wordpress&contains-charm=mysql&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"contains-charm": {"wordpress", "mysql"},
+			},
+		},
+	}, {
+		about: "metric filter",
+		query: "metric=requests&metric=latency&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"metric": {"requests", "latency"},
+			},
+		},
+	}, {
+		about: "config-option filter",
+		query: "config-option=proxy-url&config-option=port&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"config-option": {"proxy-url", "port"},
+			},
+		},
+	}, {
+		about: "channel",
+		query: "channel=edge&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Channel: params.EdgeChannel,
+		},
+	}, {
+		about: "arch filter",
+		query: "arch=arm64&arch=s390x&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"arch": {"arm64", "s390x"},
+			},
+		},
+	}, {
+		about: "resource filter",
+		query: "resource=snap&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"resource": {"snap"},
+			},
+		},
+	}, {
+		about: "storage filter",
+		query: "storage=block&storage=filesystem&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"storage": {"block", "filesystem"},
+			},
+		},
+	}, {
+		about: "all filter",
+		query: "tags-all=a+b&provides-all=http&provides-all=mysql&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			FiltersAll: map[string][]string{
+				"tags":     {"a", "b"},
+				"provides": {"http", "mysql"},
+			},
+		},
+	}, {
+		about:        "empty all filter ignored",
+		query:        "tags-all=&autocomplete=0",
+		expectParams: charmstore.SearchParams{},
+	}, {
+		about:       "all filter with unknown name",
+		query:       "foo-all=a",
+		expectError: "invalid parameter: foo-all",
+	}, {
+		about: "origin filter",
+		query: "origin=mirror&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"origin": {"mirror"},
+			},
+		},
+	}, {
+		about: "downloads range filter",
+		query: "downloads-min=1000&downloads-max=5000&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"downloads-min": {"1000"},
+				"downloads-max": {"5000"},
+			},
+		},
+	}, {
+		about: "downloads minimum filter",
+		query: "downloads-min=1000&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"downloads-min": {"1000"},
+			},
+		},
+	}, {
+		about:       "invalid downloads minimum filter",
+		query:       "downloads-min=lots",
+		expectError: `invalid downloads-min filter parameter: invalid download count "lots": expected non-negative integer`,
+	}, {
+		about:       "negative downloads maximum filter",
+		query:       "downloads-max=-1",
+		expectError: `invalid downloads-max filter parameter: invalid download count "-1": expected non-negative integer`,
+	}, {
+		about: "assumes filter",
+		query: "assumes=k8s-api&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"assumes": {"k8s-api"},
+			},
+		},
+	}, {
+		about: "container filter",
+		query: "container=mariadb:10.3&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"container": {"mariadb:10.3"},
+			},
+		},
+	}, {
+		about: "license filter",
+		query: "license=Apache-2.0&license=MIT&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"license": {"Apache-2.0", "MIT"},
+			},
+		},
 	}, {
 		about: "description filter",
 		query: "description=text&autocomplete=0",
@@ -248,6 +467,142 @@ func (s *SearchSuite) TestParseSearchParams(c *gc.C) {
 				"promulgated": {"1"},
 			},
 		},
+	}, {
+		about: "revision-count filter",
+		query: "revision-count=>=3&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"revision-count": {">=3"},
+			},
+		},
+	}, {
+		about:       "revision-count filter - bad",
+		query:       "revision-count=lots",
+		expectError: `invalid revision-count filter parameter: invalid integer filter value "lots"`,
+	}, {
+		about: "min-juju-version filter",
+		query: "min-juju-version=2.9&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"min-juju-version": {"2.9"},
+			},
+		},
+	}, {
+		about:       "min-juju-version filter - bad",
+		query:       "min-juju-version=two",
+		expectError: `invalid min-juju-version filter parameter: invalid Juju version "two"`,
+	}, {
+		about: "match all terms",
+		query: "text=wordpress+simple&match-all-terms=1&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Text:          "wordpress simple",
+			MatchAllTerms: true,
+		},
+	}, {
+		about:       "match all terms - bad",
+		query:       "match-all-terms=all",
+		expectError: `invalid match-all-terms parameter: unexpected bool value "all" \(must be "0" or "1"\)`,
+	}, {
+		about: "fuzzy search",
+		query: "text=wordpess&fuzzy=1",
+		expectParams: charmstore.SearchParams{
+			Text:         "wordpess",
+			AutoComplete: true,
+			Fuzzy:        true,
+		},
+	}, {
+		about:       "fuzzy search - bad",
+		query:       "fuzzy=maybe",
+		expectError: `invalid fuzzy parameter: unexpected bool value "maybe" \(must be "0" or "1"\)`,
+	}, {
+		about: "highlight",
+		query: "text=wordpress&highlight=1",
+		expectParams: charmstore.SearchParams{
+			Text:         "wordpress",
+			AutoComplete: true,
+			Highlight:    true,
+		},
+	}, {
+		about: "suggest",
+		query: "text=wordpres&suggest=1",
+		expectParams: charmstore.SearchParams{
+			Text:         "wordpres",
+			AutoComplete: true,
+			Suggest:      true,
+		},
+	}, {
+		about: "type counts",
+		query: "type=bundle&type-counts=1",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"type": {"bundle"},
+			},
+			AutoComplete: true,
+			TypeCounts:   true,
+		},
+	}, {
+		about:       "type counts - bad",
+		query:       "type-counts=maybe",
+		expectError: `invalid type-counts parameter: unexpected bool value "maybe" \(must be "0" or "1"\)`,
+	}, {
+		about: "include deprecated",
+		query: "text=wordpress&include-deprecated=1",
+		expectParams: charmstore.SearchParams{
+			Text:              "wordpress",
+			AutoComplete:      true,
+			IncludeDeprecated: true,
+		},
+	}, {
+		about:       "include deprecated - bad",
+		query:       "include-deprecated=maybe",
+		expectError: `invalid include-deprecated parameter: unexpected bool value "maybe" \(must be "0" or "1"\)`,
+	}, {
+		about:       "suggest - bad",
+		query:       "suggest=maybe",
+		expectError: `invalid suggest parameter: unexpected bool value "maybe" \(must be "0" or "1"\)`,
+	}, {
+		about:       "highlight - bad",
+		query:       "highlight=maybe",
+		expectError: `invalid highlight parameter: unexpected bool value "maybe" \(must be "0" or "1"\)`,
+	}, {
+		about: "minimum should match",
+		query: "text=a+b+c&minimum-should-match=2%3C75%25&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Text:               "a b c",
+			MinimumShouldMatch: "2<75%",
+		},
+	}, {
+		about:       "minimum should match - bad",
+		query:       "minimum-should-match=most",
+		expectError: `invalid minimum-should-match parameter: invalid minimum should match value "most"`,
+	}, {
+		about: "platform filter",
+		query: "platform=bionic/arm64&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Filters: map[string][]string{
+				"platform": {"bionic/arm64"},
+			},
+		},
+	}, {
+		about:       "platform filter - bad",
+		query:       "platform=arm64",
+		expectError: `invalid platform filter parameter: invalid platform "arm64"`,
+	}, {
+		about: "collapse promulgated",
+		query: "collapse=promulgated&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Collapse: charmstore.CollapsePromulgated,
+		},
+	}, {
+		about: "collapse owner",
+		query: "collapse=owner&autocomplete=0",
+		expectParams: charmstore.SearchParams{
+			Collapse: charmstore.CollapseOwner,
+		},
+	}, {
+		about:       "collapse - bad",
+		query:       "collapse=everything",
+		expectError: `invalid collapse parameter: unrecognized collapse mode "everything"`,
 	}, {
 		about:       "promulgated filter - bad",
 		query:       "promulgated=bad",
@@ -373,6 +728,13 @@ func (s *SearchSuite) TestSuccessfulSearches(c *gc.C) {
 			exportTestCharms["varnish"],
 			exportTestBundles["wordpress-simple"],
 		},
+	}, {
+		about: "type filter with excluded owner search",
+		query: "type=charm&-owner=charmers",
+		results: []*router.ResolvedURL{
+			exportTestCharms["mysql"],
+			exportTestCharms["varnish"],
+		},
 	}, {
 		about: "provides multiple interfaces filter search",
 		query: "provides=monitoring+http",
@@ -491,6 +853,12 @@ func (s *SearchSuite) TestMetadataFields(c *gc.C) {
 		meta: map[string]interface{}{
 			"charm-config": getSearchCharm("wordpress").Config(),
 		},
+	}, {
+		about: "charm-metadata",
+		query: "name=wordpress&type=charm&include=charm-metadata",
+		meta: map[string]interface{}{
+			"charm-metadata": getSearchCharm("wordpress").Meta(),
+		},
 	}, {
 		about: "charm-related",
 		query: "name=wordpress&type=charm&include=charm-related",
@@ -612,6 +980,80 @@ func (s *SearchSuite) TestSearchIncludeError(c *gc.C) {
 	c.Assert(tw.Log(), jc.LogMatches, []string{"cannot retrieve metadata for cs:precise/wordpress-23: cannot open archive data for cs:precise/wordpress-23: .*"})
 }
 
+func (s *SearchSuite) TestSearchScores(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("search?text=wordpress"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var sr v5.SearchResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &sr)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(len(sr.Results), jc.GreaterThan, 0)
+	for i, r := range sr.Results {
+		c.Assert(r.Score, jc.GreaterThan, 0.0)
+		if i > 0 {
+			c.Assert(r.Score, jc.LessThan, sr.Results[i-1].Score+1e-9)
+		}
+	}
+}
+
+func (s *SearchSuite) TestSearchCursor(c *gc.C) {
+	var ids []*charm.URL
+	url := storeURL("search?sort=name&limit=3")
+	for i := 0; ; i++ {
+		c.Assert(i, jc.LessThan, 10)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     url,
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		var sr v5.SearchResponse
+		err := json.Unmarshal(rec.Body.Bytes(), &sr)
+		c.Assert(err, gc.Equals, nil)
+		for _, r := range sr.Results {
+			ids = append(ids, r.Id)
+		}
+		if sr.NextCursor == "" {
+			break
+		}
+		url = storeURL("search?sort=name&limit=3&cursor=" + sr.NextCursor)
+	}
+	c.Assert(ids, jc.DeepEquals, []*charm.URL{
+		exportTestCharms["mysql"].PreferredURL(),
+		exportTestCharms["varnish"].PreferredURL(),
+		exportTestCharms["wordpress"].PreferredURL(),
+		exportTestBundles["wordpress-simple"].PreferredURL(),
+	})
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("search?cursor=bad&limit=3"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "error performing search: invalid cursor",
+		},
+	})
+}
+
+func (s *SearchSuite) TestSearchFacets(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("search?facet=type&facet=no-such-facet"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var sr v5.SearchResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &sr)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sr.Facets, jc.DeepEquals, map[string][]charmstore.FacetCount{
+		"type": {
+			{"charm", 3},
+			{"bundle", 1},
+		},
+	})
+}
+
 func (s *SearchSuite) TestSorting(c *gc.C) {
 	tests := []struct {
 		about   string
@@ -644,6 +1086,15 @@ func (s *SearchSuite) TestSorting(c *gc.C) {
 			exportTestCharms["mysql"],
 			exportTestCharms["varnish"],
 		},
+	}, {
+		about: "series descending, owner ascending, name descending",
+		query: "sort=-series,owner,-name",
+		results: []*router.ResolvedURL{
+			exportTestCharms["varnish"],
+			exportTestCharms["mysql"],
+			exportTestCharms["wordpress"],
+			exportTestBundles["wordpress-simple"],
+		},
 	}, {
 		about: "series descending",
 		query: "sort=-series&sort=name",
@@ -732,6 +1183,48 @@ func (s *SearchSuite) TestDownloadsBoost(c *gc.C) {
 	c.Assert(sr.Results[2].Id.Name, gc.Equals, "mysql")
 }
 
+func (s *SearchSuite) TestSearchUpdated(c *gc.C) {
+	s.addPublicCharm(c, getSearchCharm("mysql"), newResolvedURL("cs:~bob/trusty/mysql-1", -1))
+	s.addPublicCharm(c, getSearchCharm("varnish"), newResolvedURL("cs:~bob/trusty/varnish-1", -1))
+	err := s.esSuite.ES.RefreshIndex(s.esSuite.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("search/updated"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var sr params.SearchResponse
+	err = json.Unmarshal(rec.Body.Bytes(), &sr)
+	c.Assert(err, gc.Equals, nil)
+	// All the entities that are visible to everyone are
+	// returned, with the newest first.
+	c.Assert(sr.Results, gc.HasLen, 6)
+	c.Assert(sr.Results[0].Id.String(), gc.Equals, "cs:~bob/trusty/varnish-1")
+	c.Assert(sr.Results[1].Id.String(), gc.Equals, "cs:~bob/trusty/mysql-1")
+
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("search/updated?limit=1&skip=1"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	err = json.Unmarshal(rec.Body.Bytes(), &sr)
+	c.Assert(err, gc.Equals, nil)
+	c.Assert(sr.Results, gc.HasLen, 1)
+	c.Assert(sr.Results[0].Id.String(), gc.Equals, "cs:~bob/trusty/mysql-1")
+}
+
+func (s *SearchSuite) TestSearchUpdatedWithSort(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("search/updated?sort=name"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "sort parameter not allowed",
+		},
+	})
+}
+
 func (s *SearchSuite) TestSearchWithAdminCredentials(c *gc.C) {
 	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
 		Handler:  s.srv,
@@ -753,6 +1246,151 @@ func (s *SearchSuite) TestSearchWithAdminCredentials(c *gc.C) {
 	assertResultSet(c, sr, expected)
 }
 
+func (s *SearchSuite) TestAdminOnlyFilter(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("search?readable-by=test-user"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	var sr params.SearchResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &sr)
+	c.Assert(err, gc.Equals, nil)
+	assertResultSet(c, sr, []*router.ResolvedURL{
+		exportTestCharms["riak"],
+	})
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("search?readable-by=test-user"),
+		Do:           bakeryDo(s.login("test-user")),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `error performing search: filter "readable-by" is restricted to administrators`,
+		},
+	})
+}
+
+func (s *SearchSuite) TestSearchChannel(c *gc.C) {
+	id := newResolvedURL("cs:~channel-test/trusty/edge-only-1", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.SetPerms(&id.URL, "edge.read", "test-user")
+	c.Assert(err, gc.Equals, nil)
+	err = s.store.Publish(id, nil, params.EdgeChannel)
+	c.Assert(err, gc.Equals, nil)
+	err = s.esSuite.ES.RefreshIndex(s.esSuite.TestIndex)
+	c.Assert(err, gc.Equals, nil)
+
+	tests := []struct {
+		about  string
+		query  string
+		user   string
+		expect []*router.ResolvedURL
+	}{{
+		about: "stable channel by default",
+		query: "owner=channel-test",
+		user:  "test-user",
+	}, {
+		about: "edge channel without read access",
+		query: "owner=channel-test&channel=edge",
+		user:  "other-user",
+	}, {
+		about:  "edge channel with read access",
+		query:  "owner=channel-test&channel=edge",
+		user:   "test-user",
+		expect: []*router.ResolvedURL{id},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL("search?" + test.query),
+			Do:      bakeryDo(s.login(test.user)),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.Bytes()))
+		var sr params.SearchResponse
+		err := json.Unmarshal(rec.Body.Bytes(), &sr)
+		c.Assert(err, gc.Equals, nil)
+		assertResultSet(c, sr, test.expect)
+	}
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("search?channel=unpublished"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `error performing search: cannot search channel "unpublished"`,
+		},
+	})
+}
+
+func (s *SearchSuite) TestSearchExplain(c *gc.C) {
+	id := newResolvedURL("cs:~charmers/trusty/unpublished-1", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+	s.AssertAuthOnAdminEndpoint(c, httptesting.JSONCallParams{
+		URL:          storeURL("search/explain?id=~charmers/trusty/unpublished-1"),
+		ExpectStatus: http.StatusOK,
+		ExpectBody: v5.SearchExplainResponse{
+			Id:     &id.URL,
+			Reason: "not indexed: not published on stable",
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("search/explain?id=~charmers/precise/wordpress-23&series=trusty"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: v5.SearchExplainResponse{
+			Id:     charm.MustParseURL("cs:~charmers/precise/wordpress-23"),
+			Reason: `filtered by "series" filter`,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("search/explain?id=~charmers/trusty/riak-67&group=test-user"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: v5.SearchExplainResponse{
+			Id:     charm.MustParseURL("cs:~charmers/trusty/riak-67"),
+			Found:  true,
+			Reason: "matches search",
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("search/explain"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "id parameter not specified",
+		},
+	})
+}
+
+func (s *SearchSuite) TestSearchReindexProgress(c *gc.C) {
+	err := s.store.SynchroniseElasticsearch()
+	c.Assert(err, gc.Equals, nil)
+	total, err := s.store.DB.Entities().Count()
+	c.Assert(err, gc.Equals, nil)
+	s.AssertAuthOnAdminEndpoint(c, httptesting.JSONCallParams{
+		URL:          storeURL("search/reindex-progress"),
+		ExpectStatus: http.StatusOK,
+		ExpectBody: v5.ReindexProgressResponse{
+			Done:  total,
+			Total: total,
+		},
+	})
+}
+
 func (s *SearchSuite) TestSearchWithUserMacaroon(c *gc.C) {
 	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
 		Handler: s.srv,
@@ -15,6 +15,7 @@ import (
 
 	"gopkg.in/juju/charmstore.v5/internal/charmstore"
 	"gopkg.in/juju/charmstore.v5/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v5/internal/router"
 )
 
 const dateFormat = "2006-01-02"
@@ -41,6 +42,28 @@ func parseDateRange(form url.Values) (start, stop time.Time, err error) {
 	return
 }
 
+// GET stats/counts[?all=1]
+// https://github.com/juju/charmstore/blob/v5/docs/API.md#get-statscounts
+func (h *ReqHandler) serveStatsCounts(_ http.Header, r *http.Request) (interface{}, error) {
+	if err := h.authenticateAdmin(r); err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	all, err := router.ParseBool(r.Form.Get("all"))
+	if err != nil {
+		return nil, badRequestf(err, "invalid all parameter")
+	}
+	counts, err := h.Store.Counts(all)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return StatsCountsResponse{
+		Charms:      counts.Charms,
+		Bundles:     counts.Bundles,
+		Promulgated: counts.Promulgated,
+		Downloads:   counts.Downloads,
+	}, nil
+}
+
 // GET stats/counter/key[:key]...?[by=unit]&start=date][&stop=date][&list=1]
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-statscounter
 func (h *ReqHandler) serveStatsCounter(_ http.Header, r *http.Request) (interface{}, error) {
@@ -359,6 +359,41 @@ func (s *StatsSuite) TestStatsCounter(c *gc.C) {
 	}
 }
 
+func (s *StatsSuite) TestStatsCounts(c *gc.C) {
+	s.addPublicCharm(c, storetesting.NewCharm(nil), newResolvedURL("~charmers/trusty/wordpress-1", 1))
+	err := s.store.AddCharmWithArchive(newResolvedURL("~charmers/trusty/mysql-1", -1), storetesting.NewCharm(nil))
+	c.Assert(err, gc.Equals, nil)
+
+	s.AssertAuthOnAdminEndpoint(c, httptesting.JSONCallParams{
+		URL: storeURL("stats/counts"),
+		ExpectBody: v5.StatsCountsResponse{
+			Charms:      1,
+			Promulgated: 1,
+		},
+	})
+	s.AssertAuthOnAdminEndpoint(c, httptesting.JSONCallParams{
+		URL: storeURL("stats/counts?all=1"),
+		ExpectBody: v5.StatsCountsResponse{
+			Charms:      2,
+			Promulgated: 1,
+		},
+	})
+}
+
+func (s *StatsSuite) TestStatsCountsInvalidAll(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("stats/counts?all=x"),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid all parameter: unexpected bool value "x" (must be "0" or "1")`,
+		},
+	})
+}
+
 func (s *StatsSuite) TestStatsCounterList(c *gc.C) {
 	if !storetesting.MongoJSEnabled() {
 		c.Skip("MongoDB JavaScript not available")
@@ -11,6 +11,7 @@ import (
 	"sort"
 	"time"
 
+	"gopkg.in/juju/charmrepo.v3/csclient/params"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery"
 	"gopkg.in/macaroon-bakery.v2-unstable/bakery/mgostorage"
 	"gopkg.in/mgo.v2"
@@ -151,6 +152,95 @@ type ServerParams struct {
 	// DockerRegistryTokenDuration is the time a docker registry
 	// token will be valid for after it is created.
 	DockerRegistryTokenDuration time.Duration
+
+	// MaxMetaAnySize holds the maximum size in bytes of the
+	// response to an id/meta/any request. Larger responses are
+	// rejected with a 413 (Request Entity Too Large) error. If
+	// this is zero, responses are not limited.
+	MaxMetaAnySize int
+
+	// DeprecatedSeries holds the series that are considered
+	// deprecated. Search results for charms that only support
+	// deprecated series are annotated so that clients can warn
+	// users.
+	DeprecatedSeries []string
+
+	// IgnoreAdminOnlyFilters specifies that search filters that
+	// are restricted to administrators are silently ignored
+	// when used by other users, rather than causing the search
+	// to fail with a bad request error.
+	IgnoreAdminOnlyFilters bool
+
+	// SearchFallback specifies that when the search index is
+	// unavailable, because it cannot be reached or returns a
+	// server error, searches that only filter by name, owner and
+	// series are answered directly from the database. Other
+	// searches fail with a service unavailable error.
+	SearchFallback bool
+
+	// MaxSearchLimit holds the maximum number of results returned
+	// by a single search. Searches with a larger limit return at
+	// most this many results. If it's zero, a default value is
+	// used.
+	MaxSearchLimit int
+
+	// DownloadBoost holds the factor applied to the total number
+	// of downloads of a charm or bundle when ranking search
+	// results. If it's zero, a default value is used.
+	DownloadBoost float64
+
+	// PromulgatedBoost holds the boost given to promulgated charms
+	// and bundles when ranking search results. If it's zero, a
+	// default value is used.
+	PromulgatedBoost float64
+
+	// MaxBulkMetaConcurrency holds the maximum number of ids for
+	// which metadata is fetched concurrently when serving a bulk
+	// meta request. If this is zero, a default value is used.
+	MaxBulkMetaConcurrency int
+
+	// ExtraSeries holds the names of series, in addition to those
+	// built into the charm store, that are recognized in charm and
+	// bundle ids in request paths.
+	ExtraSeries []string
+
+	// CORSAllowedOrigins holds the origins that are allowed to make
+	// cross-origin requests to the API. If this is empty, requests
+	// from any origin are allowed.
+	CORSAllowedOrigins []string
+
+	// RateLimits holds the maximum number of requests a minute
+	// allowed from a single client for each family of API routes,
+	// keyed by the first element of the route path (for example
+	// "search", "archive" or "meta"). Requests with admin
+	// credentials are not limited. Routes without an entry, or
+	// with an entry that is not positive, are not limited.
+	RateLimits map[string]int
+
+	// HandlerTimeout holds the maximum length of time that an API
+	// request may take. Requests that take longer are aborted with
+	// a 504 (Gateway Timeout) response. If this is zero, requests
+	// are not limited.
+	HandlerTimeout time.Duration
+
+	// ResolveChannels holds the channels, in order of preference,
+	// that are searched when resolving an id that has no revision
+	// and when no channel is specified. If this is empty,
+	// DefaultResolveChannels is used.
+	ResolveChannels []params.Channel
+
+	// SearchRetries holds the maximum number of times a search
+	// index request that fails with a transient error, such as the
+	// search server being unreachable or returning a 5xx status,
+	// is retried. If it's zero, DefaultSearchRetries is used. If
+	// it's negative, requests are not retried.
+	SearchRetries int
+
+	// GroupsCacheMaxAge holds the maximum length of time for which
+	// the groups that a user is a member of are cached before being
+	// fetched again from the identity service. If it's zero,
+	// DefaultGroupsCacheMaxAge is used.
+	GroupsCacheMaxAge time.Duration
 }
 
 // NewServer returns a new handler that handles charm store requests and stores